@@ -0,0 +1,408 @@
+// Package client implements the status server's protocol
+// for Go programs, so that they need not deal with the
+// wire format themselves.
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/unixpickle/essentials"
+)
+
+var (
+	ErrClosed       = errors.New("client is closed")
+	ErrDisconnected = errors.New("disconnected before the server responded")
+	ErrTimeout      = errors.New("timed out waiting for the server")
+	ErrNoRequestID  = errors.New("message cannot carry a request ID")
+)
+
+const (
+	// DefaultTimeout is the time to wait for a response if
+	// a Client has no Timeout.
+	DefaultTimeout = 30 * time.Second
+
+	// DefaultReconnectDelay is the time to wait before the
+	// first attempt to reconnect if a Client has no
+	// ReconnectDelay. The delay doubles after each failed
+	// attempt, up to MaxReconnectDelay.
+	DefaultReconnectDelay = time.Second
+	MaxReconnectDelay     = time.Minute
+
+	// EventBufferSize is the number of pushed messages which
+	// the Events channel holds before the Client stops
+	// reading from the server.
+	EventBufferSize = 100
+)
+
+// A Dialer opens a new connection to the server.
+type Dialer func() (protocol.Connection, error)
+
+// TCPDialer creates a Dialer for a server's client address,
+// such as "status.example.com:8080".
+func TCPDialer(addr string) Dialer {
+	return func() (protocol.Connection, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.NewStreamConnection(conn), nil
+	}
+}
+
+// An Error is a failure reported by the server in response
+// to a request.
+type Error struct {
+	Code    protocol.ErrorCode
+	Message string
+
+	// Field is set for validation errors.
+	Field string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// A Client is a connection to a status server.
+//
+// After a successful Login, the Client keeps the session
+// alive with pings, and if the connection is lost or the
+// server asks it to reconnect, it logs in again with the
+// same password. The server then sends a sync_delta with
+// the changes since the last full state or delta which the
+// client received, so the client is brought up to date.
+//
+// Two-factor codes are not reused, so a user with
+// two-factor authentication is logged out when the
+// connection is lost, and receives a login_failure.
+type Client struct {
+	Dial Dialer
+
+	// Timeout overrides DefaultTimeout if it is non-zero.
+	Timeout time.Duration
+
+	// ReconnectDelay overrides DefaultReconnectDelay if it
+	// is non-zero.
+	ReconnectDelay time.Duration
+
+	// Handler, if non-nil, is called with each message
+	// which the server pushes rather than sending in
+	// response to a request, such as status changes.
+	//
+	// If Handler is nil, these messages are sent to the
+	// channel returned by Events.
+	Handler func(msg protocol.Message)
+
+	lock    sync.Mutex
+	conn    protocol.Connection
+	waiting map[string]chan protocol.Message
+	nextID  int
+	closed  bool
+	events  chan protocol.Message
+
+	// login is the successful login, without its
+	// two-factor code, which is repeated after
+	// reconnecting, or nil if the client is not logged in.
+	login *protocol.LoginMessage
+
+	// serverTime is the server_time of the last full state
+	// or delta, from which a reconnecting client resumes.
+	serverTime int64
+}
+
+// Dial creates a Client which connects to a server's
+// client address over TCP.
+func Dial(addr string) (*Client, error) {
+	c := &Client{Dial: TCPDialer(addr)}
+	if _, err := c.connection(); err != nil {
+		return nil, essentials.AddCtx("dial", err)
+	}
+	return c, nil
+}
+
+// Events gets the channel of messages pushed by the server
+// if there is no Handler.
+//
+// The channel must be drained, or the Client will stop
+// receiving responses once EventBufferSize messages are
+// waiting.
+func (c *Client) Events() <-chan protocol.Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.events == nil {
+		c.events = make(chan protocol.Message, EventBufferSize)
+	}
+	return c.events
+}
+
+// Request sends a request and waits for the server's
+// response.
+//
+// The request's ID is set by the Client. If the server
+// responds with an error, it is returned as an *Error.
+func (c *Client) Request(msg protocol.Message) (protocol.Message, error) {
+	idMsg, ok := msg.(interface{ SetID(id string) })
+	if !ok {
+		return nil, ErrNoRequestID
+	}
+	conn, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if c.conn != conn {
+		c.lock.Unlock()
+		return nil, ErrDisconnected
+	}
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	resChan := make(chan protocol.Message, 1)
+	c.waiting[id] = resChan
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.waiting, id)
+		c.lock.Unlock()
+	}()
+
+	idMsg.SetID(id)
+	if err := conn.WriteMessage(msg); err != nil {
+		return nil, essentials.AddCtx(msg.Type(), err)
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	select {
+	case res, ok := <-resChan:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		return res, responseError(res)
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Close ends the connection and stops reconnecting.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	c.login = nil
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// connection gets the current connection, dialing a new one
+// if necessary.
+func (c *Client) connection() (protocol.Connection, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := c.Dial()
+	if err != nil {
+		return nil, err
+	}
+	c.startConnection(conn)
+	return conn, nil
+}
+
+// startConnection makes conn the current connection and
+// starts reading from it.
+//
+// The caller must hold c.lock.
+func (c *Client) startConnection(conn protocol.Connection) {
+	c.conn = conn
+	c.waiting = map[string]chan protocol.Message{}
+	if c.Handler == nil && c.events == nil {
+		c.events = make(chan protocol.Message, EventBufferSize)
+	}
+	pinger := &keepalive{conn: conn}
+	stop := make(chan struct{})
+	go pinger.Run(stop)
+	go func() {
+		c.readLoop(conn, pinger)
+		close(stop)
+		c.connectionLost(conn)
+	}()
+}
+
+func (c *Client) readLoop(conn protocol.Connection, pinger *keepalive) {
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *protocol.PingMessage:
+			if conn.WriteMessage(&protocol.PongMessage{Time: msg.Time}) != nil {
+				return
+			}
+			continue
+		case *protocol.PongMessage:
+			pinger.HandlePong()
+			continue
+		case *protocol.ReconnectMessage:
+			conn.Close()
+			return
+		case *protocol.ForcedLogoutMessage:
+			c.lock.Lock()
+			c.login = nil
+			c.lock.Unlock()
+		case *protocol.FullStateMessage:
+			c.setServerTime(msg.ServerTime)
+		case *protocol.SyncDeltaMessage:
+			c.setServerTime(msg.ServerTime)
+		}
+		if id := protocol.RequestID(msg); id != "" {
+			c.lock.Lock()
+			resChan, ok := c.waiting[id]
+			delete(c.waiting, id)
+			c.lock.Unlock()
+			if ok {
+				resChan <- msg
+				continue
+			}
+		}
+		c.push(msg)
+	}
+}
+
+func (c *Client) setServerTime(t int64) {
+	c.lock.Lock()
+	c.serverTime = t
+	c.lock.Unlock()
+}
+
+func (c *Client) push(msg protocol.Message) {
+	if c.Handler != nil {
+		c.Handler(msg)
+	} else {
+		c.events <- msg
+	}
+}
+
+// connectionLost fails the requests waiting on a closed
+// connection, and reconnects if the client is logged in.
+func (c *Client) connectionLost(conn protocol.Connection) {
+	conn.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != conn {
+		return
+	}
+	c.conn = nil
+	for _, resChan := range c.waiting {
+		close(resChan)
+	}
+	c.waiting = nil
+	if !c.closed && c.login != nil {
+		go c.reconnect(*c.login)
+	}
+}
+
+// reconnect dials the server until it succeeds, and then
+// resumes the session.
+//
+// If the login is rejected, the failure is pushed like any
+// other message and the client stays logged out.
+func (c *Client) reconnect(login protocol.LoginMessage) {
+	delay := c.ReconnectDelay
+	if delay == 0 {
+		delay = DefaultReconnectDelay
+	}
+	for {
+		time.Sleep(delay)
+		if delay *= 2; delay > MaxReconnectDelay {
+			delay = MaxReconnectDelay
+		}
+		c.lock.Lock()
+		if c.closed || c.conn != nil {
+			c.lock.Unlock()
+			return
+		}
+		c.lock.Unlock()
+
+		err := c.resume(login)
+		var serverErr *Error
+		if err == nil {
+			return
+		} else if errors.As(err, &serverErr) {
+			c.lock.Lock()
+			c.login = nil
+			c.lock.Unlock()
+			c.push(&protocol.LoginFailureMessage{
+				Code:    serverErr.Code,
+				Message: serverErr.Message,
+				Field:   serverErr.Field,
+			})
+			return
+		}
+
+		// If the connection succeeded but the login did not,
+		// closing it starts reconnecting again.
+		c.lock.Lock()
+		conn := c.conn
+		c.lock.Unlock()
+		if conn != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// resume repeats a login on a new connection, asking for
+// the changes since the client's last state rather than a
+// full state.
+func (c *Client) resume(login protocol.LoginMessage) error {
+	c.lock.Lock()
+	login.Since = c.serverTime
+	c.lock.Unlock()
+	if login.Since != 0 {
+		caps := &protocol.CapabilitiesMessage{
+			MessageTypes: protocol.MessageTypes(),
+			Extensions:   []string{protocol.ExtSequenceResume},
+		}
+		if _, err := c.Request(caps); err != nil {
+			return err
+		}
+	}
+	_, err := c.Request(&login)
+	return err
+}
+
+// responseError converts an error response from the server
+// into an *Error.
+func responseError(msg protocol.Message) error {
+	var errMsg *protocol.ErrorMessage
+	switch msg := msg.(type) {
+	case *protocol.ErrorMessage:
+		errMsg = msg
+	case *protocol.LoginFailureMessage:
+		errMsg = (*protocol.ErrorMessage)(msg)
+	case *protocol.RegisterFailureMessage:
+		errMsg = (*protocol.ErrorMessage)(msg)
+	case *protocol.ReauthFailureMessage:
+		errMsg = (*protocol.ErrorMessage)(msg)
+	default:
+		return nil
+	}
+	return &Error{Code: errMsg.Code, Message: errMsg.Message, Field: errMsg.Field}
+}
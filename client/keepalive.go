@@ -0,0 +1,54 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// A keepalive pings the server periodically and closes the
+// connection if the server stops answering, so that the
+// Client reconnects.
+type keepalive struct {
+	conn protocol.Connection
+
+	lock     sync.Mutex
+	lastPing time.Time
+	lastPong time.Time
+}
+
+// Run sends pings until stopChan is closed or the
+// connection fails.
+func (k *keepalive) Run(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(protocol.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		k.lock.Lock()
+		timedOut := k.lastPong.Before(k.lastPing) && now.Sub(k.lastPing) > protocol.PingTimeout
+		if !k.lastPong.Before(k.lastPing) {
+			k.lastPing = now
+		}
+		k.lock.Unlock()
+		if timedOut {
+			k.conn.Close()
+			return
+		}
+		if k.conn.WriteMessage(&protocol.PingMessage{Time: protocol.UnixMillis(now)}) != nil {
+			return
+		}
+	}
+}
+
+// HandlePong records a pong from the server.
+func (k *keepalive) HandlePong() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.lastPong = time.Now()
+}
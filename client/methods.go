@@ -0,0 +1,117 @@
+package client
+
+import (
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// Register creates an account.
+func (c *Client) Register(email, password string) error {
+	_, err := c.Request(&protocol.RegisterMessage{Email: email, Password: password})
+	return err
+}
+
+// Login starts a session.
+//
+// The code is a two-factor code or recovery code, and may
+// be empty if the account does not use two-factor
+// authentication. It is only used for this login, and not
+// when reconnecting.
+func (c *Client) Login(email, password, code string) error {
+	login := &protocol.LoginMessage{Email: email, Password: password, Code: code}
+	if _, err := c.Request(login); err != nil {
+		return err
+	}
+	login.Code = ""
+	c.lock.Lock()
+	c.login = login
+	c.lock.Unlock()
+	return nil
+}
+
+// Logout ends the session and closes the connection.
+func (c *Client) Logout() error {
+	c.lock.Lock()
+	c.login = nil
+	conn := c.conn
+	c.lock.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.WriteMessage(&protocol.LogoutMessage{})
+}
+
+// SetStatus changes the user's status.
+func (c *Client) SetStatus(status statusdb.UserStatus) error {
+	_, err := c.Request(&protocol.SetStatusMessage{UserStatus: status})
+	return err
+}
+
+// AddBuddy sends a buddy request, with an optional
+// greeting.
+func (c *Client) AddBuddy(email, greeting string) error {
+	_, err := c.Request(&protocol.AddBuddyMessage{Email: email, Greeting: greeting})
+	return err
+}
+
+// AcceptRequest accepts a buddy request from a user.
+func (c *Client) AcceptRequest(email string) error {
+	_, err := c.Request(&protocol.AcceptRequestMessage{Email: email})
+	return err
+}
+
+// DeclineRequest declines a buddy request from a user.
+func (c *Client) DeclineRequest(email string) error {
+	_, err := c.Request(&protocol.DeclineRequestMessage{Email: email})
+	return err
+}
+
+// CancelRequest withdraws a buddy request to a user.
+func (c *Client) CancelRequest(email string) error {
+	_, err := c.Request(&protocol.CancelRequestMessage{Email: email})
+	return err
+}
+
+// RemoveBuddy removes a user from the buddy list.
+func (c *Client) RemoveBuddy(email string) error {
+	_, err := c.Request(&protocol.RemoveBuddyMessage{Email: email})
+	return err
+}
+
+// SetAlias sets a nickname for a buddy, or removes it if
+// the alias is empty.
+func (c *Client) SetAlias(email, alias string) error {
+	_, err := c.Request(&protocol.SetAliasMessage{Email: email, Alias: alias})
+	return err
+}
+
+// BlockUser blocks a user.
+func (c *Client) BlockUser(email string) error {
+	_, err := c.Request(&protocol.BlockUserMessage{Email: email})
+	return err
+}
+
+// UnblockUser unblocks a user.
+func (c *Client) UnblockUser(email string) error {
+	_, err := c.Request(&protocol.UnblockUserMessage{Email: email})
+	return err
+}
+
+// LookupUser checks whether a user may be sent a buddy
+// request.
+func (c *Client) LookupUser(email string) (*protocol.LookupResultMessage, error) {
+	res, err := c.Request(&protocol.LookupUserMessage{Email: email})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*protocol.LookupResultMessage), nil
+}
+
+// ServerInfo gets the server's build information.
+func (c *Client) ServerInfo() (*protocol.ServerInfo, error) {
+	res, err := c.Request(&protocol.GetServerInfoMessage{})
+	if err != nil {
+		return nil, err
+	}
+	return &res.(*protocol.ServerInfoMessage).ServerInfo, nil
+}
@@ -0,0 +1,316 @@
+// A client for the status server's WebSocket transport.
+//
+// The message definitions in protocol.ts are generated from
+// the server's Go structs by cmd/protogen, so a change to
+// the protocol shows up here as a type error.
+
+import {
+  BotLoginMessage,
+  Envelope,
+  ErrorCode,
+  LoginMessage,
+  MessageType,
+  MessageTypes,
+  UserStatus,
+} from "./protocol";
+
+export const DEFAULT_TIMEOUT = 30000;
+export const DEFAULT_RECONNECT_DELAY = 1000;
+export const MAX_RECONNECT_DELAY = 60000;
+
+// PING_INTERVAL and PING_TIMEOUT match the server's
+// keepalive settings.
+export const PING_INTERVAL = 30000;
+export const PING_TIMEOUT = 3 * PING_INTERVAL;
+
+// A ServerError is a failure reported by the server in
+// response to a request.
+export class ServerError extends Error {
+  constructor(
+    readonly code: ErrorCode,
+    message: string,
+    readonly field?: string,
+  ) {
+    super(message);
+  }
+}
+
+export class DisconnectedError extends Error {
+  constructor() {
+    super("disconnected before the server responded");
+  }
+}
+
+export class TimeoutError extends Error {
+  constructor() {
+    super("timed out waiting for the server");
+  }
+}
+
+export interface ClientOptions {
+  timeout?: number;
+  reconnectDelay?: number;
+}
+
+type Handler<T extends MessageType> = (msg: MessageTypes[T]) => void;
+
+// A Login is a request which starts a session, repeated
+// when the client reconnects.
+type Login =
+  | { type: "login"; data: LoginMessage }
+  | { type: "bot_login"; data: BotLoginMessage };
+
+type Pending = {
+  resolve: (env: Envelope) => void;
+  reject: (err: Error) => void;
+};
+
+const errorTypes: MessageType[] = [
+  "error",
+  "login_failure",
+  "register_failure",
+  "reauth_failure",
+];
+
+// A StatusClient is a connection to a status server.
+//
+// After a successful login, the client keeps the session
+// alive with pings, and if the connection is lost or the
+// server asks it to reconnect, it logs in again with the
+// same credentials. The server then sends a full state, so
+// the client is brought up to date.
+//
+// Two-factor codes are not reused, so a user with
+// two-factor authentication is logged out when the
+// connection is lost, and receives a login_failure.
+export class StatusClient {
+  private socket: WebSocket | null = null;
+  private opening: Promise<WebSocket> | null = null;
+  private waiting = new Map<string, Pending>();
+  private handlers = new Map<MessageType, Set<Handler<any>>>();
+  private nextID = 0;
+  private closed = false;
+  private login: Login | null = null;
+  private pingTimer: ReturnType<typeof setInterval> | null = null;
+  private lastPong = 0;
+
+  constructor(
+    readonly url: string,
+    readonly options: ClientOptions = {},
+  ) {}
+
+  // on registers a handler for messages which the server
+  // pushes rather than sending in response to a request,
+  // such as status changes. It returns a function which
+  // removes the handler.
+  on<T extends MessageType>(type: T, handler: Handler<T>): () => void {
+    let set = this.handlers.get(type);
+    if (!set) {
+      set = new Set();
+      this.handlers.set(type, set);
+    }
+    set.add(handler);
+    return () => set!.delete(handler);
+  }
+
+  // request sends a request and waits for the server's
+  // response. Error responses are thrown as ServerErrors.
+  async request<T extends MessageType>(
+    type: T,
+    data: MessageTypes[T],
+  ): Promise<Envelope> {
+    const socket = await this.connection();
+    const id = String(++this.nextID);
+    const response = new Promise<Envelope>((resolve, reject) => {
+      const timer = setTimeout(() => {
+        this.waiting.delete(id);
+        reject(new TimeoutError());
+      }, this.options.timeout || DEFAULT_TIMEOUT);
+      this.waiting.set(id, {
+        resolve: (env) => {
+          clearTimeout(timer);
+          resolve(env);
+        },
+        reject: (err) => {
+          clearTimeout(timer);
+          reject(err);
+        },
+      });
+    });
+    socket.send(JSON.stringify({ type, data: { ...data, id } }));
+    const env = await response;
+    if (errorTypes.includes(env.type)) {
+      const err = env.data as MessageTypes["error"];
+      throw new ServerError(err.code, err.message, err.field);
+    }
+    return env;
+  }
+
+  async register(email: string, password: string): Promise<void> {
+    await this.request("register", { email, password });
+  }
+
+  // login starts a session. The code is a two-factor code
+  // or recovery code, if the account needs one, and is only
+  // used for this login, not when reconnecting.
+  async login(email: string, password: string, code?: string): Promise<void> {
+    await this.request("login", { email, password, code });
+    this.login = { type: "login", data: { email, password } };
+  }
+
+  // botLogin starts a session for a bot account. Bots are
+  // always shown as available while connected, and set
+  // only the message and emoji of their statuses.
+  async botLogin(email: string, apiKey: string): Promise<void> {
+    const login: Login = { type: "bot_login", data: { email, api_key: apiKey } };
+    await this.request(login.type, login.data);
+    this.login = login;
+  }
+
+  // logout ends the session and closes the connection.
+  logout(): void {
+    this.login = null;
+    this.send("logout", {});
+  }
+
+  async setStatus(status: UserStatus): Promise<void> {
+    await this.request("set_status", status);
+  }
+
+  async addBuddy(email: string, greeting?: string): Promise<void> {
+    await this.request("add_buddy", { email, greeting });
+  }
+
+  async acceptRequest(email: string): Promise<void> {
+    await this.request("accept_request", { email });
+  }
+
+  async declineRequest(email: string): Promise<void> {
+    await this.request("decline_request", { email });
+  }
+
+  async removeBuddy(email: string): Promise<void> {
+    await this.request("remove_buddy", { email });
+  }
+
+  // close ends the connection and stops reconnecting.
+  close(): void {
+    this.closed = true;
+    this.login = null;
+    this.socket?.close();
+  }
+
+  private send<T extends MessageType>(type: T, data: MessageTypes[T]): void {
+    this.socket?.send(JSON.stringify({ type, data }));
+  }
+
+  // connection gets the current socket, opening a new one
+  // if necessary.
+  private connection(): Promise<WebSocket> {
+    if (this.closed) {
+      return Promise.reject(new Error("client is closed"));
+    }
+    if (this.socket) {
+      return Promise.resolve(this.socket);
+    }
+    if (!this.opening) {
+      this.opening = new Promise<WebSocket>((resolve, reject) => {
+        const socket = new WebSocket(this.url);
+        socket.onopen = () => {
+          this.opening = null;
+          this.startConnection(socket);
+          resolve(socket);
+        };
+        socket.onerror = () => {
+          this.opening = null;
+          reject(new Error("could not connect to " + this.url));
+        };
+      });
+    }
+    return this.opening;
+  }
+
+  private startConnection(socket: WebSocket): void {
+    this.socket = socket;
+    this.lastPong = Date.now();
+    this.pingTimer = setInterval(() => {
+      if (Date.now() - this.lastPong > PING_TIMEOUT) {
+        socket.close();
+        return;
+      }
+      this.send("ping", { time: Date.now() });
+    }, PING_INTERVAL);
+    socket.onmessage = (event) => this.receive(JSON.parse(event.data));
+    socket.onclose = () => this.connectionLost(socket);
+  }
+
+  private receive(env: Envelope): void {
+    switch (env.type) {
+      case "ping":
+        this.send("pong", { time: (env.data as MessageTypes["ping"]).time });
+        return;
+      case "pong":
+        this.lastPong = Date.now();
+        return;
+      case "reconnect":
+        this.socket?.close();
+        return;
+      case "forced_logout":
+        this.login = null;
+        break;
+    }
+    const id = (env.data as { id?: string } | null)?.id;
+    const pending = id ? this.waiting.get(id) : undefined;
+    if (pending) {
+      this.waiting.delete(id!);
+      pending.resolve(env);
+      return;
+    }
+    this.handlers.get(env.type)?.forEach((handler) => handler(env.data));
+  }
+
+  // connectionLost fails the requests waiting on a closed
+  // socket, and reconnects if the client is logged in.
+  private connectionLost(socket: WebSocket): void {
+    if (this.socket !== socket) {
+      return;
+    }
+    this.socket = null;
+    if (this.pingTimer) {
+      clearInterval(this.pingTimer);
+      this.pingTimer = null;
+    }
+    this.waiting.forEach((pending) => pending.reject(new DisconnectedError()));
+    this.waiting.clear();
+    if (!this.closed && this.login) {
+      this.reconnect(this.login, this.options.reconnectDelay || DEFAULT_RECONNECT_DELAY);
+    }
+  }
+
+  // reconnect repeats a login after a delay, doubling the
+  // delay after each failure. If the login is rejected, the
+  // failure is passed to the login_failure handlers and the
+  // client stays logged out.
+  private reconnect(login: Login, delay: number): void {
+    setTimeout(async () => {
+      if (this.closed || this.socket || this.login !== login) {
+        return;
+      }
+      try {
+        await this.request(login.type, login.data);
+      } catch (err) {
+        if (err instanceof ServerError) {
+          this.login = null;
+          this.receive({
+            type: "login_failure",
+            data: { code: err.code, message: err.message, field: err.field },
+          });
+        } else if (this.socket) {
+          this.socket.close();
+        } else {
+          this.reconnect(login, Math.min(delay * 2, MAX_RECONNECT_DELAY));
+        }
+      }
+    }, delay);
+  }
+}
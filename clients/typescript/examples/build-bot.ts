@@ -0,0 +1,53 @@
+// An example bot which shows the state of a build on its
+// buddies' lists.
+//
+// Create the bot's account with
+//
+//   statusctl create-bot builds@example.com
+//
+// and run this with the printed API key in $STATUS_API_KEY.
+// Users add the bot as a buddy like anyone else, and the
+// bot accepts every request it receives.
+
+import { StatusClient } from "../client";
+import { UserStatus } from "../protocol";
+
+const SERVER_URL = "wss://status.example.com/ws";
+const BOT_EMAIL = "builds@example.com";
+
+// AVAILABLE is statusdb.Available. The server shows bots
+// as available whatever they send.
+const AVAILABLE = 1;
+
+async function main(): Promise<void> {
+  const client = new StatusClient(SERVER_URL);
+  const accept = (email: string) => {
+    client.acceptRequest(email).catch((err) => console.error(err));
+  };
+  client.on("request_received", (msg) => accept(msg.email));
+  client.on("full_state", (msg) => (msg.incoming_requests || []).forEach(accept));
+  client.on("login_failure", (msg) => {
+    console.error("login failed:", msg.message);
+  });
+  await client.botLogin(BOT_EMAIL, process.env.STATUS_API_KEY || "");
+
+  // Bots are always available, so only the message and
+  // emoji carry information.
+  await client.setStatus(status("Build running", "🔨"));
+  const passed = await runBuild();
+  await client.setStatus(passed ? status("Build passed", "✅") : status("Build failed", "❌"));
+}
+
+function status(message: string, emoji: string): UserStatus {
+  return { Availability: AVAILABLE, Message: message, Emoji: emoji, Time: new Date().toISOString() };
+}
+
+// runBuild stands in for the real work.
+function runBuild(): Promise<boolean> {
+  return new Promise((resolve) => setTimeout(() => resolve(true), 5000));
+}
+
+main().catch((err) => {
+  console.error(err);
+  process.exit(1);
+});
@@ -0,0 +1,1010 @@
+// Code generated by protogen; DO NOT EDIT.
+
+export interface APIKeyMessage {
+  id?: string;
+  api_key: string;
+}
+
+export interface AcceptRequestMessage {
+  id?: string;
+  email: string;
+}
+
+export interface AcceptSentMessage {
+  email: string;
+  status: UserStatus;
+}
+
+export interface AckMessage {
+  id?: string;
+}
+
+export interface AddBuddyMessage {
+  id?: string;
+  email: string;
+  greeting?: string;
+}
+
+export interface AddPushSubscriptionMessage {
+  id?: string;
+  endpoint: string;
+  keys: PushKeys;
+}
+
+export interface AddWebhookMessage {
+  id?: string;
+  url: string;
+  events: string[] | null;
+}
+
+export interface AliasChangedMessage {
+  email: string;
+  alias: string;
+}
+
+export interface Announcement {
+  id: string;
+  level: NoticeLevel;
+  text: string;
+  key?: string;
+  start: string;
+  end?: string;
+}
+
+export interface AnnouncementsMessage {
+  announcements: Announcement[] | null;
+}
+
+export interface AuthorizeContactsMessage {
+  id?: string;
+  source: string;
+  redirect_uri: string;
+}
+
+export interface AuthorizeIntegrationMessage {
+  id?: string;
+  provider: string;
+  redirect_uri: string;
+}
+
+export type Availability = number;
+
+export interface AvatarMessage {
+  id?: string;
+  hash: string;
+  data: string | null;
+}
+
+export interface AwayNoteMessage {
+  id?: string;
+  email: string;
+  note: string;
+}
+
+export interface BatchCommand {
+  type: string;
+  data: unknown;
+}
+
+export interface BatchMessage {
+  id?: string;
+  commands: BatchCommand[] | null;
+}
+
+export interface BatchResult {
+  type: string;
+  data: unknown;
+}
+
+export interface BatchResultMessage {
+  id?: string;
+  results: BatchResult[] | null;
+}
+
+export interface BlockUserMessage {
+  id?: string;
+  email: string;
+}
+
+export interface BotLoginMessage {
+  id?: string;
+  email: string;
+  api_key: string;
+  locale?: string;
+  events?: EventCategory[];
+}
+
+export interface BuddyListMessage {
+  id?: string;
+  format: string;
+  data: string;
+}
+
+export interface BuddyRemovedMessage {
+  email: string;
+}
+
+export interface BuddyState {
+  email: string;
+  alias?: string;
+  status: UserStatus;
+  profile: Profile;
+}
+
+export interface CancelRequestMessage {
+  id?: string;
+  email: string;
+}
+
+export interface CapabilitiesMessage {
+  id?: string;
+  message_types: string[] | null;
+  extensions: string[] | null;
+  locale?: string;
+}
+
+export interface CompressedMessage {
+  inner: string;
+  data: string | null;
+}
+
+export interface ConnectIntegrationMessage {
+  id?: string;
+  provider: string;
+  code: string;
+  redirect_uri?: string;
+  import: boolean;
+  export: boolean;
+}
+
+export interface CreateAPIKeyMessage {
+  id?: string;
+}
+
+export interface CustomState {
+  name: string;
+  label: string;
+  base: Availability;
+  color?: string;
+}
+
+export interface DeclineRequestMessage {
+  id?: string;
+  email: string;
+}
+
+export interface DeleteAccountMessage {
+  id?: string;
+  password: string;
+  code?: string;
+}
+
+export interface DisableTwoFactorMessage {
+  id?: string;
+}
+
+export interface DisconnectIntegrationMessage {
+  id?: string;
+  provider: string;
+}
+
+export interface EnableTwoFactorMessage {
+  id?: string;
+}
+
+export type ErrorCode = string;
+
+export interface ErrorMessage {
+  id?: string;
+  code: ErrorCode;
+  message: string;
+  field?: string;
+  fields?: string[];
+}
+
+export type EventCategory = string;
+
+export interface ExportBuddiesMessage {
+  id?: string;
+  format: string;
+}
+
+export interface ForcedLogoutMessage {
+}
+
+export interface FullStateBeginMessage {
+  state: FullStateMessage | null;
+  buddy_count: number;
+  chunk_count: number;
+}
+
+export interface FullStateChunkMessage {
+  index: number;
+  buddies: BuddyState[] | null;
+}
+
+export interface FullStateEndMessage {
+}
+
+export interface FullStateMessage {
+  server_time: number;
+  status: UserStatus;
+  profile: Profile;
+  buddies: BuddyState[] | null;
+  incoming_requests: string[] | null;
+  outgoing_requests: string[] | null;
+  greetings?: { [key: string]: string };
+  blocked: string[] | null;
+  dnd_suppress_events: boolean;
+  away_note?: string;
+  time_zone?: string;
+  last_seen_visibility?: Visibility;
+  privacy: PrivacySettings;
+  public_presence: boolean;
+  discoverable: boolean;
+  custom_states: CustomState[] | null;
+  schedule: Schedule;
+  announcements: Announcement[] | null;
+}
+
+export interface GetAvatarMessage {
+  id?: string;
+  hash: string;
+}
+
+export interface GetAwayNoteMessage {
+  id?: string;
+  email: string;
+}
+
+export interface GetPrivacyMessage {
+  id?: string;
+}
+
+export interface GetProfileMessage {
+  id?: string;
+  email: string;
+}
+
+export interface GetPushKeyMessage {
+  id?: string;
+}
+
+export interface GetServerInfoMessage {
+  id?: string;
+}
+
+export interface GetServerStatsMessage {
+  id?: string;
+}
+
+export interface GetStatsMessage {
+  id?: string;
+}
+
+export interface GetStatusHistoryMessage {
+  id?: string;
+  email: string;
+  since?: number;
+}
+
+export interface ImportBuddiesMessage {
+  id?: string;
+  format: string;
+  data: string;
+}
+
+export interface ImportContactsMessage {
+  id?: string;
+  source: string;
+  code?: string;
+  redirect_uri?: string;
+  url?: string;
+  username?: string;
+  password?: string;
+}
+
+export interface ImportResult {
+  email: string;
+  action?: string;
+  code?: ErrorCode;
+  message?: string;
+}
+
+export interface ImportResultMessage {
+  id?: string;
+  results: ImportResult[] | null;
+}
+
+export interface Integration {
+  provider: string;
+  account_id: string;
+  token?: string;
+  import: boolean;
+  export: boolean;
+  last_sync?: string;
+  connected: string;
+}
+
+export interface IntegrationMessage {
+  id?: string;
+  integration: Integration;
+}
+
+export interface IntegrationURLMessage {
+  id?: string;
+  url: string;
+}
+
+export interface IntegrationsMessage {
+  id?: string;
+  integrations: Integration[] | null;
+}
+
+export interface LimitsMessage {
+  max_status_message_length: number;
+  max_greeting_length: number;
+  max_alias_length: number;
+  max_user_metadata_length: number;
+  max_avatar_upload_size: number;
+  max_display_name_length: number;
+  max_pronouns_length: number;
+  max_bio_length: number;
+  max_batch_commands: number;
+  max_buddies: number;
+  max_pending_requests: number;
+  max_sessions_per_user: number;
+  max_messages_per_minute: number;
+  max_lookups_per_minute: number;
+  max_reports_per_hour: number;
+  status_history_length: number;
+  ping_interval: number;
+  ping_timeout: number;
+}
+
+export interface ListIntegrationsMessage {
+  id?: string;
+}
+
+export interface ListWebhooksMessage {
+  id?: string;
+}
+
+export interface LoginFailureMessage {
+  id?: string;
+  code: ErrorCode;
+  message: string;
+  field?: string;
+  fields?: string[];
+}
+
+export interface LoginMessage {
+  id?: string;
+  email: string;
+  password: string;
+  code?: string;
+  locale?: string;
+  events?: EventCategory[];
+  since?: number;
+}
+
+export interface LoginSuccessMessage {
+  id?: string;
+}
+
+export interface LogoutMessage {
+  id?: string;
+}
+
+export interface LogoutOtherMessage {
+  id?: string;
+}
+
+export interface LookupResultMessage {
+  id?: string;
+  email: string;
+  registered: boolean;
+  requestable: boolean;
+  reason?: ErrorCode;
+}
+
+export interface LookupUserMessage {
+  id?: string;
+  email: string;
+}
+
+export interface MissedEvent {
+  type: string;
+  email: string;
+  greeting?: string;
+  text?: string;
+  time: string;
+}
+
+export interface MissedEventsMessage {
+  events: MissedEvent[] | null;
+}
+
+export type NoticeLevel = string;
+
+export interface PingMessage {
+  id?: string;
+  time: number;
+  rtt?: number;
+}
+
+export interface PongMessage {
+  id?: string;
+  time: number;
+  server_time?: number;
+}
+
+export interface PrivacyMessage {
+  id?: string;
+  privacy: PrivacySettings;
+}
+
+export interface PrivacySettings {
+  requests?: RequestPolicy;
+  status_message?: Visibility;
+  last_seen?: Visibility;
+  status_history?: Visibility;
+}
+
+export interface Profile {
+  display_name?: string;
+  pronouns?: string;
+  bio?: string;
+  avatar_hash?: string;
+  avatar_url?: string;
+  bot?: boolean;
+}
+
+export interface ProfileChangedMessage {
+  email: string;
+  profile: Profile;
+}
+
+export interface ProfileMessage {
+  id?: string;
+  email: string;
+  profile: Profile;
+}
+
+export interface PushKeyMessage {
+  id?: string;
+  public_key: string;
+}
+
+export interface PushKeys {
+  p256dh: string;
+  auth: string;
+}
+
+export interface ReauthFailureMessage {
+  id?: string;
+  code: ErrorCode;
+  message: string;
+  field?: string;
+  fields?: string[];
+}
+
+export interface ReauthSuccessMessage {
+  id?: string;
+}
+
+export interface ReauthenticateMessage {
+  id?: string;
+  password: string;
+  code?: string;
+}
+
+export interface ReconnectMessage {
+}
+
+export interface RecoveryCodesMessage {
+  id?: string;
+  recovery_codes: string[] | null;
+}
+
+export interface RegenerateRecoveryCodesMessage {
+  id?: string;
+}
+
+export interface RegisterFailureMessage {
+  id?: string;
+  code: ErrorCode;
+  message: string;
+  field?: string;
+  fields?: string[];
+}
+
+export interface RegisterMessage {
+  id?: string;
+  email: string;
+  password: string;
+  code?: string;
+  locale?: string;
+  events?: EventCategory[];
+  since?: number;
+}
+
+export interface RegisterSuccessMessage {
+  id?: string;
+}
+
+export interface RegisterVerifyMessage {
+  id?: string;
+  email: string;
+  token: string;
+}
+
+export interface RemoveBuddyMessage {
+  id?: string;
+  email: string;
+}
+
+export interface RemovePushSubscriptionMessage {
+  id?: string;
+  endpoint: string;
+}
+
+export interface RemoveWebhookMessage {
+  id?: string;
+  webhook_id: string;
+}
+
+export interface ReportUserMessage {
+  id?: string;
+  email: string;
+  reason: string;
+  evidence?: string;
+}
+
+export interface RequestAcceptedMessage {
+  email: string;
+  status: UserStatus;
+}
+
+export interface RequestCanceledMessage {
+  email: string;
+}
+
+export interface RequestDeclinedMessage {
+  email: string;
+}
+
+export type RequestPolicy = string;
+
+export interface RequestReceivedMessage {
+  email: string;
+  greeting?: string;
+}
+
+export interface RequestSentMessage {
+  email: string;
+}
+
+export interface ResetPasswordMessage {
+  id?: string;
+  email: string;
+}
+
+export interface RevokeAPIKeyMessage {
+  id?: string;
+}
+
+export interface Schedule {
+  time_zone?: string;
+  rules: ScheduleRule[] | null;
+}
+
+export interface ScheduleRule {
+  days?: Weekday[];
+  start: string;
+  end: string;
+  availability: Availability;
+  message?: string;
+}
+
+export type SecurityAlert = string;
+
+export interface SecurityAlertMessage {
+  alert: SecurityAlert;
+}
+
+export interface ServerInfoMessage {
+  id?: string;
+  version: string;
+  commit: string;
+  build_date: string;
+  go_version: string;
+}
+
+export interface ServerNoticeMessage {
+  level: NoticeLevel;
+  text: string;
+  time: string;
+  key?: string;
+}
+
+export interface ServerStatsMessage {
+  id?: string;
+  connections: number;
+  sessions: number;
+  online_users: number;
+  event_backlog: number;
+  heap_bytes: number;
+  sys_bytes: number;
+  goroutines: number;
+  uptime_seconds: number;
+}
+
+export interface SetActiveMessage {
+  id?: string;
+}
+
+export interface SetAliasMessage {
+  id?: string;
+  email: string;
+  alias: string;
+}
+
+export interface SetAvatarMessage {
+  id?: string;
+  data: string | null;
+}
+
+export interface SetAwayNoteMessage {
+  id?: string;
+  note: string;
+}
+
+export interface SetCustomStatesMessage {
+  id?: string;
+  states: CustomState[] | null;
+}
+
+export interface SetDNDSettingsMessage {
+  id?: string;
+  suppress_events: boolean;
+}
+
+export interface SetDiscoverableMessage {
+  id?: string;
+  discoverable: boolean;
+}
+
+export interface SetIdleMessage {
+  id?: string;
+  idle_seconds: number;
+}
+
+export interface SetLastSeenMessage {
+  id?: string;
+  visibility: Visibility;
+}
+
+export interface SetPasswordMessage {
+  id?: string;
+  email: string;
+  old_password: string;
+  new_password: string;
+}
+
+export interface SetPrivacyMessage {
+  id?: string;
+  privacy: PrivacySettings;
+}
+
+export interface SetProfileMessage {
+  id?: string;
+  display_name: string;
+  pronouns: string;
+  bio: string;
+}
+
+export interface SetPublicMessage {
+  id?: string;
+  public: boolean;
+}
+
+export interface SetScheduleMessage {
+  id?: string;
+  schedule: Schedule;
+}
+
+export interface SetStatusMessage {
+  id?: string;
+  Availability: Availability;
+  Message: string;
+  Time: string;
+  UserMetadata?: unknown;
+  Emoji?: string;
+  Link?: string;
+  ExpiresAt?: string;
+  Idle?: boolean;
+  Custom?: CustomState;
+  LastSeen?: string;
+  TimeZone?: string;
+  LocalTime?: string;
+}
+
+export interface SetTimeZoneMessage {
+  id?: string;
+  time_zone: string;
+}
+
+export interface SetVisibilityMessage {
+  id?: string;
+  invisible: boolean;
+}
+
+export interface StatsMessage {
+  id?: string;
+  logins: number;
+  online_seconds: number;
+  status_changes: number;
+  last_activity: string;
+}
+
+export interface StatusChangedMessage {
+  email: string;
+  status: UserStatus;
+}
+
+export interface StatusHistoryEntry {
+  time: string;
+  availability: Availability;
+  message?: string;
+  emoji?: string;
+}
+
+export interface StatusHistoryMessage {
+  id?: string;
+  email: string;
+  history: StatusHistoryEntry[] | null;
+}
+
+export interface SubscribeMessage {
+  id?: string;
+  email: string;
+}
+
+export interface SuggestBuddiesMessage {
+  id?: string;
+}
+
+export interface Suggestion {
+  email: string;
+  display_name?: string;
+  avatar_hash?: string;
+  avatar_url?: string;
+  mutual_buddies?: number;
+}
+
+export interface SuggestionsMessage {
+  id?: string;
+  suggestions: Suggestion[] | null;
+}
+
+export interface SyncDeltaMessage {
+  id?: string;
+  server_time: number;
+  full?: FullStateMessage;
+  status?: UserStatus;
+  buddies?: BuddyState[];
+  announcements?: Announcement[];
+}
+
+export interface SyncErrorMessage {
+  message: string;
+}
+
+export interface SyncSinceMessage {
+  id?: string;
+  since: number;
+}
+
+export interface TestWebhookMessage {
+  id?: string;
+  webhook_id: string;
+}
+
+export interface TwoFactorEnabledMessage {
+  id?: string;
+  secret: string;
+  recovery_codes: string[] | null;
+}
+
+export interface UnblockUserMessage {
+  id?: string;
+  email: string;
+}
+
+export interface UnsubscribeMessage {
+  id?: string;
+  email: string;
+}
+
+export interface UserBlockedMessage {
+  email: string;
+}
+
+export interface UserStatus {
+  Availability: Availability;
+  Message: string;
+  Time: string;
+  UserMetadata?: unknown;
+  Emoji?: string;
+  Link?: string;
+  ExpiresAt?: string;
+  Idle?: boolean;
+  Custom?: CustomState;
+  LastSeen?: string;
+  TimeZone?: string;
+  LocalTime?: string;
+}
+
+export interface UserUnblockedMessage {
+  email: string;
+}
+
+export type Visibility = string;
+
+export interface Webhook {
+  id: string;
+  url: string;
+  secret?: string;
+  events: string[] | null;
+  created: string;
+}
+
+export interface WebhookMessage {
+  id?: string;
+  webhook: Webhook;
+}
+
+export interface WebhooksMessage {
+  id?: string;
+  webhooks: Webhook[] | null;
+}
+
+export type Weekday = number;
+
+export interface MessageTypes {
+  "accept_request": AcceptRequestMessage;
+  "accept_sent": AcceptSentMessage;
+  "ack": AckMessage;
+  "add_buddy": AddBuddyMessage;
+  "add_push_subscription": AddPushSubscriptionMessage;
+  "add_webhook": AddWebhookMessage;
+  "alias_changed": AliasChangedMessage;
+  "announcements": AnnouncementsMessage;
+  "api_key": APIKeyMessage;
+  "authorize_contacts": AuthorizeContactsMessage;
+  "authorize_integration": AuthorizeIntegrationMessage;
+  "avatar": AvatarMessage;
+  "away_note": AwayNoteMessage;
+  "batch": BatchMessage;
+  "batch_result": BatchResultMessage;
+  "block_user": BlockUserMessage;
+  "bot_login": BotLoginMessage;
+  "buddy_list": BuddyListMessage;
+  "buddy_removed": BuddyRemovedMessage;
+  "cancel_request": CancelRequestMessage;
+  "capabilities": CapabilitiesMessage;
+  "compressed": CompressedMessage;
+  "connect_integration": ConnectIntegrationMessage;
+  "create_api_key": CreateAPIKeyMessage;
+  "decline_request": DeclineRequestMessage;
+  "delete_account": DeleteAccountMessage;
+  "disable_two_factor": DisableTwoFactorMessage;
+  "disconnect_integration": DisconnectIntegrationMessage;
+  "enable_two_factor": EnableTwoFactorMessage;
+  "error": ErrorMessage;
+  "export_buddies": ExportBuddiesMessage;
+  "forced_logout": ForcedLogoutMessage;
+  "full_state": FullStateMessage;
+  "full_state_begin": FullStateBeginMessage;
+  "full_state_chunk": FullStateChunkMessage;
+  "full_state_end": FullStateEndMessage;
+  "get_avatar": GetAvatarMessage;
+  "get_away_note": GetAwayNoteMessage;
+  "get_privacy": GetPrivacyMessage;
+  "get_profile": GetProfileMessage;
+  "get_push_key": GetPushKeyMessage;
+  "get_server_info": GetServerInfoMessage;
+  "get_server_stats": GetServerStatsMessage;
+  "get_stats": GetStatsMessage;
+  "get_status_history": GetStatusHistoryMessage;
+  "import_buddies": ImportBuddiesMessage;
+  "import_contacts": ImportContactsMessage;
+  "import_result": ImportResultMessage;
+  "integration": IntegrationMessage;
+  "integration_url": IntegrationURLMessage;
+  "integrations": IntegrationsMessage;
+  "limits": LimitsMessage;
+  "list_integrations": ListIntegrationsMessage;
+  "list_webhooks": ListWebhooksMessage;
+  "login": LoginMessage;
+  "login_failure": LoginFailureMessage;
+  "login_success": LoginSuccessMessage;
+  "logout": LogoutMessage;
+  "logout_other": LogoutOtherMessage;
+  "lookup_result": LookupResultMessage;
+  "lookup_user": LookupUserMessage;
+  "missed_events": MissedEventsMessage;
+  "ping": PingMessage;
+  "pong": PongMessage;
+  "privacy": PrivacyMessage;
+  "profile": ProfileMessage;
+  "profile_changed": ProfileChangedMessage;
+  "push_key": PushKeyMessage;
+  "reauth_failure": ReauthFailureMessage;
+  "reauth_success": ReauthSuccessMessage;
+  "reauthenticate": ReauthenticateMessage;
+  "reconnect": ReconnectMessage;
+  "recovery_codes": RecoveryCodesMessage;
+  "regenerate_recovery_codes": RegenerateRecoveryCodesMessage;
+  "register": RegisterMessage;
+  "register_failure": RegisterFailureMessage;
+  "register_success": RegisterSuccessMessage;
+  "register_verify": RegisterVerifyMessage;
+  "remove_buddy": RemoveBuddyMessage;
+  "remove_push_subscription": RemovePushSubscriptionMessage;
+  "remove_webhook": RemoveWebhookMessage;
+  "report_user": ReportUserMessage;
+  "request_accepted": RequestAcceptedMessage;
+  "request_canceled": RequestCanceledMessage;
+  "request_declined": RequestDeclinedMessage;
+  "request_received": RequestReceivedMessage;
+  "request_sent": RequestSentMessage;
+  "reset_password": ResetPasswordMessage;
+  "revoke_api_key": RevokeAPIKeyMessage;
+  "security_alert": SecurityAlertMessage;
+  "server_info": ServerInfoMessage;
+  "server_notice": ServerNoticeMessage;
+  "server_stats": ServerStatsMessage;
+  "set_active": SetActiveMessage;
+  "set_alias": SetAliasMessage;
+  "set_avatar": SetAvatarMessage;
+  "set_away_note": SetAwayNoteMessage;
+  "set_custom_states": SetCustomStatesMessage;
+  "set_discoverable": SetDiscoverableMessage;
+  "set_dnd_settings": SetDNDSettingsMessage;
+  "set_idle": SetIdleMessage;
+  "set_last_seen": SetLastSeenMessage;
+  "set_password": SetPasswordMessage;
+  "set_privacy": SetPrivacyMessage;
+  "set_profile": SetProfileMessage;
+  "set_public_presence": SetPublicMessage;
+  "set_schedule": SetScheduleMessage;
+  "set_status": SetStatusMessage;
+  "set_time_zone": SetTimeZoneMessage;
+  "set_visibility": SetVisibilityMessage;
+  "stats": StatsMessage;
+  "status_changed": StatusChangedMessage;
+  "status_history": StatusHistoryMessage;
+  "subscribe": SubscribeMessage;
+  "suggest_buddies": SuggestBuddiesMessage;
+  "suggestions": SuggestionsMessage;
+  "sync_delta": SyncDeltaMessage;
+  "sync_error": SyncErrorMessage;
+  "sync_since": SyncSinceMessage;
+  "test_webhook": TestWebhookMessage;
+  "two_factor_enabled": TwoFactorEnabledMessage;
+  "unblock_user": UnblockUserMessage;
+  "unsubscribe": UnsubscribeMessage;
+  "user_blocked": UserBlockedMessage;
+  "user_unblocked": UserUnblockedMessage;
+  "webhook": WebhookMessage;
+  "webhooks": WebhooksMessage;
+}
+
+export type MessageType = keyof MessageTypes;
+
+export interface Envelope<T extends MessageType = MessageType> {
+  type: T;
+  data: MessageTypes[T];
+}
@@ -0,0 +1,31 @@
+// Command protogen generates TypeScript definitions for
+// the status server's protocol messages.
+//
+// Browser clients should regenerate the definitions after
+// any change to the protocol:
+//
+//	go run ./cmd/protogen -o clients/typescript/protocol.ts
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/unixpickle/essentials"
+)
+
+func main() {
+	var outPath string
+	flag.StringVar(&outPath, "o", "", "output file (default: stdout)")
+	flag.Parse()
+
+	out := os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		essentials.Must(err)
+		defer f.Close()
+		out = f
+	}
+	essentials.Must(protocol.WriteTypeScript(out))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/unixpickle/essentials"
+)
+
+var errBenchRegression = errors.New("benchmarks regressed past the budget")
+
+// benchMain runs an events.BroadcastBench configured by
+// command-line arguments, and prints the results.
+//
+// With -baseline, the results are compared to those saved
+// by an earlier run with -save, and an error is returned
+// if any of them regressed by more than
+// events.BenchRegressionBudget.
+func benchMain(args []string) (err error) {
+	defer essentials.AddCtxTo("bench", &err)
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	bench := &events.BroadcastBench{}
+	fs.IntVar(&bench.Users, "users", 1000, "number of online users")
+	fs.IntVar(&bench.Buddies, "buddies", 20, "number of buddies per user")
+	baselinePath := fs.String("baseline", "", "results to compare against")
+	savePath := fs.String("save", "", "file to save the results to")
+	cpuProfile := fs.String("cpuprofile", "", "file to write a CPU profile to")
+	memProfile := fs.String("memprofile", "", "file to write a heap profile to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var baseline []events.BenchResult
+	if *baselinePath != "" {
+		data, err := ioutil.ReadFile(*baselinePath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			return err
+		}
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	results, err := bench.Run()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d users with %d buddies each\n\n", bench.Users, bench.Buddies)
+	for _, result := range results {
+		fmt.Println(result)
+	}
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			return err
+		}
+	}
+	if *savePath != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*savePath, data, 0644); err != nil {
+			return err
+		}
+	}
+	if regressions := events.CompareBench(baseline, results); len(regressions) > 0 {
+		fmt.Printf("\nRegressions past %.0f%%:\n  %s\n", events.BenchRegressionBudget*100,
+			strings.Join(regressions, "\n  "))
+		return errBenchRegression
+	}
+	return nil
+}
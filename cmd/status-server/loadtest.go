@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/PickledCode/status-server/server"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// loadTestMain runs a load test against a temporary
+// database, for the server's --loadtest mode, and prints
+// the report.
+//
+// The arguments are flags which configure the LoadTest.
+func loadTestMain(args []string) (err error) {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	test := &server.LoadTest{}
+	fs.IntVar(&test.Clients, "clients", 100, "number of simulated clients")
+	fs.DurationVar(&test.Duration, "duration", 30*time.Second, "time to send requests")
+	fs.DurationVar(&test.Interval, "interval", 100*time.Millisecond,
+		"mean time between each client's requests")
+	fs.DurationVar(&test.Timeout, "timeout", time.Minute, "time to wait for each response")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if test.Clients < 1 {
+		return &statusdb.ValidationError{Field: "clients", Reason: "must be positive"}
+	}
+
+	dir, err := os.MkdirTemp("", "status-loadtest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	config := server.DefaultConfig()
+	config.DB.Path = filepath.Join(dir, "users.json")
+	_, edb, err := config.OpenDB()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	report, err := test.Run(edb)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d clients for %s\n\n", test.Clients, time.Since(start).Round(time.Millisecond))
+	fmt.Print(report)
+	return nil
+}
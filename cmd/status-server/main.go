@@ -0,0 +1,225 @@
+// Command status-server runs a status server with the
+// configuration from a file, the environment, and flags.
+//
+// It can also run a load test, benchmarks, or replay a
+// recording:
+//
+//	status-server --loadtest [flags]
+//	status-server --bench [flags]
+//	status-server --replay [flags] <recording>
+//
+// It can also create a key pair for Web Push:
+//
+//	status-server --vapid-keys
+//
+// On SIGUSR2, the server drains its sessions and hands its
+// listeners to a new process running the current binary,
+// so that a deploy only needs to replace the binary.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/server"
+	"github.com/unixpickle/essentials"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "--loadtest", "-loadtest":
+			essentials.Must(loadTestMain(os.Args[2:]))
+			return
+		case "--bench", "-bench":
+			essentials.Must(benchMain(os.Args[2:]))
+			return
+		case "--replay", "-replay":
+			essentials.Must(server.ReplayMain(os.Args[2:]))
+			return
+		case "--vapid-keys", "-vapid-keys":
+			private, public, err := server.GenerateVAPIDKeys()
+			essentials.Must(err)
+			fmt.Println("private key:", private)
+			fmt.Println("public key: ", public)
+			return
+		}
+	}
+
+	config, err := server.LoadConfig(flag.CommandLine, os.Args[1:])
+	essentials.Must(err)
+	log.SetOutput(config.OpenLog())
+	essentials.Must(config.LoadCatalogs())
+
+	db, edb, err := config.OpenDB()
+	essentials.Must(err)
+	clientOpts, err := config.ClientOptions()
+	essentials.Must(err)
+
+	stop := make(chan struct{})
+	go edb.RunElection(stop)
+	go server.RunLeaderTask(edb, "expire statuses", server.StatusSweepInterval,
+		edb.ExpireStatuses, stop)
+	go server.RunLeaderTask(edb, "sync integrations", server.IntegrationSyncInterval,
+		edb.SyncIntegrations, stop)
+	go server.RunLeaderTask(edb, "apply schedules", server.ScheduleInterval,
+		edb.ApplySchedules, stop)
+	if age := config.DB.StaleAccountAge; age > 0 {
+		go server.RunLeaderTask(edb, "purge stale accounts", server.StaleAccountInterval,
+			server.StaleAccountPurger(edb, age), stop)
+	}
+	if interval := config.Summary.Interval; interval > 0 {
+		go server.RunSummaryReports(edb, interval, config.SummarySinks(), stop)
+	}
+
+	// listeners are the TCP listeners, without TLS, which
+	// are handed to a new process on SIGUSR2.
+	listeners := map[string]net.Listener{}
+
+	probes := &server.HealthProbes{EDB: edb}
+	if config.Listen.HealthAddr != "" {
+		listener, err := server.Listen(config.Listen.HealthAddr)
+		essentials.Must(err)
+		listeners[config.Listen.HealthAddr] = listener
+		go func() {
+			log.Println("health probes:", http.Serve(listener, probes))
+		}()
+	}
+
+	if config.Listen.AdminAddr != "" {
+		listener, err := listen(config, listeners, config.Listen.AdminAddr)
+		essentials.Must(err)
+		handler := server.AdminHandler(db, edb, config.Listen.AdminToken)
+		go func() {
+			log.Println("admin API:", http.Serve(listener, handler))
+		}()
+	}
+
+	if config.Listen.WebSocketAddr != "" {
+		listener, err := listen(config, listeners, config.Listen.WebSocketAddr)
+		essentials.Must(err)
+		handler := server.WebSocketHandler(edb, clientOpts)
+		mux := http.NewServeMux()
+		if proxy := config.GravatarProxy(); proxy != nil {
+			mux.Handle(server.GravatarProxyPath, proxy)
+		}
+		if alertmanager := config.Alertmanager(); alertmanager != nil {
+			mux.Handle(server.AlertmanagerPath, alertmanager)
+		}
+		if bridge := config.MatrixBridge(); bridge != nil {
+			mux.Handle(server.MatrixPath, bridge.Handler(db, edb))
+		}
+		mux.Handle(server.ZapierPath, server.ZapierHandler(db, edb))
+		mux.Handle(server.PublicPresencePath, server.PublicPresenceHandler(edb))
+		mux.Handle("/", handler)
+		handler = mux
+		go func() {
+			log.Println("WebSocket:", http.Serve(listener, handler))
+		}()
+	}
+
+	if config.Listen.IRCAddr != "" {
+		listener, err := listen(config, listeners, config.Listen.IRCAddr)
+		essentials.Must(err)
+		go func() {
+			log.Println("IRC:", server.ServeIRC(listener, edb))
+		}()
+	}
+
+	if config.Federation.Addr != "" {
+		peers, err := config.FederationPeers()
+		essentials.Must(err)
+		listener, err := listen(config, listeners, config.Federation.Addr)
+		essentials.Must(err)
+		handler := server.FederationHandler(edb, peers)
+		go func() {
+			log.Println("federation:", http.Serve(listener, handler))
+		}()
+	}
+
+	listener, err := listen(config, listeners, config.Listen.Addr)
+	essentials.Must(err)
+	go func() {
+		log.Println("clients:", server.Serve(listener, edb, clientOpts))
+	}()
+
+	go func() {
+		if err := server.RunSystemdWatchdog(edb, stop); err != nil {
+			log.Println("systemd:", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	for <-signals == syscall.SIGUSR2 {
+		u, err := server.PrepareUpgrade(listeners)
+		if err != nil {
+			log.Println("upgrade:", err)
+			continue
+		}
+		restart(u, listeners, probes, edb, stop)
+		return
+	}
+	probes.Stop()
+	if grace := config.Listen.TerminationGrace; grace > 0 {
+		// A second signal skips the grace period.
+		select {
+		case <-time.After(grace):
+		case <-signals:
+		}
+	}
+	close(stop)
+	if err := edb.Drain(); err != nil {
+		log.Println("drain:", err)
+	}
+}
+
+// restart hands the listeners to a new process running
+// the current binary, following the steps described by
+// server.Upgrade.
+func restart(u *server.Upgrade, listeners map[string]net.Listener, probes *server.HealthProbes,
+	edb events.EventDB, stop chan struct{}) {
+	probes.Stop()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	close(stop)
+	if err := edb.Drain(); err != nil {
+		log.Println("drain:", err)
+	}
+	if _, err := u.Start(); err != nil {
+		log.Println("upgrade:", err)
+	}
+}
+
+// listen creates a listener for an address, using TLS if
+// it is configured.
+//
+// The TCP listener is added to listeners, since a TLS
+// listener cannot be handed to a new process.
+func listen(config *server.Config, listeners map[string]net.Listener,
+	addr string) (net.Listener, error) {
+	listener, err := server.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	listeners[addr] = listener
+	if config.TLS.CertFile == "" {
+		return listener, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+}
@@ -0,0 +1,583 @@
+// Command statusctl performs administrative operations on
+// a status server through its admin API.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: statusctl [flags] <command> [args]
+
+Commands:
+  users [query]              list users, optionally matching a query
+  user <email>               show a user's details
+  create <email>             create a user (password read from stdin)
+  create-bot <email>         create a bot account and print its API key
+  rotate-key <email>         replace a bot's API key and log it out
+  delete <email>             delete a user
+  merge <email> <into>       merge a user's buddies and requests into
+                             another account and delete it
+  logout <email>             end all of a user's sessions
+  verify <email>             mark a user as verified
+  lock <email>               prevent a user from logging in
+  unlock <email>             allow a locked user to log in
+  promote <email>            grant administrator privileges
+  demote <email>             revoke administrator privileges
+  feature <email> <feature> on|off|default
+                             override a feature flag for a user
+  sessions                   list online sessions
+  stats                      show the server's load
+  version                    show the server's build information
+  maintenance [on|off]       show or change read-only maintenance mode
+  tuning [key=value...]      show or change runtime settings, such as
+                             event_buffer_size, log_level, or
+                             limits.lookups_per_minute
+  announcements              list announcements
+  announce [-level L] [-start T] [-end T] [-id ID] <text>
+                             create or replace an announcement
+  unannounce <id>            delete an announcement
+  notice [-level L] [-to E] <text>
+                             broadcast a server notice
+  export [file]              back up every user as JSON
+  import <file>              restore users from a backup
+  check                      check the database for problems
+  audit [-user E] [-action A] [-since T] [-limit N]
+                             search the audit log
+  reports [-all]             list open (or all) abuse reports
+  resolve [-message M] [-duration D] <id> <action>
+                             act on a report (dismiss, warn, suspend,
+                             or shadow_limit)
+
+Flags:
+`
+
+type client struct {
+	BaseURL string
+	Token   string
+}
+
+func main() {
+	c := &client{}
+	flag.StringVar(&c.BaseURL, "url", envDefault("STATUSCTL_URL", "http://localhost:8080/admin"),
+		"admin API URL (or $STATUSCTL_URL)")
+	flag.StringVar(&c.Token, "token", os.Getenv("STATUSCTL_TOKEN"),
+		"admin API token (or $STATUSCTL_TOKEN)")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(c, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "statusctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *client, command string, args []string) error {
+	switch command {
+	case "users":
+		return listUsers(c, args)
+	case "user":
+		if len(args) != 1 {
+			return errors.New("usage: user <email>")
+		}
+		var user interface{}
+		if err := c.Do("GET", "/users/"+url.PathEscape(args[0]), nil, &user); err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, user)
+	case "create":
+		return createUser(c, args)
+	case "create-bot":
+		if len(args) != 1 {
+			return errors.New("usage: create-bot <email>")
+		}
+		return printAPIKey(c, "/bots", map[string]string{"email": args[0]})
+	case "rotate-key":
+		if len(args) != 1 {
+			return errors.New("usage: rotate-key <email>")
+		}
+		return printAPIKey(c, "/users/"+url.PathEscape(args[0])+"/api_key", nil)
+	case "delete":
+		return userAction(c, "DELETE", "", args)
+	case "merge":
+		if len(args) != 2 {
+			return errors.New("usage: merge <email> <into>")
+		}
+		return c.Do("POST", "/users/"+url.PathEscape(args[0])+"/merge",
+			map[string]string{"into": args[1]}, nil)
+	case "logout", "verify", "lock", "unlock", "promote", "demote":
+		return userAction(c, "POST", "/"+command, args)
+	case "maintenance":
+		return maintenance(c, args)
+	case "tuning":
+		return tuning(c, args)
+	case "feature":
+		return setFeature(c, args)
+	case "sessions":
+		return listSessions(c)
+	case "version":
+		var info interface{}
+		if err := c.Do("GET", "/version", nil, &info); err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, info)
+	case "stats":
+		var stats interface{}
+		if err := c.Do("GET", "/stats", nil, &stats); err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, stats)
+	case "announcements":
+		var announcements interface{}
+		if err := c.Do("GET", "/announcements", nil, &announcements); err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, announcements)
+	case "announce":
+		return announce(c, args)
+	case "unannounce":
+		if len(args) != 1 {
+			return errors.New("usage: unannounce <id>")
+		}
+		return c.Do("DELETE", "/announcements/"+url.PathEscape(args[0]), nil, nil)
+	case "notice":
+		return sendNotice(c, args)
+	case "export":
+		return exportUsers(c, args)
+	case "import":
+		return importUsers(c, args)
+	case "check":
+		return checkDB(c)
+	case "audit":
+		return queryAudit(c, args)
+	case "reports":
+		return listReports(c, args)
+	case "resolve":
+		return resolveReport(c, args)
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+}
+
+func listUsers(c *client, args []string) error {
+	path := "/users"
+	if len(args) > 0 {
+		path += "?q=" + url.QueryEscape(args[0])
+	}
+	var users []struct {
+		Email     string `json:"email"`
+		Verified  bool   `json:"verified"`
+		Locked    bool   `json:"locked"`
+		Bot       bool   `json:"bot"`
+		TwoFactor bool   `json:"two_factor"`
+		Buddies   int    `json:"buddies"`
+		Online    bool   `json:"online"`
+	}
+	if err := c.Do("GET", path, nil, &users); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tONLINE\tBUDDIES\tVERIFIED\tLOCKED\t2FA\tBOT")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%v\t%d\t%v\t%v\t%v\t%v\n", u.Email, u.Online, u.Buddies, u.Verified,
+			u.Locked, u.TwoFactor, u.Bot)
+	}
+	return w.Flush()
+}
+
+func createUser(c *client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: create <email>")
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	body := map[string]string{
+		"email":    args[0],
+		"password": strings.TrimRight(password, "\r\n"),
+	}
+	return c.Do("POST", "/users", body, nil)
+}
+
+// printAPIKey prints the key from a request which creates
+// one, since it cannot be shown again.
+func printAPIKey(c *client, path string, body interface{}) error {
+	var result struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := c.Do("POST", path, body, &result); err != nil {
+		return err
+	}
+	fmt.Println(result.APIKey)
+	return nil
+}
+
+func userAction(c *client, method, suffix string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one email argument")
+	}
+	return c.Do(method, "/users/"+url.PathEscape(args[0])+suffix, nil, nil)
+}
+
+func tuning(c *client, args []string) error {
+	var result interface{}
+	if len(args) == 0 {
+		if err := c.Do("GET", "/tuning", nil, &result); err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, result)
+	}
+	changes := map[string]interface{}{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("usage: tuning [key=value...]")
+		}
+		var value interface{} = parts[1]
+		if n, err := strconv.Atoi(parts[1]); err == nil {
+			value = n
+		}
+		obj := changes
+		keys := strings.Split(parts[0], ".")
+		for _, key := range keys[:len(keys)-1] {
+			if _, ok := obj[key].(map[string]interface{}); !ok {
+				obj[key] = map[string]interface{}{}
+			}
+			obj = obj[key].(map[string]interface{})
+		}
+		obj[keys[len(keys)-1]] = value
+	}
+	if err := c.Do("POST", "/tuning", changes, &result); err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, result)
+}
+
+func maintenance(c *client, args []string) error {
+	if len(args) == 0 {
+		var result struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := c.Do("GET", "/maintenance", nil, &result); err != nil {
+			return err
+		}
+		if result.Enabled {
+			fmt.Println("maintenance mode is on")
+		} else {
+			fmt.Println("maintenance mode is off")
+		}
+		return nil
+	} else if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return errors.New("usage: maintenance [on|off]")
+	}
+	return c.Do("POST", "/maintenance/"+args[0], nil, nil)
+}
+
+func setFeature(c *client, args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: feature <email> <feature> on|off|default")
+	}
+	body := map[string]interface{}{"feature": args[1]}
+	switch args[2] {
+	case "on":
+		body["enabled"] = true
+	case "off":
+		body["enabled"] = false
+	case "default":
+		body["enabled"] = nil
+	default:
+		return fmt.Errorf("unknown setting: %s", args[2])
+	}
+	return c.Do("POST", "/users/"+url.PathEscape(args[0])+"/features", body, nil)
+}
+
+func listSessions(c *client) error {
+	var sessions []struct {
+		Email     string    `json:"email"`
+		AuthTime  time.Time `json:"auth_time"`
+		Invisible bool      `json:"invisible"`
+		IdleSince time.Time `json:"idle_since"`
+	}
+	if err := c.Do("GET", "/sessions", nil, &sessions); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tAUTHENTICATED\tINVISIBLE\tIDLE SINCE")
+	for _, s := range sessions {
+		idle := "-"
+		if !s.IdleSince.IsZero() {
+			idle = s.IdleSince.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", s.Email, s.AuthTime.Format(time.RFC3339),
+			s.Invisible, idle)
+	}
+	return w.Flush()
+}
+
+func sendNotice(c *client, args []string) error {
+	fs := flag.NewFlagSet("notice", flag.ContinueOnError)
+	level := fs.String("level", "info", "notice level (info, warning, or critical)")
+	to := fs.String("to", "", "comma-separated recipients (default: everyone)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: notice [-level L] [-to E] <text>")
+	}
+	body := map[string]interface{}{
+		"level": *level,
+		"text":  strings.Join(fs.Args(), " "),
+	}
+	if *to != "" {
+		body["emails"] = strings.Split(*to, ",")
+	}
+	return c.Do("POST", "/notices", body, nil)
+}
+
+func announce(c *client, args []string) error {
+	fs := flag.NewFlagSet("announce", flag.ContinueOnError)
+	level := fs.String("level", "info", "announcement level (info, warning, or critical)")
+	start := fs.String("start", "", "RFC 3339 start time (default: now)")
+	end := fs.String("end", "", "RFC 3339 end time (default: never)")
+	id := fs.String("id", "", "ID of an announcement to replace")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: announce [-level L] [-start T] [-end T] [-id ID] <text>")
+	}
+	body := map[string]interface{}{
+		"id":    *id,
+		"level": *level,
+		"text":  strings.Join(fs.Args(), " "),
+	}
+	for name, value := range map[string]string{"start": *start, "end": *end} {
+		if value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return err
+			}
+			body[name] = t
+		}
+	}
+	var result interface{}
+	if err := c.Do("POST", "/announcements", body, &result); err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, result)
+}
+
+func exportUsers(c *client, args []string) error {
+	var users json.RawMessage
+	if err := c.Do("GET", "/export", nil, &users); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		_, err := os.Stdout.Write(append(users, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(args[0], users, 0600)
+}
+
+func importUsers(c *client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: import <file>")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+	}
+	if err := c.Do("POST", "/import", json.RawMessage(data), &result); err != nil {
+		return err
+	}
+	fmt.Printf("imported %d users (%d skipped)\n", result.Imported, result.Skipped)
+	return nil
+}
+
+func checkDB(c *client) error {
+	var result struct {
+		Problems []string `json:"problems"`
+	}
+	if err := c.Do("GET", "/check", nil, &result); err != nil {
+		return err
+	}
+	for _, problem := range result.Problems {
+		fmt.Println(problem)
+	}
+	if len(result.Problems) > 0 {
+		return fmt.Errorf("found %d problems", len(result.Problems))
+	}
+	fmt.Println("no problems found")
+	return nil
+}
+
+func queryAudit(c *client, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	params := url.Values{}
+	for _, name := range []string{"user", "actor", "target", "action", "since", "until", "limit"} {
+		name := name
+		fs.Func(name, "filter by "+name, func(s string) error {
+			params.Set(name, s)
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var entries []struct {
+		Time       time.Time `json:"time"`
+		Actor      string    `json:"actor"`
+		RemoteAddr string    `json:"remote_addr"`
+		Action     string    `json:"action"`
+		Target     string    `json:"target"`
+		Details    string    `json:"details"`
+		Error      string    `json:"error"`
+	}
+	if err := c.Do("GET", "/audit?"+params.Encode(), nil, &entries); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTOR\tADDRESS\tACTION\tTARGET\tERROR\tDETAILS")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Actor,
+			dashIfEmpty(e.RemoteAddr), e.Action, dashIfEmpty(e.Target), dashIfEmpty(e.Error),
+			dashIfEmpty(e.Details))
+	}
+	return w.Flush()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func listReports(c *client, args []string) error {
+	fs := flag.NewFlagSet("reports", flag.ContinueOnError)
+	all := fs.Bool("all", false, "include resolved reports")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := "/reports"
+	if *all {
+		path += "?all=1"
+	}
+	var reports []struct {
+		ID       string    `json:"id"`
+		Reporter string    `json:"reporter"`
+		Target   string    `json:"target"`
+		Reason   string    `json:"reason"`
+		Time     time.Time `json:"time"`
+		Action   string    `json:"action"`
+	}
+	if err := c.Do("GET", path, nil, &reports); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID	TIME	TARGET	REPORTER	ACTION	REASON")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Time.Format(time.RFC3339), r.Target,
+			r.Reporter, dashIfEmpty(r.Action), r.Reason)
+	}
+	return w.Flush()
+}
+
+func resolveReport(c *client, args []string) error {
+	fs := flag.NewFlagSet("resolve", flag.ContinueOnError)
+	message := fs.String("message", "", "warning text (for warn)")
+	duration := fs.String("duration", "", "suspension length, e.g. 72h (for suspend)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: resolve [-message M] [-duration D] <id> <action>")
+	}
+	body := map[string]string{
+		"action":   fs.Arg(1),
+		"message":  *message,
+		"duration": *duration,
+	}
+	return c.Do("POST", "/reports/"+url.PathEscape(fs.Arg(0))+"/resolve", body, nil)
+}
+
+// Do sends a request to the admin API.
+//
+// If body is non-nil, it is encoded as JSON. If result is
+// non-nil, the response is decoded into it.
+func (c *client) Do(method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.BaseURL, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			return fmt.Errorf("%s (%s)", apiErr.Message, apiErr.Code)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+func printJSON(w io.Writer, obj interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(obj)
+}
+
+func envDefault(name, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
@@ -0,0 +1,102 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var ErrInvalidAnnouncement = errors.New("invalid announcement")
+
+// activeAnnouncements filters announcements which are
+// active at the given time.
+func activeAnnouncements(all []statusdb.Announcement, now time.Time) []statusdb.Announcement {
+	res := []statusdb.Announcement{}
+	for _, a := range all {
+		if a.Active(now) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+func (l *localEventDB) Announcements() ([]statusdb.Announcement, error) {
+	return l.db.Announcements()
+}
+
+func (l *localEventDB) SetAnnouncement(a statusdb.Announcement) (res statusdb.Announcement, err error) {
+	defer essentials.AddCtxTo("set announcement", &err)
+	if a.Start.IsZero() {
+		a.Start = time.Now()
+	}
+	if !a.Valid() {
+		return a, ErrInvalidAnnouncement
+	}
+	if a.ID == "" {
+		a.ID = NewRandomID()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.db.SetAnnouncement(a); err != nil {
+		return a, err
+	}
+	l.scheduleAnnouncement(a)
+	l.publish(&BusMessage{Type: BusAnnouncements, Announcement: &a})
+	l.broadcastAnnouncements()
+	return a, nil
+}
+
+func (l *localEventDB) DeleteAnnouncement(id string) (err error) {
+	defer essentials.AddCtxTo("delete announcement", &err)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.db.DeleteAnnouncement(id); err != nil {
+		return err
+	}
+	l.publish(&BusMessage{Type: BusAnnouncements})
+	l.broadcastAnnouncements()
+	return nil
+}
+
+// scheduleAnnouncements arranges for every session to be
+// told when announcements start or end.
+func (l *localEventDB) scheduleAnnouncements() {
+	all, err := l.db.Announcements()
+	if err != nil {
+		return
+	}
+	for _, a := range all {
+		l.scheduleAnnouncement(a)
+	}
+}
+
+func (l *localEventDB) scheduleAnnouncement(a statusdb.Announcement) {
+	for _, t := range []time.Time{a.Start, a.End} {
+		if t.After(time.Now()) {
+			time.AfterFunc(time.Until(t), func() {
+				l.lock.Lock()
+				defer l.lock.Unlock()
+				l.broadcastAnnouncements()
+			})
+		}
+	}
+}
+
+// broadcastAnnouncements sends the active announcements to
+// every session.
+func (l *localEventDB) broadcastAnnouncements() {
+	all, err := l.db.Announcements()
+	if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	event := &Event{
+		Type:          EventAnnouncements,
+		Announcements: activeAnnouncements(all, time.Now()),
+	}
+	for _, sess := range l.allSessions() {
+		sess.pushEvent(event)
+	}
+}
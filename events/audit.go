@@ -0,0 +1,220 @@
+package events
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// DefaultAuditQueryLimit is the number of entries returned
+// by an AuditQuery without a limit.
+const DefaultAuditQueryLimit = 100
+
+// ActorAdmin is the actor of audit entries for operations
+// performed through the admin API.
+const ActorAdmin = "admin"
+
+// ActorServer is the actor of audit entries for operations
+// which the server performs by itself, such as purges.
+const ActorServer = "server"
+
+// An AuditEntry records a state-changing operation.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+
+	// Actor is the email of the user who performed the
+	// operation, or ActorAdmin.
+	Actor string `json:"actor"`
+
+	// Session identifies the session used by the actor.
+	Session    string `json:"session,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Action describes the operation, such as
+	// "delete buddy".
+	Action string `json:"action"`
+
+	// Target is the user affected by the operation, if it
+	// is not the actor.
+	Target string `json:"target,omitempty"`
+
+	// Details describes the change made by the operation,
+	// such as the new values of settings.
+	Details string `json:"details,omitempty"`
+
+	// Error is set if the operation failed.
+	Error string `json:"error,omitempty"`
+}
+
+// An AuditQuery selects entries from an AuditLog.
+// Empty fields match every entry.
+type AuditQuery struct {
+	// User matches entries with the user as the actor or
+	// the target.
+	User   string
+	Actor  string
+	Target string
+	Action string
+	Since  time.Time
+	Until  time.Time
+
+	// Limit is the maximum number of entries to return.
+	// If zero, DefaultAuditQueryLimit is used.
+	Limit int
+}
+
+// Match checks if an entry satisfies the query.
+func (a *AuditQuery) Match(e *AuditEntry) bool {
+	if a.User != "" && !statusdb.EmailsEquivalent(e.Actor, a.User) &&
+		!statusdb.EmailsEquivalent(e.Target, a.User) {
+		return false
+	} else if a.Actor != "" && !statusdb.EmailsEquivalent(e.Actor, a.Actor) {
+		return false
+	} else if a.Target != "" && !statusdb.EmailsEquivalent(e.Target, a.Target) {
+		return false
+	} else if a.Action != "" && e.Action != a.Action {
+		return false
+	} else if !a.Since.IsZero() && e.Time.Before(a.Since) {
+		return false
+	} else if !a.Until.IsZero() && !e.Time.Before(a.Until) {
+		return false
+	}
+	return true
+}
+
+// An AuditLog is an append-only store of AuditEntries.
+type AuditLog interface {
+	Append(entry AuditEntry) error
+
+	// Query finds matching entries, newest first.
+	Query(query AuditQuery) ([]AuditEntry, error)
+}
+
+// FileAuditLog is an AuditLog which appends entries to a
+// file as lines of JSON.
+type FileAuditLog struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+func (f *FileAuditLog) Append(entry AuditEntry) (err error) {
+	defer essentials.AddCtxTo("append audit entry", &err)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *FileAuditLog) Query(query AuditQuery) (res []AuditEntry, err error) {
+	defer essentials.AddCtxTo("query audit log", &err)
+	limit := query.Limit
+	if limit == 0 {
+		limit = DefaultAuditQueryLimit
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		return []AuditEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var matches []AuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if query.Match(&entry) {
+			matches = append(matches, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	res = []AuditEntry{}
+	for i := len(matches) - 1; i >= 0 && len(res) < limit; i-- {
+		res = append(res, matches[i])
+	}
+	return res, nil
+}
+
+func (l *localEventDB) RecordAudit(entry AuditEntry) {
+	if l.audit == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	// Failing to audit an operation should not undo it.
+	l.audit.Append(entry)
+}
+
+func (l *localEventDB) QueryAudit(query AuditQuery) ([]AuditEntry, error) {
+	if l.audit == nil {
+		return []AuditEntry{}, nil
+	}
+	return l.audit.Query(query)
+}
+
+// auditedOperation is like genericOperation, but records
+// the operation in the audit log.
+//
+// The target, if any, is locked along with the session's
+// user, since the operation may change both of them.
+func (l *localDBSession) auditedOperation(ctx, target string, f func() error) error {
+	return l.lockedOperation(ctx, l.eventDB.lockUsers(l.email, target), l.audited(ctx, target, f))
+}
+
+// audited wraps an operation to record it in the audit
+// log once it finishes.
+func (l *localDBSession) audited(ctx, target string, f func() error) func() error {
+	return func() error {
+		err := f()
+		entry := AuditEntry{
+			Actor:      l.email,
+			Session:    l.id,
+			RemoteAddr: l.remoteAddr,
+			Action:     ctx,
+			Target:     target,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			l.eventDB.recordUsage(l.email, statusdb.UsageStats{LastActivity: time.Now()})
+		}
+		l.eventDB.RecordAudit(entry)
+		return err
+	}
+}
+
+// NewRandomID generates an identifier for a session or a
+// report.
+func NewRandomID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,165 @@
+package events
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// AvatarSize is the width and height of stored avatars.
+const AvatarSize = 128
+
+var (
+	ErrAvatarsDisabled = errors.New("avatars are not supported")
+	ErrAvatarTooLarge  = errors.New("avatar too large")
+	ErrAvatarFormat    = errors.New("unsupported avatar format")
+	ErrNoAvatar        = errors.New("no such avatar")
+)
+
+// An AvatarStore stores avatar images by the hex SHA-256
+// hash of their contents.
+//
+// Since avatars are content-addressed, clients may cache
+// them by hash indefinitely.
+type AvatarStore interface {
+	// Put stores an image and returns its hash.
+	Put(data []byte) (hash string, err error)
+
+	// Get retrieves an image, failing with ErrNoAvatar if
+	// it does not exist.
+	Get(hash string) ([]byte, error)
+}
+
+// An AvatarFallback provides images for users who have not
+// uploaded avatars.
+type AvatarFallback interface {
+	// AvatarURL gets the URL of the user's fallback image,
+	// or "" if there is none.
+	AvatarURL(email string) string
+}
+
+// DirAvatarStore is an AvatarStore which keeps each avatar
+// in a file in a directory.
+type DirAvatarStore struct {
+	Dir string
+}
+
+func (d *DirAvatarStore) Put(data []byte) (hash string, err error) {
+	defer essentials.AddCtxTo("put avatar", &err)
+	sum := sha256.Sum256(data)
+	hash = hex.EncodeToString(sum[:])
+	path := filepath.Join(d.Dir, hash+".png")
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (d *DirAvatarStore) Get(hash string) (data []byte, err error) {
+	defer essentials.AddCtxTo("get avatar", &err)
+	if !validAvatarHash(hash) {
+		return nil, ErrNoAvatar
+	}
+	data, err = ioutil.ReadFile(filepath.Join(d.Dir, hash+".png"))
+	if os.IsNotExist(err) {
+		return nil, ErrNoAvatar
+	}
+	return data, err
+}
+
+// ProcessAvatar decodes an uploaded PNG, JPEG, or GIF,
+// crops it to a square, and scales it to AvatarSize,
+// returning the result as a PNG.
+func ProcessAvatar(data []byte) ([]byte, error) {
+	if len(data) > protocol.MaxAvatarUploadSize {
+		return nil, ErrAvatarTooLarge
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarFormat
+	} else if cfg.Width*cfg.Height > 4096*4096 {
+		// Avoid decoding small files with huge dimensions.
+		return nil, ErrAvatarTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarFormat
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleAvatar(img)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleAvatar crops the center square of an image and
+// scales it to AvatarSize by averaging source pixels.
+func scaleAvatar(img image.Image) image.Image {
+	bounds := img.Bounds()
+	side := essentials.MinInt(bounds.Dx(), bounds.Dy())
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	size := essentials.MinInt(side, AvatarSize)
+	res := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		srcY0, srcY1 := y*side/size, essentials.MaxInt((y+1)*side/size, y*side/size+1)
+		for x := 0; x < size; x++ {
+			srcX0, srcX1 := x*side/size, essentials.MaxInt((x+1)*side/size, x*side/size+1)
+			var r, g, b, a, n uint64
+			for sy := srcY0; sy < srcY1; sy++ {
+				for sx := srcX0; sx < srcX1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(x0+sx, y0+sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			res.Set(x, y, color.NRGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return res
+}
+
+// presentProfile fills in the fallback avatar of a profile
+// which is about to be sent to a client.
+func (l *localEventDB) presentProfile(email string, profile statusdb.Profile) statusdb.Profile {
+	if profile.AvatarHash == "" && l.avatarFallback != nil {
+		profile.AvatarURL = l.avatarFallback.AvatarURL(email)
+	}
+	return profile
+}
+
+func validAvatarHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,231 @@
+package events
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BenchRegressionBudget is how much worse, as a fraction
+// of a saved baseline, a change may make the time or the
+// allocations of any benchmark before it must be justified.
+//
+// Fan-out redesigns should be compared against a baseline
+// from the same machine, since times vary between them.
+const BenchRegressionBudget = 0.10
+
+// BenchPassword is the password of the users created by a
+// BroadcastBench.
+const BenchPassword = "bench-password"
+
+// benchTime is the least time for which a BroadcastBench
+// repeats each benchmark.
+const benchTime = time.Second
+
+// A BroadcastBench measures the paths which send events to
+// sessions, with Users online users who each have Buddies
+// buddies.
+//
+// Each user has one session, whose events are read in the
+// background like a client would. Buddies are the users
+// nearest in a ring, so Buddies is rounded down to an even
+// number.
+type BroadcastBench struct {
+	Users   int
+	Buddies int
+}
+
+// A BenchResult is the outcome of one benchmark.
+type BenchResult struct {
+	Name        string `json:"name"`
+	NsPerOp     int64  `json:"ns_per_op"`
+	AllocsPerOp int64  `json:"allocs_per_op"`
+	BytesPerOp  int64  `json:"bytes_per_op"`
+}
+
+func (b BenchResult) String() string {
+	return fmt.Sprintf("%-18s %12d ns/op %10d allocs/op %12d B/op", b.Name, b.NsPerOp,
+		b.AllocsPerOp, b.BytesPerOp)
+}
+
+// Run creates the users in a temporary DB and runs each
+// benchmark:
+//
+//   - broadcast_status sends a user's status to their
+//     buddies' sessions.
+//   - begin_session logs a user in again, and closes the
+//     new session.
+//   - push_event queues an event for a session.
+func (b *BroadcastBench) Run() (results []BenchResult, err error) {
+	if b.Users < 2 {
+		return nil, &statusdb.ValidationError{Field: "users", Reason: "must be at least 2"}
+	} else if b.Buddies < 0 || b.Buddies >= b.Users {
+		return nil, &statusdb.ValidationError{Field: "buddies",
+			Reason: "must be from 0 to one less than users"}
+	}
+
+	dir, err := os.MkdirTemp("", "status-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	edb, sessions, err := b.setup(filepath.Join(dir, "users.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, sess := range sessions {
+			sess.Close()
+		}
+	}()
+
+	status := statusdb.UserStatus{Availability: statusdb.Available, Message: "benchmarking"}
+	event := &Event{Type: EventStatusChanged, Email: sessions[0].email, Status: status}
+	benchmarks := []struct {
+		name string
+		f    func(i int)
+	}{
+		{"broadcast_status", func(i int) {
+			email := sessions[i%len(sessions)].email
+			defer edb.lockUsers(email)()
+			edb.broadcastNewStatus(email, status)
+		}},
+		{"begin_session", func(i int) {
+			sess, err := edb.BeginSession(sessions[i%len(sessions)].email, BenchPassword, "")
+			if err != nil {
+				panic(err)
+			}
+			sess.Close()
+		}},
+		{"push_event", func(i int) {
+			sess := sessions[i%len(sessions)]
+			defer edb.lockUsers(sess.email)()
+			sess.pushEvent(event)
+		}},
+	}
+	for _, bench := range benchmarks {
+		results = append(results, measureBench(bench.name, bench.f))
+	}
+	return results, nil
+}
+
+// measureBench calls f with increasing numbers of
+// iterations, like a Go benchmark, until they take at
+// least benchTime, and reports the cost of each call.
+func measureBench(name string, f func(i int)) BenchResult {
+	n := 1
+	for {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+		if elapsed >= benchTime {
+			return BenchResult{
+				Name:        name,
+				NsPerOp:     elapsed.Nanoseconds() / int64(n),
+				AllocsPerOp: int64(after.Mallocs-before.Mallocs) / int64(n),
+				BytesPerOp:  int64(after.TotalAlloc-before.TotalAlloc) / int64(n),
+			}
+		}
+
+		// Aim a fifth past benchTime, growing at most 100x.
+		next := n * 100
+		if elapsed > 0 {
+			if predicted := int(int64(n) * int64(benchTime) * 6 / 5 / int64(elapsed)); predicted < next {
+				next = predicted
+			}
+		}
+		if next <= n {
+			next = n + 1
+		}
+		n = next
+	}
+}
+
+// setup creates the users and logs each of them in.
+func (b *BroadcastBench) setup(path string) (*localEventDB, []*localDBSession, error) {
+	db, err := statusdb.OpenFileDB(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Hashing every password at the default cost would
+	// take longer than the benchmarks.
+	hash, err := bcrypt.GenerateFromPassword([]byte(BenchPassword), bcrypt.MinCost)
+	if err != nil {
+		return nil, nil, err
+	}
+	emails := make([]string, b.Users)
+	for i := range emails {
+		emails[i] = "bench-" + strconv.Itoa(i) + "@bench.invalid"
+	}
+	users := make([]*statusdb.UserInfo, b.Users)
+	for i, email := range emails {
+		users[i] = &statusdb.UserInfo{
+			Email:    email,
+			Hash:     hash,
+			Verified: true,
+			ModTime:  time.Now(),
+		}
+		for d := 1; d <= b.Buddies/2; d++ {
+			users[i].Buddies = append(users[i].Buddies, emails[(i+d)%b.Users],
+				emails[(i+b.Users-d)%b.Users])
+		}
+	}
+	if _, err := db.ImportUsers(users); err != nil {
+		return nil, nil, err
+	}
+
+	edb := New(db, Options{BufferSize: 100}).(*localEventDB)
+	sessions := make([]*localDBSession, b.Users)
+	for i, email := range emails {
+		sess, err := edb.BeginSession(email, BenchPassword, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		sessions[i] = sess.(*localDBSession)
+		go func() {
+			for range sess.Events() {
+			}
+		}()
+	}
+	return edb, sessions, nil
+}
+
+// CompareBench describes the results whose time or
+// allocations are worse than their baselines by more than
+// BenchRegressionBudget.
+//
+// Bytes per operation are not compared, since they include
+// the events delivered in the background, which vary from
+// run to run.
+func CompareBench(baseline, results []BenchResult) []string {
+	var res []string
+	for _, result := range results {
+		for _, base := range baseline {
+			if base.Name != result.Name {
+				continue
+			}
+			check := func(metric string, old, new int64) {
+				if float64(new) > float64(old)*(1+BenchRegressionBudget) {
+					res = append(res, fmt.Sprintf("%s: %s went from %d to %d", result.Name,
+						metric, old, new))
+				}
+			}
+			check("ns/op", base.NsPerOp, result.NsPerOp)
+			check("allocs/op", base.AllocsPerOp, result.AllocsPerOp)
+		}
+	}
+	return res
+}
@@ -0,0 +1,67 @@
+package events
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+func BenchmarkBroadcastNewStatus(b *testing.B) {
+	edb, sessions := setupBench(b)
+	status := statusdb.UserStatus{Availability: statusdb.Available, Message: "benchmarking"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		email := sessions[i%len(sessions)].email
+		unlock := edb.lockUsers(email)
+		edb.broadcastNewStatus(email, status)
+		unlock()
+	}
+}
+
+func BenchmarkBeginSession(b *testing.B) {
+	edb, sessions := setupBench(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sess, err := edb.BeginSession(sessions[i%len(sessions)].email, BenchPassword, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		sess.Close()
+	}
+}
+
+func BenchmarkPushEvent(b *testing.B) {
+	edb, sessions := setupBench(b)
+	event := &Event{
+		Type:   EventStatusChanged,
+		Email:  sessions[0].email,
+		Status: statusdb.UserStatus{Availability: statusdb.Available, Message: "benchmarking"},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sess := sessions[i%len(sessions)]
+		unlock := edb.lockUsers(sess.email)
+		sess.pushEvent(event)
+		unlock()
+	}
+}
+
+// setupBench logs in the users of a BroadcastBench, and
+// logs them out once the benchmark ends.
+func setupBench(b *testing.B) (*localEventDB, []*localDBSession) {
+	bench := &BroadcastBench{Users: 100, Buddies: 20}
+	edb, sessions, err := bench.setup(filepath.Join(b.TempDir(), "users.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		for _, sess := range sessions {
+			sess.Close()
+		}
+	})
+	return edb, sessions
+}
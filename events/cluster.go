@@ -0,0 +1,353 @@
+package events
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+const (
+	// HeartbeatInterval is the time between the presence
+	// snapshots which each node of a cluster publishes.
+	HeartbeatInterval = 5 * time.Second
+
+	// PeerTimeout is the time after which a node which has
+	// not sent a heartbeat is presumed dead, and the users
+	// connected to it are shown offline.
+	PeerTimeout = 3 * HeartbeatInterval
+)
+
+type BusMessageType string
+
+const (
+	// BusHello announces a new node, which every other node
+	// answers with a heartbeat.
+	BusHello BusMessageType = "hello"
+
+	// BusHeartbeat carries the sender's full presence, and
+	// keeps the sender from being presumed dead.
+	BusHeartbeat BusMessageType = "heartbeat"
+
+	// BusPresence carries the sender's presence for one
+	// user, after it changes.
+	BusPresence BusMessageType = "presence"
+
+	// BusPush asks for an event to be pushed to a user's
+	// sessions.
+	BusPush BusMessageType = "push"
+
+	// BusStatus and BusProfile ask for a user's status or
+	// profile to be sent to their buddies' sessions.
+	BusStatus  BusMessageType = "status"
+	BusProfile BusMessageType = "profile"
+
+	// BusResync asks for a user's sessions to be sent a
+	// new full state.
+	BusResync BusMessageType = "resync"
+
+	// BusDisconnect asks for a user's sessions to be
+	// intentionally disconnected.
+	BusDisconnect BusMessageType = "disconnect"
+
+	// BusNotice asks for a server notice to be sent to the
+	// listed users, or to everybody if Emails is nil.
+	BusNotice BusMessageType = "notice"
+
+	// BusAnnouncements asks for the active announcements
+	// to be sent to every session.
+	BusAnnouncements BusMessageType = "announcements"
+)
+
+// A NodePresence describes one user's sessions on a node.
+type NodePresence struct {
+	Email string
+
+	// Sessions counts every session, while Visible only
+	// counts sessions which make the user appear online.
+	Sessions int
+	Visible  int
+
+	// IdleSince is zero if any of the sessions is active.
+	IdleSince time.Time
+}
+
+// A BusMessage is sent between the nodes of a cluster.
+//
+// Fields are only set for the message types which use
+// them.
+type BusMessage struct {
+	Type BusMessageType
+
+	// Node identifies the sender.
+	Node string
+
+	Email        string                 `json:",omitempty"`
+	Event        *Event                 `json:",omitempty"`
+	Status       *statusdb.UserStatus   `json:",omitempty"`
+	Alert        protocol.SecurityAlert `json:",omitempty"`
+	Emails       []string               `json:",omitempty"`
+	Presence     []NodePresence         `json:",omitempty"`
+	Announcement *statusdb.Announcement `json:",omitempty"`
+}
+
+// A Bus carries messages between the nodes of a cluster,
+// which share a DB but each hold their own sessions.
+//
+// Nodes tell each other which users they have sessions
+// for, so that every node agrees on who is online, and
+// forward the events for each other's sessions.
+type Bus interface {
+	// Publish sends a message to every node, including the
+	// sender.
+	//
+	// It is called while the EventDB is locked, so it must
+	// not block. Failures should be handled by the Bus,
+	// since heartbeats repair lost presence updates.
+	Publish(msg *BusMessage)
+
+	// Messages gets the channel of messages published by
+	// any node.
+	Messages() <-chan *BusMessage
+}
+
+// A clusterPeer is another node's presence, as last
+// reported by the node.
+type clusterPeer struct {
+	lastHeartbeat time.Time
+	presence      map[string]NodePresence
+}
+
+// joinCluster starts handling the messages from the bus,
+// if there is one.
+func (l *localEventDB) joinCluster() {
+	if l.bus == nil {
+		return
+	}
+	l.peers = map[string]*clusterPeer{}
+	go func() {
+		for msg := range l.bus.Messages() {
+			l.lock.Lock()
+			l.handleBusMessage(msg)
+			l.lock.Unlock()
+		}
+	}()
+	go func() {
+		for range time.Tick(HeartbeatInterval) {
+			l.lock.Lock()
+			if !l.draining {
+				// Once drained, the node is left to expire,
+				// which gives clients time to reconnect to
+				// other nodes before their buddies are told
+				// that they went offline.
+				l.publishHeartbeat()
+			}
+			l.expirePeers()
+			l.lock.Unlock()
+		}
+	}()
+	l.publish(&BusMessage{Type: BusHello})
+}
+
+func (l *localEventDB) publish(msg *BusMessage) {
+	if l.bus == nil {
+		return
+	}
+	msg.Node = l.nodeID
+	l.bus.Publish(msg)
+}
+
+func (l *localEventDB) handleBusMessage(msg *BusMessage) {
+	if msg.Node == l.nodeID {
+		return
+	}
+	switch msg.Type {
+	case BusHello:
+		l.publishHeartbeat()
+	case BusHeartbeat:
+		peer := l.peer(msg.Node)
+		peer.lastHeartbeat = time.Now()
+		reported := map[string]bool{}
+		for _, p := range msg.Presence {
+			reported[p.Email] = true
+			l.peerPresenceChanged(msg.Node, p)
+		}
+		for email := range peer.presence {
+			if !reported[email] {
+				l.peerPresenceChanged(msg.Node, NodePresence{Email: email})
+			}
+		}
+	case BusPresence:
+		l.peer(msg.Node)
+		for _, p := range msg.Presence {
+			l.peerPresenceChanged(msg.Node, p)
+		}
+	case BusPush:
+		l.pushToLocalUser(msg.Email, msg.Event)
+	case BusStatus:
+		l.deliverStatus(msg.Email, *msg.Status)
+		l.updateSuppression(msg.Email)
+	case BusProfile:
+		l.deliverProfile(msg.Email)
+	case BusResync:
+		l.resyncLocalUser(msg.Email)
+	case BusDisconnect:
+		wasOnline := l.userOnline(msg.Email)
+		l.disconnectLocalUser(msg.Email, nil, msg.Alert)
+		if wasOnline && !l.userOnline(msg.Email) {
+			l.userWentOffline(msg.Email)
+		}
+		l.publishPresence(msg.Email)
+	case BusNotice:
+		l.deliverNotice(msg.Event, msg.Emails)
+	case BusAnnouncements:
+		if msg.Announcement != nil {
+			l.scheduleAnnouncement(*msg.Announcement)
+		}
+		l.broadcastAnnouncements()
+	}
+}
+
+func (l *localEventDB) peer(node string) *clusterPeer {
+	peer, ok := l.peers[node]
+	if !ok {
+		peer = &clusterPeer{
+			lastHeartbeat: time.Now(),
+			presence:      map[string]NodePresence{},
+		}
+		l.peers[node] = peer
+	}
+	return peer
+}
+
+// peerPresenceChanged updates this node's sessions after
+// a user's sessions on another node change.
+//
+// Every node tells its own sessions when a user comes
+// online or goes offline, since it cannot tell whether
+// other nodes have already seen the change. For the same
+// reason, every node records the last-seen time.
+func (l *localEventDB) peerPresenceChanged(node string, updated NodePresence) {
+	peer := l.peers[node]
+	email := updated.Email
+	old := peer.presence[email]
+	wasOnline := l.userOnline(email)
+	if updated.Sessions > 0 {
+		peer.presence[email] = updated
+	} else {
+		delete(peer.presence, email)
+	}
+	if isOnline := l.userOnline(email); wasOnline && !isOnline {
+		l.userWentOffline(email)
+	} else if isOnline != wasOnline {
+		l.deliverCurrentStatus(email)
+	}
+	if !old.IdleSince.Equal(updated.IdleSince) && l.hasLocalSessions(email) {
+		// The user's idleness is decided by the nodes with
+		// sessions to report it.
+		l.checkIdle(email)
+	}
+}
+
+// expirePeers forgets the nodes which have stopped
+// sending heartbeats.
+func (l *localEventDB) expirePeers() {
+	for node, peer := range l.peers {
+		if time.Since(peer.lastHeartbeat) < PeerTimeout {
+			continue
+		}
+		for email := range peer.presence {
+			l.peerPresenceChanged(node, NodePresence{Email: email})
+		}
+		delete(l.peers, node)
+	}
+}
+
+func (l *localEventDB) publishHeartbeat() {
+	presence := []NodePresence{}
+	seen := map[string]bool{}
+	for _, sess := range l.allSessions() {
+		if !seen[sess.email] {
+			seen[sess.email] = true
+			presence = append(presence, l.localPresence(sess.email))
+		}
+	}
+	l.stateLock.Lock()
+	var reconnecting []string
+	for email := range l.reconnecting {
+		if !seen[email] {
+			reconnecting = append(reconnecting, email)
+		}
+	}
+	l.stateLock.Unlock()
+	for _, email := range reconnecting {
+		presence = append(presence, l.localPresence(email))
+	}
+	l.publish(&BusMessage{Type: BusHeartbeat, Presence: presence})
+}
+
+// publishPresence tells the other nodes about the user's
+// sessions on this node, after they change.
+func (l *localEventDB) publishPresence(email string) {
+	l.publish(&BusMessage{Type: BusPresence, Presence: []NodePresence{l.localPresence(email)}})
+}
+
+func (l *localEventDB) localPresence(email string) NodePresence {
+	res := NodePresence{Email: email}
+	active := false
+	for _, sess := range l.userSessions(email) {
+		sess.lock.Lock()
+		res.Sessions++
+		if !sess.invisible {
+			res.Visible++
+		}
+		if sess.idleSince.IsZero() {
+			active = true
+		} else if sess.idleSince.After(res.IdleSince) {
+			res.IdleSince = sess.idleSince
+		}
+		sess.lock.Unlock()
+	}
+	l.stateLock.Lock()
+	reconnecting := l.reconnecting[email]
+	l.stateLock.Unlock()
+	if reconnecting {
+		// The user is still shown online while the client
+		// reconnects, possibly to another node.
+		res.Sessions++
+		res.Visible++
+		active = true
+	}
+	if active {
+		res.IdleSince = time.Time{}
+	}
+	return res
+}
+
+func (l *localEventDB) hasLocalSessions(email string) bool {
+	return len(l.userSessions(email)) > 0
+}
+
+// peerSessions counts the user's sessions on other nodes.
+func (l *localEventDB) peerSessions(email string) (sessions, visible int) {
+	for _, peer := range l.peers {
+		if p, ok := peer.presence[email]; ok {
+			sessions += p.Sessions
+			visible += p.Visible
+		}
+	}
+	return
+}
+
+// peersIdle checks if the user's sessions on every other
+// node have been idle for at least the threshold.
+func (l *localEventDB) peersIdle(email string, threshold time.Duration) bool {
+	for _, peer := range l.peers {
+		if p, ok := peer.presence[email]; ok {
+			if p.IdleSince.IsZero() || time.Since(p.IdleSince) < threshold {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+var ErrUnknownContactSource = errors.New("unsupported contact source")
+
+// ContactCredentials let the server read a user's contacts
+// once. Which fields are used depends on the source.
+type ContactCredentials struct {
+	// Code and RedirectURI complete an OAuth authorization.
+	Code        string
+	RedirectURI string
+
+	// URL, Username, and Password identify an address book
+	// on a CardDAV server.
+	URL      string
+	Username string
+	Password string
+}
+
+// A ContactSource reads the email addresses in a user's
+// address book on another service.
+//
+// Its methods make network requests, so they are never
+// called while users are locked.
+type ContactSource interface {
+	// AuthorizeURL is the page where a user lets the server
+	// read their contacts, or "" if the source does not
+	// use OAuth.
+	AuthorizeURL(redirectURI string) string
+
+	// Contacts lists the email addresses in the user's
+	// address book.
+	Contacts(creds ContactCredentials) ([]string, error)
+}
+
+func (l *localDBSession) SetDiscoverable(discoverable bool) error {
+	return l.auditedOperation("set discoverable", "", func() error {
+		if err := l.eventDB.db.SetDiscoverable(l.email, discoverable); err != nil {
+			return err
+		}
+		l.eventDB.resyncUser(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) ContactsURL(source, redirectURI string) (string, error) {
+	s := l.eventDB.contactSources[source]
+	if s == nil {
+		return "", ErrUnknownContactSource
+	}
+	return s.AuthorizeURL(redirectURI), nil
+}
+
+func (l *localDBSession) ImportContacts(source string,
+	creds ContactCredentials) (suggestions []protocol.Suggestion, err error) {
+	s := l.eventDB.contactSources[source]
+	if s == nil {
+		return nil, ErrUnknownContactSource
+	}
+	// An import checks many emails at once, so it counts
+	// against the same limit as LookupUser.
+	err = l.genericOperation("import contacts", func() error {
+		if !l.eventDB.allowLookup(l.email) {
+			return ErrRateLimited
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := s.Contacts(creds)
+	if err != nil {
+		return nil, &IntegrationError{Provider: source, Err: RootError(err)}
+	}
+	for i, email := range contacts {
+		contacts[i] = strings.TrimSpace(email)
+	}
+	err = l.genericOperation("import contacts", func() error {
+		users, err := l.eventDB.db.FindDiscoverable(l.email, contacts)
+		if err != nil {
+			return err
+		}
+		suggestions = []protocol.Suggestion{}
+		for _, user := range users {
+			suggestions = append(suggestions, l.eventDB.suggest(user))
+		}
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) SuggestBuddies() (suggestions []protocol.Suggestion, err error) {
+	err = l.genericOperation("suggest buddies", func() error {
+		found, err := l.eventDB.db.SuggestBuddies(l.email)
+		if err != nil {
+			return err
+		}
+		suggestions = []protocol.Suggestion{}
+		for _, s := range found {
+			suggestion := l.eventDB.suggest(s.User)
+			suggestion.MutualBuddies = s.MutualBuddies
+			suggestions = append(suggestions, suggestion)
+		}
+		return nil
+	})
+	return
+}
+
+// suggest presents a user as a suggestion.
+func (l *localEventDB) suggest(user *statusdb.UserInfo) protocol.Suggestion {
+	profile := l.presentProfile(user.Email, user.Profile)
+	return protocol.Suggestion{
+		Email:       user.Email,
+		DisplayName: profile.DisplayName,
+		AvatarHash:  profile.AvatarHash,
+		AvatarURL:   profile.AvatarURL,
+	}
+}
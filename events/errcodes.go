@@ -0,0 +1,120 @@
+package events
+
+import (
+	"errors"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var ErrInjectedFault = errors.New("injected fault")
+
+var errorCodes = map[error]protocol.ErrorCode{
+	statusdb.ErrPassword:             protocol.ErrCodePassword,
+	statusdb.ErrNoEmail:              protocol.ErrCodeNoEmail,
+	statusdb.ErrEmailInUse:           protocol.ErrCodeEmailInUse,
+	statusdb.ErrAccountLocked:        protocol.ErrCodeAccountLocked,
+	statusdb.ErrNotBot:               protocol.ErrCodeNotBot,
+	statusdb.ErrExternalAccounts:     protocol.ErrCodeExternalAccounts,
+	statusdb.ErrAccountSuspended:     protocol.ErrCodeAccountSuspended,
+	statusdb.ErrTwoFactorRequired:    protocol.ErrCodeTwoFactorRequired,
+	statusdb.ErrTwoFactorCode:        protocol.ErrCodeTwoFactorCode,
+	statusdb.ErrTwoFactorEnabled:     protocol.ErrCodeTwoFactorEnabled,
+	statusdb.ErrTwoFactorDisabled:    protocol.ErrCodeTwoFactorDisabled,
+	statusdb.ErrAlreadyBuddies:       protocol.ErrCodeAlreadyBuddies,
+	statusdb.ErrNotBuddies:           protocol.ErrCodeNotBuddies,
+	statusdb.ErrRequestExists:        protocol.ErrCodeRequestExists,
+	statusdb.ErrReverseRequestExists: protocol.ErrCodeReverseRequestExists,
+	statusdb.ErrNoRequest:            protocol.ErrCodeNoRequest,
+	statusdb.ErrInvalidAvailability:  protocol.ErrCodeInvalidAvailability,
+	statusdb.ErrBlocked:              protocol.ErrCodeBlocked,
+	statusdb.ErrAlreadyBlocked:       protocol.ErrCodeAlreadyBlocked,
+	statusdb.ErrNotBlocked:           protocol.ErrCodeNotBlocked,
+	statusdb.ErrNoCustomState:        protocol.ErrCodeNoCustomState,
+	statusdb.ErrInvalidVisibility:    protocol.ErrCodeInvalidVisibility,
+	statusdb.ErrInvalidRequestPolicy: protocol.ErrCodeInvalidRequestPolicy,
+	statusdb.ErrRequestsRestricted:   protocol.ErrCodeRequestsRestricted,
+	statusdb.ErrInvalidSchedule:      protocol.ErrCodeInvalidSchedule,
+	statusdb.ErrInvalidTimeZone:      protocol.ErrCodeInvalidTimeZone,
+	statusdb.ErrCannotMerge:          protocol.ErrCodeCannotMerge,
+	statusdb.ErrHistoryHidden:        protocol.ErrCodeHistoryHidden,
+	ErrAvatarsDisabled:               protocol.ErrCodeAvatarsDisabled,
+	ErrAvatarTooLarge:                protocol.ErrCodeAvatarTooLarge,
+	ErrAvatarFormat:                  protocol.ErrCodeAvatarFormat,
+	ErrNoAvatar:                      protocol.ErrCodeNoAvatar,
+	protocol.ErrBuddyListFormat:      protocol.ErrCodeBuddyListFormat,
+	ErrNotPublic:                     protocol.ErrCodeNotPublic,
+	ErrNotSubscribed:                 protocol.ErrCodeNotSubscribed,
+	ErrInvalidNotice:                 protocol.ErrCodeInvalidNotice,
+	ErrStatusTooLong:                 protocol.ErrCodeStatusTooLong,
+	ErrStatusRejected:                protocol.ErrCodeStatusRejected,
+	statusdb.ErrNoReport:             protocol.ErrCodeNoReport,
+	statusdb.ErrReportResolved:       protocol.ErrCodeReportResolved,
+	ErrReportSelf:                    protocol.ErrCodeReportSelf,
+	ErrInvalidAction:                 protocol.ErrCodeInvalidAction,
+	ErrNotAdmin:                      protocol.ErrCodeNotAdmin,
+	ErrFeatureDisabled:               protocol.ErrCodeFeatureDisabled,
+	statusdb.ErrNoAnnouncement:       protocol.ErrCodeNoAnnouncement,
+	ErrInvalidAnnouncement:           protocol.ErrCodeInvalidAnnouncement,
+	statusdb.ErrTooManyBuddies:       protocol.ErrCodeTooManyBuddies,
+	statusdb.ErrTooManyRequests:      protocol.ErrCodeTooManyRequests,
+	ErrTooManySessions:               protocol.ErrCodeTooManySessions,
+	ErrRemoteUser:                    protocol.ErrCodeRemoteUser,
+	ErrInvalidRelay:                  protocol.ErrCodeInvalidRelay,
+	statusdb.ErrNotVerified:          protocol.ErrCodeNotVerified,
+	statusdb.ErrVerifyToken:          protocol.ErrCodeVerifyToken,
+	statusdb.ErrResetCode:            protocol.ErrCodeResetCode,
+	ErrMailDisabled:                  protocol.ErrCodeMailDisabled,
+	ErrPushDisabled:                  protocol.ErrCodePushDisabled,
+	ErrWebhooksDisabled:              protocol.ErrCodeWebhooksDisabled,
+	statusdb.ErrNoWebhook:            protocol.ErrCodeNoWebhook,
+	statusdb.ErrTooManyWebhooks:      protocol.ErrCodeTooManyWebhooks,
+	ErrUnknownProvider:               protocol.ErrCodeUnknownProvider,
+	statusdb.ErrNoIntegration:        protocol.ErrCodeNoIntegration,
+	ErrExportUnsupported:             protocol.ErrCodeExportUnsupported,
+	ErrUnknownContactSource:          protocol.ErrCodeUnknownContactSource,
+
+	ErrNotOpen:                     protocol.ErrCodeNotOpen,
+	ErrIntentionalDisconnect:       protocol.ErrCodeIntentionalDisconnect,
+	ErrReauthRequired:              protocol.ErrCodeReauthRequired,
+	ErrDraining:                    protocol.ErrCodeDraining,
+	statusdb.ErrMaintenance:        protocol.ErrCodeMaintenance,
+	ErrInjectedFault:               protocol.ErrCodeInjectedFault,
+	protocol.ErrUnsupportedMessage: protocol.ErrCodeUnsupportedMessage,
+	protocol.ErrNestedBatch:        protocol.ErrCodeNestedBatch,
+	protocol.ErrNestedCompression:  protocol.ErrCodeNestedCompression,
+	ErrRateLimited:                 protocol.ErrCodeRateLimited,
+}
+
+// DescribeError finds the code for an error and a message
+// suitable for displaying to a user.
+//
+// Context added with essentials.AddCtx is stripped from
+// the message, since it is only meaningful to developers.
+func DescribeError(err error) (code protocol.ErrorCode, message string) {
+	err = RootError(err)
+	if _, ok := err.(*statusdb.ValidationError); ok {
+		return protocol.ErrCodeValidation, err.Error()
+	} else if _, ok := err.(*protocol.UnknownFieldsError); ok {
+		return protocol.ErrCodeUnknownFields, err.Error()
+	} else if _, ok := err.(*WebhookError); ok {
+		return protocol.ErrCodeWebhookFailed, err.Error()
+	} else if _, ok := err.(*IntegrationError); ok {
+		return protocol.ErrCodeIntegrationFailed, err.Error()
+	} else if code, ok := errorCodes[err]; ok {
+		return code, err.Error()
+	}
+	return protocol.ErrCodeUnknown, err.Error()
+}
+
+// RootError strips context from an error.
+func RootError(err error) error {
+	for {
+		if ctxErr, ok := err.(*essentials.CtxError); ok {
+			err = ctxErr.Original
+		} else {
+			return err
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package events
+
+import (
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// category returns the category of the event, or "" if
+// the event must always be delivered.
+func (e *Event) category() protocol.EventCategory {
+	switch e.Type {
+	case EventStatusChanged:
+		return protocol.CategoryStatuses
+	case EventRequestSent, EventRequestReceived, EventAcceptSent, EventRequestAccepted,
+		EventRequestDeclined, EventRequestCanceled, EventBuddyRemoved, EventMissedEvents:
+		return protocol.CategoryRequests
+	case EventProfileChanged:
+		return protocol.CategoryProfiles
+	case EventUserBlocked, EventUserUnblocked, EventAliasChanged:
+		return protocol.CategorySettings
+	case EventSecurityAlert:
+		return protocol.CategorySecurity
+	}
+	return ""
+}
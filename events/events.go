@@ -0,0 +1,2494 @@
+package events
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var (
+	// An error which is returned from a DBSession when an API
+	// call fails because the session was forcefully ended.
+	ErrIntentionalDisconnect = errors.New("the DB session was intentionally closed")
+
+	ErrNotOpen = errors.New("not open")
+
+	// An error which is returned from a DBSession when a
+	// sensitive operation is attempted too long after the
+	// user last entered their password.
+	// The client should prompt for the password and call
+	// Reauthenticate().
+	ErrReauthRequired = errors.New("recent authentication required")
+
+	// An error which is returned from BeginSession once the
+	// EventDB has been drained for a restart.
+	ErrDraining = errors.New("server is restarting")
+)
+
+const (
+	// DefaultReauthWindow is the amount of time after
+	// authenticating during which a session may perform
+	// sensitive operations.
+	DefaultReauthWindow = 5 * time.Minute
+
+	// DefaultIdleThreshold is the amount of time all of a
+	// user's clients must be idle before the user is marked
+	// as Away.
+	DefaultIdleThreshold = 10 * time.Minute
+
+	// DefaultBufferSize is the number of events buffered
+	// per session if the Options do not set BufferSize.
+	DefaultBufferSize = 100
+)
+
+type EventType int
+
+const (
+	EventFullState EventType = iota
+	EventIntentionalDisconnect
+	EventRequestSent
+	EventRequestReceived
+	EventAcceptSent
+	EventRequestAccepted
+	EventBuddyRemoved
+	EventStatusChanged
+	EventSyncError
+	EventSecurityAlert
+	EventRequestDeclined
+	EventRequestCanceled
+	EventUserBlocked
+	EventUserUnblocked
+	EventAliasChanged
+	EventProfileChanged
+	EventMissedEvents
+	EventServerNotice
+	EventSyncDelta
+	EventReconnect
+	EventAnnouncements
+)
+
+// A LookupResult describes whether a user may be sent a
+// buddy request.
+type LookupResult struct {
+	Email       string
+	Registered  bool
+	Requestable bool
+
+	// Reason explains why a registered user may not be
+	// sent a request.
+	Reason protocol.ErrorCode
+}
+
+// A SessionInfo describes an open session.
+type SessionInfo struct {
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	Email     string    `json:"email"`
+	AuthTime  time.Time `json:"auth_time"`
+	Invisible bool      `json:"invisible"`
+
+	// IdleSince is zero if the client has not reported
+	// being idle.
+	IdleSince time.Time `json:"idle_since"`
+}
+
+// An Event is a notification that some information in an
+// EventDB has changed.
+type Event struct {
+	Type EventType
+
+	// For full-state and sync-delta events.
+	//
+	// For sync-delta events, Buddies lists the buddies whose
+	// state changed, and BuddyStatuses and BuddyProfiles
+	// correspond to Buddies rather than UserInfo.Buddies.
+	UserInfo      *statusdb.UserInfo
+	Buddies       []string
+	BuddyStatuses []statusdb.UserStatus
+	BuddyProfiles []statusdb.Profile
+
+	// Time is the time at which a full state or delta was
+	// computed.
+	Time time.Time
+
+	// For events pertaining to a single user.
+	Email  string
+	Status statusdb.UserStatus
+
+	// For request-received events.
+	Greeting string
+
+	// For alias-changed events.
+	Alias string
+
+	// For profile-changed events.
+	Profile statusdb.Profile
+
+	// For missed-events events.
+	Missed []statusdb.MissedEvent
+
+	// For server-notice events.
+	Notice *protocol.ServerNotice
+
+	// Priority lists events which were queued when a
+	// full-state event replaced the session's backlog, and
+	// which must still be delivered after it.
+	Priority []*Event
+
+	// Announcements lists the active announcements for
+	// EventFullState and EventAnnouncements.
+	Announcements []statusdb.Announcement
+
+	ErrorMessage string
+
+	// For security-alert and intentional-disconnect events.
+	// This may be empty for intentional disconnects that
+	// are not security-related.
+	Alert protocol.SecurityAlert
+}
+
+// priority checks if the event must never be dropped,
+// even when the session falls behind.
+func (e *Event) priority() bool {
+	return e.Type == EventServerNotice
+}
+
+// ClosesSession checks if the client should be
+// disconnected once the event is delivered.
+func (e *Event) ClosesSession() bool {
+	return e.Type == EventIntentionalDisconnect || e.Type == EventReconnect
+}
+
+// suppressible checks if the event may be withheld from a
+// user who is in DoNotDisturb mode.
+func (e *Event) suppressible() bool {
+	return e.Type == EventStatusChanged || e.Type == EventRequestReceived
+}
+
+// An EventDB is a database that synchronizes state across
+// all clients using an event mechanism.
+//
+// A client uses the DB by calling BeginSession(), then
+// calling methods on the session.
+// When a new session is opened, a full-state event will
+// be waiting with the state at the beginning of the
+// session.
+type EventDB interface {
+	// These are the only DB calls which cannot be run inside
+	// of a session.
+	AddUser(email, password string) error
+	VerifyUser(email, token string) error
+
+	// RequestPasswordReset emails a user a code with which
+	// ResetPassword may change their password.
+	//
+	// It fails with ErrMailDisabled if there is no Mailer,
+	// and succeeds for unknown users without sending
+	// anything, so that it cannot reveal who has accounts.
+	RequestPasswordReset(email string) error
+
+	// ResetPassword changes a user's password with an
+	// emailed code, and logs out all of their sessions.
+	ResetPassword(email, code, newPass string) error
+
+	// BeginSession checks the user's credentials and opens a
+	// new session.
+	//
+	// The code is a TOTP code or recovery code, and is only
+	// needed if the user has two-factor authentication on.
+	BeginSession(email, password, code string) (DBSession, error)
+
+	// BeginBotSession is like BeginSession, but for bot
+	// accounts, which authenticate with API keys.
+	//
+	// Bots are always Available while online, and their
+	// sessions ignore idleness reports.
+	BeginBotSession(email, apiKey string) (DBSession, error)
+
+	// CheckAPIKey authenticates a user's REST integrations,
+	// such as Zapier, with the key from the session's
+	// CreateAPIKey.
+	CheckAPIKey(email, apiKey string) error
+
+	// AddWebhook and RemoveWebhook are like the session
+	// methods, for integrations which authenticate with an
+	// API key.
+	AddWebhook(email, url string, events []string) (statusdb.Webhook, error)
+	RemoveWebhook(email, id string) error
+
+	// Intentionally disconnect all of the DBSessions for a
+	// user, e.g. on behalf of an administrator.
+	ForceLogout(email string) error
+
+	// WatchPublicStatus subscribes to the availability of a
+	// user who has enabled public presence.
+	//
+	// The current status is sent on the channel right away.
+	// The cancel function must be called once the caller is
+	// done watching.
+	WatchPublicStatus(email string) (statuses <-chan statusdb.UserStatus, cancel func(), err error)
+
+	// Sessions lists every open session, for administrators.
+	Sessions() []SessionInfo
+
+	// DeleteUser deletes a user on behalf of an
+	// administrator, as if they had deleted their account.
+	DeleteUser(email string) error
+
+	// MergeUsers merges one user's account into another's
+	// on behalf of an administrator, such as when two
+	// addresses turn out to belong to the same person.
+	//
+	// The sessions of from are not moved to into. They
+	// receive a SecurityAlertAccountMerged alert and are
+	// logged out, so that their clients log in again as
+	// into.
+	MergeUsers(from, into string) error
+
+	// RecordAudit adds an entry to the audit log, filling
+	// in the time if it is zero.
+	//
+	// Operations performed through DBSessions are recorded
+	// automatically.
+	RecordAudit(entry AuditEntry)
+
+	// QueryAudit searches the audit log.
+	QueryAudit(query AuditQuery) ([]AuditEntry, error)
+
+	// LockUser prevents or allows logins for a user.
+	// Locking a user disconnects all of their sessions.
+	LockUser(email string, locked bool) error
+
+	// BroadcastNotice sends a notice from the server
+	// operators to the online sessions of the given users,
+	// or to every online session if emails is nil.
+	BroadcastNotice(notice protocol.ServerNotice, emails []string) error
+
+	// Reports lists every abuse report, oldest first.
+	Reports() ([]statusdb.Report, error)
+
+	// ResolveReport takes a moderation action against the
+	// target of a report and marks the report resolved.
+	ResolveReport(id string, res Resolution) error
+
+	// ServerStats reports the server's current load.
+	ServerStats() protocol.ServerStats
+
+	// Announcements lists every announcement, including
+	// those which are not active.
+	Announcements() ([]statusdb.Announcement, error)
+
+	// SetAnnouncement creates or replaces an announcement,
+	// generating an ID and start time if they are not set.
+	//
+	// Every session is sent the active announcements when
+	// they change, including when an announcement starts or
+	// ends.
+	SetAnnouncement(a statusdb.Announcement) (statusdb.Announcement, error)
+
+	DeleteAnnouncement(id string) error
+
+	// SetMaintenance enables or disables read-only
+	// maintenance mode, in which changes fail with
+	// ErrMaintenance.
+	SetMaintenance(enabled bool)
+	Maintenance() bool
+
+	// Limits gets the current limits, with defaults
+	// filled in.
+	Limits() statusdb.Limits
+
+	// SetLimits changes the limits without a restart.
+	SetLimits(limits statusdb.Limits)
+
+	// Tuning gets the settings which may be changed while
+	// the server is running.
+	Tuning() Tuning
+
+	// UpdateTuning atomically modifies and applies the
+	// settings.
+	UpdateTuning(update func(t *Tuning) error) (old, updated Tuning, err error)
+
+	// TakeSummary summarizes the activity since the last
+	// summary, for reports to administrators.
+	TakeSummary() *ActivitySummary
+
+	// SelfCheck fails if the EventDB is wedged or the DB
+	// is unreachable.
+	SelfCheck() error
+
+	// ApplyRelay makes a change on behalf of a user of
+	// another server, after the server has been
+	// authenticated as the user's home.
+	//
+	// It fails with ErrInvalidRelay if there is no Relay.
+	ApplyRelay(msg *RelayMessage) error
+
+	// Drain ends every session in preparation for a
+	// restart, telling clients to reconnect rather than
+	// logging them out.
+	//
+	// Users are not marked offline, and new sessions fail
+	// with ErrDraining. Once the clients have been told,
+	// the Goroutines which deliver events stop.
+	Drain() error
+
+	// RunElection campaigns for the leadership of the
+	// cluster, which runs the cluster-wide periodic jobs,
+	// until stop is closed or the EventDB is drained.
+	RunElection(stop <-chan struct{})
+
+	// IsLeader checks if this node currently leads.
+	IsLeader() bool
+
+	// ExpireStatuses clears every rich status which has
+	// expired.
+	ExpireStatuses() error
+
+	// PurgeStaleAccounts deletes the accounts which have
+	// been neither used nor changed for maxAge.
+	PurgeStaleAccounts(maxAge time.Duration) (int, error)
+
+	// SyncIntegrations imports the statuses of users whose
+	// status on an integrated service has changed.
+	SyncIntegrations() error
+
+	// ApplySchedules sets the statuses of users whose
+	// schedules have changed windows.
+	ApplySchedules() error
+}
+
+// A DBSession is a connection to an EventDB on behalf of
+// an individual user.
+//
+// Each open DBSession retains a "reference" to a user.
+// Thus, closing DBSessions is necessary to mark a user as
+// offline.
+//
+// The Events() channel is sent Events whenever data is
+// changed that affects the user.
+// If the DBSession user does not read events fast enough
+// and the channel buffer fills up, events may be dropped
+// and replaced with full-state events.
+// This guarantees that the user's data always ends up
+// being up to date, even if it cannot be updated with
+// individual deltas.
+type DBSession interface {
+	Events() <-chan *Event
+
+	// Reauthenticate checks the user's credentials again,
+	// allowing sensitive operations to be performed.
+	Reauthenticate(password, code string) error
+
+	// SetPassword changes the user's password.
+	//
+	// This is a sensitive operation, and may fail with
+	// ErrReauthRequired.
+	SetPassword(oldPass, newPass string) error
+	SendRequest(email, greeting string) error
+	AcceptRequest(email string) error
+	DeclineRequest(email string) error
+	CancelRequest(email string) error
+	DeleteBuddy(email string) error
+
+	// BlockUser prevents another user from sending requests
+	// to this user or seeing this user's presence.
+	BlockUser(email string) error
+	UnblockUser(email string) error
+
+	SetAlias(email, alias string) error
+
+	// ExportBuddies lists the user's buddies and their
+	// aliases.
+	ExportBuddies() ([]protocol.BuddyEntry, error)
+
+	// SetDNDSuppressEvents changes whether non-critical
+	// events are withheld while the user is DoNotDisturb.
+	SetDNDSuppressEvents(suppress bool) error
+
+	// SetLastSeenVisibility controls whether buddies see
+	// when the user was last online.
+	// It is a shortcut for changing the LastSeen privacy
+	// setting.
+	SetLastSeenVisibility(v statusdb.Visibility) error
+
+	// SetPrivacy replaces the user's privacy settings,
+	// which Privacy gets.
+	SetPrivacy(privacy statusdb.PrivacySettings) error
+	Privacy() (statusdb.PrivacySettings, error)
+
+	// SetTimeZone changes the user's time zone, with which
+	// their buddies are shown their local time. The empty
+	// zone removes it.
+	SetTimeZone(zone string) error
+
+	// StatusHistory gets the statuses which the user or one
+	// of their buddies set since a time, oldest first,
+	// failing with ErrHistoryHidden if the buddy's privacy
+	// settings do not allow it.
+	StatusHistory(email string, since time.Time) ([]statusdb.StatusHistoryEntry, error)
+
+	// SetPublicPresence controls whether users who are not
+	// buddies may subscribe to the user's availability.
+	SetPublicPresence(public bool) error
+
+	// Subscribe starts sending the session the availability
+	// of a user with public presence, who need not be a
+	// buddy.
+	Subscribe(email string) error
+	Unsubscribe(email string) error
+
+	// SetInvisible changes whether this session makes the
+	// user appear online to their buddies.
+	//
+	// Invisible sessions still receive events, but buddies
+	// see the user as Offline unless some other session for
+	// the user is visible.
+	SetInvisible(invisible bool) error
+
+	// ReportIdle indicates that the client has been idle
+	// for the given amount of time.
+	//
+	// Once every session for the user has been idle long
+	// enough, an Available user is automatically switched
+	// to Away until ReportActive() is called.
+	ReportIdle(idle time.Duration) error
+	ReportActive() error
+
+	// LookupUser checks if a user exists and may be sent
+	// a buddy request.
+	//
+	// Lookups are rate limited, and fail with
+	// ErrRateLimited if made too quickly.
+	LookupUser(email string) (*LookupResult, error)
+
+	// ReportUser files an abuse report for moderators.
+	//
+	// Reports are rate limited, and fail with
+	// ErrRateLimited if made too quickly.
+	ReportUser(email, reason, evidence string) error
+
+	// SetProfile changes the user's display name,
+	// pronouns, and bio.
+	SetProfile(profile statusdb.Profile) error
+
+	// GetProfile fetches the profile of the user or one of
+	// their buddies.
+	GetProfile(email string) (statusdb.Profile, error)
+
+	// SetAwayNote changes the note which buddies may read
+	// while the user is Away or DoNotDisturb.
+	SetAwayNote(note string) error
+
+	// GetAwayNote fetches the away note of the user or one
+	// of their buddies. A buddy's note is empty unless they
+	// are Away or DoNotDisturb and their status message is
+	// visible to buddies.
+	GetAwayNote(email string) (string, error)
+
+	// SetAvatar processes and stores a new avatar, or
+	// removes the user's avatar if data is empty.
+	// See ProcessAvatar() for supported formats.
+	SetAvatar(data []byte) error
+
+	// GetAvatar fetches an avatar by its hash.
+	GetAvatar(hash string) ([]byte, error)
+
+	// PushKey gets the key which browsers use to subscribe
+	// to push notifications.
+	PushKey() (string, error)
+
+	// AddPushSubscription sends the user's missed buddy
+	// requests and accepts to a browser.
+	AddPushSubscription(sub statusdb.PushSubscription) error
+	RemovePushSubscription(endpoint string) error
+
+	// AddWebhook registers a URL to be called when any of
+	// the protocol.WebhookEvents occur for the user.
+	//
+	// The result includes the secret which signs
+	// deliveries, which ListWebhooks omits.
+	AddWebhook(url string, events []string) (statusdb.Webhook, error)
+	RemoveWebhook(id string) error
+	ListWebhooks() ([]statusdb.Webhook, error)
+
+	// TestWebhook sends a test delivery to a webhook,
+	// failing with a *WebhookError if it is not accepted.
+	TestWebhook(id string) error
+
+	// CreateAPIKey replaces the user's API key, which REST
+	// integrations use in place of their password.
+	// It is a sensitive operation, and may fail with
+	// ErrReauthRequired.
+	CreateAPIKey() (string, error)
+	RevokeAPIKey() error
+
+	// IntegrationURL gets the page where the user may
+	// authorize the server to use another service, which
+	// redirects to redirectURI with a code for
+	// ConnectIntegration.
+	IntegrationURL(provider, redirectURI string) (string, error)
+
+	// ConnectIntegration completes the OAuth authorization
+	// of another service, and then keeps the user's status
+	// in sync with it in the chosen directions.
+	// Connecting a provider again replaces the old
+	// integration.
+	ConnectIntegration(provider, code, redirectURI string, importStatus,
+		exportStatus bool) (statusdb.Integration, error)
+	DisconnectIntegration(provider string) error
+
+	// ListIntegrations lists the user's integrations,
+	// without their tokens.
+	ListIntegrations() ([]statusdb.Integration, error)
+
+	// SetSchedule replaces the user's recurring schedule,
+	// whose current window is applied by ApplySchedules.
+	SetSchedule(schedule statusdb.Schedule) error
+
+	// SetDiscoverable controls whether users who have the
+	// user's email in their contacts may find them with
+	// ImportContacts.
+	SetDiscoverable(discoverable bool) error
+
+	// ContactsURL gets the page where the user lets the
+	// server read their contacts from a source.
+	ContactsURL(source, redirectURI string) (string, error)
+
+	// ImportContacts reads the user's contacts from a
+	// source and suggests the discoverable users among
+	// them. The contacts themselves are not stored.
+	//
+	// Imports count against the LookupUser rate limit.
+	ImportContacts(source string, creds ContactCredentials) ([]protocol.Suggestion, error)
+
+	// SuggestBuddies suggests buddies of the user's buddies
+	// to send requests to, with their numbers of mutual
+	// buddies.
+	SuggestBuddies() ([]protocol.Suggestion, error)
+
+	// SetCustomStates replaces the user's custom states,
+	// which may then be selected by name via SetStatus().
+	SetCustomStates(states []statusdb.CustomState) error
+
+	SetStatus(status statusdb.UserStatus) error
+
+	// EnableTwoFactor turns on two-factor authentication,
+	// returning a TOTP secret and a set of recovery codes.
+	EnableTwoFactor() (secret string, recoveryCodes []string, err error)
+
+	// DisableTwoFactor and RegenerateRecoveryCodes are
+	// sensitive operations, and may fail with
+	// ErrReauthRequired.
+	DisableTwoFactor() error
+	RegenerateRecoveryCodes() ([]string, error)
+
+	// SetEventFilter limits the events delivered to the
+	// session to those in the given categories, plus events
+	// which have no category, such as full states.
+	// A nil filter delivers every event.
+	SetEventFilter(categories []protocol.EventCategory) error
+
+	// SyncSince computes the changes to the user's state
+	// since the time of a previous full state or delta.
+	//
+	// The result is a sync-delta event listing the buddies
+	// whose status or profile changed, or a full-state event
+	// if the user's own settings or relationships changed
+	// or the changes cannot be determined.
+	SyncSince(since time.Time) (*Event, error)
+
+	// DeleteAccount permanently deletes the user after
+	// checking their password and, if two-factor
+	// authentication is enabled, a code.
+	//
+	// Buddies are told that the user was removed, and every
+	// session for the user is intentionally disconnected.
+	DeleteAccount(password, code string) error
+
+	// ServerStats reports the server's current load.
+	// It fails with ErrNotAdmin unless the user is an
+	// administrator.
+	ServerStats() (protocol.ServerStats, error)
+
+	// GetStats gets the user's usage stats, including the
+	// current time online.
+	GetStats() (statusdb.UsageStats, error)
+
+	// FeatureEnabled checks if the user has a feature.
+	FeatureEnabled(feature statusdb.Feature) bool
+
+	// ID identifies the session in the audit log.
+	ID() string
+
+	// SetRemoteAddr records the address of the client for
+	// the audit log.
+	SetRemoteAddr(addr string)
+
+	Close() error
+
+	// Intentionally disconnect all the other DBSessions for
+	// this user.
+	DisconnectOthers() error
+}
+
+type localEventDB struct {
+	// lock is held for reading by operations which only
+	// involve a few users, along with those users' locks,
+	// and for writing by operations which involve everyone.
+	lock  sync.RWMutex
+	users userLocks
+
+	// stateLock guards the bookkeeping which operations on
+	// unrelated users share: reconnecting, activity,
+	// publicWatchers, started, presenceTimes, onlineSince,
+	// lookupLimiters and leaderUntil. It is never held
+	// while taking another lock.
+	stateLock sync.Mutex
+
+	shards     []*sessionShard
+	listeners  listenerIndex
+	db         statusdb.DB
+	bufferSize int
+
+	// reauthWindow overrides DefaultReauthWindow if it is
+	// non-zero.
+	reauthWindow time.Duration
+
+	statusPolicy StatusPolicy
+
+	// idleThreshold overrides DefaultIdleThreshold if it is
+	// non-zero.
+	idleThreshold time.Duration
+
+	// limits restricts what users may do. Zero fields use
+	// the defaults.
+	limits statusdb.Limits
+
+	// maxLifetime, if non-zero, is the approximate time
+	// after which sessions are asked to reconnect.
+	maxLifetime time.Duration
+
+	// reconnecting contains users whose last session was
+	// asked to reconnect, and who are still shown online
+	// until ReconnectGrace passes.
+	reconnecting map[string]bool
+
+	features FeatureFlags
+
+	// alerter is told about problems which operators
+	// should investigate.
+	alerter *statusdb.Alerter
+
+	// activity is summarized by TakeSummary.
+	activity activityCounters
+
+	// maintenance is set while the DB is read-only.
+	maintenance bool
+
+	// avatars stores uploaded avatars.
+	// If nil, avatars are not supported.
+	avatars AvatarStore
+
+	// avatarFallback, if non-nil, provides images for
+	// users without avatars.
+	avatarFallback AvatarFallback
+
+	// audit records state-changing operations.
+	// If nil, operations are not audited.
+	audit AuditLog
+
+	publicWatchers []*publicWatcher
+
+	// started is the time that the first session began,
+	// before which presence changes were not tracked.
+	started time.Time
+
+	// presenceTimes records the last time each user's
+	// status, as seen by buddies, was broadcast.
+	presenceTimes map[string]time.Time
+
+	// onlineSince records when each user with sessions
+	// opened their first session, for UsageStats.
+	onlineSince map[string]time.Time
+
+	// lookupLimiters limit the lookups of each user across
+	// all of their sessions, so that opening more sessions
+	// does not allow more lookups.
+	lookupLimiters map[string]*statusdb.RateLimiter
+
+	// bus connects the EventDB to the other nodes of a
+	// cluster, or is nil if it runs alone.
+	bus    Bus
+	nodeID string
+
+	// peers tracks the presence on other nodes.
+	peers map[string]*clusterPeer
+
+	// relay connects the EventDB to the servers of other
+	// domains, or is nil if there is no federation.
+	relay Relay
+
+	// mailer sends emails to users, or is nil if email is
+	// not configured.
+	mailer Mailer
+
+	// push notifies browsers of missed events, or is nil if
+	// Web Push is not configured.
+	push PushSender
+
+	// webhooks calls users' webhooks, or is nil if they are
+	// not supported.
+	webhooks WebhookSender
+
+	// integrations maps provider names to the services
+	// which users may synchronize their statuses with.
+	integrations map[string]StatusProvider
+
+	// contactSources maps source names to the services
+	// which users may import contacts from.
+	contactSources map[string]ContactSource
+
+	draining bool
+
+	// leaderUntil is when the node's lease on the
+	// leadership of the cluster expires.
+	leaderUntil time.Time
+}
+
+// Options configures an EventDB created with New.
+//
+// Zero fields use their defaults.
+type Options struct {
+	BufferSize    int
+	ReauthWindow  time.Duration
+	IdleThreshold time.Duration
+
+	// MaxLifetime, if non-zero, is the approximate time
+	// after which sessions are asked to reconnect.
+	MaxLifetime time.Duration
+
+	StatusPolicy StatusPolicy
+	Features     FeatureFlags
+	Limits       statusdb.Limits
+
+	// Alerter is told about problems which operators
+	// should investigate.
+	Alerter *statusdb.Alerter
+
+	// Avatars stores uploaded avatars.
+	// If nil, avatars are not supported.
+	Avatars AvatarStore
+
+	// AvatarFallback, if non-nil, provides images for
+	// users without avatars, such as from Gravatar.
+	AvatarFallback AvatarFallback
+
+	// Audit records state-changing operations.
+	// If nil, operations are not audited.
+	Audit AuditLog
+
+	// Bus, if non-nil, connects the EventDB to the other
+	// nodes of a cluster, which must share the DB.
+	Bus Bus
+
+	// NodeID identifies this node on the Bus.
+	// If empty, a random ID is used.
+	NodeID string
+
+	// SessionShards is the number of partitions which
+	// sessions are divided into by email, each of which
+	// delivers events to its sessions in the background.
+	SessionShards int
+
+	// Relay, if non-nil, lets users be buddies with the
+	// users of other servers.
+	Relay Relay
+
+	// Mailer, if non-nil, sends users the emails which
+	// verify their addresses, reset their passwords, and
+	// alert them to changes to their accounts.
+	// Without a Mailer, new users are verified right away.
+	Mailer Mailer
+
+	// Push, if non-nil, sends buddy requests and accepts to
+	// the browsers of users who are offline.
+	Push PushSender
+
+	// Webhooks, if non-nil, lets users register URLs to be
+	// called on their own events.
+	Webhooks WebhookSender
+
+	// Integrations maps provider names, such as "slack",
+	// to the services which users may synchronize their
+	// statuses with.
+	Integrations map[string]StatusProvider
+
+	// ContactSources maps source names, such as "google",
+	// to the services which users may import contacts
+	// from.
+	ContactSources map[string]ContactSource
+}
+
+// New creates an EventDB which broadcasts the changes
+// made to a DB.
+func New(db statusdb.DB, opts Options) EventDB {
+	res := &localEventDB{
+		db:             db,
+		bufferSize:     opts.BufferSize,
+		reauthWindow:   opts.ReauthWindow,
+		statusPolicy:   opts.StatusPolicy,
+		idleThreshold:  opts.IdleThreshold,
+		maxLifetime:    opts.MaxLifetime,
+		features:       opts.Features,
+		alerter:        opts.Alerter,
+		avatars:        opts.Avatars,
+		avatarFallback: opts.AvatarFallback,
+		audit:          opts.Audit,
+		bus:            opts.Bus,
+		nodeID:         opts.NodeID,
+		relay:          opts.Relay,
+		mailer:         opts.Mailer,
+		push:           opts.Push,
+		webhooks:       opts.Webhooks,
+		integrations:   opts.Integrations,
+		contactSources: opts.ContactSources,
+		shards:         newSessionShards(opts.SessionShards),
+	}
+	if res.nodeID == "" {
+		res.nodeID = NewRandomID()
+	}
+	if res.bufferSize < 1 {
+		res.bufferSize = DefaultBufferSize
+	}
+	res.SetLimits(opts.Limits)
+	res.joinCluster()
+	res.watchIntegrations()
+	return res
+}
+
+func (l *localEventDB) AddUser(email, password string) error {
+	if l.isRemote(email) {
+		return ErrRemoteUser
+	}
+	if err := l.db.AddUser(email, password); err != nil {
+		return err
+	}
+	if err := l.beginVerification(email); err != nil {
+		return err
+	}
+	l.stateLock.Lock()
+	l.activity.registrations++
+	l.stateLock.Unlock()
+	return nil
+}
+
+func (l *localEventDB) VerifyUser(email, token string) error {
+	return l.db.VerifyUser(email, token)
+}
+
+func (l *localEventDB) BeginSession(email, password, code string) (DBSession, error) {
+	if err := l.db.CheckLogin(email, password); err != nil {
+		if RootError(err) == statusdb.ErrPassword {
+			l.alerter.LoginFailed()
+		}
+		return nil, err
+	}
+	if err := l.db.CheckTwoFactor(email, code); err != nil {
+		return nil, err
+	}
+	return l.openSession(email, false)
+}
+
+func (l *localEventDB) BeginBotSession(email, apiKey string) (DBSession, error) {
+	if err := l.CheckAPIKey(email, apiKey); err != nil {
+		return nil, err
+	}
+
+	// Other users' keys are only for integrations.
+	if info, err := l.db.GetUserInfo(email); err != nil {
+		return nil, err
+	} else if !info.Bot {
+		return nil, statusdb.ErrPassword
+	}
+	return l.openSession(email, true)
+}
+
+func (l *localEventDB) CheckAPIKey(email, apiKey string) error {
+	err := l.db.CheckAPIKey(email, apiKey)
+	if RootError(err) == statusdb.ErrPassword {
+		l.alerter.LoginFailed()
+	}
+	return err
+}
+
+// openSession creates a session for an authenticated user.
+func (l *localEventDB) openSession(email string, bot bool) (DBSession, error) {
+	defer l.lockUsers(email)()
+
+	if l.draining {
+		return nil, ErrDraining
+	}
+	if err := l.checkSessionLimit(email); err != nil {
+		return nil, err
+	}
+	l.stateLock.Lock()
+	first := l.started.IsZero()
+	if first {
+		l.started = time.Now()
+	}
+	l.stateLock.Unlock()
+	if first {
+		l.scheduleAnnouncements()
+	}
+	reportLimiter := l.sessionLimiter()
+	res := &localDBSession{
+		eventDB:       l,
+		id:            NewRandomID(),
+		email:         email,
+		bot:           bot,
+		events:        make(chan *Event, l.bufferSize),
+		authTime:      time.Now(),
+		reportLimiter: reportLimiter,
+	}
+	fullState, err := res.fullStateEvent()
+	if err != nil {
+		return nil, err
+	}
+	res.events <- fullState
+	if l.maintenance {
+		// Missed events are kept until they can be cleared.
+	} else if missed, err := l.db.TakeMissedEvents(email); err != nil {
+		return nil, err
+	} else if len(missed) > 0 {
+		res.pushEvent(&Event{Type: EventMissedEvents, Missed: missed})
+	}
+	l.pushToUser(email, &Event{Type: EventSecurityAlert, Alert: protocol.SecurityAlertNewLogin})
+	wasOnline := l.userOnline(email)
+	l.stateLock.Lock()
+	wasOnline = wasOnline || l.reconnecting[email]
+	delete(l.reconnecting, email)
+	l.stateLock.Unlock()
+	l.sessionStarted(email)
+	l.addSession(res)
+	l.listeners.set(email, fullState.UserInfo.Buddies)
+	l.publishPresence(email)
+	l.stateLock.Lock()
+	l.activity.logins++
+	if n := len(l.onlineSince); n > l.activity.peakOnline {
+		l.activity.peakOnline = n
+	}
+	l.stateLock.Unlock()
+	l.scheduleSessionExpiry(res)
+	l.updateSuppression(email)
+	if !wasOnline {
+		// Other nodes see the user come online through
+		// publishPresence.
+		l.deliverCurrentStatus(email)
+	}
+	l.checkIdle(email)
+	return res, nil
+}
+
+func (l *localEventDB) Sessions() []SessionInfo {
+	res := []SessionInfo{}
+	for _, sess := range l.allSessions() {
+		sess.lock.Lock()
+		res = append(res, SessionInfo{
+			ID:         sess.id,
+			RemoteAddr: sess.remoteAddr,
+			Email:      sess.email,
+			AuthTime:   sess.authTime,
+			Invisible:  sess.invisible,
+			IdleSince:  sess.idleSince,
+		})
+		sess.lock.Unlock()
+	}
+	return res
+}
+
+func (l *localEventDB) DeleteUser(email string) (err error) {
+	defer essentials.AddCtxTo("delete user", &err)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.deleteUser(email)
+}
+
+func (l *localEventDB) MergeUsers(from, into string) (err error) {
+	defer essentials.AddCtxTo("merge users", &err)
+	defer l.lockAll()()
+	fromInfo, err := l.db.GetUserInfo(from)
+	if err != nil {
+		return err
+	}
+	if err := l.db.MergeUsers(from, into); err != nil {
+		return err
+	}
+	intoInfo, err := l.db.GetUserInfo(into)
+	if err != nil {
+		return err
+	}
+
+	// The merged account's clients are logged out, so that
+	// they log in to the account it was merged into.
+	l.disconnectUser(fromInfo.Email, nil, protocol.SecurityAlertAccountMerged)
+	l.publishPresence(fromInfo.Email)
+	l.closePublicWatchers(fromInfo.Email)
+	l.disconnectIntegrations(fromInfo.Integrations)
+
+	// Remote users forget the merged account, and local
+	// users see their lists change.
+	affected := []string{intoInfo.Email}
+	for _, list := range [][]string{fromInfo.Buddies, fromInfo.IncomingRequests,
+		fromInfo.OutgoingRequests, fromInfo.Blocked} {
+		for _, email := range list {
+			if !statusdb.ContainsEmail(affected, email) {
+				affected = append(affected, email)
+			}
+		}
+	}
+	for _, email := range affected {
+		if !l.isRemote(email) {
+			l.resyncUser(email)
+		} else if statusdb.ContainsEmail(fromInfo.Buddies, email) {
+			l.relayTo(&RelayMessage{Type: RelayRemove, From: fromInfo.Email, To: email})
+		} else if statusdb.ContainsEmail(fromInfo.IncomingRequests, email) {
+			l.relayTo(&RelayMessage{Type: RelayDecline, From: fromInfo.Email, To: email})
+		} else if statusdb.ContainsEmail(fromInfo.OutgoingRequests, email) {
+			l.relayTo(&RelayMessage{Type: RelayCancel, From: fromInfo.Email, To: email})
+		}
+	}
+	l.broadcastCurrentStatus(intoInfo.Email)
+	return nil
+}
+
+func (l *localEventDB) LockUser(email string, locked bool) (err error) {
+	defer essentials.AddCtxTo("lock user", &err)
+	defer l.lockUsers(email)()
+	if err := l.db.SetLocked(email, locked); err != nil {
+		return err
+	}
+	if locked {
+		l.disconnectUser(email, nil, protocol.SecurityAlertForcedLogout)
+		if !l.userOnline(email) {
+			l.userWentOffline(email)
+		}
+		l.publishPresence(email)
+	}
+	return nil
+}
+
+func (l *localEventDB) ForceLogout(email string) (err error) {
+	defer essentials.AddCtxTo("force logout", &err)
+	if _, err := l.db.GetUserInfo(email); err != nil {
+		return err
+	}
+	defer l.lockUsers(email)()
+	l.disconnectUser(email, nil, protocol.SecurityAlertForcedLogout)
+	if !l.userOnline(email) {
+		offline := statusdb.UserStatus{Availability: statusdb.Offline, Time: time.Now()}
+		l.deliverStatus(email, offline)
+		l.relayStatus(email, offline)
+	}
+	l.publishPresence(email)
+	return nil
+}
+
+func (l *localEventDB) maskUserStatus(email string, status statusdb.UserStatus) statusdb.UserStatus {
+	if l.isRemote(email) {
+		// The status was masked by the user's home server.
+		return status
+	}
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return offlineStatus(time.Time{})
+	}
+	now := time.Now()
+	if l.userOnline(email) {
+		status = status.Expire(now)
+		if !info.Privacy.StatusMessage.VisibleToBuddies() {
+			status = status.HideMessage()
+		}
+	} else if !info.Privacy.LastSeen.VisibleToBuddies() {
+		status = offlineStatus(time.Time{})
+	} else {
+		status = offlineStatus(info.LastSeen)
+	}
+	return status.WithLocalTime(info.TimeZone, now)
+}
+
+// userStatus reads a user's stored status.
+func (l *localEventDB) userStatus(email string) (statusdb.UserStatus, error) {
+	statuses, err := l.db.GetStatuses([]string{email})
+	if err != nil {
+		return statusdb.UserStatus{}, err
+	}
+	return statuses[0].Status, statuses[0].Err
+}
+
+// maskBuddyState is like maskUserStatus, but takes the
+// last-seen time from the state instead of reading the
+// buddy's info.
+func (l *localEventDB) maskBuddyState(state *statusdb.BuddyState) statusdb.UserStatus {
+	if l.isRemote(state.Email) {
+		return state.Status
+	}
+	now := time.Now()
+	status := offlineStatus(state.LastSeen)
+	if l.userOnline(state.Email) {
+		status = state.Status.Expire(now)
+	}
+	return status.WithLocalTime(state.TimeZone, now)
+}
+
+// offlineStatus creates the status of a user without
+// sessions, showing lastSeen unless it is zero.
+func offlineStatus(lastSeen time.Time) statusdb.UserStatus {
+	res := statusdb.UserStatus{Availability: statusdb.Offline, Time: time.Now()}
+	if !lastSeen.IsZero() {
+		res.LastSeen = &lastSeen
+	}
+	return res
+}
+
+// userWentOffline records the user's last-seen time and
+// tells their buddies on this node that they are offline.
+//
+// The caller should then call publishPresence, so that
+// other nodes see the new last-seen time.
+func (l *localEventDB) userWentOffline(email string) {
+	if l.maintenance {
+		l.deliverCurrentStatus(email)
+		return
+	}
+	if err := l.db.SetLastSeen(email, time.Now()); RootError(err) == statusdb.ErrNoEmail {
+		// The user was deleted on another node.
+		return
+	} else if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	l.deliverCurrentStatus(email)
+}
+
+// scheduleExpiry clears a user's rich status once it
+// expires, unless the status has been changed by then.
+func (l *localEventDB) scheduleExpiry(email string, expiresAt time.Time) {
+	time.AfterFunc(time.Until(expiresAt), func() {
+		l.expireStatus(email, expiresAt)
+	})
+}
+
+// expireStatus clears a user's rich status if it still
+// expires at the given time.
+func (l *localEventDB) expireStatus(email string, expiresAt time.Time) {
+	defer l.lockUsers(email)()
+	status, err := l.userStatus(email)
+	if err != nil {
+		return
+	}
+	if status.ExpiresAt == nil || !status.ExpiresAt.Equal(expiresAt) {
+		return
+	}
+	l.updateStatus(email, status.Expire(time.Now()))
+}
+
+// updateStatus changes a user's status on their behalf,
+// notifying their buddies and their own sessions.
+func (l *localEventDB) updateStatus(email string, status statusdb.UserStatus) {
+	l.setStatusFrom(email, status, "")
+}
+
+// setStatusFrom is like updateStatus, but does not export
+// the status back to the integration it came from, if any.
+func (l *localEventDB) setStatusFrom(email string, status statusdb.UserStatus, source string) {
+	if l.maintenance {
+		return
+	}
+	status.Time = time.Now()
+	if err := l.db.SetStatus(email, status); err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	l.pushToUser(email, &Event{Type: EventStatusChanged, Email: email, Status: status})
+	l.broadcastNewStatus(email, l.maskUserStatus(email, status))
+	l.fireWebhooks(email, WebhookDelivery{Event: protocol.WebhookStatusChanged, Status: &status})
+	l.exportStatus(email, status, source)
+}
+
+// checkIdle switches the user between Available and Away
+// based on the idleness of their sessions.
+func (l *localEventDB) checkIdle(email string) {
+	threshold := l.idleThreshold
+	if threshold == 0 {
+		threshold = DefaultIdleThreshold
+	}
+	idle := false
+	for _, sess := range l.userSessions(email) {
+		sess.lock.Lock()
+		idleSince := sess.idleSince
+		sess.lock.Unlock()
+		if idleSince.IsZero() || time.Since(idleSince) < threshold {
+			idle = false
+			break
+		}
+		idle = true
+	}
+	if idle && !l.peersIdle(email, threshold) {
+		idle = false
+	}
+	status, err := l.userStatus(email)
+	if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	if idle && status.Availability == statusdb.Available {
+		status.Availability = statusdb.Away
+		status.Idle = true
+		l.updateStatus(email, status)
+	} else if !idle && status.Idle {
+		status.Availability = statusdb.Available
+		status.Idle = false
+		l.updateStatus(email, status)
+	}
+}
+
+// broadcastCurrentStatus sends the user's status, as seen
+// by their buddies, to their buddies.
+func (l *localEventDB) broadcastCurrentStatus(email string) {
+	status, err := l.userStatus(email)
+	if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	l.broadcastNewStatus(email, l.maskUserStatus(email, status))
+}
+
+// deliverCurrentStatus is like broadcastCurrentStatus,
+// but only tells the buddies on this node and on other
+// servers.
+//
+// In a cluster, several nodes may relay the same status,
+// which the other servers simply store again.
+func (l *localEventDB) deliverCurrentStatus(email string) {
+	status, err := l.userStatus(email)
+	if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	status = l.maskUserStatus(email, status)
+	l.deliverStatus(email, status)
+	l.relayStatus(email, status)
+}
+
+// userOnline checks if the user has any sessions, on any
+// node, which make them appear online to their buddies.
+func (l *localEventDB) userOnline(email string) bool {
+	for _, sess := range l.userSessions(email) {
+		if sess.visible() {
+			return true
+		}
+	}
+	_, visible := l.peerSessions(email)
+	return visible > 0
+}
+
+func (l *localEventDB) broadcastNewStatus(email string, status statusdb.UserStatus) {
+	l.publish(&BusMessage{Type: BusStatus, Email: email, Status: &status})
+	l.deliverStatus(email, status)
+	l.relayStatus(email, status)
+}
+
+// deliverStatus sends a user's status to their buddies'
+// sessions on this node.
+func (l *localEventDB) deliverStatus(email string, status statusdb.UserStatus) {
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	l.stateLock.Lock()
+	if l.presenceTimes == nil {
+		l.presenceTimes = map[string]time.Time{}
+	}
+	l.presenceTimes[info.Email] = time.Now()
+	l.stateLock.Unlock()
+
+	event := &Event{Type: EventStatusChanged, Email: email, Status: status}
+	l.pushToListeners(info, event)
+	l.notifyPublic(info, status)
+}
+
+// deleteUser deletes a user from the DB, notifies the
+// users they were involved with, and disconnects the
+// user's sessions and public watchers.
+func (l *localEventDB) deleteUser(email string) error {
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return err
+	}
+	if err := l.db.DeleteUser(email); err != nil {
+		return err
+	}
+	l.disconnectUser(email, nil, protocol.SecurityAlertAccountDeleted)
+	l.publishPresence(email)
+	l.disconnectIntegrations(info.Integrations)
+	for _, buddy := range info.Buddies {
+		l.notifyUser(buddy, &Event{Type: EventBuddyRemoved, Email: info.Email})
+		l.relayTo(&RelayMessage{Type: RelayRemove, From: info.Email, To: buddy})
+	}
+	for _, other := range info.IncomingRequests {
+		l.notifyUser(other, &Event{Type: EventRequestDeclined, Email: info.Email})
+		l.relayTo(&RelayMessage{Type: RelayDecline, From: info.Email, To: other})
+	}
+	for _, other := range info.OutgoingRequests {
+		l.notifyUser(other, &Event{Type: EventRequestCanceled, Email: info.Email})
+		l.relayTo(&RelayMessage{Type: RelayCancel, From: info.Email, To: other})
+	}
+	l.closePublicWatchers(email)
+	return nil
+}
+
+// closePublicWatchers stops sending the user's public
+// status to anonymous clients.
+func (l *localEventDB) closePublicWatchers(email string) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	for i := 0; i < len(l.publicWatchers); i++ {
+		if watcher := l.publicWatchers[i]; statusdb.EmailsEquivalent(watcher.email, email) {
+			close(watcher.statuses)
+			essentials.UnorderedDelete(&l.publicWatchers, i)
+			i--
+		}
+	}
+}
+
+// broadcastProfile sends the user's profile to their own
+// sessions and to their buddies.
+func (l *localEventDB) broadcastProfile(email string) {
+	l.publish(&BusMessage{Type: BusProfile, Email: email})
+	l.deliverProfile(email)
+}
+
+// deliverProfile is like broadcastProfile, but only for
+// the sessions on this node.
+func (l *localEventDB) deliverProfile(email string) {
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	event := &Event{Type: EventProfileChanged, Email: email,
+		Profile: l.presentProfile(info.Email, info.Profile)}
+	l.pushToLocalUser(info.Email, event)
+	l.pushToListeners(info, event)
+}
+
+// pushToListeners pushes an event about a user to the
+// sessions on this node of the user's buddies, except for
+// those the user has blocked.
+func (l *localEventDB) pushToListeners(info *statusdb.UserInfo, event *Event) {
+	for _, listener := range l.listeners.listenersOf(info.Email) {
+		if statusdb.ContainsEmail(info.Blocked, listener) {
+			continue
+		}
+		for _, sess := range l.userSessions(listener) {
+			sess.pushEvent(event)
+		}
+	}
+}
+
+// hasBlocked checks if the blocker has blocked the other
+// user.
+func (l *localEventDB) hasBlocked(blocker, other string) bool {
+	info, err := l.db.GetUserInfo(blocker)
+	if err != nil {
+		return false
+	}
+	return statusdb.ContainsEmail(info.Blocked, other)
+}
+
+// updateSuppression recomputes whether the user's sessions
+// should withhold non-critical events.
+//
+// Sessions which stop withholding events are sent a full
+// state, since they may have missed changes.
+func (l *localEventDB) updateSuppression(email string) {
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	suppress := info.DNDSuppressEvents && info.LatestStatus.Availability == statusdb.DoNotDisturb
+	for _, sess := range l.userSessions(email) {
+		sess.lock.Lock()
+		wasSuppressing := sess.suppressEvents
+		sess.suppressEvents = suppress
+		sess.lock.Unlock()
+		if wasSuppressing && !suppress {
+			sess.resync()
+		}
+	}
+}
+
+func (l *localEventDB) pushToUser(email string, event *Event) {
+	l.publish(&BusMessage{Type: BusPush, Email: email, Event: event})
+	l.pushToLocalUser(email, event)
+}
+
+func (l *localEventDB) pushToLocalUser(email string, event *Event) {
+	if event.changesBuddies() {
+		l.refreshListeners(email)
+	}
+	for _, sess := range l.userSessions(email) {
+		sess.pushEvent(event)
+	}
+}
+
+// resyncUser sends a new full state to the user's
+// sessions.
+func (l *localEventDB) resyncUser(email string) {
+	l.publish(&BusMessage{Type: BusResync, Email: email})
+	l.resyncLocalUser(email)
+}
+
+func (l *localEventDB) resyncLocalUser(email string) {
+	for _, sess := range l.userSessions(email) {
+		sess.resync()
+	}
+}
+
+// disconnectUser intentionally disconnects every session
+// for the user other than except, which may be nil.
+//
+// The caller should then call publishPresence.
+func (l *localEventDB) disconnectUser(email string, except *localDBSession,
+	alert protocol.SecurityAlert) {
+	l.publish(&BusMessage{Type: BusDisconnect, Email: email, Alert: alert})
+	l.disconnectLocalUser(email, except, alert)
+	l.mailSecurityAlert(email, alert)
+}
+
+func (l *localEventDB) disconnectLocalUser(email string, except *localDBSession,
+	alert protocol.SecurityAlert) {
+	for _, sess := range l.userSessions(email) {
+		if sess != except {
+			sess.intentionalDiscon = true
+			sess.clearAndPush(&Event{Type: EventIntentionalDisconnect, Alert: alert})
+			l.removeSession(sess)
+		}
+	}
+	l.sessionsEnded(email)
+}
+
+func (l *localEventDB) Drain() error {
+	l.lock.Lock()
+	l.draining = true
+	for _, sess := range l.removeAllSessions() {
+		sess.intentionalDiscon = true
+		sess.clearAndPush(&Event{Type: EventReconnect})
+		l.sessionsEnded(sess.email)
+	}
+	l.lock.Unlock()
+
+	// The shards lock users to build full states, so they
+	// are stopped once the EventDB is unlocked.
+	l.stopShards()
+	return nil
+}
+
+func (l *localEventDB) cannotBroadcast() {
+	l.stateLock.Lock()
+	l.activity.syncErrors++
+	l.stateLock.Unlock()
+	l.alerter.Raise(statusdb.AlertSyncError, "could not keep data consistent")
+	for _, sess := range l.allSessions() {
+		sess.pushEvent(&Event{
+			Type:         EventSyncError,
+			ErrorMessage: "could not keep data consistent",
+		})
+	}
+}
+
+type localDBSession struct {
+	eventDB           *localEventDB
+	id                string
+	email             string
+	bot               bool
+	events            chan *Event
+	intentionalDiscon bool
+	closed            bool
+	reportLimiter     statusdb.RateLimiter
+	expiry            *time.Timer
+
+	// lock guards the fields below, which the operations
+	// of other users read. They are only changed while the
+	// session's user is locked as well, so the session's
+	// own operations may read them without lock.
+	lock           sync.Mutex
+	remoteAddr     string
+	authTime       time.Time
+	suppressEvents bool
+	invisible      bool
+	idleSince      time.Time
+
+	// subscriptions lists non-buddies whose public presence
+	// the session follows.
+	subscriptions []string
+
+	// eventFilter, if non-nil, is the set of event
+	// categories the client wants.
+	eventFilter map[protocol.EventCategory]bool
+}
+
+func (l *localDBSession) Events() <-chan *Event {
+	return l.events
+}
+
+func (l *localDBSession) Reauthenticate(password, code string) error {
+	if err := l.eventDB.db.CheckLogin(l.email, password); err != nil {
+		return essentials.AddCtx("reauthenticate", err)
+	}
+	if err := l.eventDB.db.CheckTwoFactor(l.email, code); err != nil {
+		return essentials.AddCtx("reauthenticate", err)
+	}
+	return l.genericOperation("reauthenticate", func() error {
+		l.lock.Lock()
+		l.authTime = time.Now()
+		l.lock.Unlock()
+		return nil
+	})
+}
+
+func (l *localDBSession) SetPassword(oldPass, newPass string) error {
+	return l.sensitiveOperation("set password", func() error {
+		if err := l.eventDB.db.SetPassword(l.email, oldPass, newPass); err != nil {
+			return err
+		}
+		l.eventDB.disconnectUser(l.email, l, protocol.SecurityAlertPasswordChanged)
+		l.eventDB.publishPresence(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) SendRequest(email, greeting string) error {
+	return l.auditedOperation("send request", email, func() error {
+		if l.eventDB.isRemote(email) {
+			if err := l.eventDB.addRemoteUser(email); err != nil {
+				return err
+			}
+		}
+		if err := l.eventDB.db.SendRequest(l.email, email, greeting); err != nil {
+			return err
+		}
+		self, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		if !self.ShadowLimited && !l.eventDB.hasBlocked(email, l.email) {
+			l.eventDB.notifyUser(email, &Event{Type: EventRequestReceived, Email: l.email,
+				Greeting: greeting})
+			l.eventDB.relayTo(&RelayMessage{Type: RelayRequest, From: l.email, To: email,
+				Greeting: greeting})
+		}
+		l.eventDB.pushToUser(l.email, &Event{Type: EventRequestSent, Email: email})
+		return nil
+	})
+}
+
+func (l *localDBSession) AcceptRequest(email string) error {
+	return l.auditedOperation("accept request", email, func() error {
+		statuses, err := l.eventDB.db.GetStatuses([]string{l.email, email})
+		if err != nil {
+			return err
+		}
+		for _, result := range statuses {
+			if result.Err != nil {
+				return result.Err
+			}
+		}
+		ourStatus := l.eventDB.maskUserStatus(l.email, statuses[0].Status)
+		otherStatus := l.eventDB.maskUserStatus(email, statuses[1].Status)
+		if l.eventDB.hasBlocked(l.email, email) {
+			ourStatus = statusdb.UserStatus{Availability: statusdb.Offline, Time: time.Now()}
+		}
+		if l.eventDB.hasBlocked(email, l.email) {
+			otherStatus = statusdb.UserStatus{Availability: statusdb.Offline, Time: time.Now()}
+		}
+		if err := l.eventDB.db.AcceptRequest(l.email, email); err != nil {
+			return err
+		}
+		l.eventDB.notifyUser(email, &Event{Type: EventRequestAccepted, Email: l.email,
+			Status: ourStatus})
+
+		// Whichever user is remote is sent the other's status
+		// after the acceptance itself.
+		l.eventDB.relayTo(&RelayMessage{Type: RelayAccept, From: l.email, To: email})
+		l.eventDB.relayTo(&RelayMessage{Type: RelayStatus, From: l.email, To: email,
+			Status: &ourStatus})
+		l.eventDB.relayTo(&RelayMessage{Type: RelayStatus, From: email, To: l.email,
+			Status: &otherStatus})
+		l.eventDB.pushToUser(l.email, &Event{Type: EventAcceptSent, Email: email,
+			Status: otherStatus})
+		return nil
+	})
+}
+
+func (l *localDBSession) DeclineRequest(email string) error {
+	return l.auditedOperation("decline request", email, func() error {
+		if err := l.eventDB.db.DeclineRequest(l.email, email); err != nil {
+			return err
+		}
+		l.eventDB.notifyUser(email, &Event{Type: EventRequestDeclined, Email: l.email})
+		l.eventDB.relayTo(&RelayMessage{Type: RelayDecline, From: l.email, To: email})
+		l.eventDB.pushToUser(l.email, &Event{Type: EventRequestDeclined, Email: email})
+		return nil
+	})
+}
+
+func (l *localDBSession) CancelRequest(email string) error {
+	return l.auditedOperation("cancel request", email, func() error {
+		if err := l.eventDB.db.CancelRequest(l.email, email); err != nil {
+			return err
+		}
+		l.eventDB.notifyUser(email, &Event{Type: EventRequestCanceled, Email: l.email})
+		l.eventDB.relayTo(&RelayMessage{Type: RelayCancel, From: l.email, To: email})
+		l.eventDB.pushToUser(l.email, &Event{Type: EventRequestCanceled, Email: email})
+		return nil
+	})
+}
+
+func (l *localDBSession) DeleteBuddy(email string) error {
+	return l.auditedOperation("delete buddy", email, func() error {
+		if err := l.eventDB.db.DeleteBuddy(l.email, email); err != nil {
+			return err
+		}
+		l.eventDB.notifyUser(email, &Event{Type: EventBuddyRemoved, Email: l.email})
+		l.eventDB.relayTo(&RelayMessage{Type: RelayRemove, From: l.email, To: email})
+		l.eventDB.pushToUser(l.email, &Event{Type: EventBuddyRemoved, Email: email})
+		return nil
+	})
+}
+
+func (l *localDBSession) BlockUser(email string) error {
+	return l.auditedOperation("block user", email, func() error {
+		if l.eventDB.isRemote(email) {
+			if err := l.eventDB.addRemoteUser(email); err != nil {
+				return err
+			}
+		}
+		self, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		if err := l.eventDB.db.BlockUser(l.email, email); err != nil {
+			return err
+		}
+
+		// The block severed any relationship between the users.
+		// The other home server severs it when it is relayed.
+		l.eventDB.relayTo(&RelayMessage{Type: RelayBlock, From: l.email, To: email})
+		if statusdb.ContainsEmail(self.Buddies, email) {
+			// The blocked user first sees the blocker go
+			// offline, for clients which keep showing the
+			// presence of removed buddies.
+			l.eventDB.pushToUser(email, &Event{Type: EventStatusChanged, Email: l.email,
+				Status: offlineStatus(time.Time{})})
+			l.eventDB.notifyUser(email, &Event{Type: EventBuddyRemoved, Email: l.email})
+			l.eventDB.pushToUser(l.email, &Event{Type: EventBuddyRemoved, Email: email})
+		} else if statusdb.ContainsEmail(self.OutgoingRequests, email) {
+			l.eventDB.notifyUser(email, &Event{Type: EventRequestCanceled, Email: l.email})
+			l.eventDB.pushToUser(l.email, &Event{Type: EventRequestCanceled, Email: email})
+		}
+		if statusdb.ContainsEmail(self.IncomingRequests, email) {
+			l.eventDB.pushToUser(l.email, &Event{Type: EventRequestDeclined, Email: email})
+		}
+		l.eventDB.pushToUser(l.email, &Event{Type: EventUserBlocked, Email: email})
+		return nil
+	})
+}
+
+func (l *localDBSession) UnblockUser(email string) error {
+	return l.auditedOperation("unblock user", email, func() error {
+		if err := l.eventDB.db.UnblockUser(l.email, email); err != nil {
+			return err
+		}
+		l.eventDB.relayTo(&RelayMessage{Type: RelayUnblock, From: l.email, To: email})
+		l.eventDB.pushToUser(l.email, &Event{Type: EventUserUnblocked, Email: email})
+		if l.isBuddy(email) {
+			status, err := l.eventDB.userStatus(l.email)
+			if err != nil {
+				return err
+			}
+			status = l.eventDB.maskUserStatus(l.email, status)
+			l.eventDB.pushToUser(email, &Event{
+				Type:   EventStatusChanged,
+				Email:  l.email,
+				Status: status,
+			})
+			l.eventDB.relayTo(&RelayMessage{Type: RelayStatus, From: l.email, To: email,
+				Status: &status})
+		}
+		return nil
+	})
+}
+
+func (l *localDBSession) ExportBuddies() (entries []protocol.BuddyEntry, err error) {
+	err = l.genericOperation("export buddies", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		for _, buddy := range info.Buddies {
+			entries = append(entries, protocol.BuddyEntry{Email: buddy, Alias: info.Aliases[buddy]})
+		}
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) SetAlias(email, alias string) error {
+	return l.auditedOperation("set alias", email, func() error {
+		if err := l.eventDB.db.SetAlias(l.email, email, alias); err != nil {
+			return err
+		}
+		l.eventDB.pushToUser(l.email, &Event{Type: EventAliasChanged, Email: email, Alias: alias})
+		return nil
+	})
+}
+
+func (l *localDBSession) SetDNDSuppressEvents(suppress bool) error {
+	return l.auditedOperation("set DND settings", "", func() error {
+		if err := l.eventDB.db.SetDNDSuppressEvents(l.email, suppress); err != nil {
+			return err
+		}
+		l.eventDB.updateSuppression(l.email)
+		l.eventDB.resyncLocalUser(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) SetLastSeenVisibility(v statusdb.Visibility) error {
+	return l.auditedOperation("set last seen visibility", "", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		privacy := info.Privacy
+		privacy.LastSeen = v
+		return l.setPrivacy(privacy)
+	})
+}
+
+func (l *localDBSession) SetPrivacy(privacy statusdb.PrivacySettings) error {
+	return l.auditedOperation("set privacy", "", func() error {
+		return l.setPrivacy(privacy)
+	})
+}
+
+// setPrivacy changes the privacy settings of the locked
+// user, and shows their buddies the newly masked status.
+func (l *localDBSession) setPrivacy(privacy statusdb.PrivacySettings) error {
+	if err := l.eventDB.db.SetPrivacy(l.email, privacy); err != nil {
+		return err
+	}
+	l.eventDB.resyncUser(l.email)
+	l.eventDB.broadcastCurrentStatus(l.email)
+	return nil
+}
+
+func (l *localDBSession) Privacy() (privacy statusdb.PrivacySettings, err error) {
+	err = l.genericOperation("get privacy", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		privacy = info.Privacy
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) SetTimeZone(zone string) error {
+	return l.auditedOperation("set time zone", "", func() error {
+		if err := l.eventDB.db.SetTimeZone(l.email, zone); err != nil {
+			return err
+		}
+		l.eventDB.resyncUser(l.email)
+		l.eventDB.broadcastCurrentStatus(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) SetPublicPresence(public bool) error {
+	return l.auditedOperation("set public presence", "", func() error {
+		if err := l.eventDB.db.SetPublicPresence(l.email, public); err != nil {
+			return err
+		}
+		l.eventDB.resyncUser(l.email)
+
+		// When public presence is turned off, broadcasting
+		// the status unsubscribes its watchers on every
+		// node.
+		l.eventDB.broadcastCurrentStatus(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) Subscribe(email string) error {
+	return l.genericOperation("subscribe", func() error {
+		info, err := l.eventDB.db.GetUserInfo(email)
+		if RootError(err) == statusdb.ErrNoEmail {
+			return ErrNotPublic
+		} else if err != nil {
+			return err
+		} else if !info.PublicPresence || statusdb.ContainsEmail(info.Blocked, l.email) {
+			return ErrNotPublic
+		}
+		l.lock.Lock()
+		if !statusdb.ContainsEmail(l.subscriptions, info.Email) {
+			l.subscriptions = append(l.subscriptions, info.Email)
+		}
+		l.lock.Unlock()
+		status := l.eventDB.maskUserStatus(info.Email, info.LatestStatus)
+		l.pushEvent(&Event{
+			Type:   EventStatusChanged,
+			Email:  info.Email,
+			Status: publicStatus(info, status),
+		})
+		return nil
+	})
+}
+
+func (l *localDBSession) Unsubscribe(email string) error {
+	return l.genericOperation("unsubscribe", func() error {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		for i, sub := range l.subscriptions {
+			if statusdb.EmailsEquivalent(sub, email) {
+				essentials.OrderedDelete(&l.subscriptions, i)
+				return nil
+			}
+		}
+		return ErrNotSubscribed
+	})
+}
+
+func (l *localDBSession) SetInvisible(invisible bool) error {
+	return l.genericOperation("set invisible", func() error {
+		wasOnline := l.eventDB.userOnline(l.email)
+		l.lock.Lock()
+		l.invisible = invisible
+		l.lock.Unlock()
+		if isOnline := l.eventDB.userOnline(l.email); wasOnline && !isOnline {
+			l.eventDB.userWentOffline(l.email)
+		} else if isOnline != wasOnline {
+			l.eventDB.deliverCurrentStatus(l.email)
+		}
+		l.eventDB.publishPresence(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) ReportIdle(idle time.Duration) error {
+	return l.genericOperation("report idle", func() error {
+		if l.bot {
+			// Bots never become Away.
+			return nil
+		}
+		l.lock.Lock()
+		l.idleSince = time.Now().Add(-idle)
+		l.lock.Unlock()
+		l.eventDB.checkIdle(l.email)
+		l.eventDB.publishPresence(l.email)
+
+		threshold := l.eventDB.idleThreshold
+		if threshold == 0 {
+			threshold = DefaultIdleThreshold
+		}
+		if idle < threshold {
+			time.AfterFunc(threshold-idle, func() {
+				defer l.eventDB.lockUsers(l.email)()
+				if !l.closed && !l.intentionalDiscon {
+					l.eventDB.checkIdle(l.email)
+				}
+			})
+		}
+		return nil
+	})
+}
+
+func (l *localDBSession) ReportActive() error {
+	return l.genericOperation("report active", func() error {
+		l.lock.Lock()
+		l.idleSince = time.Time{}
+		l.lock.Unlock()
+		l.eventDB.checkIdle(l.email)
+		l.eventDB.publishPresence(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) LookupUser(email string) (res *LookupResult, err error) {
+	err = l.genericOperation("lookup user", func() error {
+		if !l.eventDB.allowLookup(l.email) {
+			return ErrRateLimited
+		}
+		self, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		other, err := l.eventDB.db.GetUserInfo(strings.TrimSpace(email))
+		if RootError(err) == statusdb.ErrNoEmail && l.eventDB.isRemote(email) {
+			// Only the user's home server knows if they exist.
+			res = &LookupResult{Email: strings.TrimSpace(email), Registered: true,
+				Requestable: true}
+			return nil
+		} else if RootError(err) == statusdb.ErrNoEmail || (err == nil && statusdb.HasBlocked(other, self)) {
+			// Users who blocked us are indistinguishable from
+			// users who do not exist.
+			res = &LookupResult{Email: email}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		res = &LookupResult{Email: other.Email, Registered: true}
+		if reason := statusdb.RequestBlocker(self, other); reason != nil {
+			res.Reason, _ = DescribeError(reason)
+		} else {
+			res.Requestable = true
+		}
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) SetProfile(profile statusdb.Profile) error {
+	return l.auditedOperation("set profile", "", func() error {
+		if err := l.eventDB.db.SetProfile(l.email, profile); err != nil {
+			return err
+		}
+		l.eventDB.broadcastProfile(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) GetProfile(email string) (profile statusdb.Profile, err error) {
+	err = l.genericOperation("get profile", func() error {
+		if !statusdb.EmailsEquivalent(email, l.email) {
+			if !l.isBuddy(email) {
+				return statusdb.ErrNotBuddies
+			} else if l.eventDB.hasBlocked(email, l.email) {
+				return statusdb.ErrBlocked
+			}
+		}
+		info, err := l.eventDB.db.GetUserInfo(email)
+		if err != nil {
+			return err
+		}
+		profile = l.eventDB.presentProfile(info.Email, info.Profile)
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) SetAwayNote(note string) error {
+	return l.auditedOperation("set away note", "", func() error {
+		if err := l.eventDB.db.SetAwayNote(l.email, note); err != nil {
+			return err
+		}
+		l.eventDB.resyncUser(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) GetAwayNote(email string) (note string, err error) {
+	err = l.genericOperation("get away note", func() error {
+		self := statusdb.EmailsEquivalent(email, l.email)
+		if !self {
+			if !l.isBuddy(email) {
+				return statusdb.ErrNotBuddies
+			} else if l.eventDB.hasBlocked(email, l.email) {
+				return statusdb.ErrBlocked
+			}
+		}
+		info, err := l.eventDB.db.GetUserInfo(email)
+		if err != nil {
+			return err
+		}
+		if !self {
+			status := l.eventDB.maskUserStatus(email, info.LatestStatus)
+			if (status.Availability != statusdb.Away && status.Availability != statusdb.DoNotDisturb) ||
+				!info.Privacy.StatusMessage.VisibleToBuddies() {
+				return nil
+			}
+		}
+		note = info.AwayNote
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) StatusHistory(email string,
+	since time.Time) (history []statusdb.StatusHistoryEntry, err error) {
+	err = l.genericOperation("get status history", func() error {
+		info, err := l.eventDB.db.GetUserInfo(email)
+		if err != nil {
+			return err
+		}
+		self := statusdb.EmailsEquivalent(info.Email, l.email)
+		if !self && (statusdb.ContainsEmail(info.Blocked, l.email) ||
+			!info.Privacy.HistoryVisibleTo(statusdb.ContainsEmail(info.Buddies, l.email))) {
+			return statusdb.ErrHistoryHidden
+		}
+		history = []statusdb.StatusHistoryEntry{}
+		for _, entry := range info.StatusHistory {
+			if entry.Time.Before(since) {
+				continue
+			}
+			if !self && !info.Privacy.StatusMessage.VisibleToBuddies() {
+				entry = entry.HideMessage()
+			}
+			history = append(history, entry)
+		}
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) SetAvatar(data []byte) error {
+	if l.eventDB.avatars == nil {
+		return ErrAvatarsDisabled
+	}
+	var hash string
+	if len(data) > 0 {
+		processed, err := ProcessAvatar(data)
+		if err != nil {
+			return err
+		}
+		hash, err = l.eventDB.avatars.Put(processed)
+		if err != nil {
+			return err
+		}
+	}
+	return l.auditedOperation("set avatar", "", func() error {
+		if err := l.eventDB.db.SetAvatar(l.email, hash); err != nil {
+			return err
+		}
+		l.eventDB.broadcastProfile(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) GetAvatar(hash string) ([]byte, error) {
+	if l.eventDB.avatars == nil {
+		return nil, ErrAvatarsDisabled
+	}
+	return l.eventDB.avatars.Get(hash)
+}
+
+func (l *localDBSession) SetCustomStates(states []statusdb.CustomState) error {
+	return l.auditedOperation("set custom states", "", func() error {
+		if err := l.eventDB.db.SetCustomStates(l.email, states); err != nil {
+			return err
+		}
+		l.eventDB.resyncLocalUser(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) SetStatus(status statusdb.UserStatus) (err error) {
+	return l.auditedOperation("set status", "", func() error {
+		policy := l.eventDB.statusPolicy
+		if policy.MaxMessageLength == 0 {
+			policy.MaxMessageLength = l.eventDB.limits.WithDefaults().MaxStatusMessageLength
+		}
+		status, err := policy.Sanitize(status)
+		if err != nil {
+			return err
+		}
+		status.Idle = false
+		if status.Emoji != "" || status.Link != "" || status.ExpiresAt != nil {
+			if !l.eventDB.featureEnabled(l.email, FeatureRichStatus) {
+				return ErrFeatureDisabled
+			}
+		}
+		if status.Custom != nil {
+			info, err := l.eventDB.db.GetUserInfo(l.email)
+			if err != nil {
+				return err
+			}
+			custom := findCustomState(info.CustomStates, status.Custom.Name)
+			if custom == nil {
+				return statusdb.ErrNoCustomState
+			}
+			status.Custom = custom
+			status.Availability = custom.Base
+		}
+		status.Time = time.Now()
+		if err := l.eventDB.db.SetStatus(l.email, status); err != nil {
+			return err
+		}
+		l.eventDB.recordUsage(l.email, statusdb.UsageStats{StatusChanges: 1})
+		if status.ExpiresAt != nil {
+			l.eventDB.scheduleExpiry(l.email, *status.ExpiresAt)
+		}
+		l.eventDB.broadcastNewStatus(l.email, l.eventDB.maskUserStatus(l.email, status))
+		l.eventDB.updateSuppression(l.email)
+		l.eventDB.fireWebhooks(l.email, WebhookDelivery{Event: protocol.WebhookStatusChanged,
+			Status: &status})
+		l.eventDB.exportStatus(l.email, status, "")
+		return nil
+	})
+}
+
+func (l *localDBSession) EnableTwoFactor() (secret string, codes []string, err error) {
+	err = l.auditedOperation("enable two-factor", "", func() error {
+		secret, codes, err = l.eventDB.db.EnableTwoFactor(l.email)
+		return err
+	})
+	return
+}
+
+func (l *localDBSession) DisableTwoFactor() error {
+	return l.sensitiveOperation("disable two-factor", func() error {
+		return l.eventDB.db.DisableTwoFactor(l.email)
+	})
+}
+
+func (l *localDBSession) RegenerateRecoveryCodes() (codes []string, err error) {
+	err = l.sensitiveOperation("regenerate recovery codes", func() error {
+		codes, err = l.eventDB.db.RegenerateRecoveryCodes(l.email)
+		return err
+	})
+	return
+}
+
+func (l *localDBSession) SetEventFilter(categories []protocol.EventCategory) error {
+	return l.genericOperation("set event filter", func() error {
+		var filter map[protocol.EventCategory]bool
+		if categories != nil {
+			filter = map[protocol.EventCategory]bool{}
+			for _, category := range categories {
+				filter[category] = true
+			}
+		}
+		l.lock.Lock()
+		l.eventFilter = filter
+		l.lock.Unlock()
+		return nil
+	})
+}
+
+func (l *localDBSession) SyncSince(since time.Time) (res *Event, err error) {
+	err = l.genericOperation("sync since", func() error {
+		now := time.Now()
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		l.eventDB.stateLock.Lock()
+		started := l.eventDB.started
+		l.eventDB.stateLock.Unlock()
+		if since.Before(started) || info.ModTime.After(since) ||
+			!l.eventDB.features.Enabled(FeatureDeltaSync, info) {
+			res, err = l.fullStateEvent()
+			return err
+		}
+		statuses, err := l.eventDB.db.GetStatuses(info.Buddies)
+		if err != nil {
+			return err
+		}
+		announcements, err := l.eventDB.db.Announcements()
+		if err != nil {
+			return err
+		}
+		res = &Event{
+			Type:          EventSyncDelta,
+			UserInfo:      info,
+			Time:          now,
+			Announcements: activeAnnouncements(announcements, now),
+		}
+		for i, buddy := range info.Buddies {
+			// A buddy deleted since the info was read is
+			// left to the EventBuddyRemoved which follows.
+			if statuses[i].Err != nil {
+				continue
+			}
+			buddyInfo, err := l.eventDB.db.GetUserInfo(buddy)
+			if RootError(err) == statusdb.ErrNoEmail {
+				continue
+			} else if err != nil {
+				return err
+			}
+			status := statuses[i].Status
+			l.eventDB.stateLock.Lock()
+			presenceTime := l.eventDB.presenceTimes[buddyInfo.Email]
+			l.eventDB.stateLock.Unlock()
+			if !buddyInfo.ModTime.After(since) && !status.Time.After(since) &&
+				!buddyInfo.LastSeen.After(since) && !presenceTime.After(since) {
+				continue
+			}
+			res.Buddies = append(res.Buddies, buddy)
+			if statusdb.HasBlocked(buddyInfo, info) {
+				res.BuddyStatuses = append(res.BuddyStatuses,
+					statusdb.UserStatus{Availability: statusdb.Offline, Time: now})
+				res.BuddyProfiles = append(res.BuddyProfiles, statusdb.Profile{})
+			} else {
+				res.BuddyStatuses = append(res.BuddyStatuses,
+					l.eventDB.maskUserStatus(buddy, status))
+				res.BuddyProfiles = append(res.BuddyProfiles,
+					l.eventDB.presentProfile(buddyInfo.Email, buddyInfo.Profile))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) DeleteAccount(password, code string) error {
+	if err := l.eventDB.db.CheckLogin(l.email, password); err != nil {
+		return essentials.AddCtx("delete account", err)
+	}
+	if err := l.eventDB.db.CheckTwoFactor(l.email, code); err != nil {
+		return essentials.AddCtx("delete account", err)
+	}
+	// The user's buddies and requesters are told, so every
+	// user may be involved.
+	return l.lockedOperation("delete account", l.eventDB.lockAll(),
+		l.audited("delete account", "", func() error {
+			return l.eventDB.deleteUser(l.email)
+		}))
+}
+
+func (l *localDBSession) Close() (err error) {
+	defer l.eventDB.lockUsers(l.email)()
+	defer essentials.AddCtxTo("close DBSession", &err)
+	if l.closed {
+		return ErrNotOpen
+	}
+	l.closed = true
+	if l.expiry != nil {
+		l.expiry.Stop()
+	}
+	if l.intentionalDiscon {
+		return nil
+	}
+	if !l.eventDB.removeSession(l) {
+		panic("internal inconsistency: DBSession missing from list")
+	}
+	l.eventDB.sessionsEnded(l.email)
+	if !l.invisible && !l.eventDB.userOnline(l.email) {
+		l.eventDB.userWentOffline(l.email)
+	}
+	l.eventDB.publishPresence(l.email)
+	return nil
+}
+
+func (l *localDBSession) ID() string {
+	return l.id
+}
+
+func (l *localDBSession) SetRemoteAddr(addr string) {
+	defer l.eventDB.lockUsers(l.email)()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.remoteAddr = addr
+}
+
+func (l *localDBSession) DisconnectOthers() error {
+	return l.auditedOperation("disconnect others", "", func() error {
+		l.eventDB.disconnectUser(l.email, l, "")
+		l.eventDB.publishPresence(l.email)
+		return nil
+	})
+}
+
+func (l *localDBSession) genericOperation(ctx string, f func() error) error {
+	return l.lockedOperation(ctx, l.eventDB.lockUsers(l.email), f)
+}
+
+// lockedOperation runs an operation once the caller has
+// taken the locks which unlock releases.
+func (l *localDBSession) lockedOperation(ctx string, unlock func(), f func() error) (err error) {
+	defer essentials.AddCtxTo(ctx, &err)
+	defer unlock()
+	if l.closed {
+		return ErrNotOpen
+	} else if l.intentionalDiscon {
+		return ErrIntentionalDisconnect
+	} else {
+		err := f()
+		l.eventDB.countError(err)
+		return err
+	}
+}
+
+// sensitiveOperation is like genericOperation, but fails
+// if the user has not authenticated recently.
+//
+// Since sensitive operations change the user's account,
+// they are always audited.
+func (l *localDBSession) sensitiveOperation(ctx string, f func() error) error {
+	return l.auditedOperation(ctx, "", func() error {
+		window := l.eventDB.reauthWindow
+		if window == 0 {
+			window = DefaultReauthWindow
+		}
+		if time.Since(l.authTime) > window {
+			return ErrReauthRequired
+		}
+		return f()
+	})
+}
+
+// pushEvent queues an event for the session, unless the
+// session is withholding or filtering out such events.
+func (l *localDBSession) pushEvent(e *Event) {
+	if !l.wants(e) {
+		return
+	}
+	l.eventDB.shard(l.email).enqueue(delivery{kind: deliverEvent, sess: l, event: e})
+}
+
+// wants checks that the session is neither withholding
+// nor filtering out an event.
+func (l *localDBSession) wants(e *Event) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.suppressEvents && e.suppressible() {
+		return false
+	}
+	category := e.category()
+	return l.eventFilter == nil || category == "" || l.eventFilter[category]
+}
+
+// visible checks if the session makes its user appear
+// online.
+func (l *localDBSession) visible() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return !l.invisible
+}
+
+// resync queues a full state to replace the session's
+// backlog.
+func (l *localDBSession) resync() {
+	l.eventDB.shard(l.email).enqueue(delivery{kind: deliverResync, sess: l})
+}
+
+// clearAndPush queues an event to replace the session's
+// backlog.
+func (l *localDBSession) clearAndPush(e *Event) {
+	l.eventDB.shard(l.email).enqueue(delivery{kind: deliverReplace, sess: l, event: e})
+}
+
+// replaceBacklog replaces the session's backlog with a
+// full-state event, unless the session has ended.
+//
+// Priority events in the backlog or in dropped are kept,
+// and are delivered along with the full state.
+//
+// It is called by the session's shard, and locks the
+// session's user while building the full state.
+func (l *localDBSession) replaceBacklog(dropped ...*Event) {
+	unlock := l.eventDB.lockUsers(l.email)
+	if l.closed || l.intentionalDiscon {
+		unlock()
+		return
+	}
+	if len(dropped) > 0 {
+		l.eventDB.countDrop(l.email)
+	}
+	newEvent, err := l.fullStateEvent()
+	unlock()
+	if err != nil {
+		newEvent = &Event{Type: EventSyncError, ErrorMessage: err.Error()}
+	}
+	for drained := false; !drained; {
+		select {
+		case e := <-l.events:
+			newEvent.Priority = append(newEvent.Priority, e.Priority...)
+			if e.priority() {
+				newEvent.Priority = append(newEvent.Priority, e)
+			}
+		default:
+			drained = true
+		}
+	}
+	for _, e := range dropped {
+		if e.priority() {
+			newEvent.Priority = append(newEvent.Priority, e)
+		}
+	}
+	l.clearBacklog(newEvent)
+}
+
+// clearBacklog replaces the session's backlog with an
+// event. It is called by the session's shard.
+func (l *localDBSession) clearBacklog(e *Event) {
+	for {
+		select {
+		case <-l.events:
+		default:
+			l.events <- e
+			return
+		}
+	}
+}
+
+func (l *localDBSession) fullStateEvent() (*Event, error) {
+	now := time.Now()
+	userInfo, err := l.eventDB.db.GetUserInfo(l.email)
+	if err != nil {
+		return nil, err
+	}
+	states, err := l.eventDB.db.GetBuddyStates(l.email, userInfo.Buddies)
+	if err != nil {
+		return nil, err
+	}
+	announcements, err := l.eventDB.db.Announcements()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]statusdb.UserStatus, len(states))
+	profiles := make([]statusdb.Profile, len(states))
+	for i := range states {
+		state := &states[i]
+		if state.Blocking {
+			statuses[i] = offlineStatus(time.Time{})
+			continue
+		}
+		statuses[i] = l.eventDB.maskBuddyState(state)
+		profiles[i] = l.eventDB.presentProfile(state.Email, state.Profile)
+	}
+	userInfo.Profile = l.eventDB.presentProfile(userInfo.Email, userInfo.Profile)
+	return &Event{
+		Type:          EventFullState,
+		UserInfo:      userInfo,
+		BuddyStatuses: statuses,
+		BuddyProfiles: profiles,
+		Time:          now,
+		Announcements: activeAnnouncements(announcements, now),
+	}, nil
+}
+
+func (l *localDBSession) isBuddy(email string) bool {
+	info, err := l.eventDB.db.GetUserInfo(l.email)
+	return err == nil && statusdb.ContainsEmail(info.Buddies, email)
+}
+
+func findCustomState(states []statusdb.CustomState, name string) *statusdb.CustomState {
+	for _, state := range states {
+		if state.Name == name {
+			return &state
+		}
+	}
+	return nil
+}
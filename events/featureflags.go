@@ -0,0 +1,86 @@
+package events
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+var ErrFeatureDisabled = errors.New("feature not enabled for this user")
+
+const (
+	// FeatureDeltaSync allows SyncSince to return deltas.
+	// Without it, SyncSince always returns the full state.
+	FeatureDeltaSync statusdb.Feature = "delta_sync"
+
+	// FeatureRichStatus allows emoji, links, and expiry
+	// times in statuses.
+	FeatureRichStatus statusdb.Feature = "rich_status"
+)
+
+// FeatureFlags decides which users have each Feature.
+//
+// The zero value enables every feature for everyone.
+type FeatureFlags struct {
+	// Rollout maps features to the percentage of users,
+	// from 0 to 100, who have them.
+	// Features which are not listed are enabled for
+	// everyone.
+	Rollout map[statusdb.Feature]int
+}
+
+// Enabled checks if a user has a feature.
+//
+// The user's overrides take precedence over the rollout.
+// Users are assigned to a rollout by a hash of their email,
+// so a user keeps a feature as the percentage grows.
+func (f *FeatureFlags) Enabled(feature statusdb.Feature, user *statusdb.UserInfo) bool {
+	if enabled, ok := user.FeatureOverrides[feature]; ok {
+		return enabled
+	}
+	percent, ok := f.Rollout[feature]
+	if !ok {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(string(feature) + ":" + user.Email))
+	return int(hash.Sum32()%100) < percent
+}
+
+// ParseRollout parses a comma-separated list of features
+// and percentages, such as "delta_sync=10,rich_status=50".
+func ParseRollout(s string) (map[statusdb.Feature]int, error) {
+	res := map[statusdb.Feature]int{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, &statusdb.ValidationError{Field: "rollout", Reason: "expected feature=percent"}
+		}
+		percent, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, &statusdb.ValidationError{Field: "rollout", Reason: "percent must be from 0 to 100"}
+		}
+		res[statusdb.Feature(strings.TrimSpace(parts[0]))] = percent
+	}
+	return res, nil
+}
+
+// featureEnabled checks if a user has a feature, treating
+// missing users as not having it.
+func (l *localEventDB) featureEnabled(email string, feature statusdb.Feature) bool {
+	info, err := l.db.GetUserInfo(email)
+	return err == nil && l.features.Enabled(feature, info)
+}
+
+func (l *localDBSession) FeatureEnabled(feature statusdb.Feature) bool {
+	l.eventDB.lock.RLock()
+	defer l.eventDB.lock.RUnlock()
+	return l.eventDB.featureEnabled(l.email, feature)
+}
@@ -0,0 +1,172 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var (
+	// ErrRemoteUser is returned when registering an email
+	// address which belongs to another server.
+	ErrRemoteUser = errors.New("this address belongs to another server")
+
+	ErrInvalidRelay = errors.New("invalid relayed change")
+)
+
+type RelayType string
+
+const (
+	RelayRequest RelayType = "request"
+	RelayAccept  RelayType = "accept"
+	RelayDecline RelayType = "decline"
+	RelayCancel  RelayType = "cancel"
+	RelayRemove  RelayType = "remove"
+	RelayBlock   RelayType = "block"
+	RelayUnblock RelayType = "unblock"
+	RelayStatus  RelayType = "status"
+)
+
+// A RelayMessage is a change made by a user, which is sent
+// to the home server of another user involved in it.
+type RelayMessage struct {
+	Type RelayType `json:"type"`
+
+	// From is the user who made the change, on the sending
+	// server, and To is the user on the receiving server.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// For request messages.
+	Greeting string `json:"greeting,omitempty"`
+
+	// For status messages. The status is masked as the
+	// sender's buddies should see it.
+	Status *statusdb.UserStatus `json:"status,omitempty"`
+}
+
+// A Relay connects an EventDB to the servers of other
+// domains, so that their users can be buddies with ours.
+//
+// Users of other servers are stored in the DB as remote
+// users, which cannot log in. Their relationships mirror
+// those stored by their home servers, and their statuses
+// are the last ones relayed.
+type Relay interface {
+	// Home gets the domain of the server which a user
+	// belongs to, or "" if they belong to this server.
+	Home(email string) string
+
+	// Send delivers a message to another server.
+	//
+	// It is called while the EventDB is locked, so it must
+	// not block.
+	Send(domain string, msg *RelayMessage)
+}
+
+func (l *localEventDB) ApplyRelay(msg *RelayMessage) (err error) {
+	defer essentials.AddCtxTo("apply relay", &err)
+	if l.relay == nil || !l.isRemote(msg.From) || l.isRemote(msg.To) {
+		return ErrInvalidRelay
+	}
+	if msg.Type == RelayRequest || msg.Type == RelayBlock {
+		if err := l.addRemoteUser(msg.From); err != nil {
+			return err
+		}
+	}
+
+	// The remote user acts through a session which is not
+	// connected to any client.
+	sess := &localDBSession{
+		eventDB:    l,
+		id:         "relay",
+		email:      msg.From,
+		remoteAddr: l.relay.Home(msg.From),
+	}
+	switch msg.Type {
+	case RelayRequest:
+		return sess.SendRequest(msg.To, msg.Greeting)
+	case RelayAccept:
+		return sess.AcceptRequest(msg.To)
+	case RelayDecline:
+		return sess.DeclineRequest(msg.To)
+	case RelayCancel:
+		return sess.CancelRequest(msg.To)
+	case RelayRemove:
+		return sess.DeleteBuddy(msg.To)
+	case RelayBlock:
+		return sess.BlockUser(msg.To)
+	case RelayUnblock:
+		return sess.UnblockUser(msg.To)
+	case RelayStatus:
+		if msg.Status == nil {
+			return ErrInvalidRelay
+		}
+		return sess.genericOperation("relay status", func() error {
+			return l.applyRemoteStatus(msg.From, msg.To, *msg.Status)
+		})
+	}
+	return ErrInvalidRelay
+}
+
+// applyRemoteStatus stores the status of a remote user and
+// sends it to one of their buddies.
+func (l *localEventDB) applyRemoteStatus(from, to string, status statusdb.UserStatus) error {
+	info, err := l.db.GetUserInfo(to)
+	if err != nil {
+		return err
+	} else if !statusdb.ContainsEmail(info.Buddies, from) {
+		return statusdb.ErrNotBuddies
+	}
+	if err := l.db.SetStatus(from, status); err != nil {
+		return err
+	}
+	l.pushToUser(to, &Event{Type: EventStatusChanged, Email: from, Status: status})
+	return nil
+}
+
+// isRemote checks if a user belongs to another server.
+func (l *localEventDB) isRemote(email string) bool {
+	return l.relay != nil && l.relay.Home(email) != ""
+}
+
+// addRemoteUser stores a user of another server, if they
+// are not stored already.
+func (l *localEventDB) addRemoteUser(email string) error {
+	_, err := l.db.ImportUsers([]*statusdb.UserInfo{{
+		Email:   email,
+		Remote:  true,
+		ModTime: time.Now(),
+	}})
+	return err
+}
+
+// relayTo sends a change to a user's home server, if they
+// belong to another server.
+func (l *localEventDB) relayTo(msg *RelayMessage) {
+	if l.relay == nil {
+		return
+	}
+	if domain := l.relay.Home(msg.To); domain != "" {
+		l.relay.Send(domain, msg)
+	}
+}
+
+// relayStatus sends a user's status to their buddies on
+// other servers.
+func (l *localEventDB) relayStatus(email string, status statusdb.UserStatus) {
+	if l.relay == nil || l.isRemote(email) {
+		return
+	}
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return
+	}
+	for _, buddy := range info.Buddies {
+		if !statusdb.ContainsEmail(info.Blocked, buddy) {
+			l.relayTo(&RelayMessage{Type: RelayStatus, From: info.Email, To: buddy, Status: &status})
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// Provider names of the supported services.
+const (
+	IntegrationSlack        = "slack"
+	IntegrationDiscord      = "discord"
+	IntegrationAlertmanager = "alertmanager"
+)
+
+var (
+	ErrUnknownProvider   = errors.New("unsupported integration provider")
+	ErrExportUnsupported = errors.New("statuses cannot be exported to this provider")
+)
+
+// An IntegrationError is returned when another service
+// rejects a request, such as to connect an integration or
+// to read contacts.
+type IntegrationError struct {
+	Provider string
+	Err      error
+}
+
+func (i *IntegrationError) Error() string {
+	return i.Provider + ": " + i.Err.Error()
+}
+
+// A StatusProvider synchronizes users' statuses with
+// another service, such as Slack.
+//
+// Its methods make network requests, so they are never
+// called while users are locked.
+type StatusProvider interface {
+	// AuthorizeURL is the page where a user authorizes the
+	// server to use the service on their behalf, which
+	// then redirects them to redirectURI with a code.
+	AuthorizeURL(redirectURI string) string
+
+	// Connect completes an OAuth authorization, returning
+	// an integration with an encrypted token.
+	Connect(code, redirectURI string) (statusdb.Integration, error)
+
+	// Fetch gets the user's status on the service, along
+	// with a version which changes whenever it does.
+	// An empty version means that there is no status to
+	// import, such as when the user is offline.
+	Fetch(in statusdb.Integration) (status statusdb.UserStatus, version string, err error)
+
+	// CanExport checks if Publish is supported.
+	CanExport() bool
+
+	// Publish sets the user's status on the service.
+	Publish(in statusdb.Integration, status statusdb.UserStatus) error
+
+	// Disconnect revokes the integration's token.
+	Disconnect(in statusdb.Integration) error
+}
+
+// A StatusNotifier is a StatusProvider which learns of
+// status changes as they happen, such as through a
+// persistent connection, rather than only when polled.
+type StatusNotifier interface {
+	StatusProvider
+
+	// Changes receives a value after statuses change, so
+	// that the leader may import them right away.
+	Changes() <-chan struct{}
+}
+
+func (l *localEventDB) SyncIntegrations() error {
+	return l.syncIntegrations("")
+}
+
+// syncIntegrations imports changed statuses from one
+// provider, or from every provider if it is empty.
+func (l *localEventDB) syncIntegrations(provider string) error {
+	if len(l.integrations) == 0 {
+		return nil
+	}
+	users, err := l.db.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		for _, in := range user.Integrations {
+			p := l.integrations[in.Provider]
+			if !in.Import || p == nil || (provider != "" && in.Provider != provider) {
+				continue
+			}
+			status, version, err := p.Fetch(in)
+			if err != nil {
+				statusdb.LogAt(statusdb.LogWarn, "fetch %s status of %s: %v", in.Provider,
+					user.Email, err)
+				continue
+			}
+			if version != "" && version != in.LastSync {
+				l.importStatus(user.Email, in, status, version)
+			}
+		}
+	}
+	return nil
+}
+
+// watchIntegrations imports statuses from every
+// StatusNotifier as they change, while this node leads.
+func (l *localEventDB) watchIntegrations() {
+	for name, provider := range l.integrations {
+		notifier, ok := provider.(StatusNotifier)
+		if !ok {
+			continue
+		}
+		go func(name string, notifier StatusNotifier) {
+			for range notifier.Changes() {
+				if !l.IsLeader() {
+					continue
+				}
+				if err := l.syncIntegrations(name); err != nil {
+					statusdb.LogAt(statusdb.LogWarn, "sync %s: %v", name, err)
+				}
+			}
+		}(name, notifier)
+	}
+}
+
+// importStatus sets a user's status from an integration,
+// unless the integration was changed while its status was
+// being fetched.
+func (l *localEventDB) importStatus(email string, in statusdb.Integration,
+	status statusdb.UserStatus, version string) {
+	defer l.lockUsers(email)()
+	if !l.recordSync(email, in, version) {
+		return
+	}
+	policy := l.statusPolicy
+	if policy.MaxMessageLength == 0 {
+		policy.MaxMessageLength = l.limits.WithDefaults().MaxStatusMessageLength
+	}
+	status, err := policy.Sanitize(status)
+	if err != nil {
+		statusdb.LogAt(statusdb.LogWarn, "import %s status of %s: %v", in.Provider, email, err)
+		return
+	}
+	if !l.featureEnabled(email, FeatureRichStatus) {
+		status.Emoji = ""
+		status.Link = ""
+		status.ExpiresAt = nil
+	}
+	l.setStatusFrom(email, status, in.Provider)
+	if status.ExpiresAt != nil {
+		l.scheduleExpiry(email, *status.ExpiresAt)
+	}
+}
+
+// recordSync stores the version of the status last seen
+// on an integration's service, returning false if the
+// integration has since been replaced or removed.
+//
+// The caller must hold the user's lock.
+func (l *localEventDB) recordSync(email string, in statusdb.Integration, version string) bool {
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return false
+	}
+	current := info.FindIntegration(in.Provider)
+	if current == nil || !current.Connected.Equal(in.Connected) {
+		return false
+	}
+	updated := *current
+	updated.LastSync = version
+	return l.db.SetIntegration(email, updated) == nil
+}
+
+// exportStatus publishes a user's new status in the
+// background to their integrations, except for the one
+// which the status came from.
+func (l *localEventDB) exportStatus(email string, status statusdb.UserStatus, source string) {
+	if len(l.integrations) == 0 {
+		return
+	}
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return
+	}
+	for _, in := range info.Integrations {
+		provider := l.integrations[in.Provider]
+		if in.Export && in.Provider != source && provider != nil {
+			go l.publishStatus(email, provider, in, status)
+		}
+	}
+}
+
+// publishStatus sets a user's status on another service,
+// and then records the resulting version so that the
+// status is not imported back.
+func (l *localEventDB) publishStatus(email string, provider StatusProvider,
+	in statusdb.Integration, status statusdb.UserStatus) {
+	if err := provider.Publish(in, status); err != nil {
+		statusdb.LogAt(statusdb.LogWarn, "publish %s status of %s: %v", in.Provider, email, err)
+		return
+	}
+	if !in.Import {
+		return
+	}
+	_, version, err := provider.Fetch(in)
+	if err != nil {
+		return
+	}
+	defer l.lockUsers(email)()
+	l.recordSync(email, in, version)
+}
+
+// disconnectIntegrations revokes the tokens of a user's
+// integrations in the background.
+func (l *localEventDB) disconnectIntegrations(integrations []statusdb.Integration) {
+	for _, in := range integrations {
+		if provider := l.integrations[in.Provider]; provider != nil {
+			go func(in statusdb.Integration) {
+				if err := provider.Disconnect(in); err != nil {
+					statusdb.LogAt(statusdb.LogWarn, "disconnect %s: %v", in.Provider, err)
+				}
+			}(in)
+		}
+	}
+}
+
+func (l *localDBSession) IntegrationURL(provider, redirectURI string) (string, error) {
+	p := l.eventDB.integrations[provider]
+	if p == nil {
+		return "", ErrUnknownProvider
+	}
+	return p.AuthorizeURL(redirectURI), nil
+}
+
+func (l *localDBSession) ConnectIntegration(provider, code, redirectURI string, importStatus,
+	exportStatus bool) (in statusdb.Integration, err error) {
+	p := l.eventDB.integrations[provider]
+	if p == nil {
+		return in, ErrUnknownProvider
+	} else if exportStatus && !p.CanExport() {
+		return in, ErrExportUnsupported
+	}
+	in, err = p.Connect(code, redirectURI)
+	if err != nil {
+		return in, &IntegrationError{Provider: provider, Err: RootError(err)}
+	}
+	in.Provider = provider
+	in.Import = importStatus
+	in.Export = exportStatus
+	in.Connected = time.Now()
+	err = l.auditedOperation("connect integration", "", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		if old := info.FindIntegration(provider); old != nil {
+			l.eventDB.disconnectIntegrations([]statusdb.Integration{*old})
+		}
+		if err := l.eventDB.db.SetIntegration(l.email, in); err != nil {
+			return err
+		}
+		if exportStatus {
+			l.eventDB.exportStatus(l.email, info.LatestStatus, "")
+		}
+		return nil
+	})
+	if err != nil {
+		l.eventDB.disconnectIntegrations([]statusdb.Integration{in})
+		return statusdb.Integration{}, err
+	}
+	in.Token = ""
+	return in, nil
+}
+
+func (l *localDBSession) DisconnectIntegration(provider string) error {
+	return l.auditedOperation("disconnect integration", "", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		in := info.FindIntegration(provider)
+		if in == nil {
+			return statusdb.ErrNoIntegration
+		}
+		if err := l.eventDB.db.RemoveIntegration(l.email, provider); err != nil {
+			return err
+		}
+		l.eventDB.disconnectIntegrations([]statusdb.Integration{*in})
+		return nil
+	})
+}
+
+func (l *localDBSession) ListIntegrations() (integrations []statusdb.Integration, err error) {
+	err = l.genericOperation("list integrations", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		for _, in := range info.Integrations {
+			in.Token = ""
+			integrations = append(integrations, in)
+		}
+		return nil
+	})
+	return
+}
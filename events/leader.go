@@ -0,0 +1,153 @@
+package events
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+const (
+	// LeaderLease is the time for which a node remains the
+	// leader of a cluster after renewing its lease, and so
+	// the longest that the cluster goes without a leader
+	// when the leader dies.
+	LeaderLease = 15 * time.Second
+
+	// LeaderRenewInterval is the time between attempts to
+	// take or renew the leader's lease.
+	LeaderRenewInterval = LeaderLease / 3
+)
+
+// leaderLeaseName names the leader's lease in the DB.
+const leaderLeaseName = "leader"
+
+// RunElection campaigns for the leadership of the cluster
+// until stop is closed or the EventDB is drained, after
+// which the lease is released so that another node can
+// take over right away.
+//
+// Nodes which share a DB elect one leader through a lease
+// in the DB. A node which runs alone always leads.
+func (l *localEventDB) RunElection(stop <-chan struct{}) {
+	ticker := time.NewTicker(LeaderRenewInterval)
+	defer ticker.Stop()
+	defer l.resign()
+	for !l.isDraining() {
+		l.campaign()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// IsLeader checks if the node holds an unexpired lease on
+// the leadership of the cluster.
+func (l *localEventDB) IsLeader() bool {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return time.Now().Before(l.leaderUntil)
+}
+
+// campaign takes or renews the leader's lease.
+func (l *localEventDB) campaign() {
+	// The lease is counted from before the request, so
+	// that it never outlasts the copy in the DB.
+	start := time.Now()
+	acquired, err := l.db.AcquireLease(leaderLeaseName, l.nodeID, LeaderLease)
+	if err != nil {
+		statusdb.LogAt(statusdb.LogWarn, "leader election: %v", err)
+	}
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	wasLeader := time.Now().Before(l.leaderUntil)
+	if acquired {
+		l.leaderUntil = start.Add(LeaderLease)
+	}
+	if acquired && !wasLeader {
+		statusdb.LogAt(statusdb.LogInfo, "node %s became the leader", l.nodeID)
+	}
+}
+
+// resign stops leading and releases the lease.
+func (l *localEventDB) resign() {
+	l.stateLock.Lock()
+	l.leaderUntil = time.Time{}
+	l.stateLock.Unlock()
+	if err := l.db.ReleaseLease(leaderLeaseName, l.nodeID); err != nil {
+		statusdb.LogAt(statusdb.LogWarn, "leader election: %v", err)
+	}
+}
+
+func (l *localEventDB) isDraining() bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.draining
+}
+
+// ExpireStatuses clears the rich statuses which have
+// expired, for users whose expiry timers were lost, such
+// as when the node which set the status restarted.
+func (l *localEventDB) ExpireStatuses() error {
+	users, err := l.db.ListUsers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, user := range users {
+		expiresAt := user.LatestStatus.ExpiresAt
+		if expiresAt != nil && !now.Before(*expiresAt) {
+			l.expireStatus(user.Email, *expiresAt)
+		}
+	}
+	return nil
+}
+
+// PurgeStaleAccounts deletes the accounts which have been
+// neither used nor changed for maxAge, and returns the
+// number deleted.
+//
+// Administrators, remote users, users with sessions on any
+// node, and users from before registrations were dated are
+// never purged.
+func (l *localEventDB) PurgeStaleAccounts(maxAge time.Duration) (purged int, err error) {
+	users, err := l.db.ListUsers()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, user := range users {
+		if user.Admin || user.Remote || user.ModTime.IsZero() ||
+			!user.ModTime.Before(cutoff) || !user.Stats.LastActivity.Before(cutoff) {
+			continue
+		}
+		deleted, err := l.purgeAccount(user.Email)
+		if err != nil {
+			return purged, err
+		} else if deleted {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// purgeAccount deletes a stale user unless they have come
+// online since they were found to be stale.
+func (l *localEventDB) purgeAccount(email string) (deleted bool, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if sessions, _ := l.peerSessions(email); sessions > 0 || len(l.userSessions(email)) > 0 {
+		return false, nil
+	}
+	err = l.deleteUser(email)
+	if RootError(err) == statusdb.ErrNoEmail {
+		return false, nil
+	}
+	entry := AuditEntry{Actor: ActorServer, Action: "purge stale account", Target: email}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	l.RecordAudit(entry)
+	return err == nil, err
+}
@@ -0,0 +1,63 @@
+package events
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ReconnectGrace is the time that a user whose session
+// reached its maximum lifetime keeps appearing online while
+// the client reconnects.
+const ReconnectGrace = 30 * time.Second
+
+// scheduleSessionExpiry starts a timer to end a session
+// once it reaches the maximum lifetime, if there is one.
+//
+// Lifetimes are randomized by up to 10% in either direction
+// so that clients which connected together, such as after a
+// restart, do not all reconnect at once.
+func (l *localEventDB) scheduleSessionExpiry(sess *localDBSession) {
+	if l.maxLifetime == 0 {
+		return
+	}
+	spread := int64(l.maxLifetime / 5)
+	lifetime := l.maxLifetime - time.Duration(spread/2) + time.Duration(rand.Int63n(spread+1))
+	sess.expiry = time.AfterFunc(lifetime, func() {
+		l.expireSession(sess)
+	})
+}
+
+// expireSession asks a session's client to reconnect, the
+// same way as Drain, and ends the session.
+func (l *localEventDB) expireSession(sess *localDBSession) {
+	defer l.lockUsers(sess.email)()
+	if !l.removeSession(sess) {
+		return
+	}
+	sess.intentionalDiscon = true
+	sess.clearAndPush(&Event{Type: EventReconnect})
+	l.sessionsEnded(sess.email)
+	if sess.invisible || l.userOnline(sess.email) {
+		l.publishPresence(sess.email)
+		return
+	}
+	email := sess.email
+	l.stateLock.Lock()
+	if l.reconnecting == nil {
+		l.reconnecting = map[string]bool{}
+	}
+	l.reconnecting[email] = true
+	l.stateLock.Unlock()
+	l.publishPresence(email)
+	time.AfterFunc(ReconnectGrace, func() {
+		defer l.lockUsers(email)()
+		l.stateLock.Lock()
+		reconnecting := l.reconnecting[email]
+		delete(l.reconnecting, email)
+		l.stateLock.Unlock()
+		if reconnecting {
+			l.userWentOffline(email)
+			l.publishPresence(email)
+		}
+	})
+}
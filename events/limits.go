@@ -0,0 +1,60 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+var ErrTooManySessions = errors.New("too many sessions")
+
+func (l *localEventDB) Limits() statusdb.Limits {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.limits.WithDefaults()
+}
+
+// SetLimits changes the limits of the EventDB and its DB.
+//
+// Report rate limits apply to sessions which begin
+// afterwards.
+func (l *localEventDB) SetLimits(limits statusdb.Limits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits.WithDefaults()
+	l.db.SetLimits(l.limits)
+}
+
+// sessionLimiter creates the report rate limiter for a new
+// session.
+func (l *localEventDB) sessionLimiter() statusdb.RateLimiter {
+	return statusdb.RateLimiter{Limit: l.limits.WithDefaults().ReportsPerHour, Window: time.Hour}
+}
+
+// allowLookup records a lookup by a user, or returns false
+// if the user has reached LookupsPerMinute.
+func (l *localEventDB) allowLookup(email string) bool {
+	limit := l.Limits().LookupsPerMinute
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	if l.lookupLimiters == nil {
+		l.lookupLimiters = map[string]*statusdb.RateLimiter{}
+	}
+	limiter := l.lookupLimiters[email]
+	if limiter == nil {
+		limiter = &statusdb.RateLimiter{Window: time.Minute}
+		l.lookupLimiters[email] = limiter
+	}
+	limiter.Limit = limit
+	return limiter.Allow(time.Now())
+}
+
+// checkSessionLimit checks that a user may begin another
+// session.
+func (l *localEventDB) checkSessionLimit(email string) error {
+	if len(l.userSessions(email)) >= l.limits.WithDefaults().MaxSessionsPerUser {
+		return ErrTooManySessions
+	}
+	return nil
+}
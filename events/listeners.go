@@ -0,0 +1,91 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// A listenerIndex maps each user to the users with
+// sessions on this node who have them as a buddy, so that
+// a change to a user only needs to be routed to the
+// sessions listening for it.
+//
+// A user's entry is set from the DB whenever one of their
+// sessions begins or they gain or lose a buddy, and is
+// removed when their last session ends.
+type listenerIndex struct {
+	lock sync.RWMutex
+
+	// listeners maps users to the local users who have
+	// them as a buddy.
+	listeners map[string]map[string]bool
+
+	// buddies maps local users to the buddies they are
+	// listed as listeners of.
+	buddies map[string][]string
+}
+
+// set replaces the buddies which a local user listens to.
+// If buddies is nil, the user stops listening altogether.
+func (x *listenerIndex) set(email string, buddies []string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, buddy := range x.buddies[email] {
+		delete(x.listeners[buddy], email)
+		if len(x.listeners[buddy]) == 0 {
+			delete(x.listeners, buddy)
+		}
+	}
+	if buddies == nil {
+		delete(x.buddies, email)
+		return
+	}
+	if x.listeners == nil {
+		x.listeners = map[string]map[string]bool{}
+		x.buddies = map[string][]string{}
+	}
+	for _, buddy := range buddies {
+		if x.listeners[buddy] == nil {
+			x.listeners[buddy] = map[string]bool{}
+		}
+		x.listeners[buddy][email] = true
+	}
+	x.buddies[email] = append([]string{}, buddies...)
+}
+
+// listenersOf gets the local users who have a user as a
+// buddy.
+func (x *listenerIndex) listenersOf(email string) []string {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	res := make([]string, 0, len(x.listeners[email]))
+	for listener := range x.listeners[email] {
+		res = append(res, listener)
+	}
+	return res
+}
+
+// refreshListeners re-reads a local user's buddies into
+// the listener index, after they may have changed.
+func (l *localEventDB) refreshListeners(email string) {
+	if !l.hasLocalSessions(email) {
+		return
+	}
+	info, err := l.db.GetUserInfo(email)
+	if RootError(err) == statusdb.ErrNoEmail {
+		// The user was deleted on another node.
+		return
+	} else if err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	l.listeners.set(email, info.Buddies)
+}
+
+// changesBuddies checks if the event means that the
+// recipient gained or lost a buddy.
+func (e *Event) changesBuddies() bool {
+	return e.Type == EventAcceptSent || e.Type == EventRequestAccepted ||
+		e.Type == EventBuddyRemoved
+}
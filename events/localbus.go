@@ -0,0 +1,68 @@
+package events
+
+import "sync"
+
+// A LocalBus connects EventDBs in the same process, such
+// as for testing a cluster or embedding several nodes.
+type LocalBus struct {
+	lock    sync.Mutex
+	members []*localBusMember
+}
+
+// Join creates a Bus for another node.
+func (l *LocalBus) Join() Bus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	m := &localBusMember{
+		bus:      l,
+		wake:     make(chan struct{}, 1),
+		messages: make(chan *BusMessage),
+	}
+	go m.deliver()
+	l.members = append(l.members, m)
+	return m
+}
+
+type localBusMember struct {
+	bus      *LocalBus
+	lock     sync.Mutex
+	queue    []*BusMessage
+	wake     chan struct{}
+	messages chan *BusMessage
+}
+
+func (m *localBusMember) Publish(msg *BusMessage) {
+	m.bus.lock.Lock()
+	defer m.bus.lock.Unlock()
+	for _, member := range m.bus.members {
+		member.enqueue(msg)
+	}
+}
+
+func (m *localBusMember) Messages() <-chan *BusMessage {
+	return m.messages
+}
+
+// enqueue adds a message without waiting for the receiver,
+// since Publish must not block.
+func (m *localBusMember) enqueue(msg *BusMessage) {
+	m.lock.Lock()
+	m.queue = append(m.queue, msg)
+	m.lock.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *localBusMember) deliver() {
+	for range m.wake {
+		m.lock.Lock()
+		queue := m.queue
+		m.queue = nil
+		m.lock.Unlock()
+		for _, msg := range queue {
+			m.messages <- msg
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+const (
+	// PasswordResetLifetime is the time for which an
+	// emailed password reset code is valid.
+	PasswordResetLifetime = time.Hour
+
+	// PasswordResetInterval is the minimum time between
+	// password reset emails to a user, so that nobody can
+	// flood a user with them.
+	PasswordResetInterval = time.Minute
+)
+
+var ErrMailDisabled = errors.New("email is not configured on this server")
+
+// A MailTemplate names an email which the server sends to
+// users.
+type MailTemplate string
+
+const (
+	// MailVerify asks a new user to verify their address
+	// with MailData.Code.
+	MailVerify MailTemplate = "verify"
+
+	// MailResetPassword gives a user MailData.Code, with
+	// which they may reset their password until
+	// MailData.Expires.
+	MailResetPassword MailTemplate = "reset_password"
+
+	// MailSecurityAlert tells a user about MailData.Alert,
+	// such as their password being changed.
+	MailSecurityAlert MailTemplate = "security_alert"
+)
+
+// MailData fills in a MailTemplate.
+//
+// Fields are only set for the templates which use them.
+type MailData struct {
+	Email   string
+	Code    string
+	Expires time.Time
+	Alert   protocol.SecurityAlert
+}
+
+// A Mailer sends templated emails to users.
+type Mailer interface {
+	Send(to string, template MailTemplate, data MailData) error
+}
+
+// beginVerification emails a new user the token to verify
+// their address, if there is a Mailer.
+//
+// If the email cannot be sent, the user is deleted again
+// so that they can register once more.
+func (l *localEventDB) beginVerification(email string) error {
+	if l.mailer == nil {
+		return nil
+	}
+	token, err := l.db.BeginVerification(email)
+	if err == nil {
+		err = l.mailer.Send(email, MailVerify, MailData{Email: email, Code: token})
+	}
+	if err != nil {
+		l.db.DeleteUser(email)
+		return err
+	}
+	return nil
+}
+
+func (l *localEventDB) RequestPasswordReset(email string) error {
+	if l.mailer == nil {
+		return ErrMailDisabled
+	}
+	info, err := l.db.GetUserInfo(email)
+	if RootError(err) == statusdb.ErrNoEmail {
+		// Unknown addresses are not revealed to the caller.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if time.Until(info.ResetExpires) > PasswordResetLifetime-PasswordResetInterval {
+		return nil
+	}
+	code, err := l.db.BeginPasswordReset(email, PasswordResetLifetime)
+	if RootError(err) == statusdb.ErrNoEmail {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return l.mailer.Send(email, MailResetPassword, MailData{
+		Email:   email,
+		Code:    code,
+		Expires: time.Now().Add(PasswordResetLifetime),
+	})
+}
+
+func (l *localEventDB) ResetPassword(email, code, newPass string) error {
+	if err := l.db.ResetPassword(email, code, newPass); err != nil {
+		return err
+	}
+	defer l.lockUsers(email)()
+	l.disconnectUser(email, nil, protocol.SecurityAlertPasswordChanged)
+	l.publishPresence(email)
+	return nil
+}
+
+// mailSecurityAlert emails a user about a security alert
+// in the background, since it may be raised while users
+// are locked.
+func (l *localEventDB) mailSecurityAlert(email string, alert protocol.SecurityAlert) {
+	if l.mailer == nil {
+		return
+	}
+	switch alert {
+	case protocol.SecurityAlertPasswordChanged, protocol.SecurityAlertSuspended, protocol.SecurityAlertAccountDeleted,
+		protocol.SecurityAlertAccountMerged:
+	default:
+		return
+	}
+	go func() {
+		err := l.mailer.Send(email, MailSecurityAlert, MailData{Email: email, Alert: alert})
+		if err != nil {
+			statusdb.LogAt(statusdb.LogWarn, "mail security alert: %v", err)
+		}
+	}()
+}
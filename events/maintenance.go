@@ -0,0 +1,20 @@
+package events
+
+// SetMaintenance enables or disables maintenance mode.
+//
+// In maintenance mode, the DB is read-only: logins and
+// reads succeed, but every change fails with
+// ErrMaintenance. Changes which the server would make on
+// its own, such as marking idle users Away, are skipped.
+func (l *localEventDB) SetMaintenance(enabled bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.maintenance = enabled
+	l.db.SetReadOnly(enabled)
+}
+
+func (l *localEventDB) Maintenance() bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.maintenance
+}
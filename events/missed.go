@@ -0,0 +1,56 @@
+package events
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// missedEventTypes maps events which should not go
+// unnoticed to the message types used to report them.
+//
+// These match the MsgType constants of the protocol.
+var missedEventTypes = map[EventType]string{
+	EventRequestReceived: "request_received",
+	EventRequestAccepted: "request_accepted",
+	EventRequestDeclined: "request_declined",
+	EventRequestCanceled: "request_canceled",
+	EventBuddyRemoved:    "buddy_removed",
+	EventServerNotice:    "server_notice",
+}
+
+// notifyUser pushes an event to the user's sessions, or
+// stores it for their next login if they have none.
+//
+// Remote users are skipped, since their own server tells
+// them about relayed changes.
+func (l *localEventDB) notifyUser(email string, event *Event) {
+	if l.isRemote(email) {
+		return
+	}
+	if hookEvent, ok := webhookEventTypes[event.Type]; ok {
+		l.fireWebhooks(email, WebhookDelivery{Event: hookEvent, Email: event.Email,
+			Greeting: event.Greeting})
+	}
+	if sessions, _ := l.peerSessions(email); sessions > 0 || l.hasLocalSessions(email) {
+		l.pushToUser(email, event)
+		return
+	}
+	msgType, ok := missedEventTypes[event.Type]
+	if !ok || l.maintenance {
+		return
+	}
+	missed := statusdb.MissedEvent{
+		Type:     msgType,
+		Email:    event.Email,
+		Greeting: event.Greeting,
+		Time:     time.Now(),
+	}
+	if event.Notice != nil {
+		missed.Text = event.Notice.Text
+	}
+	if err := l.db.AddMissedEvent(email, missed); err != nil {
+		l.cannotBroadcast()
+	}
+	l.pushMissedEvent(email, event, missed)
+}
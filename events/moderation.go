@@ -0,0 +1,122 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var (
+	ErrReportSelf    = errors.New("cannot report yourself")
+	ErrInvalidAction = errors.New("invalid moderation action")
+)
+
+const (
+	// ActionDismiss closes a report without any action.
+	ActionDismiss statusdb.ModerationAction = "dismiss"
+
+	// ActionWarn sends the reported user a warning notice.
+	ActionWarn statusdb.ModerationAction = "warn"
+
+	// ActionSuspend prevents the reported user from logging
+	// in for a period of time.
+	ActionSuspend statusdb.ModerationAction = "suspend"
+
+	// ActionShadowLimit silently stops the reported user's
+	// buddy requests from being delivered.
+	ActionShadowLimit statusdb.ModerationAction = "shadow_limit"
+)
+
+// A Resolution describes how a moderator resolves a report.
+type Resolution struct {
+	Action statusdb.ModerationAction
+
+	// Message is the warning text for ActionWarn.
+	Message string
+
+	// Duration is the suspension length for ActionSuspend.
+	Duration time.Duration
+}
+
+func (l *localEventDB) Reports() ([]statusdb.Report, error) {
+	return l.db.Reports()
+}
+
+func (l *localEventDB) ResolveReport(id string, res Resolution) (err error) {
+	defer essentials.AddCtxTo("resolve report", &err)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	reports, err := l.db.Reports()
+	if err != nil {
+		return err
+	}
+	var report *statusdb.Report
+	for i := range reports {
+		if reports[i].ID == id {
+			report = &reports[i]
+		}
+	}
+	if report == nil {
+		return statusdb.ErrNoReport
+	} else if report.Resolved() {
+		return statusdb.ErrReportResolved
+	}
+
+	switch res.Action {
+	case ActionDismiss:
+	case ActionWarn:
+		if res.Message == "" {
+			return ErrInvalidAction
+		}
+		l.notifyUser(report.Target, &Event{
+			Type: EventServerNotice,
+			Notice: &protocol.ServerNotice{
+				Level: statusdb.NoticeWarning,
+				Text:  res.Message,
+				Time:  time.Now(),
+			},
+		})
+	case ActionSuspend:
+		if res.Duration <= 0 {
+			return ErrInvalidAction
+		}
+		if err := l.db.SetSuspended(report.Target, time.Now().Add(res.Duration)); err != nil {
+			return err
+		}
+		l.disconnectUser(report.Target, nil, protocol.SecurityAlertSuspended)
+		if !l.userOnline(report.Target) {
+			l.userWentOffline(report.Target)
+		}
+		l.publishPresence(report.Target)
+	case ActionShadowLimit:
+		if err := l.db.SetShadowLimited(report.Target, true); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidAction
+	}
+	return l.db.ResolveReport(id, res.Action)
+}
+
+func (l *localDBSession) ReportUser(email, reason, evidence string) error {
+	return l.auditedOperation("report user", email, func() error {
+		if statusdb.EmailsEquivalent(email, l.email) {
+			return ErrReportSelf
+		}
+		if !l.reportLimiter.Allow(time.Now()) {
+			return ErrRateLimited
+		}
+		return l.eventDB.db.AddReport(statusdb.Report{
+			ID:       NewRandomID(),
+			Reporter: l.email,
+			Target:   email,
+			Reason:   reason,
+			Evidence: evidence,
+			Time:     time.Now(),
+		})
+	})
+}
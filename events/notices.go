@@ -0,0 +1,48 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var ErrInvalidNotice = errors.New("invalid server notice")
+
+func (l *localEventDB) BroadcastNotice(notice protocol.ServerNotice, emails []string) (err error) {
+	defer essentials.AddCtxTo("broadcast notice", &err)
+	switch notice.Level {
+	case statusdb.NoticeInfo, statusdb.NoticeWarning, statusdb.NoticeCritical:
+	default:
+		return ErrInvalidNotice
+	}
+	if notice.Text == "" {
+		return ErrInvalidNotice
+	}
+	if notice.Time.IsZero() {
+		notice.Time = time.Now()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	event := &Event{Type: EventServerNotice, Notice: &notice}
+	l.publish(&BusMessage{Type: BusNotice, Event: event, Emails: emails})
+	l.deliverNotice(event, emails)
+	return nil
+}
+
+// deliverNotice pushes a notice event to the listed users'
+// sessions on this node, or to every session if emails is
+// nil.
+func (l *localEventDB) deliverNotice(event *Event, emails []string) {
+	if emails == nil {
+		for _, sess := range l.allSessions() {
+			sess.pushEvent(event)
+		}
+		return
+	}
+	for _, email := range emails {
+		l.pushToLocalUser(email, event)
+	}
+}
@@ -0,0 +1,133 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var (
+	ErrNotPublic     = errors.New("user has not enabled public presence")
+	ErrNotSubscribed = errors.New("not subscribed to user")
+)
+
+// A publicWatcher receives the public status of a user on
+// behalf of an anonymous client.
+type publicWatcher struct {
+	email    string
+	statuses chan statusdb.UserStatus
+}
+
+// publicStatus reduces a masked status to the parts which
+// the user's privacy settings make visible to the public.
+func publicStatus(info *statusdb.UserInfo, status statusdb.UserStatus) statusdb.UserStatus {
+	res := statusdb.UserStatus{Availability: status.Availability, Time: status.Time}
+	if info.Privacy.StatusMessage == statusdb.VisibleEveryone {
+		res.Message = status.Message
+		res.Emoji = status.Emoji
+		res.Link = status.Link
+	}
+	if info.Privacy.LastSeen == statusdb.VisibleEveryone {
+		res.LastSeen = status.LastSeen
+	}
+	return res
+}
+
+func (l *localEventDB) WatchPublicStatus(email string) (statuses <-chan statusdb.UserStatus,
+	cancel func(), err error) {
+	defer essentials.AddCtxTo("watch public status", &err)
+	defer l.lockUsers(email)()
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return nil, nil, err
+	} else if !info.PublicPresence {
+		return nil, nil, ErrNotPublic
+	}
+	watcher := &publicWatcher{email: info.Email, statuses: make(chan statusdb.UserStatus, 1)}
+	watcher.statuses <- publicStatus(info, l.maskUserStatus(info.Email, info.LatestStatus))
+	l.stateLock.Lock()
+	l.publicWatchers = append(l.publicWatchers, watcher)
+	l.stateLock.Unlock()
+	cancel = func() {
+		l.stateLock.Lock()
+		defer l.stateLock.Unlock()
+		for i, w := range l.publicWatchers {
+			if w == watcher {
+				essentials.UnorderedDelete(&l.publicWatchers, i)
+				close(watcher.statuses)
+				return
+			}
+		}
+	}
+	return watcher.statuses, cancel, nil
+}
+
+// notifyPublic sends a user's new status to the sessions
+// and anonymous clients which subscribed to it without
+// being buddies.
+//
+// If the user has turned public presence off, they are
+// unsubscribed instead.
+func (l *localEventDB) notifyPublic(info *statusdb.UserInfo, status statusdb.UserStatus) {
+	if !info.PublicPresence {
+		l.endPublicPresence(info)
+		return
+	}
+	status = publicStatus(info, status)
+	event := &Event{Type: EventStatusChanged, Email: info.Email, Status: status}
+	for _, sess := range l.allSessions() {
+		sess.lock.Lock()
+		subscribed := statusdb.ContainsEmail(sess.subscriptions, info.Email)
+		sess.lock.Unlock()
+		if subscribed && !statusdb.ContainsEmail(info.Buddies, sess.email) &&
+			!statusdb.ContainsEmail(info.Blocked, sess.email) {
+			sess.pushEvent(event)
+		}
+	}
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	for _, watcher := range l.publicWatchers {
+		if statusdb.EmailsEquivalent(watcher.email, info.Email) {
+			// Only the latest status matters to a watcher.
+			select {
+			case <-watcher.statuses:
+			default:
+			}
+			watcher.statuses <- status
+		}
+	}
+}
+
+// endPublicPresence unsubscribes the sessions and
+// anonymous clients which watched a user who has turned
+// public presence off.
+//
+// Subscribed sessions are told that the user is offline
+// one last time, so that they are not left thinking the
+// user is still online.
+func (l *localEventDB) endPublicPresence(info *statusdb.UserInfo) {
+	event := &Event{
+		Type:   EventStatusChanged,
+		Email:  info.Email,
+		Status: statusdb.UserStatus{Availability: statusdb.Offline, Time: time.Now()},
+	}
+	for _, sess := range l.allSessions() {
+		subscribed := false
+		sess.lock.Lock()
+		for i, sub := range sess.subscriptions {
+			if statusdb.EmailsEquivalent(sub, info.Email) {
+				essentials.OrderedDelete(&sess.subscriptions, i)
+				subscribed = true
+				break
+			}
+		}
+		sess.lock.Unlock()
+		if subscribed && !statusdb.ContainsEmail(info.Buddies, sess.email) &&
+			!statusdb.ContainsEmail(info.Blocked, sess.email) {
+			sess.pushEvent(event)
+		}
+	}
+	l.closePublicWatchers(info.Email)
+}
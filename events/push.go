@@ -0,0 +1,87 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+var (
+	ErrPushDisabled = errors.New("push notifications are not supported")
+
+	// ErrPushGone is returned by a PushSender when the
+	// browser has unsubscribed, so the subscription should
+	// be forgotten.
+	ErrPushGone = errors.New("push subscription has expired")
+)
+
+// pushEventTypes are the missed events which are pushed to
+// a user's browsers, since they ask the user to act.
+var pushEventTypes = map[EventType]bool{
+	EventRequestReceived: true,
+	EventRequestAccepted: true,
+}
+
+// A PushSender delivers Web Push messages to browsers.
+type PushSender interface {
+	// PublicKey is the application server key which
+	// browsers subscribe with, base64url encoded.
+	PublicKey() string
+
+	// Push encrypts and sends a payload to a subscription.
+	// It fails with ErrPushGone if the subscription is no
+	// longer valid.
+	Push(sub statusdb.PushSubscription, payload []byte) error
+}
+
+// pushMissedEvent sends a missed event to the user's
+// browsers in the background, since it is raised while
+// users are locked.
+func (l *localEventDB) pushMissedEvent(email string, event *Event, missed statusdb.MissedEvent) {
+	if l.push == nil || !pushEventTypes[event.Type] {
+		return
+	}
+	info, err := l.db.GetUserInfo(email)
+	if err != nil || len(info.PushSubscriptions) == 0 {
+		return
+	}
+	payload, err := json.Marshal(missed)
+	if err != nil {
+		return
+	}
+	go func() {
+		for _, sub := range info.PushSubscriptions {
+			err := l.push.Push(sub, payload)
+			if RootError(err) == ErrPushGone {
+				l.db.RemovePushSubscription(email, sub.Endpoint)
+			} else if err != nil {
+				statusdb.LogAt(statusdb.LogWarn, "push to %s: %v", email, err)
+			}
+		}
+	}()
+}
+
+func (l *localDBSession) PushKey() (string, error) {
+	if l.eventDB.push == nil {
+		return "", ErrPushDisabled
+	}
+	return l.eventDB.push.PublicKey(), nil
+}
+
+func (l *localDBSession) AddPushSubscription(sub statusdb.PushSubscription) error {
+	if l.eventDB.push == nil {
+		return ErrPushDisabled
+	}
+	return l.auditedOperation("add push subscription", "", func() error {
+		sub.Created = time.Now()
+		return l.eventDB.db.AddPushSubscription(l.email, sub)
+	})
+}
+
+func (l *localDBSession) RemovePushSubscription(endpoint string) error {
+	return l.auditedOperation("remove push subscription", "", func() error {
+		return l.eventDB.db.RemovePushSubscription(l.email, endpoint)
+	})
+}
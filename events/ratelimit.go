@@ -0,0 +1,7 @@
+package events
+
+import (
+	"errors"
+)
+
+var ErrRateLimited = errors.New("too many requests")
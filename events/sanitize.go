@@ -0,0 +1,78 @@
+package events
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+var (
+	ErrStatusTooLong  = errors.New("status message too long")
+	ErrStatusRejected = errors.New("status message contains disallowed words")
+)
+
+// A StatusPolicy decides which status messages are
+// acceptable.
+//
+// The zero value enforces MaxStatusMessageLength and has
+// no word filter.
+type StatusPolicy struct {
+	// MaxMessageLength is the maximum number of characters
+	// in a status message.
+	// If zero, MaxStatusMessageLength is used.
+	MaxMessageLength int
+
+	// BannedWords lists words which may not appear in a
+	// status message, compared case-insensitively.
+	BannedWords []string
+
+	// Metadata, if non-nil, is the schema which
+	// UserMetadata objects must satisfy.
+	// If nil, any JSON object is accepted.
+	Metadata *statusdb.MetadataSchema
+}
+
+// Sanitize strips control characters from a status
+// message and checks that the result and the status's
+// metadata are acceptable.
+func (s *StatusPolicy) Sanitize(status statusdb.UserStatus) (statusdb.UserStatus, error) {
+	status.Message = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, status.Message)
+	status.Message = strings.TrimSpace(status.Message)
+
+	maxLen := s.MaxMessageLength
+	if maxLen == 0 {
+		maxLen = statusdb.MaxStatusMessageLength
+	}
+	if utf8.RuneCountInString(status.Message) > maxLen {
+		return status, ErrStatusTooLong
+	}
+
+	if len(s.BannedWords) > 0 {
+		words := strings.FieldsFunc(strings.ToLower(status.Message), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		for _, word := range words {
+			for _, banned := range s.BannedWords {
+				if word == strings.ToLower(banned) {
+					return status, ErrStatusRejected
+				}
+			}
+		}
+	}
+
+	if s.Metadata != nil {
+		if err := s.Metadata.Validate(status.UserMetadata); err != nil {
+			return status, err
+		}
+	}
+
+	return status, nil
+}
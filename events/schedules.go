@@ -0,0 +1,85 @@
+package events
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// ApplySchedules sets the status of each user whose
+// schedule has entered or left a window since it was last
+// applied.
+//
+// Bots and remote users do not follow schedules.
+func (l *localEventDB) ApplySchedules() error {
+	users, err := l.db.ListUsers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, user := range users {
+		if user.Bot || user.Remote || len(user.Schedule.Rules) == 0 {
+			continue
+		}
+		if window, _ := user.CurrentWindow(now); window != user.ScheduleWindow {
+			l.applySchedule(user.Email, now)
+		}
+	}
+	return nil
+}
+
+// applySchedule applies the status of the user's current
+// schedule window, unless it was applied since the user
+// was listed.
+func (l *localEventDB) applySchedule(email string, now time.Time) {
+	defer l.lockUsers(email)()
+	if l.maintenance {
+		return
+	}
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return
+	}
+	window, rule := info.CurrentWindow(now)
+	if window == info.ScheduleWindow {
+		return
+	}
+	if err := l.db.SetScheduleWindow(email, window); err != nil {
+		l.cannotBroadcast()
+		return
+	}
+	status := statusdb.UserStatus{Availability: statusdb.Available}
+	if rule != nil {
+		status.Availability = rule.Availability
+		status.Message = rule.Message
+	}
+	l.updateStatus(email, status)
+	l.updateSuppression(email)
+}
+
+func (l *localDBSession) SetSchedule(schedule statusdb.Schedule) error {
+	return l.auditedOperation("set schedule", "", func() error {
+		policy := l.eventDB.statusPolicy
+		if policy.MaxMessageLength == 0 {
+			policy.MaxMessageLength = l.eventDB.limits.WithDefaults().MaxStatusMessageLength
+		}
+		rules := make([]statusdb.ScheduleRule, len(schedule.Rules))
+		for i, rule := range schedule.Rules {
+			status, err := policy.Sanitize(statusdb.UserStatus{
+				Availability: rule.Availability,
+				Message:      rule.Message,
+			})
+			if err != nil {
+				return err
+			}
+			rule.Message = status.Message
+			rules[i] = rule
+		}
+		schedule.Rules = rules
+		if err := l.eventDB.db.SetSchedule(l.email, schedule); err != nil {
+			return err
+		}
+		l.eventDB.resyncUser(l.email)
+		return nil
+	})
+}
@@ -0,0 +1,59 @@
+package events
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+var ErrNotAdmin = errors.New("administrator privileges required")
+
+// serverStart is used to compute the server's uptime.
+var serverStart = time.Now()
+
+// ActiveConnections counts the clients being handled by
+// HandleClient, including those which have not logged in.
+var ActiveConnections int64
+
+func (l *localEventDB) ServerStats() protocol.ServerStats {
+	stats := protocol.ServerStats{
+		Connections: int(atomic.LoadInt64(&ActiveConnections)),
+	}
+	online := map[string]bool{}
+	for _, sess := range l.allSessions() {
+		stats.Sessions++
+		if sess.visible() {
+			online[sess.email] = true
+		}
+		stats.EventBacklog += len(sess.events)
+	}
+	stats.OnlineUsers = len(online)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.HeapBytes = mem.HeapAlloc
+	stats.SysBytes = mem.Sys
+	stats.Goroutines = runtime.NumGoroutine()
+	stats.UptimeSeconds = int64(time.Since(serverStart) / time.Second)
+	return stats
+}
+
+func (l *localDBSession) ServerStats() (stats protocol.ServerStats, err error) {
+	err = l.genericOperation("server stats", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		} else if !info.Admin {
+			return ErrNotAdmin
+		}
+		return nil
+	})
+	if err == nil {
+		// Computing stats does not need the user's lock.
+		stats = l.eventDB.ServerStats()
+	}
+	return
+}
@@ -0,0 +1,238 @@
+package events
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// DefaultSessionShards is the number of session shards if
+// Options.SessionShards is zero.
+const DefaultSessionShards = 16
+
+// MaxShardQueue is the number of deliveries which may wait
+// in a shard's queue. Once it is full, further events for
+// a session are replaced by a single full state, which is
+// built after the queue has been delivered.
+//
+// Priority events and the events which end sessions are
+// queued regardless, since they must not be dropped.
+const MaxShardQueue = 4096
+
+// A sessionShard holds the sessions of the users whose
+// emails hash to it.
+//
+// Events for the shard's sessions are queued and delivered
+// by the shard's own Goroutine, so that an operation does
+// not wait while events are sent to every affected session,
+// or while a full state is built for a session whose buffer
+// filled up. Since all of a user's sessions belong to one
+// shard, each session still receives its events in order.
+type sessionShard struct {
+	// lock guards sessions, which is read far more often
+	// than sessions are added or removed.
+	lock sync.RWMutex
+
+	// sessions maps emails to sessions. The slices are
+	// never modified in place, so they may be used after
+	// the lock is released.
+	sessions map[string][]*localDBSession
+
+	// queueLock guards queue, resyncs and stopped.
+	queueLock sync.Mutex
+	queue     []delivery
+	resyncs   map[*localDBSession]bool
+	stopped   bool
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+type deliveryKind int
+
+const (
+	// deliverEvent adds an event to the session's backlog,
+	// or replaces the backlog with a full state if the
+	// backlog is full.
+	deliverEvent deliveryKind = iota
+
+	// deliverResync replaces the backlog with a full state.
+	deliverResync
+
+	// deliverReplace replaces the backlog with the event.
+	deliverReplace
+)
+
+type delivery struct {
+	kind  deliveryKind
+	sess  *localDBSession
+	event *Event
+}
+
+func newSessionShards(count int) []*sessionShard {
+	if count <= 0 {
+		count = DefaultSessionShards
+	}
+	res := make([]*sessionShard, count)
+	for i := range res {
+		res[i] = &sessionShard{
+			sessions: map[string][]*localDBSession{},
+			wake:     make(chan struct{}, 1),
+			done:     make(chan struct{}),
+		}
+		go res[i].run()
+	}
+	return res
+}
+
+func (l *localEventDB) shard(email string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(email))
+	return l.shards[h.Sum32()%uint32(len(l.shards))]
+}
+
+// userSessions gets a user's sessions on this node.
+//
+// The result must not be modified.
+func (l *localEventDB) userSessions(email string) []*localDBSession {
+	s := l.shard(email)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sessions[email]
+}
+
+// allSessions gets every session on this node.
+func (l *localEventDB) allSessions() []*localDBSession {
+	var res []*localDBSession
+	for _, s := range l.shards {
+		s.lock.RLock()
+		for _, sessions := range s.sessions {
+			res = append(res, sessions...)
+		}
+		s.lock.RUnlock()
+	}
+	return res
+}
+
+func (l *localEventDB) addSession(sess *localDBSession) {
+	s := l.shard(sess.email)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sessions := s.sessions[sess.email]
+	s.sessions[sess.email] = append(sessions[:len(sessions):len(sessions)], sess)
+}
+
+// removeSession removes a session, returning false if it
+// was already removed.
+func (l *localEventDB) removeSession(sess *localDBSession) bool {
+	s := l.shard(sess.email)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var remaining []*localDBSession
+	found := false
+	for _, other := range s.sessions[sess.email] {
+		if other == sess {
+			found = true
+		} else {
+			remaining = append(remaining, other)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(s.sessions, sess.email)
+	} else {
+		s.sessions[sess.email] = remaining
+	}
+	return found
+}
+
+// removeAllSessions removes and returns every session.
+func (l *localEventDB) removeAllSessions() []*localDBSession {
+	var res []*localDBSession
+	for _, s := range l.shards {
+		s.lock.Lock()
+		for _, sessions := range s.sessions {
+			res = append(res, sessions...)
+		}
+		s.sessions = map[string][]*localDBSession{}
+		s.lock.Unlock()
+	}
+	return res
+}
+
+// stopShards stops the shards once they have delivered
+// what is already queued, and waits for them. Later
+// deliveries are dropped.
+func (l *localEventDB) stopShards() {
+	for _, s := range l.shards {
+		s.queueLock.Lock()
+		s.stopped = true
+		s.queueLock.Unlock()
+		s.signal()
+	}
+	for _, s := range l.shards {
+		<-s.done
+	}
+}
+
+// enqueue schedules a delivery without waiting for it.
+func (s *sessionShard) enqueue(d delivery) {
+	s.queueLock.Lock()
+	if s.stopped {
+		s.queueLock.Unlock()
+		return
+	}
+	overflow := len(s.queue) >= MaxShardQueue && d.kind != deliverReplace &&
+		(d.kind != deliverEvent || !d.event.priority())
+	if overflow {
+		if s.resyncs == nil {
+			s.resyncs = map[*localDBSession]bool{}
+		}
+		s.resyncs[d.sess] = true
+	} else {
+		s.queue = append(s.queue, d)
+	}
+	s.queueLock.Unlock()
+	s.signal()
+}
+
+// signal wakes the shard's Goroutine if it is waiting.
+func (s *sessionShard) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sessionShard) run() {
+	defer close(s.done)
+	for range s.wake {
+		s.queueLock.Lock()
+		queue, resyncs, stopped := s.queue, s.resyncs, s.stopped
+		s.queue, s.resyncs = nil, nil
+		s.queueLock.Unlock()
+		for _, d := range queue {
+			s.deliver(d)
+		}
+		for sess := range resyncs {
+			s.deliver(delivery{kind: deliverResync, sess: sess})
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+func (s *sessionShard) deliver(d delivery) {
+	sess := d.sess
+	switch d.kind {
+	case deliverEvent:
+		select {
+		case sess.events <- d.event:
+			return
+		default:
+		}
+		sess.replaceBacklog(d.event)
+	case deliverResync:
+		sess.replaceBacklog()
+	case deliverReplace:
+		sess.clearBacklog(d.event)
+	}
+}
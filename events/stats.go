@@ -0,0 +1,71 @@
+package events
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// recordUsage adds to a user's stats.
+// Failing to record stats should not fail an operation, so
+// errors are ignored.
+func (l *localEventDB) recordUsage(email string, usage statusdb.UsageStats) {
+	l.db.RecordUsage(email, usage)
+}
+
+// userStats gets a user's stats, including the time they
+// have been online so far if they are currently online.
+func (l *localEventDB) userStats(info *statusdb.UserInfo) statusdb.UsageStats {
+	stats := info.Stats
+	l.stateLock.Lock()
+	since, ok := l.onlineSince[info.Email]
+	l.stateLock.Unlock()
+	if ok {
+		stats.OnlineTime += time.Since(since)
+	}
+	return stats
+}
+
+// sessionStarted counts a login, and starts counting
+// online time if the user has no other sessions.
+func (l *localEventDB) sessionStarted(email string) {
+	l.recordUsage(email, statusdb.UsageStats{Logins: 1, LastActivity: time.Now()})
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	if _, ok := l.onlineSince[email]; ok {
+		return
+	}
+	if l.onlineSince == nil {
+		l.onlineSince = map[string]time.Time{}
+	}
+	l.onlineSince[email] = time.Now()
+}
+
+// sessionsEnded records online time for a user whose
+// sessions have been removed, if none remain, and stops
+// routing their buddies' changes to this node.
+func (l *localEventDB) sessionsEnded(email string) {
+	if l.hasLocalSessions(email) {
+		return
+	}
+	l.listeners.set(email, nil)
+	l.stateLock.Lock()
+	since, ok := l.onlineSince[email]
+	delete(l.onlineSince, email)
+	l.stateLock.Unlock()
+	if ok {
+		l.recordUsage(email, statusdb.UsageStats{OnlineTime: time.Since(since)})
+	}
+}
+
+func (l *localDBSession) GetStats() (stats statusdb.UsageStats, err error) {
+	err = l.genericOperation("get stats", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		stats = l.eventDB.userStats(info)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,135 @@
+package events
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// MaxSummaryDroppers is the number of users listed in an
+// ActivitySummary's TopDroppers.
+const MaxSummaryDroppers = 10
+
+// An ActivitySummary describes the server's activity over
+// a period of time, for reports to administrators.
+type ActivitySummary struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	Registrations int `json:"registrations"`
+	Logins        int `json:"logins"`
+
+	// PeakOnline is the largest number of users with
+	// sessions at once.
+	PeakOnline int `json:"peak_online"`
+
+	// Errors counts unexpected errors in client operations,
+	// and SyncErrors counts failures to keep clients'
+	// state consistent.
+	Errors     int `json:"errors"`
+	SyncErrors int `json:"sync_errors"`
+
+	// TopDroppers lists the users whose sessions most
+	// often fell behind on events, so that their pending
+	// events were replaced with a full state.
+	TopDroppers []DropCount `json:"top_droppers"`
+}
+
+// A DropCount is the number of times a user's sessions fell
+// behind on events.
+type DropCount struct {
+	Email string `json:"email"`
+	Count int    `json:"count"`
+}
+
+// String formats the summary as a plain-text report.
+func (a *ActivitySummary) String() string {
+	var res strings.Builder
+	fmt.Fprintf(&res, "Server activity from %s to %s\n\n", a.Start.Format(time.RFC1123),
+		a.End.Format(time.RFC1123))
+	fmt.Fprintf(&res, "New registrations:  %d\n", a.Registrations)
+	fmt.Fprintf(&res, "Logins:             %d\n", a.Logins)
+	fmt.Fprintf(&res, "Peak online users:  %d\n", a.PeakOnline)
+	fmt.Fprintf(&res, "Errors:             %d\n", a.Errors)
+	fmt.Fprintf(&res, "Sync errors:        %d\n", a.SyncErrors)
+	if len(a.TopDroppers) > 0 {
+		res.WriteString("\nUsers who fell behind on events most often:\n")
+		for _, d := range a.TopDroppers {
+			fmt.Fprintf(&res, "  %-40s %d\n", d.Email, d.Count)
+		}
+	}
+	return res.String()
+}
+
+// activityCounters accumulates an ActivitySummary between
+// reports.
+type activityCounters struct {
+	start         time.Time
+	registrations int
+	logins        int
+	peakOnline    int
+	errors        int
+	syncErrors    int
+	drops         map[string]int
+}
+
+// TakeSummary summarizes the activity since the previous
+// summary (or since the server started), and starts a new
+// period.
+func (l *localEventDB) TakeSummary() *ActivitySummary {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	c := &l.activity
+	start := c.start
+	if start.IsZero() {
+		start = serverStart
+	}
+	res := &ActivitySummary{
+		Start:         start,
+		End:           time.Now(),
+		Registrations: c.registrations,
+		Logins:        c.logins,
+		PeakOnline:    c.peakOnline,
+		Errors:        c.errors,
+		SyncErrors:    c.syncErrors,
+		TopDroppers:   []DropCount{},
+	}
+	for email, count := range c.drops {
+		res.TopDroppers = append(res.TopDroppers, DropCount{Email: email, Count: count})
+	}
+	sort.Slice(res.TopDroppers, func(i, j int) bool {
+		d1, d2 := res.TopDroppers[i], res.TopDroppers[j]
+		return d1.Count > d2.Count || (d1.Count == d2.Count && d1.Email < d2.Email)
+	})
+	if len(res.TopDroppers) > MaxSummaryDroppers {
+		res.TopDroppers = res.TopDroppers[:MaxSummaryDroppers]
+	}
+	*c = activityCounters{start: res.End, peakOnline: len(l.onlineSince)}
+	return res
+}
+
+// countError counts an operation's error in the activity
+// summary if it is unexpected.
+func (l *localEventDB) countError(err error) {
+	if err == nil {
+		return
+	}
+	if code, _ := DescribeError(err); code == protocol.ErrCodeUnknown {
+		l.stateLock.Lock()
+		l.activity.errors++
+		l.stateLock.Unlock()
+	}
+}
+
+// countDrop records that a session fell behind on events.
+func (l *localEventDB) countDrop(email string) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	if l.activity.drops == nil {
+		l.activity.drops = map[string]int{}
+	}
+	l.activity.drops[email]++
+}
@@ -0,0 +1,42 @@
+package events
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// SelfCheckTimeout is the time a self-check may take before
+// the server is considered wedged.
+const SelfCheckTimeout = 10 * time.Second
+
+var ErrSelfCheckTimeout = errors.New("self-check timed out")
+
+// SelfCheck verifies that sessions are being served and
+// that the DB is reachable.
+//
+// If the check is stuck, it keeps running in the
+// background after SelfCheckTimeout.
+func (l *localEventDB) SelfCheck() error {
+	res := make(chan error, 1)
+	go func() {
+		l.lock.Lock()
+		l.lock.Unlock()
+
+		// A read of a missing user touches the DB without
+		// copying any user data.
+		_, err := l.db.GetUserInfo("")
+		if RootError(err) == statusdb.ErrNoEmail {
+			err = nil
+		}
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		return essentials.AddCtx("self-check", err)
+	case <-time.After(SelfCheckTimeout):
+		return essentials.AddCtx("self-check", ErrSelfCheckTimeout)
+	}
+}
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// Tuning contains the settings which may be changed while
+// the server is running.
+type Tuning struct {
+	// EventBufferSize is the number of events buffered
+	// for each new session.
+	EventBufferSize int `json:"event_buffer_size"`
+
+	// Limits apply as described by EventDB.SetLimits.
+	Limits statusdb.Limits `json:"limits"`
+
+	LogLevel string `json:"log_level"`
+}
+
+// Validate checks that the settings are usable.
+func (t *Tuning) Validate() error {
+	if t.EventBufferSize < 1 {
+		return &statusdb.ValidationError{Field: "event_buffer_size", Reason: "must be positive"}
+	} else if err := t.Limits.Validate(); err != nil {
+		return err
+	} else if _, err := statusdb.ParseLogLevel(t.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Changes describes the settings which differ from old,
+// such as "event_buffer_size=200".
+func (t *Tuning) Changes(old *Tuning) string {
+	var changes []string
+	add := func(name string, oldVal, newVal interface{}) {
+		if oldVal != newVal {
+			changes = append(changes, fmt.Sprintf("%s=%v", name, newVal))
+		}
+	}
+	add("event_buffer_size", old.EventBufferSize, t.EventBufferSize)
+	add("limits.max_buddies", old.Limits.MaxBuddies, t.Limits.MaxBuddies)
+	add("limits.max_pending_requests", old.Limits.MaxPendingRequests, t.Limits.MaxPendingRequests)
+	add("limits.max_sessions_per_user", old.Limits.MaxSessionsPerUser, t.Limits.MaxSessionsPerUser)
+	add("limits.max_status_message_length", old.Limits.MaxStatusMessageLength,
+		t.Limits.MaxStatusMessageLength)
+	add("limits.messages_per_minute", old.Limits.MessagesPerMinute, t.Limits.MessagesPerMinute)
+	add("limits.lookups_per_minute", old.Limits.LookupsPerMinute, t.Limits.LookupsPerMinute)
+	add("limits.reports_per_hour", old.Limits.ReportsPerHour, t.Limits.ReportsPerHour)
+	add("log_level", old.LogLevel, t.LogLevel)
+	return strings.Join(changes, " ")
+}
+
+func (l *localEventDB) Tuning() Tuning {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.tuning()
+}
+
+func (l *localEventDB) tuning() Tuning {
+	return Tuning{
+		EventBufferSize: l.bufferSize,
+		Limits:          l.limits.WithDefaults(),
+		LogLevel:        statusdb.CurrentLogLevel().String(),
+	}
+}
+
+// UpdateTuning changes the settings in one step, so that
+// concurrent updates do not undo each other's changes.
+//
+// The update function modifies a copy of the current
+// settings, and is called with the EventDB locked.
+// It returns the old and new settings.
+func (l *localEventDB) UpdateTuning(update func(t *Tuning) error) (old, updated Tuning,
+	err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	old = l.tuning()
+	updated = old
+	if err := update(&updated); err != nil {
+		return old, old, err
+	}
+	if err := updated.Validate(); err != nil {
+		return old, old, err
+	}
+	level, _ := statusdb.ParseLogLevel(updated.LogLevel)
+	updated.Limits = updated.Limits.WithDefaults()
+	updated.LogLevel = level.String()
+
+	l.bufferSize = updated.EventBufferSize
+	l.limits = updated.Limits
+	l.db.SetLimits(updated.Limits)
+	statusdb.SetLogLevel(level)
+	return old, updated, nil
+}
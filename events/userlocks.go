@@ -0,0 +1,94 @@
+package events
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// userLocks serializes the operations on each user, so
+// that operations on unrelated users may run at once.
+type userLocks struct {
+	lock  sync.Mutex
+	users map[string]*userLock
+}
+
+type userLock struct {
+	lock sync.Mutex
+
+	// refs counts the holders and waiters, so that the
+	// entry can be deleted once nobody needs it.
+	refs int
+}
+
+// Lock locks every listed user, ignoring duplicates and
+// empty emails, and returns a function to unlock them.
+//
+// Users are always locked in sorted order, so that two
+// operations involving the same users cannot deadlock.
+func (u *userLocks) Lock(emails ...string) (unlock func()) {
+	var sorted []string
+	for _, email := range emails {
+		if email != "" && !statusdb.ContainsEmail(sorted, email) {
+			sorted = append(sorted, email)
+		}
+	}
+	sort.Strings(sorted)
+
+	locks := make([]*userLock, len(sorted))
+	u.lock.Lock()
+	if u.users == nil {
+		u.users = map[string]*userLock{}
+	}
+	for i, email := range sorted {
+		ul, ok := u.users[email]
+		if !ok {
+			ul = &userLock{}
+			u.users[email] = ul
+		}
+		ul.refs++
+		locks[i] = ul
+	}
+	u.lock.Unlock()
+
+	for _, ul := range locks {
+		ul.lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].lock.Unlock()
+		}
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		for i, ul := range locks {
+			ul.refs--
+			if ul.refs == 0 {
+				delete(u.users, sorted[i])
+			}
+		}
+	}
+}
+
+// lockUsers locks the listed users for an operation which
+// only involves them, and returns a function to unlock
+// them.
+//
+// Operations which involve every user, such as handling
+// cluster messages, lock the EventDB itself instead, which
+// waits for every per-user operation to finish.
+func (l *localEventDB) lockUsers(emails ...string) (unlock func()) {
+	l.lock.RLock()
+	unlockUsers := l.users.Lock(emails...)
+	return func() {
+		unlockUsers()
+		l.lock.RUnlock()
+	}
+}
+
+// lockAll locks the EventDB for an operation which may
+// involve any user, and returns a function to unlock it.
+func (l *localEventDB) lockAll() (unlock func()) {
+	l.lock.Lock()
+	return l.lock.Unlock
+}
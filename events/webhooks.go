@@ -0,0 +1,202 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+var ErrWebhooksDisabled = errors.New("webhooks are not supported")
+
+// A WebhookError is returned when a test delivery to a
+// webhook fails.
+type WebhookError struct {
+	Err error
+}
+
+func (w *WebhookError) Error() string {
+	return "webhook failed: " + w.Err.Error()
+}
+
+// A WebhookDelivery is the JSON body posted to a webhook.
+type WebhookDelivery struct {
+	// ID is unique to the delivery, and is the same for
+	// every attempt to make it.
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// User is the owner of the webhook.
+	User string `json:"user"`
+
+	// Email and Greeting describe a received request.
+	Email    string `json:"email,omitempty"`
+	Greeting string `json:"greeting,omitempty"`
+
+	// Status is the user's new status.
+	Status *statusdb.UserStatus `json:"status,omitempty"`
+}
+
+// A WebhookSender posts deliveries to users' webhooks,
+// signed with the webhooks' secrets.
+type WebhookSender interface {
+	// Send delivers in the background, retrying failed
+	// attempts.
+	//
+	// It is called while users are locked, so it must not
+	// block.
+	Send(hook statusdb.Webhook, delivery *WebhookDelivery)
+
+	// Deliver makes a single attempt at a delivery.
+	Deliver(hook statusdb.Webhook, delivery *WebhookDelivery) error
+}
+
+// webhookEventTypes maps events which a user is notified
+// of to the webhook events which they trigger.
+var webhookEventTypes = map[EventType]string{
+	EventRequestReceived: protocol.WebhookRequestReceived,
+}
+
+// fireWebhooks sends a delivery to each of the user's
+// webhooks which is triggered by its event.
+func (l *localEventDB) fireWebhooks(email string, delivery WebhookDelivery) {
+	if l.webhooks == nil {
+		return
+	}
+	info, err := l.db.GetUserInfo(email)
+	if err != nil {
+		return
+	}
+	delivery.User = info.Email
+	delivery.Time = time.Now()
+	for _, hook := range info.Webhooks {
+		if hook.Triggers(delivery.Event) {
+			d := delivery
+			d.ID = NewRandomID()
+			l.webhooks.Send(hook, &d)
+		}
+	}
+}
+
+func (l *localEventDB) AddWebhook(email, url string, events []string) (hook statusdb.Webhook,
+	err error) {
+	defer essentials.AddCtxTo("add webhook", &err)
+	if l.webhooks == nil {
+		return hook, ErrWebhooksDisabled
+	}
+	defer l.lockUsers(email)()
+	return l.addWebhook(email, url, events)
+}
+
+func (l *localEventDB) RemoveWebhook(email, id string) (err error) {
+	defer essentials.AddCtxTo("remove webhook", &err)
+	defer l.lockUsers(email)()
+	return l.db.RemoveWebhook(email, id)
+}
+
+// addWebhook generates a webhook's ID and secret, and adds
+// it to a locked user.
+func (l *localEventDB) addWebhook(email, url string, events []string) (statusdb.Webhook, error) {
+	var secret [16]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return statusdb.Webhook{}, err
+	}
+	hook := statusdb.Webhook{
+		ID:      NewRandomID(),
+		URL:     url,
+		Secret:  hex.EncodeToString(secret[:]),
+		Events:  events,
+		Created: time.Now(),
+	}
+	return hook, l.db.AddWebhook(email, hook)
+}
+
+func (l *localDBSession) AddWebhook(url string, events []string) (hook statusdb.Webhook,
+	err error) {
+	if l.eventDB.webhooks == nil {
+		return hook, ErrWebhooksDisabled
+	}
+	err = l.auditedOperation("add webhook", "", func() error {
+		hook, err = l.eventDB.addWebhook(l.email, url, events)
+		return err
+	})
+	return
+}
+
+func (l *localDBSession) RemoveWebhook(id string) error {
+	return l.auditedOperation("remove webhook", "", func() error {
+		return l.eventDB.db.RemoveWebhook(l.email, id)
+	})
+}
+
+func (l *localDBSession) ListWebhooks() (hooks []statusdb.Webhook, err error) {
+	err = l.genericOperation("list webhooks", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		for _, hook := range info.Webhooks {
+			hook.Secret = ""
+			hooks = append(hooks, hook)
+		}
+		return nil
+	})
+	return
+}
+
+func (l *localDBSession) TestWebhook(id string) error {
+	if l.eventDB.webhooks == nil {
+		return ErrWebhooksDisabled
+	}
+	var hook *statusdb.Webhook
+	err := l.genericOperation("test webhook", func() error {
+		info, err := l.eventDB.db.GetUserInfo(l.email)
+		if err != nil {
+			return err
+		}
+		for _, h := range info.Webhooks {
+			if h.ID == id {
+				hook = &h
+				return nil
+			}
+		}
+		return statusdb.ErrNoWebhook
+	})
+	if err != nil {
+		return err
+	}
+
+	// The delivery is made without holding any locks, since
+	// the receiver may be slow.
+	return l.audited("test webhook", "", func() error {
+		err := l.eventDB.webhooks.Deliver(*hook, &WebhookDelivery{
+			ID:    NewRandomID(),
+			Event: protocol.WebhookTest,
+			Time:  time.Now(),
+			User:  l.email,
+		})
+		if err != nil {
+			return &WebhookError{Err: RootError(err)}
+		}
+		return nil
+	})()
+}
+
+func (l *localDBSession) CreateAPIKey() (apiKey string, err error) {
+	err = l.sensitiveOperation("create api key", func() error {
+		apiKey, err = l.eventDB.db.CreateAPIKey(l.email)
+		return err
+	})
+	return
+}
+
+func (l *localDBSession) RevokeAPIKey() error {
+	return l.auditedOperation("revoke api key", "", func() error {
+		return l.eventDB.db.RevokeAPIKey(l.email)
+	})
+}
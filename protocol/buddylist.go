@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// MaxImportEntries is the maximum number of buddies in an
+// imported buddy list.
+const MaxImportEntries = 500
+
+// Buddy list formats for import and export.
+const (
+	BuddyListJSON = "json"
+	BuddyListCSV  = "csv"
+)
+
+var ErrBuddyListFormat = errors.New("unsupported buddy list format")
+
+// A BuddyEntry is one buddy in an exported buddy list.
+type BuddyEntry struct {
+	Email string `json:"email"`
+	Alias string `json:"alias,omitempty"`
+}
+
+// An ImportResult describes the outcome of importing a
+// single BuddyEntry.
+type ImportResult struct {
+	Email string `json:"email"`
+
+	// Action is "requested" if a buddy request was sent,
+	// or "updated" if the user was already a buddy.
+	// It is empty if the import failed.
+	Action string `json:"action,omitempty"`
+
+	Code    ErrorCode `json:"code,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// EncodeBuddyList serializes a buddy list.
+//
+// CSV lists have a header row of "email,alias".
+func EncodeBuddyList(entries []BuddyEntry, format string) (data string, err error) {
+	defer essentials.AddCtxTo("encode buddy list", &err)
+	switch format {
+	case BuddyListJSON:
+		if entries == nil {
+			entries = []BuddyEntry{}
+		}
+		res, err := json.Marshal(entries)
+		return string(res), err
+	case BuddyListCSV:
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"email", "alias"})
+		for _, entry := range entries {
+			w.Write([]string{entry.Email, entry.Alias})
+		}
+		w.Flush()
+		return buf.String(), w.Error()
+	}
+	return "", ErrBuddyListFormat
+}
+
+// DecodeBuddyList parses a buddy list produced by
+// EncodeBuddyList.
+//
+// CSV lists may omit the header row and the alias column.
+func DecodeBuddyList(data, format string) (entries []BuddyEntry, err error) {
+	defer essentials.AddCtxTo("decode buddy list", &err)
+	switch format {
+	case BuddyListJSON:
+		if err := json.Unmarshal([]byte(data), &entries); err != nil {
+			return nil, err
+		}
+	case BuddyListCSV:
+		r := csv.NewReader(strings.NewReader(data))
+		r.FieldsPerRecord = -1
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			email := strings.TrimSpace(record[0])
+			if email == "" || (len(entries) == 0 && strings.EqualFold(email, "email")) {
+				continue
+			}
+			entry := BuddyEntry{Email: email}
+			if len(record) > 1 {
+				entry.Alias = strings.TrimSpace(record[1])
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		return nil, ErrBuddyListFormat
+	}
+	if len(entries) > MaxImportEntries {
+		return nil, &statusdb.ValidationError{Field: "data", Reason: "too many buddies"}
+	}
+	return entries, nil
+}
+
+// ValidateBuddyEntry checks an entry of an imported buddy
+// list, which is not validated along with its message.
+func ValidateBuddyEntry(entry BuddyEntry) error {
+	return firstError(validateEmail("email", entry.Email),
+		validateLength("alias", entry.Alias, MaxAliasLength))
+}
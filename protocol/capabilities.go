@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// Protocol extensions which may be listed in a
+// CapabilitiesMessage.
+const (
+	ExtCompression    = "compression"
+	ExtSequenceResume = "sequence_resume"
+	ExtRichStatus     = "rich_status"
+	ExtPagedState     = "paged_full_state"
+)
+
+// serverExtensions lists the extensions which the server
+// implements.
+var serverExtensions = []string{ExtCompression, ExtSequenceResume, ExtRichStatus, ExtPagedState}
+
+// ServerCapabilities creates a message listing the
+// capabilities of the server.
+func ServerCapabilities(id MessageID) *CapabilitiesMessage {
+	return &CapabilitiesMessage{
+		MessageID:    id,
+		MessageTypes: MessageTypes(),
+		Extensions:   append([]string{}, serverExtensions...),
+	}
+}
+
+// ServerLimits creates a message advertising the server's
+// limits.
+func ServerLimits(limits statusdb.Limits) *LimitsMessage {
+	limits = limits.WithDefaults()
+	return &LimitsMessage{
+		MaxStatusMessageLength: limits.MaxStatusMessageLength,
+		MaxGreetingLength:      MaxGreetingLength,
+		MaxAliasLength:         MaxAliasLength,
+		MaxUserMetadataLength:  MaxUserMetadataLength,
+		MaxAvatarUploadSize:    MaxAvatarUploadSize,
+		MaxDisplayNameLength:   MaxDisplayNameLength,
+		MaxPronounsLength:      MaxPronounsLength,
+		MaxBioLength:           MaxBioLength,
+		MaxBatchCommands:       MaxBatchCommands,
+		MaxBuddies:             limits.MaxBuddies,
+		MaxPendingRequests:     limits.MaxPendingRequests,
+		MaxSessionsPerUser:     limits.MaxSessionsPerUser,
+		MaxMessagesPerMinute:   limits.MessagesPerMinute,
+		MaxLookupsPerMinute:    limits.LookupsPerMinute,
+		MaxReportsPerHour:      limits.ReportsPerHour,
+		StatusHistoryLength:    limits.StatusHistoryLength,
+		PingInterval:           int(PingInterval / time.Second),
+		PingTimeout:            int(PingTimeout / time.Second),
+	}
+}
@@ -0,0 +1,23 @@
+package protocol
+
+// An EventCategory groups related events so that clients
+// can opt out of the ones they do not handle.
+type EventCategory string
+
+const (
+	CategoryStatuses EventCategory = "statuses"
+	CategoryRequests EventCategory = "requests"
+	CategoryProfiles EventCategory = "profiles"
+	CategorySettings EventCategory = "settings"
+	CategorySecurity EventCategory = "security"
+)
+
+// Valid checks if c is a known category.
+func (c EventCategory) Valid() bool {
+	switch c {
+	case CategoryStatuses, CategoryRequests, CategoryProfiles, CategorySettings,
+		CategorySecurity:
+		return true
+	}
+	return false
+}
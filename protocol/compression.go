@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/unixpickle/essentials"
+)
+
+var ErrDecompressedSize = errors.New("decompressed message too large")
+
+// MaxDecompressedSize limits the size of a message sent
+// compressed by a client.
+const MaxDecompressedSize = 1 << 22
+
+// A CompressedMessage wraps another message whose JSON
+// encoding has been gzipped.
+//
+// The server only sends compressed messages to clients
+// supporting the "compression" extension. Clients with the
+// extension may also send them.
+type CompressedMessage struct {
+	// Inner is the type of the wrapped message.
+	Inner string `json:"inner"`
+
+	// Data is the gzipped JSON of the wrapped message,
+	// which is base64 encoded in JSON.
+	Data []byte `json:"data"`
+}
+
+// Decompress decodes the wrapped message.
+func (c *CompressedMessage) Decompress() (Message, error) {
+	return c.decompress(false)
+}
+
+// DecompressStrict is like Decompress, but decodes the
+// wrapped message like DecodeMessageStrict.
+func (c *CompressedMessage) DecompressStrict() (Message, error) {
+	return c.decompress(true)
+}
+
+func (c *CompressedMessage) decompress(strict bool) (msg Message, err error) {
+	defer essentials.AddCtxTo("decompress message", &err)
+	r, err := gzip.NewReader(bytes.NewReader(c.Data))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > MaxDecompressedSize {
+		return nil, ErrDecompressedSize
+	}
+	if c.Inner == MsgTypeCompressed {
+		return nil, ErrNestedCompression
+	}
+	if strict {
+		return DecodeMessageStrict(c.Inner, data)
+	}
+	return DecodeMessage(c.Inner, data)
+}
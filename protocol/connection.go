@@ -1,4 +1,4 @@
-package main
+package protocol
 
 // A Connection communicates with a remote client in a
 // blocking manner.
@@ -19,3 +19,22 @@ type Connection interface {
 	// WriteMessage() calls.
 	Close() error
 }
+
+// A StrictConnection is a Connection which decodes the
+// messages it reads, and can be told to reject messages
+// with unknown fields, like DecodeMessageStrict.
+type StrictConnection interface {
+	Connection
+
+	SetStrictDecoding(strict bool)
+}
+
+// A RemoteConnection is a Connection which knows the
+// address of the remote client.
+//
+// The address is recorded in the audit log.
+type RemoteConnection interface {
+	Connection
+
+	RemoteAddr() string
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrNestedCompression = errors.New("compressed messages cannot be nested")
+
+// An ErrorCode is a stable, machine-readable description of
+// an error, sent to clients alongside a human-readable
+// message.
+type ErrorCode string
+
+const (
+	ErrCodeUnknown ErrorCode = "ERR_UNKNOWN"
+
+	ErrCodePassword             ErrorCode = "ERR_PASSWORD"
+	ErrCodeNoEmail              ErrorCode = "ERR_NO_EMAIL"
+	ErrCodeEmailInUse           ErrorCode = "ERR_EMAIL_IN_USE"
+	ErrCodeAccountLocked        ErrorCode = "ERR_ACCOUNT_LOCKED"
+	ErrCodeNotBot               ErrorCode = "ERR_NOT_BOT"
+	ErrCodeExternalAccounts     ErrorCode = "ERR_EXTERNAL_ACCOUNTS"
+	ErrCodeAccountSuspended     ErrorCode = "ERR_ACCOUNT_SUSPENDED"
+	ErrCodeTwoFactorRequired    ErrorCode = "ERR_TWO_FACTOR_REQUIRED"
+	ErrCodeTwoFactorCode        ErrorCode = "ERR_TWO_FACTOR_CODE"
+	ErrCodeTwoFactorEnabled     ErrorCode = "ERR_TWO_FACTOR_ENABLED"
+	ErrCodeTwoFactorDisabled    ErrorCode = "ERR_TWO_FACTOR_DISABLED"
+	ErrCodeAlreadyBuddies       ErrorCode = "ERR_ALREADY_BUDDIES"
+	ErrCodeNotBuddies           ErrorCode = "ERR_NOT_BUDDIES"
+	ErrCodeRequestExists        ErrorCode = "ERR_REQUEST_EXISTS"
+	ErrCodeReverseRequestExists ErrorCode = "ERR_REVERSE_REQUEST_EXISTS"
+	ErrCodeNoRequest            ErrorCode = "ERR_NO_REQUEST"
+	ErrCodeInvalidAvailability  ErrorCode = "ERR_INVALID_AVAILABILITY"
+	ErrCodeBlocked              ErrorCode = "ERR_BLOCKED"
+	ErrCodeAlreadyBlocked       ErrorCode = "ERR_ALREADY_BLOCKED"
+	ErrCodeNotBlocked           ErrorCode = "ERR_NOT_BLOCKED"
+	ErrCodeNoCustomState        ErrorCode = "ERR_NO_CUSTOM_STATE"
+	ErrCodeInvalidVisibility    ErrorCode = "ERR_INVALID_VISIBILITY"
+	ErrCodeInvalidRequestPolicy ErrorCode = "ERR_INVALID_REQUEST_POLICY"
+	ErrCodeRequestsRestricted   ErrorCode = "ERR_REQUESTS_RESTRICTED"
+	ErrCodeInvalidSchedule      ErrorCode = "ERR_INVALID_SCHEDULE"
+	ErrCodeInvalidTimeZone      ErrorCode = "ERR_INVALID_TIME_ZONE"
+	ErrCodeCannotMerge          ErrorCode = "ERR_CANNOT_MERGE"
+	ErrCodeHistoryHidden        ErrorCode = "ERR_HISTORY_HIDDEN"
+	ErrCodeAvatarsDisabled      ErrorCode = "ERR_AVATARS_DISABLED"
+	ErrCodeAvatarTooLarge       ErrorCode = "ERR_AVATAR_TOO_LARGE"
+	ErrCodeAvatarFormat         ErrorCode = "ERR_AVATAR_FORMAT"
+	ErrCodeNoAvatar             ErrorCode = "ERR_NO_AVATAR"
+	ErrCodeBuddyListFormat      ErrorCode = "ERR_BUDDY_LIST_FORMAT"
+	ErrCodeNotPublic            ErrorCode = "ERR_NOT_PUBLIC"
+	ErrCodeNotSubscribed        ErrorCode = "ERR_NOT_SUBSCRIBED"
+	ErrCodeInvalidNotice        ErrorCode = "ERR_INVALID_NOTICE"
+	ErrCodeStatusTooLong        ErrorCode = "ERR_STATUS_TOO_LONG"
+	ErrCodeStatusRejected       ErrorCode = "ERR_STATUS_REJECTED"
+	ErrCodeNoReport             ErrorCode = "ERR_NO_REPORT"
+	ErrCodeReportResolved       ErrorCode = "ERR_REPORT_RESOLVED"
+	ErrCodeReportSelf           ErrorCode = "ERR_REPORT_SELF"
+	ErrCodeInvalidAction        ErrorCode = "ERR_INVALID_ACTION"
+	ErrCodeNotAdmin             ErrorCode = "ERR_NOT_ADMIN"
+	ErrCodeFeatureDisabled      ErrorCode = "ERR_FEATURE_DISABLED"
+	ErrCodeNoAnnouncement       ErrorCode = "ERR_NO_ANNOUNCEMENT"
+	ErrCodeInvalidAnnouncement  ErrorCode = "ERR_INVALID_ANNOUNCEMENT"
+	ErrCodeTooManyBuddies       ErrorCode = "ERR_TOO_MANY_BUDDIES"
+	ErrCodeTooManyRequests      ErrorCode = "ERR_TOO_MANY_REQUESTS"
+	ErrCodeTooManySessions      ErrorCode = "ERR_TOO_MANY_SESSIONS"
+	ErrCodeRemoteUser           ErrorCode = "ERR_REMOTE_USER"
+	ErrCodeInvalidRelay         ErrorCode = "ERR_INVALID_RELAY"
+	ErrCodeNotVerified          ErrorCode = "ERR_NOT_VERIFIED"
+	ErrCodeVerifyToken          ErrorCode = "ERR_VERIFY_TOKEN"
+	ErrCodeResetCode            ErrorCode = "ERR_RESET_CODE"
+	ErrCodeMailDisabled         ErrorCode = "ERR_MAIL_DISABLED"
+	ErrCodePushDisabled         ErrorCode = "ERR_PUSH_DISABLED"
+	ErrCodeWebhooksDisabled     ErrorCode = "ERR_WEBHOOKS_DISABLED"
+	ErrCodeNoWebhook            ErrorCode = "ERR_NO_WEBHOOK"
+	ErrCodeTooManyWebhooks      ErrorCode = "ERR_TOO_MANY_WEBHOOKS"
+	ErrCodeWebhookFailed        ErrorCode = "ERR_WEBHOOK_FAILED"
+	ErrCodeUnknownProvider      ErrorCode = "ERR_UNKNOWN_PROVIDER"
+	ErrCodeNoIntegration        ErrorCode = "ERR_NO_INTEGRATION"
+	ErrCodeIntegrationFailed    ErrorCode = "ERR_INTEGRATION_FAILED"
+	ErrCodeExportUnsupported    ErrorCode = "ERR_EXPORT_UNSUPPORTED"
+	ErrCodeUnknownContactSource ErrorCode = "ERR_UNKNOWN_CONTACT_SOURCE"
+
+	ErrCodeNotOpen               ErrorCode = "ERR_NOT_OPEN"
+	ErrCodeIntentionalDisconnect ErrorCode = "ERR_INTENTIONAL_DISCONNECT"
+	ErrCodeReauthRequired        ErrorCode = "ERR_REAUTH_REQUIRED"
+	ErrCodeDraining              ErrorCode = "ERR_DRAINING"
+	ErrCodeMaintenance           ErrorCode = "ERR_MAINTENANCE"
+	ErrCodeInjectedFault         ErrorCode = "ERR_INJECTED_FAULT"
+	ErrCodeValidation            ErrorCode = "ERR_VALIDATION"
+	ErrCodeUnknownFields         ErrorCode = "ERR_UNKNOWN_FIELDS"
+	ErrCodeUnsupportedMessage    ErrorCode = "ERR_UNSUPPORTED_MESSAGE"
+	ErrCodeNestedBatch           ErrorCode = "ERR_NESTED_BATCH"
+	ErrCodeNestedCompression     ErrorCode = "ERR_NESTED_COMPRESSION"
+
+	// ErrCodeRateLimited is used for requests rejected
+	// because the client is sending them too quickly.
+	ErrCodeRateLimited ErrorCode = "ERR_RATE_LIMITED"
+)
+
+var (
+	ErrUnsupportedMessage = errors.New("unsupported message type")
+	ErrNestedBatch        = errors.New("batches cannot be nested")
+)
+
+// An UnknownFieldsError is returned when strict decoding
+// encounters fields which a message type does not have.
+type UnknownFieldsError struct {
+	MessageType string
+	Fields      []string
+}
+
+func (u *UnknownFieldsError) Error() string {
+	return "unknown fields in " + u.MessageType + ": " + strings.Join(u.Fields, ", ")
+}
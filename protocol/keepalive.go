@@ -0,0 +1,21 @@
+package protocol
+
+import (
+	"time"
+)
+
+const (
+	// PingInterval is the amount of time between pings sent
+	// by the server to authenticated clients.
+	PingInterval = 30 * time.Second
+
+	// PingTimeout is the amount of time after which a client
+	// that has stopped answering pings is disconnected.
+	PingTimeout = 3 * PingInterval
+)
+
+// UnixMillis converts a time into the millisecond
+// timestamps used by ping messages.
+func UnixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,1995 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// Client messages.
+	MsgTypeLogin           = "login"
+	MsgTypeRegister        = "register"
+	MsgTypeBotLogin        = "bot_login"
+	MsgTypeRegisterVerify  = "register_verify"
+	MsgTypeSetPassword     = "set_password"
+	MsgTypeResetPassword   = "reset_password"
+	MsgTypeLogout          = "logout"
+	MsgTypeLogoutOther     = "logout_other"
+	MsgTypeSetStatus       = "set_status"
+	MsgTypeAddBuddy        = "add_buddy"
+	MsgTypeAcceptRequest   = "accept_request"
+	MsgTypeRemoveBuddy     = "remove_buddy"
+	MsgTypeDeclineRequest  = "decline_request"
+	MsgTypeCancelRequest   = "cancel_request"
+	MsgTypeBlockUser       = "block_user"
+	MsgTypeUnblockUser     = "unblock_user"
+	MsgTypeSetAlias        = "set_alias"
+	MsgTypeSetDNDSettings  = "set_dnd_settings"
+	MsgTypeSetVisibility   = "set_visibility"
+	MsgTypeSetLastSeen     = "set_last_seen"
+	MsgTypeSetPrivacy      = "set_privacy"
+	MsgTypeGetPrivacy      = "get_privacy"
+	MsgTypeSetTimeZone     = "set_time_zone"
+	MsgTypeGetHistory      = "get_status_history"
+	MsgTypeSetPublic       = "set_public_presence"
+	MsgTypeSubscribe       = "subscribe"
+	MsgTypeUnsubscribe     = "unsubscribe"
+	MsgTypeSetIdle         = "set_idle"
+	MsgTypeSetActive       = "set_active"
+	MsgTypeSetCustomStates = "set_custom_states"
+	MsgTypeSetSchedule     = "set_schedule"
+	MsgTypeLookupUser      = "lookup_user"
+	MsgTypeReportUser      = "report_user"
+	MsgTypeGetStats        = "get_stats"
+	MsgTypeGetServerStats  = "get_server_stats"
+	MsgTypeGetServerInfo   = "get_server_info"
+	MsgTypeExportBuddies   = "export_buddies"
+	MsgTypeImportBuddies   = "import_buddies"
+	MsgTypeSetProfile      = "set_profile"
+	MsgTypeGetProfile      = "get_profile"
+	MsgTypeSetAwayNote     = "set_away_note"
+	MsgTypeGetAwayNote     = "get_away_note"
+	MsgTypeSetAvatar       = "set_avatar"
+	MsgTypeGetAvatar       = "get_avatar"
+	MsgTypeGetPushKey      = "get_push_key"
+	MsgTypeAddPushSub      = "add_push_subscription"
+	MsgTypeRemovePushSub   = "remove_push_subscription"
+	MsgTypeAddWebhook      = "add_webhook"
+	MsgTypeRemoveWebhook   = "remove_webhook"
+	MsgTypeListWebhooks    = "list_webhooks"
+	MsgTypeTestWebhook     = "test_webhook"
+	MsgTypeCreateAPIKey    = "create_api_key"
+	MsgTypeRevokeAPIKey    = "revoke_api_key"
+
+	MsgTypeAuthorizeIntegration  = "authorize_integration"
+	MsgTypeConnectIntegration    = "connect_integration"
+	MsgTypeDisconnectIntegration = "disconnect_integration"
+	MsgTypeListIntegrations      = "list_integrations"
+
+	MsgTypeSetDiscoverable   = "set_discoverable"
+	MsgTypeAuthorizeContacts = "authorize_contacts"
+	MsgTypeImportContacts    = "import_contacts"
+	MsgTypeSuggestBuddies    = "suggest_buddies"
+
+	MsgTypeEnableTwoFactor         = "enable_two_factor"
+	MsgTypeDisableTwoFactor        = "disable_two_factor"
+	MsgTypeRegenerateRecoveryCodes = "regenerate_recovery_codes"
+	MsgTypeReauthenticate          = "reauthenticate"
+	MsgTypeDeleteAccount           = "delete_account"
+	MsgTypeSyncSince               = "sync_since"
+	MsgTypeBatch                   = "batch"
+
+	// Control messages.
+	MsgTypeRegisterSuccess    = "register_success"
+	MsgTypeRegisterFailure    = "register_failure"
+	MsgTypeLoginSuccess       = "login_success"
+	MsgTypeLoginFailure       = "login_failure"
+	MsgTypeForcedLogout       = "forced_logout"
+	MsgTypeReconnect          = "reconnect"
+	MsgTypeNoSuchEmail        = "no_email"
+	MsgTypeSetPasswordSuccess = "set_password_success"
+	MsgTypeSetPasswordFailure = "set_password_failure"
+	MsgTypeSecurityAlert      = "security_alert"
+	MsgTypeTwoFactorEnabled   = "two_factor_enabled"
+	MsgTypeRecoveryCodes      = "recovery_codes"
+	MsgTypeReauthSuccess      = "reauth_success"
+	MsgTypeReauthFailure      = "reauth_failure"
+	MsgTypeAck                = "ack"
+	MsgTypeError              = "error"
+	MsgTypeCapabilities       = "capabilities"
+	MsgTypePing               = "ping"
+	MsgTypePong               = "pong"
+	MsgTypeBatchResult        = "batch_result"
+	MsgTypeLimits             = "limits"
+	MsgTypeServerNotice       = "server_notice"
+	MsgTypeCompressed         = "compressed"
+	MsgTypeAvatar             = "avatar"
+	MsgTypeProfile            = "profile"
+	MsgTypeAwayNote           = "away_note"
+	MsgTypeLookupResult       = "lookup_result"
+	MsgTypeBuddyList          = "buddy_list"
+	MsgTypeImportResult       = "import_result"
+	MsgTypeStats              = "stats"
+	MsgTypeServerStats        = "server_stats"
+	MsgTypeServerInfo         = "server_info"
+	MsgTypePushKey            = "push_key"
+	MsgTypeWebhook            = "webhook"
+	MsgTypeWebhooks           = "webhooks"
+	MsgTypeAPIKey             = "api_key"
+	MsgTypePrivacy            = "privacy"
+	MsgTypeStatusHistory      = "status_history"
+	MsgTypeIntegrationURL     = "integration_url"
+	MsgTypeIntegration        = "integration"
+	MsgTypeIntegrations       = "integrations"
+	MsgTypeSuggestions        = "suggestions"
+
+	// State messages.
+	MsgTypeFullState       = "full_state"
+	MsgTypeFullStateBegin  = "full_state_begin"
+	MsgTypeFullStateChunk  = "full_state_chunk"
+	MsgTypeFullStateEnd    = "full_state_end"
+	MsgTypeSyncDelta       = "sync_delta"
+	MsgTypeRequestSent     = "request_sent"
+	MsgTypeRequestReceived = "request_received"
+	MsgTypeAcceptSent      = "accept_sent"
+	MsgTypeRequestAccepted = "request_accepted"
+	MsgTypeBuddyRemoved    = "buddy_removed"
+	MsgTypeStatusChanged   = "status_changed"
+	MsgTypeRequestDeclined = "request_declined"
+	MsgTypeRequestCanceled = "request_canceled"
+	MsgTypeUserBlocked     = "user_blocked"
+	MsgTypeUserUnblocked   = "user_unblocked"
+	MsgTypeAliasChanged    = "alias_changed"
+	MsgTypeProfileChanged  = "profile_changed"
+	MsgTypeAnnouncements   = "announcements"
+	MsgTypeMissedEvents    = "missed_events"
+	MsgTypeSyncError       = "sync_error"
+)
+
+// A Message is the main unit of information sent between
+// the client and the server.
+type Message interface {
+	Type() string
+}
+
+// A MessageID is embedded in client messages and their
+// responses.
+//
+// Clients may set an ID on a message, and the server will
+// echo it in the response so that the client can tell
+// which request the response corresponds to.
+type MessageID struct {
+	ID string `json:"id,omitempty"`
+}
+
+// RequestID returns the ID.
+func (m *MessageID) RequestID() string {
+	return m.ID
+}
+
+// SetID sets the ID, for clients sending requests.
+func (m *MessageID) SetID(id string) {
+	m.ID = id
+}
+
+// RequestID gets the client-chosen ID of a message, or ""
+// if the message has no ID.
+func RequestID(msg Message) string {
+	if m, ok := msg.(interface {
+		RequestID() string
+	}); ok {
+		return m.RequestID()
+	}
+	return ""
+}
+
+type LoginMessage struct {
+	MessageID
+
+	Email    string `json:"email"`
+	Password string `json:"password"`
+
+	// Code is a TOTP code or a recovery code, required if
+	// the user has two-factor authentication enabled.
+	Code string `json:"code,omitempty"`
+
+	// Locale is an optional language tag, such as "es" or
+	// "pt-BR", for human-readable strings from the server.
+	Locale string `json:"locale,omitempty"`
+
+	// Events optionally limits the event categories pushed
+	// to the client, e.g. ["statuses"] for a status widget.
+	Events []EventCategory `json:"events,omitempty"`
+
+	// Since is the server_time of the last full state or
+	// delta which a reconnecting client received. If it is
+	// set and the client has declared the "sequence_resume"
+	// extension, the server sends a sync_delta in place of
+	// the full state.
+	Since int64 `json:"since,omitempty"`
+}
+
+type RegisterMessage LoginMessage
+
+// BotLoginMessage starts a session for a bot account with
+// its API key.
+type BotLoginMessage struct {
+	MessageID
+
+	Email  string `json:"email"`
+	APIKey string `json:"api_key"`
+
+	Locale string          `json:"locale,omitempty"`
+	Events []EventCategory `json:"events,omitempty"`
+}
+
+type RegisterVerifyMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+type SetPasswordMessage struct {
+	MessageID
+
+	Email       string `json:"email"`
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type ResetPasswordMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+}
+
+type LogoutMessage struct {
+	MessageID
+}
+
+type LogoutOtherMessage struct {
+	MessageID
+}
+
+type SetStatusMessage struct {
+	MessageID
+	statusdb.UserStatus
+}
+
+type AddBuddyMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+
+	// Greeting is an optional introduction shown to the
+	// recipient of the request.
+	Greeting string `json:"greeting,omitempty"`
+}
+
+type AcceptRequestMessage ResetPasswordMessage
+
+type RemoveBuddyMessage ResetPasswordMessage
+
+type DeclineRequestMessage ResetPasswordMessage
+
+type CancelRequestMessage ResetPasswordMessage
+
+type BlockUserMessage ResetPasswordMessage
+
+type UnblockUserMessage ResetPasswordMessage
+
+// A SetAliasMessage sets a nickname for a buddy.
+// An empty alias removes the nickname.
+type SetAliasMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+	Alias string `json:"alias"`
+}
+
+// A SetLastSeenMessage controls who may see when the user
+// was last online.
+type SetLastSeenMessage struct {
+	MessageID
+
+	Visibility statusdb.Visibility `json:"visibility"`
+}
+
+// A SetPrivacyMessage replaces the user's privacy
+// settings. SetLastSeenMessage only changes one of them.
+type SetPrivacyMessage struct {
+	MessageID
+
+	Privacy statusdb.PrivacySettings `json:"privacy"`
+}
+
+type GetPrivacyMessage struct {
+	MessageID
+}
+
+// A SetTimeZoneMessage changes the user's time zone, with
+// which buddies' clients show the user's local time. An
+// empty time zone removes it.
+type SetTimeZoneMessage struct {
+	MessageID
+
+	TimeZone string `json:"time_zone"`
+}
+
+// A SetPublicMessage controls whether users who are not
+// buddies may subscribe to the user's availability.
+//
+// Turning it off ends every subscription, after a final
+// offline status.
+type SetPublicMessage struct {
+	MessageID
+
+	Public bool `json:"public"`
+}
+
+// A SubscribeMessage starts following the availability of
+// a user with public presence.
+// Updates are sent as StatusChangedMessages.
+type SubscribeMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+}
+
+type UnsubscribeMessage SubscribeMessage
+
+// A SetDNDSettingsMessage configures how the server
+// behaves while the user is in DoNotDisturb mode.
+type SetDNDSettingsMessage struct {
+	MessageID
+
+	// SuppressEvents indicates that buddy status changes and
+	// incoming requests should be withheld until the user
+	// leaves DoNotDisturb mode.
+	SuppressEvents bool `json:"suppress_events"`
+}
+
+// A SetVisibilityMessage toggles invisible mode for the
+// current connection.
+// While invisible, the user appears Offline to buddies.
+type SetVisibilityMessage struct {
+	MessageID
+
+	Invisible bool `json:"invisible"`
+}
+
+// A SetIdleMessage indicates that the user has not used
+// the client for some time.
+type SetIdleMessage struct {
+	MessageID
+
+	IdleSeconds int `json:"idle_seconds"`
+}
+
+// A SetActiveMessage indicates that the user is using the
+// client again after a SetIdleMessage.
+type SetActiveMessage struct {
+	MessageID
+}
+
+// A SetCustomStatesMessage replaces the user's custom
+// availability states.
+//
+// A custom state is selected by sending a SetStatusMessage
+// whose Custom field names the state.
+type SetCustomStatesMessage struct {
+	MessageID
+
+	States []statusdb.CustomState `json:"states"`
+}
+
+// A SetScheduleMessage replaces the user's recurring
+// schedule of statuses.
+type SetScheduleMessage struct {
+	MessageID
+
+	Schedule statusdb.Schedule `json:"schedule"`
+}
+
+// A LookupUserMessage checks if an email address may be
+// sent a buddy request.
+type LookupUserMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+}
+
+// A ReportUserMessage reports a user to the moderators
+// for abuse, such as harassment through buddy requests.
+type ReportUserMessage struct {
+	MessageID
+
+	Email    string `json:"email"`
+	Reason   string `json:"reason"`
+	Evidence string `json:"evidence,omitempty"`
+}
+
+// A GetStatsMessage requests the user's usage stats.
+type GetStatsMessage struct {
+	MessageID
+}
+
+// A StatsMessage is the response to a GetStatsMessage.
+type StatsMessage struct {
+	MessageID
+	statusdb.UsageSummary
+}
+
+// A GetServerStatsMessage requests the server's load.
+// Only administrators may send it.
+type GetServerStatsMessage struct {
+	MessageID
+}
+
+// ServerStats is a snapshot of the server's load.
+type ServerStats struct {
+	Connections int `json:"connections"`
+	Sessions    int `json:"sessions"`
+	OnlineUsers int `json:"online_users"`
+
+	// EventBacklog is the number of events waiting to be
+	// sent, summed over every session.
+	EventBacklog int `json:"event_backlog"`
+
+	// HeapBytes is the memory occupied by live and
+	// not-yet-collected objects.
+	HeapBytes uint64 `json:"heap_bytes"`
+
+	// SysBytes is the memory obtained from the OS.
+	SysBytes uint64 `json:"sys_bytes"`
+
+	Goroutines    int   `json:"goroutines"`
+	UptimeSeconds int64 `json:"uptime_seconds"`
+}
+
+// A ServerStatsMessage is the response to a
+// GetServerStatsMessage.
+type ServerStatsMessage struct {
+	MessageID
+	ServerStats
+}
+
+// A GetServerInfoMessage requests the server's version.
+// It may be sent before logging in.
+type GetServerInfoMessage struct {
+	MessageID
+}
+
+// A ServerInfoMessage is the response to a
+// GetServerInfoMessage.
+type ServerInfoMessage struct {
+	MessageID
+	ServerInfo
+}
+
+// An ExportBuddiesMessage requests the user's buddy list
+// in the given format ("json" or "csv").
+type ExportBuddiesMessage struct {
+	MessageID
+
+	Format string `json:"format"`
+}
+
+// An ImportBuddiesMessage sends buddy requests to every
+// user in a buddy list, and restores the aliases of users
+// who are already buddies.
+type ImportBuddiesMessage struct {
+	MessageID
+
+	Format string `json:"format"`
+	Data   string `json:"data"`
+}
+
+type SetProfileMessage struct {
+	MessageID
+
+	DisplayName string `json:"display_name"`
+	Pronouns    string `json:"pronouns"`
+	Bio         string `json:"bio"`
+}
+
+// A GetProfileMessage requests the profile of the user or
+// one of their buddies.
+type GetProfileMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+}
+
+// A SetAwayNoteMessage changes the user's away note, a
+// longer message than their status message which buddies
+// may read while the user is Away or DoNotDisturb.
+type SetAwayNoteMessage struct {
+	MessageID
+
+	Note string `json:"note"`
+}
+
+// A GetAwayNoteMessage requests the away note of the user
+// or one of their buddies.
+type GetAwayNoteMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+}
+
+// A GetStatusHistoryMessage requests the statuses which
+// the user or one of their buddies set, if the server
+// keeps status history and the buddy's privacy settings
+// allow it.
+type GetStatusHistoryMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+
+	// Since is a time in Unix milliseconds before which
+	// statuses are omitted.
+	Since int64 `json:"since,omitempty"`
+}
+
+// MaxAvatarUploadSize is the maximum size of an uploaded
+// avatar, in bytes.
+const MaxAvatarUploadSize = 1 << 20
+
+// A SetAvatarMessage uploads a new avatar.
+// An empty Data field removes the user's avatar.
+type SetAvatarMessage struct {
+	MessageID
+
+	// Data is a PNG, JPEG, or GIF image, which is base64
+	// encoded in JSON.
+	Data []byte `json:"data"`
+}
+
+type GetAvatarMessage struct {
+	MessageID
+
+	Hash string `json:"hash"`
+}
+
+type GetPushKeyMessage struct {
+	MessageID
+}
+
+// PushKeys are the keys of a browser's push subscription,
+// base64url encoded.
+type PushKeys struct {
+	P256DH string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// An AddPushSubscriptionMessage asks the server to send
+// the user's buddy requests and accepts to a browser while
+// the user is offline.
+//
+// The fields match the JSON form of the browser's
+// PushSubscription.
+type AddPushSubscriptionMessage struct {
+	MessageID
+
+	Endpoint string   `json:"endpoint"`
+	Keys     PushKeys `json:"keys"`
+}
+
+type RemovePushSubscriptionMessage struct {
+	MessageID
+
+	Endpoint string `json:"endpoint"`
+}
+
+// Events which may trigger a user's webhooks.
+const (
+	WebhookStatusChanged   = "status_changed"
+	WebhookRequestReceived = "request_received"
+
+	// WebhookTest is only sent by TestWebhook.
+	WebhookTest = "test"
+)
+
+// WebhookEvents lists the events which users may register
+// webhooks for.
+var WebhookEvents = []string{WebhookStatusChanged, WebhookRequestReceived}
+
+// An AddWebhookMessage registers a URL to be called when
+// some of the user's own events occur.
+type AddWebhookMessage struct {
+	MessageID
+
+	URL string `json:"url"`
+
+	// Events are from WebhookEvents.
+	Events []string `json:"events"`
+}
+
+type RemoveWebhookMessage struct {
+	MessageID
+
+	ID string `json:"webhook_id"`
+}
+
+type ListWebhooksMessage struct {
+	MessageID
+}
+
+// An AuthorizeIntegrationMessage asks for the page where
+// the user may authorize the server to use another
+// service, such as "slack".
+//
+// The service then redirects the user to RedirectURI with
+// a code, which the client sends in a
+// ConnectIntegrationMessage.
+type AuthorizeIntegrationMessage struct {
+	MessageID
+
+	Provider    string `json:"provider"`
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// A ConnectIntegrationMessage completes the authorization
+// of another service, and chooses which directions the
+// user's status is synchronized in.
+//
+// For "alertmanager", which needs no authorization, the
+// code is the name of an Alertmanager receiver and there
+// is no redirect URI.
+type ConnectIntegrationMessage struct {
+	MessageID
+
+	Provider    string `json:"provider"`
+	Code        string `json:"code"`
+	RedirectURI string `json:"redirect_uri,omitempty"`
+	Import      bool   `json:"import"`
+	Export      bool   `json:"export"`
+}
+
+type DisconnectIntegrationMessage struct {
+	MessageID
+
+	Provider string `json:"provider"`
+}
+
+type ListIntegrationsMessage struct {
+	MessageID
+}
+
+// A SetDiscoverableMessage controls whether users who have
+// the user's email in their contacts may find them with an
+// ImportContactsMessage.
+type SetDiscoverableMessage struct {
+	MessageID
+
+	Discoverable bool `json:"discoverable"`
+}
+
+// An AuthorizeContactsMessage asks for the page where the
+// user may let the server read their contacts from an
+// OAuth source, such as "google".
+//
+// The source then redirects the user to RedirectURI with a
+// code, which the client sends in an
+// ImportContactsMessage. The response is an
+// IntegrationURLMessage.
+type AuthorizeContactsMessage struct {
+	MessageID
+
+	Source      string `json:"source"`
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// Names of the supported contact sources.
+const (
+	ContactsGoogle  = "google"
+	ContactsCardDAV = "carddav"
+)
+
+// An ImportContactsMessage reads the user's contacts once,
+// either with an OAuth code or from a CardDAV address book,
+// and suggests the registered users among them.
+type ImportContactsMessage struct {
+	MessageID
+
+	Source      string `json:"source"`
+	Code        string `json:"code,omitempty"`
+	RedirectURI string `json:"redirect_uri,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+}
+
+// A SuggestBuddiesMessage asks for buddies of the user's
+// buddies, with the numbers of buddies they share.
+type SuggestBuddiesMessage struct {
+	MessageID
+}
+
+// A TestWebhookMessage asks the server to send a webhook a
+// delivery with the "test" event, and to report whether it
+// was accepted.
+type TestWebhookMessage struct {
+	MessageID
+
+	ID string `json:"webhook_id"`
+}
+
+// A CreateAPIKeyMessage replaces the user's API key, with
+// which REST integrations, such as Zapier, authenticate.
+// The response is an APIKeyMessage.
+type CreateAPIKeyMessage struct {
+	MessageID
+}
+
+type RevokeAPIKeyMessage struct {
+	MessageID
+}
+
+type EnableTwoFactorMessage struct {
+	MessageID
+}
+
+type DisableTwoFactorMessage struct {
+	MessageID
+}
+
+type RegenerateRecoveryCodesMessage struct {
+	MessageID
+}
+
+type ReauthenticateMessage struct {
+	MessageID
+
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"`
+}
+
+// A DeleteAccountMessage permanently deletes the user's
+// account.
+//
+// On success, every session for the user receives a
+// security_alert of "account_deleted" followed by a
+// forced_logout.
+type DeleteAccountMessage struct {
+	MessageID
+
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"`
+}
+
+// A SyncSinceMessage asks for the changes since a
+// previous full state or delta, identified by its
+// server_time.
+type SyncSinceMessage struct {
+	MessageID
+
+	// Since is a server time in Unix milliseconds.
+	Since int64 `json:"since"`
+}
+
+// A BatchCommand is an encoded client message inside of a
+// BatchMessage.
+type BatchCommand struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// A BatchMessage contains client messages to be executed
+// in order.
+// The server replies with a single BatchResultMessage.
+type BatchMessage struct {
+	MessageID
+
+	Commands []BatchCommand `json:"commands"`
+}
+
+type LoginSuccessMessage struct {
+	MessageID
+}
+
+type LoginFailureMessage ErrorMessage
+
+type RegisterSuccessMessage struct {
+	MessageID
+}
+
+type RegisterFailureMessage LoginFailureMessage
+
+type ForcedLogoutMessage struct{}
+
+// An AnnouncementsMessage replaces the client's list of
+// active announcements.
+type AnnouncementsMessage struct {
+	Announcements []statusdb.Announcement `json:"announcements"`
+}
+
+// A ReconnectMessage tells the client that the server is
+// restarting, or that the connection has reached its
+// maximum lifetime, and that it should log in again with
+// its saved credentials.
+type ReconnectMessage struct{}
+
+// A SecurityAlert identifies the reason behind a security
+// alert or an intentional disconnect.
+type SecurityAlert string
+
+const (
+	SecurityAlertPasswordChanged SecurityAlert = "password_changed"
+	SecurityAlertNewLogin        SecurityAlert = "new_login"
+	SecurityAlertForcedLogout    SecurityAlert = "forced_logout"
+	SecurityAlertAccountDeleted  SecurityAlert = "account_deleted"
+	SecurityAlertSuspended       SecurityAlert = "account_suspended"
+	SecurityAlertAccountMerged   SecurityAlert = "account_merged"
+)
+
+// A SecurityAlertMessage notifies the client of an event
+// which may affect the security of the account, such as a
+// password change from a different device.
+type SecurityAlertMessage struct {
+	Alert SecurityAlert `json:"alert"`
+}
+
+type TwoFactorEnabledMessage struct {
+	MessageID
+
+	Secret        string   `json:"secret"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type RecoveryCodesMessage struct {
+	MessageID
+
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type ReauthSuccessMessage struct {
+	MessageID
+}
+
+type ReauthFailureMessage LoginFailureMessage
+
+// An AckMessage indicates that a client message was
+// handled successfully.
+type AckMessage struct {
+	MessageID
+}
+
+// An ErrorMessage indicates that a client message could
+// not be handled.
+type ErrorMessage struct {
+	MessageID
+
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+
+	// Field is set for validation errors to indicate which
+	// field of the client message was invalid.
+	Field string `json:"field,omitempty"`
+
+	// Fields is set when strict decoding rejects a message,
+	// and lists the fields which the server did not expect.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// A CapabilitiesMessage lists the message types and
+// protocol extensions supported by the sender.
+//
+// Either side may send this message.
+// Once a client has declared its capabilities, the server
+// will not push it messages of unsupported types.
+type CapabilitiesMessage struct {
+	MessageID
+
+	MessageTypes []string `json:"message_types"`
+	Extensions   []string `json:"extensions"`
+
+	// Locale may be set by clients; see LoginMessage.
+	Locale string `json:"locale,omitempty"`
+}
+
+// A RequestSentMessage indicates that the user sent a
+// buddy request, possibly from a different device.
+type RequestSentMessage struct {
+	Email string `json:"email"`
+}
+
+type RequestReceivedMessage struct {
+	Email    string `json:"email"`
+	Greeting string `json:"greeting,omitempty"`
+}
+
+// An AcceptSentMessage indicates that the user accepted a
+// request, possibly from a different device. Status is the
+// new buddy's status.
+type AcceptSentMessage struct {
+	Email  string              `json:"email"`
+	Status statusdb.UserStatus `json:"status"`
+}
+
+// A RequestAcceptedMessage indicates that the recipient of
+// one of the user's requests accepted it. Status is the
+// new buddy's status.
+type RequestAcceptedMessage struct {
+	Email  string              `json:"email"`
+	Status statusdb.UserStatus `json:"status"`
+}
+
+// A BuddyRemovedMessage indicates that the user and a
+// buddy stopped being buddies, because either of them
+// removed or blocked the other or deleted their account.
+type BuddyRemovedMessage struct {
+	Email string `json:"email"`
+}
+
+// A SyncErrorMessage indicates that the server could not
+// keep the client's data consistent. The client should
+// reconnect to get a new full state.
+type SyncErrorMessage struct {
+	Message string `json:"message"`
+}
+
+// A RequestDeclinedMessage indicates that a request was
+// declined, either by the user or by the recipient of one
+// of the user's requests.
+type RequestDeclinedMessage struct {
+	Email string `json:"email"`
+}
+
+// A RequestCanceledMessage indicates that a request was
+// withdrawn, either by the user or by the sender of one of
+// the user's incoming requests.
+type RequestCanceledMessage struct {
+	Email string `json:"email"`
+}
+
+type StatusChangedMessage struct {
+	Email  string              `json:"email"`
+	Status statusdb.UserStatus `json:"status"`
+}
+
+// A UserBlockedMessage indicates that the user blocked
+// someone, possibly from a different device.
+type UserBlockedMessage struct {
+	Email string `json:"email"`
+}
+
+type UserUnblockedMessage UserBlockedMessage
+
+type AliasChangedMessage struct {
+	Email string `json:"email"`
+	Alias string `json:"alias"`
+}
+
+// A LimitsMessage advertises the server's policies, so
+// that clients can adapt their UI accordingly.
+//
+// Limits which are zero are not enforced.
+type LimitsMessage struct {
+	MaxStatusMessageLength int `json:"max_status_message_length"`
+	MaxGreetingLength      int `json:"max_greeting_length"`
+	MaxAliasLength         int `json:"max_alias_length"`
+	MaxUserMetadataLength  int `json:"max_user_metadata_length"`
+	MaxAvatarUploadSize    int `json:"max_avatar_upload_size"`
+	MaxDisplayNameLength   int `json:"max_display_name_length"`
+	MaxPronounsLength      int `json:"max_pronouns_length"`
+	MaxBioLength           int `json:"max_bio_length"`
+	MaxBatchCommands       int `json:"max_batch_commands"`
+	MaxBuddies             int `json:"max_buddies"`
+	MaxPendingRequests     int `json:"max_pending_requests"`
+	MaxSessionsPerUser     int `json:"max_sessions_per_user"`
+
+	// MaxMessagesPerMinute is the number of client messages
+	// which may be sent per minute.
+	MaxMessagesPerMinute int `json:"max_messages_per_minute"`
+	MaxLookupsPerMinute  int `json:"max_lookups_per_minute"`
+	MaxReportsPerHour    int `json:"max_reports_per_hour"`
+
+	// StatusHistoryLength is zero if status history is
+	// disabled.
+	StatusHistoryLength int `json:"status_history_length"`
+
+	// PingInterval and PingTimeout are measured in seconds.
+	PingInterval int `json:"ping_interval"`
+	PingTimeout  int `json:"ping_timeout"`
+}
+
+// A PingMessage may be sent by either side to measure
+// latency or check that the other side is responsive.
+// The receiver should reply with a PongMessage.
+type PingMessage struct {
+	MessageID
+
+	// Time is the sender's clock, in Unix milliseconds.
+	Time int64 `json:"time"`
+
+	// RTT is the round-trip time most recently measured by
+	// the server, in milliseconds.
+	// It is only set on pings from the server.
+	RTT int64 `json:"rtt,omitempty"`
+}
+
+type PongMessage struct {
+	MessageID
+
+	// Time is copied from the PingMessage.
+	Time int64 `json:"time"`
+
+	// ServerTime is the server's clock, in Unix
+	// milliseconds.
+	// It is only set on pongs from the server.
+	ServerTime int64 `json:"server_time,omitempty"`
+}
+
+// A PushKeyMessage is the response to a GetPushKeyMessage,
+// giving the applicationServerKey for subscribing to push
+// notifications.
+type PushKeyMessage struct {
+	MessageID
+
+	PublicKey string `json:"public_key"`
+}
+
+// A WebhookMessage is the response to an
+// AddWebhookMessage.
+//
+// This is the only time that the webhook's secret is sent
+// to the client.
+type WebhookMessage struct {
+	MessageID
+
+	Webhook statusdb.Webhook `json:"webhook"`
+}
+
+// A WebhooksMessage is the response to a
+// ListWebhooksMessage. The webhooks' secrets are omitted.
+type WebhooksMessage struct {
+	MessageID
+
+	Webhooks []statusdb.Webhook `json:"webhooks"`
+}
+
+// A PrivacyMessage is the response to a
+// GetPrivacyMessage.
+type PrivacyMessage struct {
+	MessageID
+
+	Privacy statusdb.PrivacySettings `json:"privacy"`
+}
+
+// A StatusHistoryMessage is the response to a
+// GetStatusHistoryMessage, listing statuses oldest first.
+type StatusHistoryMessage struct {
+	MessageID
+
+	Email   string                        `json:"email"`
+	History []statusdb.StatusHistoryEntry `json:"history"`
+}
+
+// An APIKeyMessage is the response to a
+// CreateAPIKeyMessage. The key cannot be retrieved again
+// later.
+type APIKeyMessage struct {
+	MessageID
+
+	APIKey string `json:"api_key"`
+}
+
+// An IntegrationURLMessage is the response to an
+// AuthorizeIntegrationMessage or AuthorizeContactsMessage.
+type IntegrationURLMessage struct {
+	MessageID
+
+	URL string `json:"url"`
+}
+
+// An IntegrationMessage is the response to a
+// ConnectIntegrationMessage.
+type IntegrationMessage struct {
+	MessageID
+
+	Integration statusdb.Integration `json:"integration"`
+}
+
+// An IntegrationsMessage is the response to a
+// ListIntegrationsMessage.
+type IntegrationsMessage struct {
+	MessageID
+
+	Integrations []statusdb.Integration `json:"integrations"`
+}
+
+// A Suggestion is a user who the session's user might want
+// to send a buddy request to.
+type Suggestion struct {
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarHash  string `json:"avatar_hash,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+
+	// MutualBuddies is the number of buddies whom the users
+	// share, for suggestions from SuggestBuddies.
+	MutualBuddies int `json:"mutual_buddies,omitempty"`
+}
+
+// A SuggestionsMessage is the response to an
+// ImportContactsMessage or a SuggestBuddiesMessage,
+// listing users who the client may offer to send buddy
+// requests to.
+type SuggestionsMessage struct {
+	MessageID
+
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+// An AvatarMessage is the response to a GetAvatarMessage.
+type AvatarMessage struct {
+	MessageID
+
+	Hash string `json:"hash"`
+
+	// Data is a PNG image.
+	Data []byte `json:"data"`
+}
+
+// A LookupResultMessage is the response to a
+// LookupUserMessage.
+type LookupResultMessage struct {
+	MessageID
+
+	Email       string `json:"email"`
+	Registered  bool   `json:"registered"`
+	Requestable bool   `json:"requestable"`
+
+	// Reason is set when a registered user is not
+	// requestable, e.g. to ERR_ALREADY_BUDDIES.
+	Reason ErrorCode `json:"reason,omitempty"`
+}
+
+// A BuddyListMessage is the response to an
+// ExportBuddiesMessage.
+type BuddyListMessage struct {
+	MessageID
+
+	Format string `json:"format"`
+	Data   string `json:"data"`
+}
+
+// An ImportResultMessage is the response to an
+// ImportBuddiesMessage, with one result per buddy.
+type ImportResultMessage struct {
+	MessageID
+
+	Results []ImportResult `json:"results"`
+}
+
+// A ProfileMessage is the response to a GetProfileMessage.
+type ProfileMessage struct {
+	MessageID
+
+	Email   string           `json:"email"`
+	Profile statusdb.Profile `json:"profile"`
+}
+
+// An AwayNoteMessage is the response to a
+// GetAwayNoteMessage. The note is empty if the buddy is
+// not Away or DoNotDisturb.
+type AwayNoteMessage struct {
+	MessageID
+
+	Email string `json:"email"`
+	Note  string `json:"note"`
+}
+
+// A MissedEventsMessage is sent after the full state on
+// login, listing buddy-related events which occurred while
+// the user had no sessions.
+type MissedEventsMessage struct {
+	Events []statusdb.MissedEvent `json:"events"`
+}
+
+// A ProfileChangedMessage indicates that a buddy, or the
+// user themselves, changed their profile.
+type ProfileChangedMessage struct {
+	Email   string           `json:"email"`
+	Profile statusdb.Profile `json:"profile"`
+}
+
+// A ServerNotice is a message from the server operators,
+// such as a maintenance warning or a policy update.
+type ServerNotice struct {
+	Level statusdb.NoticeLevel `json:"level"`
+	Text  string               `json:"text"`
+	Time  time.Time            `json:"time"`
+
+	// Key optionally identifies a translation of Text in
+	// the message catalogs.
+	Key string `json:"key,omitempty"`
+}
+
+// A ServerNoticeMessage relays a notice from the server
+// operators.
+type ServerNoticeMessage struct {
+	ServerNotice
+}
+
+// A BuddyState describes a buddy in a FullStateMessage.
+type BuddyState struct {
+	Email   string              `json:"email"`
+	Alias   string              `json:"alias,omitempty"`
+	Status  statusdb.UserStatus `json:"status"`
+	Profile statusdb.Profile    `json:"profile"`
+}
+
+// A FullStateMessage contains all of the information the
+// client needs to render the user's buddy list.
+type FullStateMessage struct {
+	// ServerTime is the time at which the state was read,
+	// in Unix milliseconds, for use with sync_since.
+	ServerTime int64 `json:"server_time"`
+
+	// Status and Profile are the user's own.
+	Status  statusdb.UserStatus `json:"status"`
+	Profile statusdb.Profile    `json:"profile"`
+
+	Buddies          []BuddyState `json:"buddies"`
+	IncomingRequests []string     `json:"incoming_requests"`
+	OutgoingRequests []string     `json:"outgoing_requests"`
+
+	// Greetings maps senders of incoming requests to their
+	// introductions, if they included one.
+	Greetings map[string]string `json:"greetings,omitempty"`
+
+	Blocked []string `json:"blocked"`
+
+	DNDSuppressEvents bool   `json:"dnd_suppress_events"`
+	AwayNote          string `json:"away_note,omitempty"`
+	TimeZone          string `json:"time_zone,omitempty"`
+
+	// LastSeenVisibility is the LastSeen privacy setting,
+	// for clients from before Privacy.
+	LastSeenVisibility statusdb.Visibility      `json:"last_seen_visibility,omitempty"`
+	Privacy            statusdb.PrivacySettings `json:"privacy"`
+	PublicPresence     bool                     `json:"public_presence"`
+	Discoverable       bool                     `json:"discoverable"`
+
+	CustomStates []statusdb.CustomState `json:"custom_states"`
+	Schedule     statusdb.Schedule      `json:"schedule"`
+
+	// Announcements are the active announcements.
+	Announcements []statusdb.Announcement `json:"announcements"`
+}
+
+// A SyncDeltaMessage is the response to a
+// SyncSinceMessage.
+//
+// If Full is set, the client should replace its state
+// entirely. Otherwise, Buddies lists only the buddies
+// whose status or profile changed.
+type SyncDeltaMessage struct {
+	MessageID
+
+	ServerTime int64 `json:"server_time"`
+
+	Full *FullStateMessage `json:"full,omitempty"`
+
+	Status  *statusdb.UserStatus `json:"status,omitempty"`
+	Buddies []BuddyState         `json:"buddies,omitempty"`
+
+	// Announcements are always sent in full.
+	Announcements []statusdb.Announcement `json:"announcements,omitempty"`
+}
+
+// FullStateChunkSize is the maximum number of buddies in
+// a FullStateChunkMessage.
+const FullStateChunkSize = 100
+
+// A FullStateBeginMessage starts a full state which is
+// split into chunks, for clients supporting the
+// "paged_full_state" extension.
+//
+// It is followed by ChunkCount FullStateChunkMessages and
+// a FullStateEndMessage.
+type FullStateBeginMessage struct {
+	// State contains everything but the buddies.
+	State *FullStateMessage `json:"state"`
+
+	BuddyCount int `json:"buddy_count"`
+	ChunkCount int `json:"chunk_count"`
+}
+
+type FullStateChunkMessage struct {
+	Index   int          `json:"index"`
+	Buddies []BuddyState `json:"buddies"`
+}
+
+type FullStateEndMessage struct{}
+
+// A BatchResult is an encoded response to a command in a
+// BatchMessage.
+type BatchResult BatchCommand
+
+// NewBatchResult encodes a response message.
+func NewBatchResult(msg Message) *BatchResult {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		msg = &ErrorMessage{
+			MessageID: MessageID{ID: RequestID(msg)},
+			Code:      ErrCodeUnknown,
+			Message:   err.Error(),
+		}
+		data, _ = json.Marshal(msg)
+	}
+	return &BatchResult{Type: msg.Type(), Data: data}
+}
+
+// A BatchResultMessage contains the responses to the
+// commands in a BatchMessage, in order.
+type BatchResultMessage struct {
+	MessageID
+
+	Results []*BatchResult `json:"results"`
+}
+
+func (*LoginMessage) Type() string {
+	return MsgTypeLogin
+}
+
+func (*RegisterMessage) Type() string {
+	return MsgTypeRegister
+}
+
+func (*BotLoginMessage) Type() string {
+	return MsgTypeBotLogin
+}
+
+func (*RegisterVerifyMessage) Type() string {
+	return MsgTypeRegisterVerify
+}
+
+func (*SetPasswordMessage) Type() string {
+	return MsgTypeSetPassword
+}
+
+func (*ResetPasswordMessage) Type() string {
+	return MsgTypeResetPassword
+}
+
+func (*LogoutMessage) Type() string {
+	return MsgTypeLogout
+}
+
+func (*LogoutOtherMessage) Type() string {
+	return MsgTypeLogoutOther
+}
+
+func (*SetStatusMessage) Type() string {
+	return MsgTypeSetStatus
+}
+
+func (*AddBuddyMessage) Type() string {
+	return MsgTypeAddBuddy
+}
+
+func (*AcceptRequestMessage) Type() string {
+	return MsgTypeAcceptRequest
+}
+
+func (*RemoveBuddyMessage) Type() string {
+	return MsgTypeRemoveBuddy
+}
+
+func (*DeclineRequestMessage) Type() string {
+	return MsgTypeDeclineRequest
+}
+
+func (*CancelRequestMessage) Type() string {
+	return MsgTypeCancelRequest
+}
+
+func (*BlockUserMessage) Type() string {
+	return MsgTypeBlockUser
+}
+
+func (*UnblockUserMessage) Type() string {
+	return MsgTypeUnblockUser
+}
+
+func (*SetAliasMessage) Type() string {
+	return MsgTypeSetAlias
+}
+
+func (*SetDNDSettingsMessage) Type() string {
+	return MsgTypeSetDNDSettings
+}
+
+func (*SetVisibilityMessage) Type() string {
+	return MsgTypeSetVisibility
+}
+
+func (*SetLastSeenMessage) Type() string {
+	return MsgTypeSetLastSeen
+}
+
+func (*SetPrivacyMessage) Type() string {
+	return MsgTypeSetPrivacy
+}
+
+func (*GetPrivacyMessage) Type() string {
+	return MsgTypeGetPrivacy
+}
+
+func (*SetTimeZoneMessage) Type() string {
+	return MsgTypeSetTimeZone
+}
+
+func (*GetStatusHistoryMessage) Type() string {
+	return MsgTypeGetHistory
+}
+
+func (*SetPublicMessage) Type() string {
+	return MsgTypeSetPublic
+}
+
+func (*SubscribeMessage) Type() string {
+	return MsgTypeSubscribe
+}
+
+func (*UnsubscribeMessage) Type() string {
+	return MsgTypeUnsubscribe
+}
+
+func (*SetIdleMessage) Type() string {
+	return MsgTypeSetIdle
+}
+
+func (*SetActiveMessage) Type() string {
+	return MsgTypeSetActive
+}
+
+func (*SetCustomStatesMessage) Type() string {
+	return MsgTypeSetCustomStates
+}
+
+func (*SetScheduleMessage) Type() string {
+	return MsgTypeSetSchedule
+}
+
+func (*LookupUserMessage) Type() string {
+	return MsgTypeLookupUser
+}
+
+func (*ReportUserMessage) Type() string {
+	return MsgTypeReportUser
+}
+
+func (*GetStatsMessage) Type() string {
+	return MsgTypeGetStats
+}
+
+func (*StatsMessage) Type() string {
+	return MsgTypeStats
+}
+
+func (*GetServerStatsMessage) Type() string {
+	return MsgTypeGetServerStats
+}
+
+func (*ServerStatsMessage) Type() string {
+	return MsgTypeServerStats
+}
+
+func (*GetServerInfoMessage) Type() string {
+	return MsgTypeGetServerInfo
+}
+
+func (*ServerInfoMessage) Type() string {
+	return MsgTypeServerInfo
+}
+
+func (*ExportBuddiesMessage) Type() string {
+	return MsgTypeExportBuddies
+}
+
+func (*ImportBuddiesMessage) Type() string {
+	return MsgTypeImportBuddies
+}
+
+func (*SetProfileMessage) Type() string {
+	return MsgTypeSetProfile
+}
+
+func (*GetProfileMessage) Type() string {
+	return MsgTypeGetProfile
+}
+
+func (*SetAwayNoteMessage) Type() string {
+	return MsgTypeSetAwayNote
+}
+
+func (*GetAwayNoteMessage) Type() string {
+	return MsgTypeGetAwayNote
+}
+
+func (*SetAvatarMessage) Type() string {
+	return MsgTypeSetAvatar
+}
+
+func (*GetAvatarMessage) Type() string {
+	return MsgTypeGetAvatar
+}
+
+func (*GetPushKeyMessage) Type() string {
+	return MsgTypeGetPushKey
+}
+
+func (*AddPushSubscriptionMessage) Type() string {
+	return MsgTypeAddPushSub
+}
+
+func (*RemovePushSubscriptionMessage) Type() string {
+	return MsgTypeRemovePushSub
+}
+
+func (*AddWebhookMessage) Type() string {
+	return MsgTypeAddWebhook
+}
+
+func (*RemoveWebhookMessage) Type() string {
+	return MsgTypeRemoveWebhook
+}
+
+func (*ListWebhooksMessage) Type() string {
+	return MsgTypeListWebhooks
+}
+
+func (*TestWebhookMessage) Type() string {
+	return MsgTypeTestWebhook
+}
+
+func (*CreateAPIKeyMessage) Type() string {
+	return MsgTypeCreateAPIKey
+}
+
+func (*RevokeAPIKeyMessage) Type() string {
+	return MsgTypeRevokeAPIKey
+}
+
+func (*AuthorizeIntegrationMessage) Type() string {
+	return MsgTypeAuthorizeIntegration
+}
+
+func (*ConnectIntegrationMessage) Type() string {
+	return MsgTypeConnectIntegration
+}
+
+func (*DisconnectIntegrationMessage) Type() string {
+	return MsgTypeDisconnectIntegration
+}
+
+func (*ListIntegrationsMessage) Type() string {
+	return MsgTypeListIntegrations
+}
+
+func (*SetDiscoverableMessage) Type() string {
+	return MsgTypeSetDiscoverable
+}
+
+func (*AuthorizeContactsMessage) Type() string {
+	return MsgTypeAuthorizeContacts
+}
+
+func (*ImportContactsMessage) Type() string {
+	return MsgTypeImportContacts
+}
+
+func (*SuggestBuddiesMessage) Type() string {
+	return MsgTypeSuggestBuddies
+}
+
+func (*EnableTwoFactorMessage) Type() string {
+	return MsgTypeEnableTwoFactor
+}
+
+func (*DisableTwoFactorMessage) Type() string {
+	return MsgTypeDisableTwoFactor
+}
+
+func (*RegenerateRecoveryCodesMessage) Type() string {
+	return MsgTypeRegenerateRecoveryCodes
+}
+
+func (*ReauthenticateMessage) Type() string {
+	return MsgTypeReauthenticate
+}
+
+func (*DeleteAccountMessage) Type() string {
+	return MsgTypeDeleteAccount
+}
+
+func (*SyncSinceMessage) Type() string {
+	return MsgTypeSyncSince
+}
+
+func (*BatchMessage) Type() string {
+	return MsgTypeBatch
+}
+
+func (*LoginSuccessMessage) Type() string {
+	return MsgTypeLoginSuccess
+}
+
+func (*LoginFailureMessage) Type() string {
+	return MsgTypeLoginFailure
+}
+
+func (*RegisterSuccessMessage) Type() string {
+	return MsgTypeRegisterSuccess
+}
+
+func (*RegisterFailureMessage) Type() string {
+	return MsgTypeRegisterFailure
+}
+
+func (*ForcedLogoutMessage) Type() string {
+	return MsgTypeForcedLogout
+}
+
+func (*AnnouncementsMessage) Type() string {
+	return MsgTypeAnnouncements
+}
+
+func (*ReconnectMessage) Type() string {
+	return MsgTypeReconnect
+}
+
+func (*SecurityAlertMessage) Type() string {
+	return MsgTypeSecurityAlert
+}
+
+func (*TwoFactorEnabledMessage) Type() string {
+	return MsgTypeTwoFactorEnabled
+}
+
+func (*RecoveryCodesMessage) Type() string {
+	return MsgTypeRecoveryCodes
+}
+
+func (*ReauthSuccessMessage) Type() string {
+	return MsgTypeReauthSuccess
+}
+
+func (*ReauthFailureMessage) Type() string {
+	return MsgTypeReauthFailure
+}
+
+func (*CapabilitiesMessage) Type() string {
+	return MsgTypeCapabilities
+}
+
+func (*RequestSentMessage) Type() string {
+	return MsgTypeRequestSent
+}
+
+func (*RequestReceivedMessage) Type() string {
+	return MsgTypeRequestReceived
+}
+
+func (*AcceptSentMessage) Type() string {
+	return MsgTypeAcceptSent
+}
+
+func (*RequestAcceptedMessage) Type() string {
+	return MsgTypeRequestAccepted
+}
+
+func (*BuddyRemovedMessage) Type() string {
+	return MsgTypeBuddyRemoved
+}
+
+func (*SyncErrorMessage) Type() string {
+	return MsgTypeSyncError
+}
+
+func (*RequestDeclinedMessage) Type() string {
+	return MsgTypeRequestDeclined
+}
+
+func (*RequestCanceledMessage) Type() string {
+	return MsgTypeRequestCanceled
+}
+
+func (*StatusChangedMessage) Type() string {
+	return MsgTypeStatusChanged
+}
+
+func (*UserBlockedMessage) Type() string {
+	return MsgTypeUserBlocked
+}
+
+func (*UserUnblockedMessage) Type() string {
+	return MsgTypeUserUnblocked
+}
+
+func (*AliasChangedMessage) Type() string {
+	return MsgTypeAliasChanged
+}
+
+func (*MissedEventsMessage) Type() string {
+	return MsgTypeMissedEvents
+}
+
+func (*ProfileChangedMessage) Type() string {
+	return MsgTypeProfileChanged
+}
+
+func (*LookupResultMessage) Type() string {
+	return MsgTypeLookupResult
+}
+
+func (*BuddyListMessage) Type() string {
+	return MsgTypeBuddyList
+}
+
+func (*ImportResultMessage) Type() string {
+	return MsgTypeImportResult
+}
+
+func (*ProfileMessage) Type() string {
+	return MsgTypeProfile
+}
+
+func (*AwayNoteMessage) Type() string {
+	return MsgTypeAwayNote
+}
+
+func (*AvatarMessage) Type() string {
+	return MsgTypeAvatar
+}
+
+func (*PushKeyMessage) Type() string {
+	return MsgTypePushKey
+}
+
+func (*WebhookMessage) Type() string {
+	return MsgTypeWebhook
+}
+
+func (*WebhooksMessage) Type() string {
+	return MsgTypeWebhooks
+}
+
+func (*APIKeyMessage) Type() string {
+	return MsgTypeAPIKey
+}
+
+func (*PrivacyMessage) Type() string {
+	return MsgTypePrivacy
+}
+
+func (*StatusHistoryMessage) Type() string {
+	return MsgTypeStatusHistory
+}
+
+func (*IntegrationURLMessage) Type() string {
+	return MsgTypeIntegrationURL
+}
+
+func (*IntegrationMessage) Type() string {
+	return MsgTypeIntegration
+}
+
+func (*IntegrationsMessage) Type() string {
+	return MsgTypeIntegrations
+}
+
+func (*SuggestionsMessage) Type() string {
+	return MsgTypeSuggestions
+}
+
+func (*CompressedMessage) Type() string {
+	return MsgTypeCompressed
+}
+
+func (*ServerNoticeMessage) Type() string {
+	return MsgTypeServerNotice
+}
+
+func (*LimitsMessage) Type() string {
+	return MsgTypeLimits
+}
+
+func (*PingMessage) Type() string {
+	return MsgTypePing
+}
+
+func (*PongMessage) Type() string {
+	return MsgTypePong
+}
+
+func (*FullStateBeginMessage) Type() string {
+	return MsgTypeFullStateBegin
+}
+
+func (*FullStateChunkMessage) Type() string {
+	return MsgTypeFullStateChunk
+}
+
+func (*FullStateEndMessage) Type() string {
+	return MsgTypeFullStateEnd
+}
+
+func (*SyncDeltaMessage) Type() string {
+	return MsgTypeSyncDelta
+}
+
+func (*FullStateMessage) Type() string {
+	return MsgTypeFullState
+}
+
+func (*BatchResultMessage) Type() string {
+	return MsgTypeBatchResult
+}
+
+func (*AckMessage) Type() string {
+	return MsgTypeAck
+}
+
+func (*ErrorMessage) Type() string {
+	return MsgTypeError
+}
+
+// DecodeMessage decodes a message into its Go type.
+func DecodeMessage(msgType string, data []byte) (msg Message, err error) {
+	defer essentials.AddCtxTo("decode message", &err)
+	if obj, ok := NewMessage(msgType); ok {
+		if err := json.Unmarshal(data, obj); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	} else {
+		return nil, errors.New("unknown message type: " + msgType)
+	}
+}
+
+// builtinMessages creates an empty message of every type
+// which is built into the protocol.
+func builtinMessages() []Message {
+	return []Message{
+		&LoginMessage{},
+		&RegisterMessage{},
+		&BotLoginMessage{},
+		&RegisterVerifyMessage{},
+		&SetPasswordMessage{},
+		&ResetPasswordMessage{},
+		&LogoutMessage{},
+		&LogoutOtherMessage{},
+		&SetStatusMessage{},
+		&AddBuddyMessage{},
+		&AcceptRequestMessage{},
+		&RemoveBuddyMessage{},
+		&DeclineRequestMessage{},
+		&CancelRequestMessage{},
+		&BlockUserMessage{},
+		&UnblockUserMessage{},
+		&SetAliasMessage{},
+		&SetDNDSettingsMessage{},
+		&SetVisibilityMessage{},
+		&SetLastSeenMessage{},
+		&SetPrivacyMessage{},
+		&GetPrivacyMessage{},
+		&SetTimeZoneMessage{},
+		&GetStatusHistoryMessage{},
+		&SetPublicMessage{},
+		&SubscribeMessage{},
+		&UnsubscribeMessage{},
+		&SetIdleMessage{},
+		&SetActiveMessage{},
+		&SetCustomStatesMessage{},
+		&SetScheduleMessage{},
+		&LookupUserMessage{},
+		&ReportUserMessage{},
+		&GetStatsMessage{},
+		&GetServerStatsMessage{},
+		&GetServerInfoMessage{},
+		&ExportBuddiesMessage{},
+		&ImportBuddiesMessage{},
+		&SetProfileMessage{},
+		&GetProfileMessage{},
+		&SetAwayNoteMessage{},
+		&GetAwayNoteMessage{},
+		&SetAvatarMessage{},
+		&GetAvatarMessage{},
+		&GetPushKeyMessage{},
+		&AddPushSubscriptionMessage{},
+		&RemovePushSubscriptionMessage{},
+		&AddWebhookMessage{},
+		&RemoveWebhookMessage{},
+		&ListWebhooksMessage{},
+		&TestWebhookMessage{},
+		&CreateAPIKeyMessage{},
+		&RevokeAPIKeyMessage{},
+		&AuthorizeIntegrationMessage{},
+		&ConnectIntegrationMessage{},
+		&DisconnectIntegrationMessage{},
+		&ListIntegrationsMessage{},
+		&SetDiscoverableMessage{},
+		&AuthorizeContactsMessage{},
+		&ImportContactsMessage{},
+		&SuggestBuddiesMessage{},
+
+		&EnableTwoFactorMessage{},
+		&DisableTwoFactorMessage{},
+		&RegenerateRecoveryCodesMessage{},
+		&ReauthenticateMessage{},
+		&DeleteAccountMessage{},
+		&SyncSinceMessage{},
+		&BatchMessage{},
+
+		&LoginSuccessMessage{},
+		&LoginFailureMessage{},
+		&RegisterSuccessMessage{},
+		&RegisterFailureMessage{},
+		&ForcedLogoutMessage{},
+		&ReconnectMessage{},
+		&AnnouncementsMessage{},
+		&SecurityAlertMessage{},
+		&TwoFactorEnabledMessage{},
+		&RecoveryCodesMessage{},
+		&ReauthSuccessMessage{},
+		&ReauthFailureMessage{},
+		&AckMessage{},
+		&ErrorMessage{},
+		&CapabilitiesMessage{},
+		&PingMessage{},
+		&PongMessage{},
+		&FullStateMessage{},
+		&FullStateBeginMessage{},
+		&FullStateChunkMessage{},
+		&FullStateEndMessage{},
+		&SyncDeltaMessage{},
+		&BatchResultMessage{},
+		&LimitsMessage{},
+		&ServerNoticeMessage{},
+		&CompressedMessage{},
+		&AvatarMessage{},
+		&ProfileMessage{},
+		&AwayNoteMessage{},
+		&LookupResultMessage{},
+		&BuddyListMessage{},
+		&ImportResultMessage{},
+		&StatsMessage{},
+		&ServerStatsMessage{},
+		&ServerInfoMessage{},
+		&PushKeyMessage{},
+		&WebhookMessage{},
+		&WebhooksMessage{},
+		&APIKeyMessage{},
+		&PrivacyMessage{},
+		&StatusHistoryMessage{},
+		&IntegrationURLMessage{},
+		&IntegrationMessage{},
+		&IntegrationsMessage{},
+		&SuggestionsMessage{},
+		&RequestSentMessage{},
+		&RequestReceivedMessage{},
+		&AcceptSentMessage{},
+		&RequestAcceptedMessage{},
+		&BuddyRemovedMessage{},
+		&RequestDeclinedMessage{},
+		&RequestCanceledMessage{},
+		&StatusChangedMessage{},
+		&UserBlockedMessage{},
+		&UserUnblockedMessage{},
+		&AliasChangedMessage{},
+		&ProfileChangedMessage{},
+		&MissedEventsMessage{},
+		&SyncErrorMessage{},
+	}
+}
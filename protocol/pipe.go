@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"io"
+	"sync"
+)
+
+// NewPipe creates two Connections which are connected to
+// each other in memory.
+//
+// Messages are passed as-is rather than being encoded, so
+// they should not be modified after they are written.
+// Closing either end closes both.
+func NewPipe() (Connection, Connection) {
+	ch1 := make(chan Message, 16)
+	ch2 := make(chan Message, 16)
+	closed := make(chan struct{})
+	closeOnce := &sync.Once{}
+	return &pipeConn{in: ch1, out: ch2, closed: closed, closeOnce: closeOnce},
+		&pipeConn{in: ch2, out: ch1, closed: closed, closeOnce: closeOnce}
+}
+
+// A pipeConn is one end of a pipe.
+type pipeConn struct {
+	in  <-chan Message
+	out chan<- Message
+
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func (p *pipeConn) ReadMessage() (Message, error) {
+	select {
+	case msg := <-p.in:
+		return msg, nil
+	case <-p.closed:
+		return nil, io.EOF
+	}
+}
+
+func (p *pipeConn) WriteMessage(msg Message) error {
+	select {
+	case <-p.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case p.out <- msg:
+		return nil
+	case <-p.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (p *pipeConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
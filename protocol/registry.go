@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+var messageRegistry = struct {
+	lock      sync.RWMutex
+	factories map[string]func() Message
+}{factories: map[string]func() Message{}}
+
+func init() {
+	for _, msg := range builtinMessages() {
+		msgType := reflect.TypeOf(msg).Elem()
+		RegisterMessageType(msg.Type(), func() Message {
+			return reflect.New(msgType).Interface().(Message)
+		})
+	}
+}
+
+// RegisterMessageType adds a message type to the protocol,
+// so that DecodeMessage can decode it.
+//
+// The server rejects messages of the type from clients
+// unless it has a handler for them, which is added with
+// server.RegisterMessageHandler.
+//
+// The factory should return an empty message whose Type()
+// is name.
+// It panics if the name is already registered.
+func RegisterMessageType(name string, factory func() Message) {
+	messageRegistry.lock.Lock()
+	defer messageRegistry.lock.Unlock()
+	if _, ok := messageRegistry.factories[name]; ok {
+		panic("message type already registered: " + name)
+	}
+	messageRegistry.factories[name] = factory
+}
+
+// NewMessage creates an empty message of a registered
+// type.
+func NewMessage(msgType string) (Message, bool) {
+	messageRegistry.lock.RLock()
+	factory, ok := messageRegistry.factories[msgType]
+	messageRegistry.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
+
+// MessageTypes lists every registered message type in
+// sorted order.
+func MessageTypes() []string {
+	messageRegistry.lock.RLock()
+	defer messageRegistry.lock.RUnlock()
+	var res []string
+	for msgType := range messageRegistry.factories {
+		res = append(res, msgType)
+	}
+	sort.Strings(res)
+	return res
+}
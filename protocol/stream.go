@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// MaxStreamMessageSize is the largest encoded message
+// which a stream connection will read.
+const MaxStreamMessageSize = 1 << 20
+
+// A streamConn is a Connection over a byte stream, such as
+// a TCP connection.
+//
+// Each message is a line of JSON with the same form as a
+// BatchCommand, e.g. {"type": "login", "data": {...}}.
+type streamConn struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	strict  bool
+
+	writeLock sync.Mutex
+}
+
+// NewStreamConnection creates a Connection which exchanges
+// newline-delimited JSON messages over conn, for either
+// end of a TCP connection.
+func NewStreamConnection(conn net.Conn) RemoteConnection {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, MaxStreamMessageSize)
+	return &streamConn{conn: conn, scanner: scanner}
+}
+
+func (s *streamConn) ReadMessage() (msg Message, err error) {
+	defer essentials.AddCtxTo("read message", &err)
+	for s.scanner.Scan() {
+		line := s.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		return UnmarshalMessage(line, s.strict)
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, net.ErrClosed
+}
+
+func (s *streamConn) WriteMessage(msg Message) (err error) {
+	defer essentials.AddCtxTo("write message", &err)
+	line, err := MarshalMessage(msg)
+	if err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err = s.conn.Write(append(line, '\n'))
+	return err
+}
+
+// SetStrictDecoding changes whether messages are decoded
+// like DecodeMessageStrict. It must be called before the
+// connection is read.
+func (s *streamConn) SetStrictDecoding(strict bool) {
+	s.strict = strict
+}
+
+func (s *streamConn) Close() error {
+	return s.conn.Close()
+}
+
+func (s *streamConn) RemoteAddr() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// MarshalMessage encodes a message for a transport, as a
+// JSON object like a BatchCommand.
+func MarshalMessage(msg Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(BatchCommand{Type: msg.Type(), Data: data})
+}
+
+// A DecodeError is returned when a message was received
+// but could not be decoded. The connection is still
+// usable, so the error can be sent back to the client.
+type DecodeError struct {
+	// ID is the request ID of the message, if it could be
+	// read.
+	ID string
+
+	Err error
+}
+
+func (d *DecodeError) Error() string {
+	return d.Err.Error()
+}
+
+// UnmarshalMessage decodes a message encoded with
+// MarshalMessage, like DecodeMessageStrict if strict is
+// set, or else like DecodeMessage.
+//
+// Failures are returned as *DecodeErrors.
+func UnmarshalMessage(data []byte, strict bool) (msg Message, err error) {
+	var command BatchCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+	if strict {
+		msg, err = DecodeMessageStrict(command.Type, command.Data)
+	} else {
+		msg, err = DecodeMessage(command.Type, command.Data)
+	}
+	if err != nil {
+		var id MessageID
+		json.Unmarshal(command.Data, &id)
+		return nil, &DecodeError{ID: id.ID, Err: err}
+	}
+	return msg, nil
+}
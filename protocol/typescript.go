@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// WriteTypeScript writes TypeScript definitions for every
+// registered message type, derived from the Go structs
+// with the same rules as encoding/json.
+//
+// The output declares an interface per message, a
+// MessageTypes interface mapping each type name to its
+// message, and the Envelope in which messages are sent.
+func WriteTypeScript(w io.Writer) (err error) {
+	defer essentials.AddCtxTo("write TypeScript", &err)
+	gen := &tsGenerator{decls: map[string]string{}, goTypes: map[string]reflect.Type{}}
+	var index bytes.Buffer
+	index.WriteString("export interface MessageTypes {\n")
+	for _, msgType := range MessageTypes() {
+		msg, _ := NewMessage(msgType)
+		name, err := gen.named(reflect.TypeOf(msg).Elem())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&index, "  %q: %s;\n", msgType, name)
+	}
+	index.WriteString("}\n")
+
+	var names []string
+	for name := range gen.decls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	out.WriteString("// Code generated by protogen; DO NOT EDIT.\n\n")
+	for _, name := range names {
+		out.WriteString(gen.decls[name])
+		out.WriteString("\n")
+	}
+	out.Write(index.Bytes())
+	out.WriteString("\nexport type MessageType = keyof MessageTypes;\n\n")
+	out.WriteString("export interface Envelope<T extends MessageType = MessageType> {\n")
+	out.WriteString("  type: T;\n")
+	out.WriteString("  data: MessageTypes[T];\n")
+	out.WriteString("}\n")
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+type tsGenerator struct {
+	decls   map[string]string
+	goTypes map[string]reflect.Type
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// expr gets the TypeScript for a Go type, declaring any
+// named types which it uses.
+func (t *tsGenerator) expr(goType reflect.Type) (string, error) {
+	switch goType {
+	case timeType:
+		return "string", nil
+	case durationType:
+		return "number", nil
+	case rawMessageType:
+		return "unknown", nil
+	}
+	if goType.Name() != "" && goType.PkgPath() != "" {
+		return t.named(goType)
+	}
+	return t.anonymous(goType)
+}
+
+// anonymous gets the TypeScript for a Go type without
+// using its name.
+func (t *tsGenerator) anonymous(goType reflect.Type) (string, error) {
+	switch goType.Kind() {
+	case reflect.String:
+		return "string", nil
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number", nil
+	case reflect.Interface:
+		return "unknown", nil
+	case reflect.Ptr:
+		return t.expr(goType.Elem())
+	case reflect.Slice, reflect.Array:
+		if goType.Elem().Kind() == reflect.Uint8 {
+			// encoding/json uses base64 for byte slices.
+			return "string", nil
+		}
+		elem, err := t.expr(goType.Elem())
+		if err != nil {
+			return "", err
+		}
+		if strings.ContainsAny(elem, " |") {
+			elem = "(" + elem + ")"
+		}
+		return elem + "[]", nil
+	case reflect.Map:
+		value, err := t.expr(goType.Elem())
+		if err != nil {
+			return "", err
+		}
+		return "{ [key: string]: " + value + " }", nil
+	case reflect.Struct:
+		var body bytes.Buffer
+		if err := t.fields(&body, goType, "  "); err != nil {
+			return "", err
+		}
+		return "{\n" + body.String() + "}", nil
+	}
+	return "", fmt.Errorf("unsupported type: %s", goType)
+}
+
+// named declares a named Go type, if it has not been
+// declared already, and returns its name.
+func (t *tsGenerator) named(goType reflect.Type) (string, error) {
+	name := goType.Name()
+	if existing, ok := t.goTypes[name]; ok {
+		if existing != goType {
+			return "", fmt.Errorf("types %s and %s have the same name", existing, goType)
+		}
+		return name, nil
+	}
+	t.goTypes[name] = goType
+
+	var decl bytes.Buffer
+	if goType.Kind() == reflect.Struct {
+		fmt.Fprintf(&decl, "export interface %s {\n", name)
+		if err := t.fields(&decl, goType, "  "); err != nil {
+			return "", err
+		}
+		decl.WriteString("}\n")
+	} else {
+		expr, err := t.anonymous(goType)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&decl, "export type %s = %s;\n", name, expr)
+	}
+	t.decls[name] = decl.String()
+	return name, nil
+}
+
+// fields writes the properties of a struct, inlining
+// embedded structs as encoding/json does.
+func (t *tsGenerator) fields(w *bytes.Buffer, goType reflect.Type, indent string) error {
+	for i := 0; i < goType.NumField(); i++ {
+		field := goType.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+		if field.Anonymous && name == "" {
+			embedded := fieldType
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if err := t.fields(w, embedded, indent); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		expr, err := t.expr(fieldType)
+		if err != nil {
+			return essentials.AddCtx(goType.Name()+"."+field.Name, err)
+		}
+		optional := ""
+		if strings.Contains(","+opts+",", ",omitempty,") {
+			optional = "?"
+		} else if nullable(fieldType) {
+			expr += " | null"
+		}
+		fmt.Fprintf(w, "%s%s%s: %s;\n", indent, name, optional, expr)
+	}
+	return nil
+}
+
+// nullable checks if encoding/json may encode a value of
+// a type as null.
+func nullable(goType reflect.Type) bool {
+	if goType == rawMessageType {
+		return false
+	}
+	switch goType.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return true
+	}
+	return false
+}
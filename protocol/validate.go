@@ -0,0 +1,448 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	MaxEmailLength        = 254
+	MaxPasswordLength     = 72
+	MaxGreetingLength     = 140
+	MaxAliasLength        = 64
+	MaxUserMetadataLength = 4096
+	MaxBatchCommands      = 32
+	MaxStatusEmojiLength  = 32
+	MaxStatusLinkLength   = 512
+	MaxCustomStates       = 16
+	MaxCustomStateName    = 32
+	MaxCustomStateLabel   = 64
+	MaxScheduleRules      = 16
+	MaxDisplayNameLength  = 64
+	MaxPronounsLength     = 32
+	MaxBioLength          = 512
+	MaxAwayNoteLength     = 2048
+	MaxReportReasonLength = 512
+	MaxReportEvidence     = 8192
+	MaxPushEndpointLength = 1024
+	MaxPushKeyLength      = 128
+	MaxWebhookURLLength   = 1024
+)
+
+var colorExpr = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// DecodeMessageStrict is like DecodeMessage, but fails
+// with an *UnknownFieldsError if the data contains fields
+// which the message type does not have.
+//
+// This is useful while developing clients, since typos in
+// field names are otherwise silently ignored.
+func DecodeMessageStrict(msgType string, data []byte) (msg Message, err error) {
+	defer essentials.AddCtxTo("decode message", &err)
+	obj, ok := NewMessage(msgType)
+	if !ok {
+		return nil, errors.New("unknown message type: " + msgType)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		if !strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return nil, err
+		}
+		fields := unknownFields(obj, data)
+		if len(fields) == 0 {
+			// The unknown field is inside of a nested object.
+			name := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			fields = []string{strings.Trim(name, `"`)}
+		}
+		return nil, &UnknownFieldsError{MessageType: msgType, Fields: fields}
+	}
+	return obj, nil
+}
+
+// unknownFields lists the top-level fields of a JSON
+// object which do not match any field of msg.
+func unknownFields(msg Message, data []byte) []string {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(data, &obj) != nil {
+		return nil
+	}
+	known := jsonFieldNames(reflect.TypeOf(msg).Elem())
+	var res []string
+	for name := range obj {
+		found := false
+		for _, knownName := range known {
+			// encoding/json matches names case-insensitively.
+			if strings.EqualFold(name, knownName) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func jsonFieldNames(t reflect.Type) []string {
+	var res []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			res = append(res, jsonFieldNames(field.Type)...)
+		} else if tag != "" {
+			res = append(res, tag)
+		} else if field.PkgPath == "" {
+			res = append(res, field.Name)
+		}
+	}
+	return res
+}
+
+// ValidateMessage checks that the fields of a client
+// message are present and sensible.
+//
+// Messages which have no fields to validate are always
+// valid.
+func ValidateMessage(msg Message) error {
+	switch msg := msg.(type) {
+	case *LoginMessage:
+		for _, category := range msg.Events {
+			if !category.Valid() {
+				return &statusdb.ValidationError{Field: "events", Reason: "unknown category"}
+			}
+		}
+		return firstError(validateEmail("email", msg.Email),
+			validatePassword("password", msg.Password))
+	case *BotLoginMessage:
+		for _, category := range msg.Events {
+			if !category.Valid() {
+				return &statusdb.ValidationError{Field: "events", Reason: "unknown category"}
+			}
+		}
+		return firstError(validateEmail("email", msg.Email),
+			validatePassword("api_key", msg.APIKey))
+	case *RegisterMessage:
+		return firstError(validateEmail("email", msg.Email),
+			validatePassword("password", msg.Password))
+	case *RegisterVerifyMessage:
+		return firstError(validateEmail("email", msg.Email),
+			validateRequired("token", msg.Token))
+	case *SetPasswordMessage:
+		return firstError(validatePassword("old_password", msg.OldPassword),
+			validatePassword("new_password", msg.NewPassword))
+	case *ResetPasswordMessage:
+		return validateEmail("email", msg.Email)
+	case *AddBuddyMessage:
+		return firstError(validateEmail("email", msg.Email),
+			validateLength("greeting", msg.Greeting, MaxGreetingLength))
+	case *AcceptRequestMessage:
+		return validateEmail("email", msg.Email)
+	case *RemoveBuddyMessage:
+		return validateEmail("email", msg.Email)
+	case *DeclineRequestMessage:
+		return validateEmail("email", msg.Email)
+	case *CancelRequestMessage:
+		return validateEmail("email", msg.Email)
+	case *BlockUserMessage:
+		return validateEmail("email", msg.Email)
+	case *UnblockUserMessage:
+		return validateEmail("email", msg.Email)
+	case *SetAliasMessage:
+		return firstError(validateEmail("email", msg.Email),
+			validateLength("alias", msg.Alias, MaxAliasLength))
+	case *ReauthenticateMessage:
+		return validatePassword("password", msg.Password)
+	case *DeleteAccountMessage:
+		return validatePassword("password", msg.Password)
+	case *SetStatusMessage:
+		return validateStatus(&msg.UserStatus)
+	case *LookupUserMessage:
+		return validateEmail("email", strings.TrimSpace(msg.Email))
+	case *ReportUserMessage:
+		return firstError(
+			validateEmail("email", msg.Email),
+			validateRequired("reason", msg.Reason),
+			validateLength("reason", msg.Reason, MaxReportReasonLength),
+			validateLength("evidence", msg.Evidence, MaxReportEvidence),
+		)
+	case *ExportBuddiesMessage:
+		return validateBuddyListFormat(msg.Format)
+	case *ImportBuddiesMessage:
+		return validateBuddyListFormat(msg.Format)
+	case *SetProfileMessage:
+		return firstError(
+			validateLength("display_name", msg.DisplayName, MaxDisplayNameLength),
+			validateLength("pronouns", msg.Pronouns, MaxPronounsLength),
+			validateLength("bio", msg.Bio, MaxBioLength),
+		)
+	case *GetProfileMessage:
+		return validateEmail("email", msg.Email)
+	case *SetAwayNoteMessage:
+		return validateLength("note", msg.Note, MaxAwayNoteLength)
+	case *GetAwayNoteMessage:
+		return validateEmail("email", msg.Email)
+	case *SetAvatarMessage:
+		if len(msg.Data) > MaxAvatarUploadSize {
+			return &statusdb.ValidationError{Field: "data", Reason: "too large"}
+		}
+	case *GetAvatarMessage:
+		return validateRequired("hash", msg.Hash)
+	case *AddPushSubscriptionMessage:
+		return firstError(
+			validatePushEndpoint(msg.Endpoint),
+			validateRequired("keys.p256dh", msg.Keys.P256DH),
+			validateLength("keys.p256dh", msg.Keys.P256DH, MaxPushKeyLength),
+			validateRequired("keys.auth", msg.Keys.Auth),
+			validateLength("keys.auth", msg.Keys.Auth, MaxPushKeyLength),
+		)
+	case *RemovePushSubscriptionMessage:
+		return validateRequired("endpoint", msg.Endpoint)
+	case *AddWebhookMessage:
+		return firstError(
+			validateWebhookURL(msg.URL),
+			validateWebhookEvents(msg.Events),
+		)
+	case *RemoveWebhookMessage:
+		return validateRequired("webhook_id", msg.ID)
+	case *TestWebhookMessage:
+		return validateRequired("webhook_id", msg.ID)
+	case *AuthorizeIntegrationMessage:
+		return firstError(
+			validateRequired("provider", msg.Provider),
+			validateRequired("redirect_uri", msg.RedirectURI),
+		)
+	case *ConnectIntegrationMessage:
+		if !msg.Import && !msg.Export {
+			return &statusdb.ValidationError{Field: "import", Reason: "import or export is required"}
+		}
+		return firstError(
+			validateRequired("provider", msg.Provider),
+			validateRequired("code", msg.Code),
+		)
+	case *DisconnectIntegrationMessage:
+		return validateRequired("provider", msg.Provider)
+	case *AuthorizeContactsMessage:
+		return firstError(
+			validateRequired("source", msg.Source),
+			validateRequired("redirect_uri", msg.RedirectURI),
+		)
+	case *ImportContactsMessage:
+		if msg.Source == ContactsCardDAV {
+			return validateAddressBookURL(msg.URL)
+		}
+		return firstError(
+			validateRequired("source", msg.Source),
+			validateRequired("code", msg.Code),
+			validateRequired("redirect_uri", msg.RedirectURI),
+		)
+	case *SetLastSeenMessage:
+		if !msg.Visibility.Valid() {
+			return &statusdb.ValidationError{Field: "visibility", Reason: "unsupported value"}
+		}
+	case *SetPrivacyMessage:
+		if msg.Privacy.Validate() != nil {
+			return &statusdb.ValidationError{Field: "privacy", Reason: "unsupported value"}
+		}
+	case *SetTimeZoneMessage:
+		if !statusdb.ValidTimeZone(msg.TimeZone) {
+			return &statusdb.ValidationError{Field: "time_zone", Reason: "unknown time zone"}
+		}
+	case *SubscribeMessage:
+		return validateEmail("email", msg.Email)
+	case *GetStatusHistoryMessage:
+		return validateEmail("email", msg.Email)
+	case *UnsubscribeMessage:
+		return validateEmail("email", msg.Email)
+	case *SetCustomStatesMessage:
+		return validateCustomStates(msg.States)
+	case *SetScheduleMessage:
+		return validateSchedule(msg.Schedule)
+	case *SetIdleMessage:
+		if msg.IdleSeconds < 0 {
+			return &statusdb.ValidationError{Field: "idle_seconds", Reason: "negative"}
+		}
+	case *BatchMessage:
+		if len(msg.Commands) > MaxBatchCommands {
+			return &statusdb.ValidationError{Field: "commands", Reason: "too many commands"}
+		}
+	}
+	return nil
+}
+
+// validatePushEndpoint checks that a push endpoint is an
+// https URL, since the server will make requests to it.
+func validatePushEndpoint(endpoint string) error {
+	if err := validateLength("endpoint", endpoint, MaxPushEndpointLength); err != nil {
+		return err
+	}
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return &statusdb.ValidationError{Field: "endpoint", Reason: "not an https URL"}
+	}
+	return nil
+}
+
+func validateWebhookURL(rawURL string) error {
+	if err := validateLength("url", rawURL, MaxWebhookURLLength); err != nil {
+		return err
+	}
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" &&
+		u.Scheme != "https") || u.Host == "" {
+		return &statusdb.ValidationError{Field: "url", Reason: "not an http(s) URL"}
+	}
+	return nil
+}
+
+func validateAddressBookURL(rawURL string) error {
+	if err := validateLength("url", rawURL, MaxWebhookURLLength); err != nil {
+		return err
+	}
+	if u, err := url.Parse(rawURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return &statusdb.ValidationError{Field: "url", Reason: "not an https URL"}
+	}
+	return nil
+}
+
+func validateWebhookEvents(hookEvents []string) error {
+	if len(hookEvents) == 0 {
+		return &statusdb.ValidationError{Field: "events", Reason: "required"}
+	}
+	for _, event := range hookEvents {
+		var known bool
+		for _, e := range WebhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return &statusdb.ValidationError{Field: "events", Reason: "unknown event: " + event}
+		}
+	}
+	return nil
+}
+
+func validateStatus(status *statusdb.UserStatus) error {
+	if !status.Availability.Settable() {
+		return &statusdb.ValidationError{Field: "Availability", Reason: "unsupported value"}
+	}
+	if status.Link != "" {
+		if u, err := url.Parse(status.Link); err != nil || (u.Scheme != "http" &&
+			u.Scheme != "https") || u.Host == "" {
+			return &statusdb.ValidationError{Field: "Link", Reason: "not an http(s) URL"}
+		}
+	}
+	if status.ExpiresAt != nil && !status.ExpiresAt.After(time.Now()) {
+		return &statusdb.ValidationError{Field: "ExpiresAt", Reason: "not in the future"}
+	}
+	// The message itself is checked by the StatusPolicy,
+	// since its limits are configurable.
+	return firstError(
+		validateLength("UserMetadata", string(status.UserMetadata), MaxUserMetadataLength),
+		validateMetadataObject(status.UserMetadata),
+		validateLength("Emoji", status.Emoji, MaxStatusEmojiLength),
+		validateLength("Link", status.Link, MaxStatusLinkLength),
+	)
+}
+
+func validateSchedule(schedule statusdb.Schedule) error {
+	if len(schedule.Rules) > MaxScheduleRules {
+		return &statusdb.ValidationError{Field: "rules", Reason: "too many rules"}
+	}
+	if schedule.Validate() != nil {
+		return &statusdb.ValidationError{Field: "schedule", Reason: "unsupported value"}
+	}
+	return nil
+}
+
+func validateCustomStates(states []statusdb.CustomState) error {
+	if len(states) > MaxCustomStates {
+		return &statusdb.ValidationError{Field: "states", Reason: "too many states"}
+	}
+	names := map[string]bool{}
+	for _, state := range states {
+		if err := firstError(
+			validateRequired("name", state.Name),
+			validateLength("name", state.Name, MaxCustomStateName),
+			validateRequired("label", state.Label),
+			validateLength("label", state.Label, MaxCustomStateLabel),
+		); err != nil {
+			return err
+		}
+		if names[state.Name] {
+			return &statusdb.ValidationError{Field: "name", Reason: "duplicate name"}
+		}
+		names[state.Name] = true
+		if !state.Base.Settable() {
+			return &statusdb.ValidationError{Field: "base", Reason: "unsupported value"}
+		}
+		if state.Color != "" && !colorExpr.MatchString(state.Color) {
+			return &statusdb.ValidationError{Field: "color", Reason: "not an #rrggbb color"}
+		}
+	}
+	return nil
+}
+
+func validateMetadataObject(data json.RawMessage) error {
+	_, err := statusdb.DecodeMetadata(data)
+	return err
+}
+
+func validateBuddyListFormat(format string) error {
+	if format != BuddyListJSON && format != BuddyListCSV {
+		return &statusdb.ValidationError{Field: "format", Reason: "unsupported value"}
+	}
+	return nil
+}
+
+func validateEmail(field, email string) error {
+	if err := validateRequired(field, email); err != nil {
+		return err
+	} else if !strings.Contains(email, "@") {
+		return &statusdb.ValidationError{Field: field, Reason: "not an email address"}
+	}
+	return validateLength(field, email, MaxEmailLength)
+}
+
+func validatePassword(field, password string) error {
+	if err := validateRequired(field, password); err != nil {
+		return err
+	}
+	return validateLength(field, password, MaxPasswordLength)
+}
+
+func validateRequired(field, value string) error {
+	if value == "" {
+		return &statusdb.ValidationError{Field: field, Reason: "required"}
+	}
+	return nil
+}
+
+func validateLength(field, value string, max int) error {
+	if len(value) > max {
+		return &statusdb.ValidationError{Field: field, Reason: "too long"}
+	}
+	return nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// ServerInfo describes the running build of the server.
+type ServerInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// String formats the info for the --version flag.
+func (s ServerInfo) String() string {
+	return fmt.Sprintf("status-server %s (commit %s, built %s, %s)", s.Version, s.Commit,
+		s.BuildDate, s.GoVersion)
+}
@@ -0,0 +1,636 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// An AdminUser summarizes a user for the admin API.
+type AdminUser struct {
+	Email     string              `json:"email"`
+	Verified  bool                `json:"verified"`
+	Locked    bool                `json:"locked"`
+	Admin     bool                `json:"admin"`
+	Bot       bool                `json:"bot"`
+	TwoFactor bool                `json:"two_factor"`
+	Buddies   int                 `json:"buddies"`
+	Online    bool                `json:"online"`
+	LastSeen  time.Time           `json:"last_seen"`
+	Status    statusdb.UserStatus `json:"status"`
+
+	SuspendedUntil time.Time `json:"suspended_until"`
+	ShadowLimited  bool      `json:"shadow_limited"`
+
+	FeatureOverrides map[statusdb.Feature]bool `json:"feature_overrides"`
+
+	// Stats do not include the time of current sessions.
+	Stats statusdb.UsageSummary `json:"stats"`
+}
+
+// An AdminUserDetail describes a user's relationships for
+// the admin API.
+type AdminUserDetail struct {
+	AdminUser
+
+	BuddyList        []string `json:"buddy_list"`
+	IncomingRequests []string `json:"incoming_requests"`
+	OutgoingRequests []string `json:"outgoing_requests"`
+	Blocked          []string `json:"blocked"`
+}
+
+// An AdminCreateUser is the body of a request to create
+// a user through the admin API.
+type AdminCreateUser struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// An AdminAPIKey is the response to creating a bot or
+// rotating its API key through the admin API.
+//
+// The key cannot be retrieved again later.
+type AdminAPIKey struct {
+	Email  string `json:"email"`
+	APIKey string `json:"api_key"`
+}
+
+// An AdminNotice is the body of a request to broadcast a
+// ServerNotice through the admin API.
+//
+// If Emails is empty, the notice is sent to everyone.
+type AdminNotice struct {
+	protocol.ServerNotice
+	Emails []string `json:"emails,omitempty"`
+}
+
+// An AdminFeatureOverride is the body of a request to
+// override a feature for a user through the admin API.
+//
+// A null Enabled removes the override.
+type AdminFeatureOverride struct {
+	Feature statusdb.Feature `json:"feature"`
+	Enabled *bool            `json:"enabled"`
+}
+
+// An AdminMerge is the body of a request to merge a user
+// into another through the admin API.
+type AdminMerge struct {
+	Into string `json:"into"`
+}
+
+// An AdminResolution is the body of a request to resolve
+// an abuse report through the admin API.
+//
+// Duration is a string such as "72h", and is only used to
+// suspend users.
+type AdminResolution struct {
+	Action   statusdb.ModerationAction `json:"action"`
+	Message  string                    `json:"message,omitempty"`
+	Duration string                    `json:"duration,omitempty"`
+}
+
+// AdminHandler serves an HTTP API for server operators.
+//
+// Every request must include the header
+// "Authorization: Bearer <token>".
+//
+// The API supports:
+//
+//	GET    /users?q=<substring>   list or search users
+//	POST   /users                 create a user
+//	POST   /bots                  create a bot account
+//	GET    /users/<email>         show a user
+//	DELETE /users/<email>         delete a user
+//	GET    /users/<email>/requests
+//	POST   /users/<email>/logout
+//	POST   /users/<email>/verify
+//	POST   /users/<email>/lock
+//	POST   /users/<email>/unlock
+//	POST   /users/<email>/promote    grant administrator privileges
+//	POST   /users/<email>/demote     revoke administrator privileges
+//	POST   /users/<email>/features  override a feature flag
+//	POST   /users/<email>/api_key   replace a bot's API key
+//	GET    /sessions              list online sessions
+//	GET    /stats                 show the server's load
+//	GET    /version               show the server's build information
+//	GET    /tuning                show the runtime settings
+//	POST   /tuning                change runtime settings (partial Tuning)
+//	GET    /maintenance           check if maintenance mode is on
+//	POST   /maintenance/on        enter read-only maintenance mode
+//	POST   /maintenance/off       leave maintenance mode
+//	POST   /notices               broadcast a notice
+//	GET    /export                back up every user
+//	POST   /import                restore users from a backup
+//	GET    /check                 check the database for problems
+//	GET    /announcements         list announcements
+//	POST   /announcements         create or replace an announcement
+//	DELETE /announcements/<id>    delete an announcement
+//	GET    /audit?<filters>       search the audit log
+//	GET    /reports?all=1         list open (or all) abuse reports
+//	POST   /reports/<id>/resolve  act on an abuse report
+//
+// Successful operations without a result respond with
+// 204 No Content. Errors are JSON objects with a code and
+// a message.
+//
+// Request bodies are JSON: an AdminCreateUser for
+// POST /users (or POST /bots, without a password), an
+// AdminFeatureOverride for
+// POST /users/<email>/features, an AdminNotice for
+// POST /notices, an Announcement for POST /announcements,
+// an AdminResolution for POST /reports/<id>/resolve, and a
+// list of users from GET /export for POST /import.
+//
+// The audit log filters are user, actor, target, action,
+// since and until (RFC 3339 times), and limit.
+// Operations performed through the admin API are audited
+// with ActorAdmin as the actor.
+//
+// See AdminDebug for optional debugging endpoints.
+func AdminHandler(db statusdb.DB, edb events.EventDB, token string) http.Handler {
+	a := &adminAPI{db: db, edb: edb}
+	if AdminDebug {
+		a.debug = newDebugHandler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth),
+			[]byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		a.ServeHTTP(w, r)
+	})
+}
+
+type adminAPI struct {
+	db    statusdb.DB
+	edb   events.EventDB
+	debug http.Handler
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "debug" && a.debug != nil {
+		a.debug.ServeHTTP(w, r)
+		return
+	}
+	route := r.Method + " " + parts[0]
+	if len(parts) > 1 {
+		route += "/*"
+	}
+	if len(parts) > 2 {
+		route += "/" + strings.Join(parts[2:], "/")
+	}
+	switch route {
+	case "GET users":
+		a.listUsers(w, r.URL.Query().Get("q"))
+	case "POST users":
+		a.createUser(w, r)
+	case "POST bots":
+		a.createBot(w, r)
+	case "GET sessions":
+		writeAdminJSON(w, a.edb.Sessions())
+	case "GET version":
+		writeAdminJSON(w, CurrentServerInfo())
+	case "GET stats":
+		writeAdminJSON(w, a.edb.ServerStats())
+	case "GET tuning":
+		writeAdminJSON(w, a.edb.Tuning())
+	case "POST tuning":
+		a.updateTuning(w, r)
+	case "GET maintenance":
+		writeAdminJSON(w, map[string]bool{"enabled": a.edb.Maintenance()})
+	case "POST maintenance/on", "POST maintenance/off":
+		enabled := parts[1] == "on"
+		a.edb.SetMaintenance(enabled)
+		writeAdminResult(w, a.audited(r, "set maintenance "+parts[1], "", nil))
+	case "GET users/*":
+		a.showUser(w, parts[1])
+	case "DELETE users/*":
+		writeAdminResult(w, a.audited(r, "delete user", parts[1], a.edb.DeleteUser(parts[1])))
+	case "GET users/*/requests":
+		a.showRequests(w, parts[1])
+	case "POST users/*/logout":
+		writeAdminResult(w, a.audited(r, "force logout", parts[1], a.edb.ForceLogout(parts[1])))
+	case "POST users/*/verify":
+		writeAdminResult(w, a.audited(r, "verify user", parts[1], a.db.SetVerified(parts[1], true)))
+	case "POST users/*/lock":
+		writeAdminResult(w, a.audited(r, "lock user", parts[1], a.edb.LockUser(parts[1], true)))
+	case "POST users/*/unlock":
+		writeAdminResult(w, a.audited(r, "unlock user", parts[1], a.edb.LockUser(parts[1], false)))
+	case "POST users/*/promote":
+		writeAdminResult(w, a.audited(r, "promote user", parts[1], a.db.SetAdmin(parts[1], true)))
+	case "POST users/*/merge":
+		a.mergeUser(w, r, parts[1])
+	case "POST users/*/features":
+		a.setFeatureOverride(w, r, parts[1])
+	case "POST users/*/api_key":
+		a.rotateAPIKey(w, r, parts[1])
+	case "POST users/*/demote":
+		writeAdminResult(w, a.audited(r, "demote user", parts[1], a.db.SetAdmin(parts[1], false)))
+	case "POST notices":
+		a.broadcastNotice(w, r)
+	case "GET export":
+		users, err := a.db.ListUsers()
+		if err != nil {
+			writeAdminError(w, err)
+		} else {
+			writeAdminJSON(w, users)
+		}
+	case "GET announcements":
+		announcements, err := a.edb.Announcements()
+		if err != nil {
+			writeAdminError(w, err)
+		} else {
+			writeAdminJSON(w, announcements)
+		}
+	case "POST announcements":
+		a.setAnnouncement(w, r)
+	case "DELETE announcements/*":
+		writeAdminResult(w, a.audited(r, "delete announcement "+parts[1], "",
+			a.edb.DeleteAnnouncement(parts[1])))
+	case "GET audit":
+		a.queryAudit(w, r)
+	case "GET reports":
+		a.listReports(w, r.URL.Query().Get("all") != "")
+	case "POST reports/*/resolve":
+		a.resolveReport(w, r, parts[1])
+	case "POST import":
+		a.importUsers(w, r)
+	case "GET check":
+		users, err := a.db.ListUsers()
+		if err != nil {
+			writeAdminError(w, err)
+		} else {
+			writeAdminJSON(w, map[string][]string{"problems": append([]string{}, statusdb.CheckUsers(users)...)})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *adminAPI) listUsers(w http.ResponseWriter, query string) {
+	users, err := a.db.ListUsers()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	online := a.onlineUsers()
+	res := []AdminUser{}
+	for _, user := range users {
+		if strings.Contains(strings.ToLower(user.Email), strings.ToLower(query)) {
+			res = append(res, adminUser(user, online))
+		}
+	}
+	writeAdminJSON(w, res)
+}
+
+func (a *adminAPI) showUser(w http.ResponseWriter, email string) {
+	user, err := a.db.GetUserInfo(email)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, &AdminUserDetail{
+		AdminUser:        adminUser(user, a.onlineUsers()),
+		BuddyList:        append([]string{}, user.Buddies...),
+		IncomingRequests: append([]string{}, user.IncomingRequests...),
+		OutgoingRequests: append([]string{}, user.OutgoingRequests...),
+		Blocked:          append([]string{}, user.Blocked...),
+	})
+}
+
+func (a *adminAPI) showRequests(w http.ResponseWriter, email string) {
+	user, err := a.db.GetUserInfo(email)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, map[string]interface{}{
+		"incoming":  append([]string{}, user.IncomingRequests...),
+		"outgoing":  append([]string{}, user.OutgoingRequests...),
+		"greetings": user.Greetings,
+	})
+}
+
+func (a *adminAPI) createUser(w http.ResponseWriter, r *http.Request) {
+	var req AdminCreateUser
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	if req.Email == "" {
+		writeAdminError(w, &statusdb.ValidationError{Field: "email", Reason: "missing email"})
+		return
+	} else if req.Password == "" {
+		writeAdminError(w, &statusdb.ValidationError{Field: "password", Reason: "missing password"})
+		return
+	}
+	writeAdminResult(w, a.audited(r, "add user", req.Email, a.db.AddUser(req.Email, req.Password)))
+}
+
+func (a *adminAPI) createBot(w http.ResponseWriter, r *http.Request) {
+	var req AdminCreateUser
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	if req.Email == "" {
+		writeAdminError(w, &statusdb.ValidationError{Field: "email", Reason: "missing email"})
+		return
+	}
+	apiKey, err := a.db.AddBot(req.Email)
+	if err := a.audited(r, "add bot", req.Email, err); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, &AdminAPIKey{Email: req.Email, APIKey: apiKey})
+}
+
+// rotateAPIKey replaces a bot's key and ends the sessions
+// which used the old one.
+func (a *adminAPI) rotateAPIKey(w http.ResponseWriter, r *http.Request, email string) {
+	apiKey, err := a.db.RotateAPIKey(email)
+	if err == nil {
+		err = a.edb.ForceLogout(email)
+	}
+	if err := a.audited(r, "rotate api key", email, err); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, &AdminAPIKey{Email: email, APIKey: apiKey})
+}
+
+func (a *adminAPI) mergeUser(w http.ResponseWriter, r *http.Request, email string) {
+	var req AdminMerge
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	if req.Into == "" {
+		writeAdminError(w, &statusdb.ValidationError{Field: "into", Reason: "missing email"})
+		return
+	}
+	writeAdminResult(w, a.audited(r, "merge user into "+req.Into, email,
+		a.edb.MergeUsers(email, req.Into)))
+}
+
+func (a *adminAPI) setFeatureOverride(w http.ResponseWriter, r *http.Request, email string) {
+	var req AdminFeatureOverride
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	if req.Feature == "" {
+		writeAdminError(w, &statusdb.ValidationError{Field: "feature", Reason: "missing feature"})
+		return
+	}
+	action := "clear feature " + string(req.Feature)
+	if req.Enabled != nil {
+		action = "set feature " + string(req.Feature) + " to " + strconv.FormatBool(*req.Enabled)
+	}
+	writeAdminResult(w, a.audited(r, action, email,
+		a.db.SetFeatureOverride(email, req.Feature, req.Enabled)))
+}
+
+func (a *adminAPI) broadcastNotice(w http.ResponseWriter, r *http.Request) {
+	var req AdminNotice
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	var emails []string
+	if len(req.Emails) > 0 {
+		emails = req.Emails
+	}
+	writeAdminResult(w, a.audited(r, "broadcast notice", "",
+		a.edb.BroadcastNotice(req.ServerNotice, emails)))
+}
+
+func (a *adminAPI) importUsers(w http.ResponseWriter, r *http.Request) {
+	var users []*statusdb.UserInfo
+	if !readAdminJSON(w, r, &users) {
+		return
+	}
+	for _, user := range users {
+		if user == nil || user.Email == "" {
+			writeAdminError(w, &statusdb.ValidationError{Field: "Email", Reason: "missing email"})
+			return
+		}
+	}
+	imported, err := a.db.ImportUsers(users)
+	a.audited(r, "import users", "", err)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, map[string]int{"imported": imported, "skipped": len(users) - imported})
+}
+
+func (a *adminAPI) listReports(w http.ResponseWriter, all bool) {
+	reports, err := a.edb.Reports()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	res := []statusdb.Report{}
+	for _, report := range reports {
+		if all || !report.Resolved() {
+			res = append(res, report)
+		}
+	}
+	writeAdminJSON(w, res)
+}
+
+func (a *adminAPI) resolveReport(w http.ResponseWriter, r *http.Request, id string) {
+	var req AdminResolution
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	res := events.Resolution{Action: req.Action, Message: req.Message}
+	if req.Duration != "" {
+		var err error
+		res.Duration, err = time.ParseDuration(req.Duration)
+		if err != nil {
+			writeAdminError(w, &statusdb.ValidationError{Field: "duration", Reason: err.Error()})
+			return
+		}
+	}
+	var target string
+	if reports, err := a.edb.Reports(); err == nil {
+		for _, report := range reports {
+			if report.ID == id {
+				target = report.Target
+			}
+		}
+	}
+	err := a.edb.ResolveReport(id, res)
+	writeAdminResult(w, a.audited(r, "resolve report ("+string(res.Action)+")", target, err))
+}
+
+func (a *adminAPI) setAnnouncement(w http.ResponseWriter, r *http.Request) {
+	var req statusdb.Announcement
+	if !readAdminJSON(w, r, &req) {
+		return
+	}
+	res, err := a.edb.SetAnnouncement(req)
+	if a.audited(r, "set announcement "+res.ID, "", err) != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, res)
+}
+
+func (a *adminAPI) queryAudit(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := events.AuditQuery{
+		User:   params.Get("user"),
+		Actor:  params.Get("actor"),
+		Target: params.Get("target"),
+		Action: params.Get("action"),
+	}
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		if s := params.Get(param.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				writeAdminError(w, &statusdb.ValidationError{Field: param.name, Reason: err.Error()})
+				return
+			}
+			*param.dest = t
+		}
+	}
+	if s := params.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			writeAdminError(w, &statusdb.ValidationError{Field: "limit", Reason: "must be a positive integer"})
+			return
+		}
+		query.Limit = limit
+	}
+	entries, err := a.edb.QueryAudit(query)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, entries)
+}
+
+// updateTuning applies the fields of a partial Tuning in
+// the request body, recording the changes in the audit
+// log.
+func (a *adminAPI) updateTuning(w http.ResponseWriter, r *http.Request) {
+	var changes json.RawMessage
+	if !readAdminJSON(w, r, &changes) {
+		return
+	}
+	old, updated, err := a.edb.UpdateTuning(func(t *events.Tuning) error {
+		if err := json.Unmarshal(changes, t); err != nil {
+			return &statusdb.ValidationError{Field: "body", Reason: err.Error()}
+		}
+		return nil
+	})
+	entry := events.AuditEntry{
+		Actor:      events.ActorAdmin,
+		RemoteAddr: r.RemoteAddr,
+		Action:     "update tuning",
+		Details:    updated.Changes(&old),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	a.edb.RecordAudit(entry)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeAdminJSON(w, updated)
+}
+
+// audited records an admin operation in the audit log and
+// returns its error.
+func (a *adminAPI) audited(r *http.Request, action, target string, err error) error {
+	entry := events.AuditEntry{
+		Actor:      events.ActorAdmin,
+		RemoteAddr: r.RemoteAddr,
+		Action:     action,
+		Target:     target,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	a.edb.RecordAudit(entry)
+	return err
+}
+
+func (a *adminAPI) onlineUsers() map[string]bool {
+	res := map[string]bool{}
+	for _, sess := range a.edb.Sessions() {
+		res[sess.Email] = true
+	}
+	return res
+}
+
+func adminUser(user *statusdb.UserInfo, online map[string]bool) AdminUser {
+	return AdminUser{
+		Email:     user.Email,
+		Verified:  user.Verified,
+		Locked:    user.Locked,
+		Admin:     user.Admin,
+		Bot:       user.Bot,
+		TwoFactor: user.TwoFactorSecret != "",
+		Buddies:   len(user.Buddies),
+		Online:    online[user.Email],
+		LastSeen:  user.LastSeen,
+		Status:    user.LatestStatus,
+
+		SuspendedUntil: user.SuspendedUntil,
+		ShadowLimited:  user.ShadowLimited,
+
+		FeatureOverrides: user.FeatureOverrides,
+
+		Stats: user.Stats.Summary(),
+	}
+}
+
+func readAdminJSON(w http.ResponseWriter, r *http.Request, obj interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(obj); err != nil {
+		writeAdminError(w, &statusdb.ValidationError{Field: "body", Reason: err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeAdminResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeAdminError(w, err)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	code, message := events.DescribeError(err)
+	status := http.StatusBadRequest
+	switch code {
+	case protocol.ErrCodeNoEmail, protocol.ErrCodeNoReport, protocol.ErrCodeNoAnnouncement:
+		status = http.StatusNotFound
+	case protocol.ErrCodeUnknown:
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": string(code), "message": message})
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+const (
+	// AlertmanagerPath is where the WebSocket listener
+	// receives Alertmanager webhooks.
+	AlertmanagerPath = "/alertmanager"
+
+	// MaxAlertAge is how long an alert group counts as
+	// firing after its latest notification, in case its
+	// resolution is never sent. Alertmanager's
+	// repeat_interval should be shorter.
+	MaxAlertAge = 12 * time.Hour
+
+	DefaultAlertMessage = "Responding to incident"
+	DefaultAlertEmoji   = "🔥"
+
+	maxAlertmanagerPayload = 1 << 20
+)
+
+// Alertmanager is an events.StatusNotifier which marks
+// on-call users as responding to incidents while
+// Prometheus Alertmanager reports firing alerts.
+//
+// Users connect the integration with the name of an
+// Alertmanager receiver as the code. While any alert group
+// sent to that receiver is firing, their status is
+// DoNotDisturb with the responding message, naming the
+// alert if there is only one. Once every group resolves,
+// they become Available with no message.
+//
+// It is also the http.Handler for the webhooks, which must
+// carry the token as a bearer token. Only the leader
+// imports statuses, so in a cluster Alertmanager should
+// notify every node.
+type Alertmanager struct {
+	Token string
+
+	// Message and Emoji override DefaultAlertMessage and
+	// DefaultAlertEmoji if they are non-empty.
+	Message string
+	Emoji   string
+
+	lock      sync.Mutex
+	receivers map[string]map[string]alertGroup
+	changes   chan struct{}
+}
+
+// An alertGroup is a firing group of alerts, as named by
+// its alertname label.
+type alertGroup struct {
+	name    string
+	updated time.Time
+}
+
+// NewAlertmanager creates a receiver which has seen no
+// alerts.
+func NewAlertmanager(token string) *Alertmanager {
+	return &Alertmanager{
+		Token:     token,
+		receivers: map[string]map[string]alertGroup{},
+		changes:   make(chan struct{}, 1),
+	}
+}
+
+func (a *Alertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if a.Token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+a.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var payload struct {
+		Receiver     string            `json:"receiver"`
+		Status       string            `json:"status"`
+		GroupKey     string            `json:"groupKey"`
+		CommonLabels map[string]string `json:"commonLabels"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAlertmanagerPayload)).Decode(&payload)
+	if err != nil || payload.Receiver == "" || payload.GroupKey == "" {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	a.lock.Lock()
+	groups := a.receivers[payload.Receiver]
+	if groups == nil {
+		groups = map[string]alertGroup{}
+		a.receivers[payload.Receiver] = groups
+	}
+	if payload.Status == "firing" {
+		groups[payload.GroupKey] = alertGroup{
+			name:    payload.CommonLabels["alertname"],
+			updated: time.Now(),
+		}
+	} else {
+		delete(groups, payload.GroupKey)
+	}
+	a.lock.Unlock()
+
+	select {
+	case a.changes <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Alertmanager) Changes() <-chan struct{} {
+	return a.changes
+}
+
+func (a *Alertmanager) AuthorizeURL(redirectURI string) string {
+	return ""
+}
+
+// Connect subscribes a user to the receiver named by code.
+//
+// Unless the receiver is firing, the current state is
+// marked as synced, so that connecting does not clear the
+// user's status.
+func (a *Alertmanager) Connect(code, redirectURI string) (statusdb.Integration, error) {
+	receiver := strings.TrimSpace(code)
+	if receiver == "" {
+		return statusdb.Integration{}, errors.New("missing receiver name")
+	}
+	in := statusdb.Integration{Provider: events.IntegrationAlertmanager, AccountID: receiver}
+	if status, _ := a.status(receiver); status.Availability == statusdb.Available {
+		in.LastSync = alertVersion(status)
+	}
+	return in, nil
+}
+
+func (a *Alertmanager) Fetch(in statusdb.Integration) (status statusdb.UserStatus,
+	version string, err error) {
+	status, seen := a.status(in.AccountID)
+	if !seen {
+		return status, "", nil
+	}
+	return status, alertVersion(status), nil
+}
+
+func (a *Alertmanager) CanExport() bool {
+	return false
+}
+
+func (a *Alertmanager) Publish(in statusdb.Integration, status statusdb.UserStatus) error {
+	return events.ErrExportUnsupported
+}
+
+func (a *Alertmanager) Disconnect(in statusdb.Integration) error {
+	return nil
+}
+
+// status gets the status of a receiver's users, and
+// whether any webhooks have been sent to the receiver.
+func (a *Alertmanager) status(receiver string) (status statusdb.UserStatus, seen bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	groups, seen := a.receivers[receiver]
+	names := map[string]bool{}
+	for key, group := range groups {
+		if time.Since(group.updated) > MaxAlertAge {
+			delete(groups, key)
+		} else {
+			names[group.name] = true
+		}
+	}
+	if len(groups) == 0 {
+		return statusdb.UserStatus{Availability: statusdb.Available}, seen
+	}
+	status = statusdb.UserStatus{
+		Availability: statusdb.DoNotDisturb,
+		Message:      a.Message,
+		Emoji:        a.Emoji,
+	}
+	if status.Message == "" {
+		status.Message = DefaultAlertMessage
+	}
+	if status.Emoji == "" {
+		status.Emoji = DefaultAlertEmoji
+	}
+	if len(names) == 1 && !names[""] {
+		for name := range names {
+			status.Message += ": " + name
+		}
+	}
+	return status, true
+}
+
+func alertVersion(status statusdb.UserStatus) string {
+	return fmt.Sprintf("%d\n%s\n%s", status.Availability, status.Message, status.Emoji)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// A WebhookAlertSink posts alerts as JSON objects to a URL.
+type WebhookAlertSink struct {
+	URL string
+}
+
+func (w *WebhookAlertSink) SendAlert(a *statusdb.Alert) error {
+	return postWebhookJSON(w.URL, a)
+}
+
+// A SlackAlertSink posts alerts to a Slack incoming
+// webhook.
+type SlackAlertSink struct {
+	WebhookURL string
+}
+
+func (s *SlackAlertSink) SendAlert(a *statusdb.Alert) error {
+	return postWebhookJSON(s.WebhookURL, map[string]string{
+		"text": fmt.Sprintf(":rotating_light: *%s*: %s", a.Condition, a.Message),
+	})
+}
+
+// postWebhookJSON posts a JSON object to a webhook.
+func postWebhookJSON(url string, obj interface{}) (err error) {
+	defer essentials.AddCtxTo("post to webhook", &err)
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
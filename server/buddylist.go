@@ -0,0 +1,34 @@
+package server
+
+import (
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// importBuddies sends a buddy request to each new buddy in
+// a list, and restores the aliases of existing buddies.
+func importBuddies(sess events.DBSession, entries []protocol.BuddyEntry) []protocol.ImportResult {
+	results := make([]protocol.ImportResult, 0, len(entries))
+	for _, entry := range entries {
+		result := protocol.ImportResult{Email: entry.Email}
+		err := protocol.ValidateBuddyEntry(entry)
+		if err == nil {
+			result.Action = "requested"
+			err = sess.SendRequest(entry.Email, "")
+			if events.RootError(err) == statusdb.ErrAlreadyBuddies {
+				result.Action = "updated"
+				err = nil
+				if entry.Alias != "" {
+					err = sess.SetAlias(entry.Email, entry.Alias)
+				}
+			}
+		}
+		if err != nil {
+			result.Action = ""
+			result.Code, result.Message = events.DescribeError(err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// clientCapabilities tracks the capabilities that a client
+// has declared.
+//
+// Before a client declares anything, it is assumed to
+// support every message type but no extensions.
+type clientCapabilities struct {
+	lock       sync.RWMutex
+	declared   bool
+	types      map[string]bool
+	extensions map[string]bool
+	locale     string
+}
+
+// Set updates the capabilities from a client message.
+func (c *clientCapabilities) Set(msg *protocol.CapabilitiesMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.declared = true
+	c.types = map[string]bool{}
+	c.extensions = map[string]bool{}
+	for _, msgType := range msg.MessageTypes {
+		c.types[msgType] = true
+	}
+	for _, ext := range msg.Extensions {
+		c.extensions[ext] = true
+	}
+	if msg.Locale != "" {
+		c.locale = msg.Locale
+	}
+}
+
+// SetLocale changes the client's locale.
+func (c *clientCapabilities) SetLocale(locale string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.locale = locale
+}
+
+// Locale gets the client's locale, or "" if the client
+// has not chosen one.
+func (c *clientCapabilities) Locale() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.locale
+}
+
+// SupportsType checks if the client can handle a message
+// type.
+func (c *clientCapabilities) SupportsType(msgType string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return !c.declared || c.types[msgType]
+}
+
+// DeclaresType checks if the client has declared support
+// for a message type, rather than sending no capabilities.
+func (c *clientCapabilities) DeclaresType(msgType string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.declared && c.types[msgType]
+}
+
+// SupportsExtension checks if the client has declared
+// support for a protocol extension.
+func (c *clientCapabilities) SupportsExtension(ext string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.extensions[ext]
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// A FaultInjector randomly delays and fails operations, to
+// test how the server recovers from slow clients and
+// storage errors.
+//
+// It should only be enabled for resilience testing.
+type FaultInjector struct {
+	// ErrorPercent is the percentage of operations which
+	// fail with ErrInjectedFault.
+	ErrorPercent int
+
+	// DelayPercent is the percentage of operations which
+	// are delayed by up to MaxDelay.
+	DelayPercent int
+	MaxDelay     time.Duration
+
+	lock sync.Mutex
+	rng  *rand.Rand
+}
+
+// WrapConnection creates a Connection whose reads and
+// writes are subject to faults.
+//
+// Delayed writes make the session's events back up, which
+// exercises the full-state recovery path.
+func (f *FaultInjector) WrapConnection(conn protocol.Connection) protocol.Connection {
+	return &chaosConn{Connection: conn, faults: f}
+}
+
+// WrapDB creates a DB whose most common operations are
+// subject to faults.
+//
+// Failed writes exercise the paths which report sync
+// errors to clients. Other operations pass through.
+func (f *FaultInjector) WrapDB(db statusdb.DB) statusdb.DB {
+	return &chaosDB{DB: db, faults: f}
+}
+
+// inject delays or fails an operation at random.
+func (f *FaultInjector) inject() error {
+	f.lock.Lock()
+	if f.rng == nil {
+		f.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	var delay time.Duration
+	if f.MaxDelay > 0 && f.rng.Intn(100) < f.DelayPercent {
+		delay = time.Duration(f.rng.Int63n(int64(f.MaxDelay)))
+	}
+	fail := f.rng.Intn(100) < f.ErrorPercent
+	f.lock.Unlock()
+
+	time.Sleep(delay)
+	if fail {
+		return events.ErrInjectedFault
+	}
+	return nil
+}
+
+type chaosConn struct {
+	protocol.Connection
+	faults *FaultInjector
+}
+
+func (c *chaosConn) ReadMessage() (protocol.Message, error) {
+	if err := c.faults.inject(); err != nil {
+		return nil, err
+	}
+	return c.Connection.ReadMessage()
+}
+
+func (c *chaosConn) WriteMessage(msg protocol.Message) error {
+	if err := c.faults.inject(); err != nil {
+		return err
+	}
+	return c.Connection.WriteMessage(msg)
+}
+
+type chaosDB struct {
+	statusdb.DB
+	faults *FaultInjector
+}
+
+func (c *chaosDB) GetUserInfo(email string) (*statusdb.UserInfo, error) {
+	if err := c.faults.inject(); err != nil {
+		return nil, err
+	}
+	return c.DB.GetUserInfo(email)
+}
+
+func (c *chaosDB) GetStatuses(emails []string) ([]statusdb.StatusResult, error) {
+	if err := c.faults.inject(); err != nil {
+		return nil, err
+	}
+	return c.DB.GetStatuses(emails)
+}
+
+func (c *chaosDB) GetBuddyStates(email string, buddies []string) ([]statusdb.BuddyState, error) {
+	if err := c.faults.inject(); err != nil {
+		return nil, err
+	}
+	return c.DB.GetBuddyStates(email, buddies)
+}
+
+func (c *chaosDB) SetStatus(email string, status statusdb.UserStatus) error {
+	if err := c.faults.inject(); err != nil {
+		return err
+	}
+	return c.DB.SetStatus(email, status)
+}
+
+func (c *chaosDB) SetLastSeen(email string, t time.Time) error {
+	if err := c.faults.inject(); err != nil {
+		return err
+	}
+	return c.DB.SetLastSeen(email, t)
+}
+
+func (c *chaosDB) SendRequest(from, to, greeting string) error {
+	if err := c.faults.inject(); err != nil {
+		return err
+	}
+	return c.DB.SendRequest(from, to, greeting)
+}
+
+func (c *chaosDB) AcceptRequest(email, other string) error {
+	if err := c.faults.inject(); err != nil {
+		return err
+	}
+	return c.DB.AcceptRequest(email, other)
+}
+
+func (c *chaosDB) DeleteBuddy(email, other string) error {
+	if err := c.faults.inject(); err != nil {
+		return err
+	}
+	return c.DB.DeleteBuddy(email, other)
+}
+
+func (c *chaosDB) AddMissedEvent(email string, event statusdb.MissedEvent) error {
+	if err := c.faults.inject(); err != nil {
+		return err
+	}
+	return c.DB.AddMissedEvent(email, event)
+}
+
+func (c *chaosDB) TakeMissedEvents(email string) ([]statusdb.MissedEvent, error) {
+	if err := c.faults.inject(); err != nil {
+		return nil, err
+	}
+	return c.DB.TakeMissedEvents(email)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/unixpickle/essentials"
+)
+
+// CompressionThreshold is the encoded size, in bytes,
+// above which large messages are compressed for clients
+// supporting the "compression" extension.
+const CompressionThreshold = 4096
+
+// compressibleTypes lists the message types which may be
+// large enough to be worth compressing.
+var compressibleTypes = map[string]bool{
+	protocol.MsgTypeFullState:      true,
+	protocol.MsgTypeFullStateChunk: true,
+	protocol.MsgTypeSyncDelta:      true,
+	protocol.MsgTypeImportResult:   true,
+	protocol.MsgTypeBuddyList:      true,
+	protocol.MsgTypeBatchResult:    true,
+}
+
+// Compress wraps a message in a CompressedMessage.
+func Compress(msg protocol.Message) (res *protocol.CompressedMessage, err error) {
+	defer essentials.AddCtxTo("compress message", &err)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return compressData(msg.Type(), data)
+}
+
+func compressData(msgType string, data []byte) (*protocol.CompressedMessage, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &protocol.CompressedMessage{Inner: msgType, Data: buf.Bytes()}, nil
+}
+
+// compressingConn compresses large outgoing messages and
+// decompresses incoming ones.
+type compressingConn struct {
+	protocol.Connection
+	caps *clientCapabilities
+
+	// strict is set if decompressed messages are decoded
+	// like DecodeMessageStrict.
+	strict bool
+}
+
+func (c *compressingConn) ReadMessage() (protocol.Message, error) {
+	msg, err := c.Connection.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if compressed, ok := msg.(*protocol.CompressedMessage); ok {
+		decompress := compressed.Decompress
+		if c.strict {
+			decompress = compressed.DecompressStrict
+		}
+		if msg, err = decompress(); err != nil {
+			return nil, &protocol.DecodeError{Err: err}
+		}
+	}
+	return msg, nil
+}
+
+func (c *compressingConn) WriteMessage(msg protocol.Message) error {
+	if compressibleTypes[msg.Type()] && c.caps.SupportsExtension(protocol.ExtCompression) {
+		data, err := json.Marshal(msg)
+		if err == nil && len(data) > CompressionThreshold {
+			if compressed, err := compressData(msg.Type(), data); err == nil {
+				return c.Connection.WriteMessage(compressed)
+			}
+		}
+	}
+	return c.Connection.WriteMessage(msg)
+}
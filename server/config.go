@@ -0,0 +1,1107 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// ConfigEnvPrefix is prepended to the names of environment
+// variables which override configuration options.
+//
+// For example, events.buffer_size is overridden by
+// STATUS_EVENTS_BUFFER_SIZE.
+const ConfigEnvPrefix = "STATUS_"
+
+var (
+	ErrConfigBackend      = errors.New("unsupported database backend")
+	ErrConfigMailProvider = errors.New("unsupported mail provider")
+)
+
+// Config stores the settings needed to run a server.
+//
+// Options are named "<section>.<key>" after their struct
+// tags, and are loaded by LoadConfig from (in increasing
+// order of precedence) the defaults, a configuration file,
+// environment variables, and command-line flags.
+type Config struct {
+	Listen struct {
+		// Addr is the address for client connections.
+		Addr string `config:"addr" usage:"address for client connections"`
+
+		// AdminAddr is the address for the admin API.
+		// If empty, the admin API is disabled.
+		AdminAddr  string `config:"admin_addr" usage:"address for the admin API (empty to disable)"`
+		AdminToken string `config:"admin_token" usage:"bearer token for the admin API"`
+
+		// WebSocketAddr is the address for browser clients.
+		// If empty, WebSocket connections are not accepted.
+		WebSocketAddr string `config:"websocket_addr" usage:"address for WebSocket clients (empty to disable)"`
+
+		// IRCAddr is the address for IRC clients, which see
+		// their buddies in IRCChannel.
+		// If empty, IRC connections are not accepted.
+		IRCAddr string `config:"irc_addr" usage:"address for IRC clients (empty to disable)"`
+
+		// HealthAddr is the address for HealthProbes.
+		// If empty, the probes are disabled.
+		HealthAddr string `config:"health_addr" usage:"address for health and readiness probes (empty to disable)"`
+
+		// TerminationGrace is the time between failing the
+		// readiness probe and draining the server when it is
+		// told to stop, which lets load balancers stop
+		// sending it new clients first.
+		TerminationGrace time.Duration `config:"termination_grace" usage:"time between failing readiness and draining on shutdown"`
+
+		// StrictDecoding rejects client messages with
+		// unknown fields, for servers used to develop
+		// clients.
+		StrictDecoding bool `config:"strict_decoding" usage:"reject client messages with unknown fields"`
+
+		// LocaleDir holds message catalogs, named like
+		// es.json, for clients which choose a locale.
+		// If empty, every client sees English.
+		LocaleDir string `config:"locale_dir" usage:"directory of message catalogs, e.g. locales (empty for English only)"`
+	} `config:"listen"`
+
+	TLS struct {
+		// CertFile and KeyFile enable TLS on every listener
+		// when both are set.
+		CertFile string `config:"cert_file" usage:"TLS certificate file"`
+		KeyFile  string `config:"key_file" usage:"TLS private key file"`
+	} `config:"tls"`
+
+	DB struct {
+		// Backend selects the DB implementation, which is
+		// either "file" or "shared_file". A shared file may
+		// be used by several nodes of a cluster.
+		Backend string `config:"backend" usage:"database backend (file or shared_file)"`
+		Path    string `config:"path" usage:"database path"`
+
+		// AvatarDir stores uploaded avatars.
+		// If empty, avatars are disabled.
+		AvatarDir string `config:"avatar_dir" usage:"avatar directory (empty to disable avatars)"`
+
+		// ReadOnly starts the server in maintenance mode.
+		ReadOnly bool `config:"read_only" usage:"start in read-only maintenance mode"`
+
+		// AuditPath is the file for the audit log.
+		// If empty, operations are not audited.
+		AuditPath string `config:"audit_path" usage:"audit log file (empty to disable auditing)"`
+
+		// StaleAccountAge is the time after which accounts
+		// which have been neither used nor changed are
+		// deleted. If zero, they are kept.
+		StaleAccountAge time.Duration `config:"stale_account_age" usage:"time without use after which accounts are deleted (0 to keep them)"`
+	} `config:"db"`
+
+	Events struct {
+		BufferSize    int           `config:"buffer_size" usage:"events buffered per session"`
+		ReauthWindow  time.Duration `config:"reauth_window" usage:"time before sensitive operations need reauthentication"`
+		IdleThreshold time.Duration `config:"idle_threshold" usage:"idle time before a user is marked away"`
+
+		// MaxLifetime, if non-zero, is the approximate time
+		// after which clients are asked to reconnect, which
+		// spreads connections evenly across servers behind a
+		// load balancer.
+		MaxLifetime time.Duration `config:"max_lifetime" usage:"approximate connection lifetime before clients reconnect (0 for no limit)"`
+
+		SessionShards int `config:"session_shards" usage:"number of partitions of the sessions, each delivering its own events"`
+	} `config:"events"`
+
+	Limits struct {
+		MaxBuddies             int `config:"max_buddies" usage:"maximum buddies per user"`
+		MaxPendingRequests     int `config:"max_pending_requests" usage:"maximum outgoing buddy requests awaiting a response"`
+		MaxSessionsPerUser     int `config:"max_sessions_per_user" usage:"maximum simultaneous sessions per user"`
+		MaxStatusMessageLength int `config:"max_status_message_length" usage:"maximum characters in a status message"`
+		MessagesPerMinute      int `config:"messages_per_minute" usage:"client messages allowed per session per minute"`
+		LookupsPerMinute       int `config:"lookups_per_minute" usage:"user lookups allowed per user per minute"`
+		ReportsPerHour         int `config:"reports_per_hour" usage:"abuse reports allowed per session per hour"`
+		StatusHistoryLength    int `config:"status_history_length" usage:"statuses kept in each user's history (0 to disable)"`
+	} `config:"limits"`
+
+	Status struct {
+		// BannedWords is a comma-separated list of words
+		// which status messages may not contain.
+		BannedWords string `config:"banned_words" usage:"comma-separated words which status messages may not contain"`
+
+		// MetadataSchema is a JSON file holding the
+		// statusdb.MetadataSchema which status metadata must
+		// satisfy. If empty, any JSON object is accepted.
+		MetadataSchema string `config:"metadata_schema" usage:"JSON file of the schema for status metadata (empty to accept any object)"`
+	} `config:"status"`
+
+	Features struct {
+		// Rollout limits features to a percentage of users,
+		// as parsed by ParseRollout.
+		Rollout string `config:"rollout" usage:"feature rollout percentages, e.g. delta_sync=10"`
+	} `config:"features"`
+
+	Log struct {
+		// Level is the minimum level of messages to log,
+		// such as "info" or "warn".
+		Level string `config:"level" usage:"minimum log level (debug, info, warn, or error)"`
+
+		// Path is the log file. If empty, logs are written
+		// to standard error.
+		Path string `config:"path" usage:"log file (empty for standard error)"`
+
+		// MaxSize and Interval control when the log file is
+		// rotated, and Keep and MaxAge control how long the
+		// rotated files are retained.
+		MaxSize  int           `config:"max_size" usage:"log file size in megabytes before rotation (0 for no limit)"`
+		Interval time.Duration `config:"interval" usage:"log file age before rotation (0 for no limit)"`
+		Keep     int           `config:"keep" usage:"rotated log files to keep (0 for no limit)"`
+		MaxAge   time.Duration `config:"max_age" usage:"time to keep rotated log files (0 for no limit)"`
+	} `config:"log"`
+
+	Record struct {
+		// Dir stores recordings of the connections of the
+		// users in Emails, a comma-separated list.
+		Dir    string `config:"dir" usage:"directory for connection recordings"`
+		Emails string `config:"emails" usage:"comma-separated users whose connections are recorded"`
+	} `config:"record"`
+
+	Alerts struct {
+		WebhookURL string `config:"webhook_url" usage:"URL to post alerts to as JSON"`
+		SlackURL   string `config:"slack_url" usage:"Slack incoming webhook URL for alerts"`
+
+		// Cooldown is the minimum time between alerts for
+		// the same condition.
+		Cooldown time.Duration `config:"cooldown" usage:"minimum time between repeated alerts"`
+
+		LoginFailuresPerMinute int `config:"login_failures_per_minute" usage:"failed logins per minute which raise an alert (0 to disable)"`
+	} `config:"alerts"`
+
+	Summary struct {
+		// Interval is the time between summary reports,
+		// such as 24h or 168h. If zero, none are sent.
+		Interval   time.Duration `config:"interval" usage:"time between activity summaries (0 to disable)"`
+		WebhookURL string        `config:"webhook_url" usage:"URL to post activity summaries to as JSON"`
+
+		// Email is a comma-separated list of recipients,
+		// who are sent summaries using the SMTP options.
+		Email string `config:"email" usage:"comma-separated addresses to email activity summaries to"`
+	} `config:"summary"`
+
+	Chaos struct {
+		// Enabled turns on fault injection, which should
+		// only be used for resilience testing.
+		Enabled      bool          `config:"enabled" usage:"inject faults into DB and connection operations (testing only)"`
+		ErrorPercent int           `config:"error_percent" usage:"percentage of operations which fail"`
+		DelayPercent int           `config:"delay_percent" usage:"percentage of operations which are delayed"`
+		MaxDelay     time.Duration `config:"max_delay" usage:"maximum injected delay"`
+	} `config:"chaos"`
+
+	Cluster struct {
+		// RedisAddr is the Redis server which carries
+		// messages between the nodes of a cluster.
+		// If empty, the server runs alone.
+		RedisAddr     string `config:"redis_addr" usage:"Redis address for clustering (empty to run alone)"`
+		RedisPassword string `config:"redis_password" usage:"Redis password"`
+		Channel       string `config:"channel" usage:"Redis channel for cluster messages"`
+
+		// NodeID identifies this node to the others.
+		// If empty, a random ID is used.
+		NodeID string `config:"node_id" usage:"name of this node (default: random)"`
+	} `config:"cluster"`
+
+	Federation struct {
+		// PeersFile is a JSON array of FederationPeers, whose
+		// users may be buddies with ours.
+		// If empty, federation is disabled.
+		PeersFile string `config:"peers_file" usage:"JSON file of federated servers (empty to disable)"`
+		Addr      string `config:"addr" usage:"address for the federation endpoint (empty to disable)"`
+	} `config:"federation"`
+
+	Matrix struct {
+		// HomeserverURL enables the Matrix bridge, which the
+		// homeserver must have registered as an application
+		// service with the tokens and namespaces below.
+		HomeserverURL string `config:"homeserver_url" usage:"Matrix homeserver client API URL (empty to disable the bridge)"`
+		ServerName    string `config:"server_name" usage:"Matrix server name, which is also the domain of Matrix users' addresses"`
+		ASToken       string `config:"as_token" usage:"application service token for the homeserver"`
+		HSToken       string `config:"hs_token" usage:"token which the homeserver sends the bridge"`
+		UserPrefix    string `config:"user_prefix" usage:"localpart prefix of the bridge's users and aliases"`
+		Bot           string `config:"bot" usage:"localpart of the bridge's own user"`
+	} `config:"matrix"`
+
+	SMTP struct {
+		Host     string `config:"host" usage:"SMTP server host"`
+		Port     int    `config:"port" usage:"SMTP server port"`
+		Username string `config:"username" usage:"SMTP username"`
+		Password string `config:"password" usage:"SMTP password"`
+		From     string `config:"from" usage:"sender address for outgoing mail"`
+	} `config:"smtp"`
+
+	Mail struct {
+		// Provider sends users the emails which verify
+		// their addresses and reset their passwords, and is
+		// "smtp", "ses", or "sendgrid". If empty, no emails
+		// are sent and new users are verified right away.
+		//
+		// Every provider sends from smtp.from.
+		Provider string `config:"provider" usage:"email provider for user emails (smtp, ses, or sendgrid; empty to disable)"`
+
+		// TemplateDir may replace the built-in emails with
+		// files such as verify.txt, as described by
+		// MailTemplates.
+		TemplateDir string `config:"template_dir" usage:"directory of email templates replacing the built-in ones"`
+
+		// The SES credentials default to the standard AWS
+		// environment variables.
+		SESRegion          string `config:"ses_region" usage:"AWS region for SES"`
+		SESAccessKeyID     string `config:"ses_access_key_id" usage:"AWS access key ID for SES"`
+		SESSecretAccessKey string `config:"ses_secret_access_key" usage:"AWS secret access key for SES"`
+
+		SendGridAPIKey string `config:"sendgrid_api_key" usage:"SendGrid API key"`
+	} `config:"mail"`
+
+	Push struct {
+		// VAPIDPrivateKey enables Web Push notifications.
+		// Keys are created with status-server --vapid-keys.
+		VAPIDPrivateKey string `config:"vapid_private_key" usage:"VAPID private key for Web Push (empty to disable)"`
+		VAPIDSubject    string `config:"vapid_subject" usage:"mailto: or https: contact URL sent to push services"`
+	} `config:"push"`
+
+	Webhooks struct {
+		// Enabled lets users register webhooks, which the
+		// server calls on their own events.
+		Enabled bool `config:"enabled" usage:"let users register webhooks for their own events"`
+
+		// AllowPrivate lets webhooks reach loopback and
+		// private addresses, which is only safe when every
+		// user is trusted.
+		AllowPrivate bool `config:"allow_private" usage:"let webhooks call private and loopback addresses"`
+	} `config:"webhooks"`
+
+	Integrations struct {
+		// Key encrypts the tokens which users' integrations
+		// store in the DB, and is 32 random bytes encoded
+		// with base64.
+		Key string `config:"key" usage:"base64 key of 32 bytes which encrypts integration tokens"`
+
+		// The Slack app's credentials enable Slack status
+		// synchronization.
+		SlackClientID     string `config:"slack_client_id" usage:"Slack app client ID (empty to disable Slack)"`
+		SlackClientSecret string `config:"slack_client_secret" usage:"Slack app client secret"`
+
+		// The Discord bot's token and OAuth credentials
+		// enable importing presence from Discord.
+		DiscordBotToken     string `config:"discord_bot_token" usage:"Discord bot token (empty to disable Discord)"`
+		DiscordClientID     string `config:"discord_client_id" usage:"Discord application client ID"`
+		DiscordClientSecret string `config:"discord_client_secret" usage:"Discord application client secret"`
+
+		// AlertmanagerToken enables marking on-call users as
+		// responding while Alertmanager's alerts fire.
+		AlertmanagerToken string `config:"alertmanager_token" usage:"bearer token for Alertmanager webhooks (empty to disable)"`
+		AlertMessage      string `config:"alert_message" usage:"status message of users responding to alerts"`
+		AlertEmoji        string `config:"alert_emoji" usage:"status emoji of users responding to alerts"`
+	} `config:"integrations"`
+
+	Contacts struct {
+		// The Google app's credentials enable importing
+		// Google contacts.
+		GoogleClientID     string `config:"google_client_id" usage:"Google OAuth client ID (empty to disable Google contacts)"`
+		GoogleClientSecret string `config:"google_client_secret" usage:"Google OAuth client secret"`
+
+		// CardDAV lets users import address books from
+		// CardDAV servers by URL. AllowPrivate lets those
+		// URLs reach loopback and private addresses.
+		CardDAV      bool `config:"carddav" usage:"let users import CardDAV address books"`
+		AllowPrivate bool `config:"allow_private" usage:"let CardDAV imports reach private and loopback addresses"`
+	} `config:"contacts"`
+
+	LDAP struct {
+		// URL, if set, makes the directory the source of
+		// users' passwords, and users are provisioned when
+		// they first log in.
+		URL      string `config:"url" usage:"ldap:// or ldaps:// URL of the directory (empty to use local passwords)"`
+		StartTLS bool   `config:"start_tls" usage:"upgrade ldap:// connections with StartTLS"`
+
+		BindDN        string `config:"bind_dn" usage:"DN to bind as when searching for users (empty for anonymous)"`
+		BindPassword  string `config:"bind_password" usage:"password of bind_dn"`
+		BaseDN        string `config:"base_dn" usage:"DN under which to search for users"`
+		UserFilter    string `config:"user_filter" usage:"search filter in which %s is the user's email"`
+		NameAttribute string `config:"name_attribute" usage:"attribute copied into new users' display names"`
+	} `config:"ldap"`
+
+	Gravatar struct {
+		// Mode shows Gravatar images for users without
+		// avatars. It is "url" to link clients to Gravatar,
+		// "proxy" to serve the images from the WebSocket
+		// listener at ProxyURL, or empty to disable them.
+		Mode     string `config:"mode" usage:"Gravatar fallback for users without avatars (url or proxy; empty to disable)"`
+		Default  string `config:"default" usage:"Gravatar image for emails without one, such as identicon or mp"`
+		ProxyURL string `config:"proxy_url" usage:"public URL of the WebSocket listener's /gravatar/ path, for proxy mode"`
+	} `config:"gravatar"`
+
+	// alertmanager and matrix are shared by the DB and the
+	// WebSocket listener.
+	alertmanager *Alertmanager
+	matrix       *MatrixBridge
+}
+
+// DefaultConfig creates a Config with default values for
+// every option.
+func DefaultConfig() *Config {
+	c := &Config{}
+	c.Listen.Addr = ":8080"
+	c.DB.Backend = "file"
+	c.DB.Path = "users.json"
+	c.Cluster.Channel = "status-server"
+	c.Events.BufferSize = events.DefaultBufferSize
+	c.Events.ReauthWindow = events.DefaultReauthWindow
+	c.Events.IdleThreshold = events.DefaultIdleThreshold
+	c.Events.SessionShards = events.DefaultSessionShards
+	limits := statusdb.DefaultLimits()
+	c.Limits.MaxBuddies = limits.MaxBuddies
+	c.Limits.MaxPendingRequests = limits.MaxPendingRequests
+	c.Limits.MaxSessionsPerUser = limits.MaxSessionsPerUser
+	c.Limits.MaxStatusMessageLength = limits.MaxStatusMessageLength
+	c.Limits.MessagesPerMinute = limits.MessagesPerMinute
+	c.Limits.LookupsPerMinute = limits.LookupsPerMinute
+	c.Limits.ReportsPerHour = limits.ReportsPerHour
+	c.Limits.StatusHistoryLength = limits.StatusHistoryLength
+	c.Alerts.Cooldown = statusdb.DefaultAlertCooldown
+	c.Integrations.AlertMessage = DefaultAlertMessage
+	c.Matrix.UserPrefix = DefaultMatrixUserPrefix
+	c.Matrix.Bot = DefaultMatrixBot
+	c.Integrations.AlertEmoji = DefaultAlertEmoji
+	c.Alerts.LoginFailuresPerMinute = 100
+	c.Log.Level = "info"
+	c.Log.MaxSize = 100
+	c.Log.Keep = 10
+	c.SMTP.Port = 587
+	c.LDAP.UserFilter = DefaultLDAPUserFilter
+	c.LDAP.NameAttribute = DefaultLDAPNameAttribute
+	return c
+}
+
+// LoadConfig creates a Config from the defaults, the
+// configuration file, environment variables, and flags, in
+// that order.
+//
+// The configuration file is named by the -config flag or
+// the STATUS_CONFIG environment variable. Files ending in
+// .json are JSON objects with one object per section.
+// Other files use a TOML or YAML subset with one level of
+// sections and scalar values, for example:
+//
+//	[events]
+//	buffer_size = 200
+//
+// or
+//
+//	events:
+//	  buffer_size: 200
+//
+// Flags are added to fs and parsed from args. If the
+// -version flag is set, the server's build information is
+// printed and the process exits.
+func LoadConfig(fs *flag.FlagSet, args []string) (c *Config, err error) {
+	defer essentials.AddCtxTo("load config", &err)
+	c = DefaultConfig()
+	path := configPathArg(args)
+	if path == "" {
+		path = os.Getenv(ConfigEnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range c.fields() {
+		envName := ConfigEnvPrefix + strings.ToUpper(strings.Replace(field.name, ".", "_", -1))
+		if val, ok := os.LookupEnv(envName); ok {
+			if err := field.Set(val); err != nil {
+				return nil, essentials.AddCtx(envName, err)
+			}
+		}
+	}
+	fs.String("config", path, "configuration file")
+	showVersion := fs.Bool("version", false, "print version information and exit")
+	for _, field := range c.fields() {
+		fs.Var(field, field.name, field.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *showVersion {
+		fmt.Println(CurrentServerInfo())
+		os.Exit(0)
+	}
+	return c, c.Validate()
+}
+
+// Validate checks that the options are usable.
+func (c *Config) Validate() error {
+	if c.DB.Backend != "file" && c.DB.Backend != "shared_file" {
+		return ErrConfigBackend
+	} else if c.Cluster.RedisAddr != "" && c.DB.Backend != "shared_file" {
+		return &statusdb.ValidationError{Field: "cluster.redis_addr", Reason: "requires a shared_file backend"}
+	} else if c.Federation.Addr != "" && c.Federation.PeersFile == "" {
+		return &statusdb.ValidationError{Field: "federation.addr", Reason: "requires peers_file"}
+	} else if c.Matrix.HomeserverURL != "" && (c.Matrix.ServerName == "" || c.Matrix.ASToken == "" ||
+		c.Matrix.HSToken == "") {
+		return &statusdb.ValidationError{Field: "matrix.homeserver_url",
+			Reason: "requires server_name, as_token, and hs_token"}
+	} else if c.Matrix.HomeserverURL != "" && (c.Matrix.UserPrefix == "" || c.Matrix.Bot == "") {
+		return &statusdb.ValidationError{Field: "matrix.user_prefix", Reason: "must not be empty"}
+	} else if c.Events.BufferSize < 1 {
+		return &statusdb.ValidationError{Field: "events.buffer_size", Reason: "must be positive"}
+	} else if c.Events.SessionShards < 1 {
+		return &statusdb.ValidationError{Field: "events.session_shards", Reason: "must be positive"}
+	} else if c.Events.MaxLifetime < 0 {
+		return &statusdb.ValidationError{Field: "events.max_lifetime", Reason: "must not be negative"}
+	} else if c.Alerts.LoginFailuresPerMinute < 0 {
+		return &statusdb.ValidationError{Field: "alerts.login_failures_per_minute", Reason: "must not be negative"}
+	} else if c.Chaos.ErrorPercent < 0 || c.Chaos.ErrorPercent > 100 ||
+		c.Chaos.DelayPercent < 0 || c.Chaos.DelayPercent > 100 {
+		return &statusdb.ValidationError{Field: "chaos", Reason: "percentages must be between 0 and 100"}
+	} else if c.Summary.Interval < 0 {
+		return &statusdb.ValidationError{Field: "summary.interval", Reason: "must not be negative"}
+	} else if c.Summary.Email != "" && (c.SMTP.Host == "" || c.SMTP.From == "") {
+		return &statusdb.ValidationError{Field: "summary.email", Reason: "requires smtp.host and smtp.from"}
+	} else if c.Push.VAPIDPrivateKey != "" && c.Push.VAPIDSubject == "" {
+		return &statusdb.ValidationError{Field: "push.vapid_subject", Reason: "required by vapid_private_key"}
+	} else if c.Integrations.SlackClientID != "" && (c.Integrations.SlackClientSecret == "" ||
+		c.Integrations.Key == "") {
+		return &statusdb.ValidationError{Field: "integrations.slack_client_id",
+			Reason: "requires slack_client_secret and key"}
+	} else if c.Gravatar.Mode != "" && c.Gravatar.Mode != "url" && c.Gravatar.Mode != "proxy" {
+		return &statusdb.ValidationError{Field: "gravatar.mode", Reason: "must be url or proxy"}
+	} else if c.Gravatar.Mode == "proxy" && (c.Gravatar.ProxyURL == "" ||
+		c.Listen.WebSocketAddr == "") {
+		return &statusdb.ValidationError{Field: "gravatar.mode",
+			Reason: "proxy requires proxy_url and listen.websocket_addr"}
+	} else if c.LDAP.URL != "" && !strings.HasPrefix(c.LDAP.URL, "ldap://") &&
+		!strings.HasPrefix(c.LDAP.URL, "ldaps://") {
+		return &statusdb.ValidationError{Field: "ldap.url", Reason: "must be an ldap:// or ldaps:// URL"}
+	} else if c.LDAP.URL != "" && c.LDAP.BaseDN == "" {
+		return &statusdb.ValidationError{Field: "ldap.base_dn", Reason: "required by url"}
+	} else if c.LDAP.URL != "" && c.LDAPAuthenticator().CheckFilter() != nil {
+		return &statusdb.ValidationError{Field: "ldap.user_filter",
+			Reason: "must be a filter of and, or, not, equality, and presence terms containing %s"}
+	} else if c.Contacts.GoogleClientID != "" && c.Contacts.GoogleClientSecret == "" {
+		return &statusdb.ValidationError{Field: "contacts.google_client_id",
+			Reason: "requires google_client_secret"}
+	} else if c.Integrations.DiscordBotToken != "" && (c.Integrations.DiscordClientID == "" ||
+		c.Integrations.DiscordClientSecret == "") {
+		return &statusdb.ValidationError{Field: "integrations.discord_bot_token",
+			Reason: "requires discord_client_id and discord_client_secret"}
+	} else if err := c.limits().Validate(); err != nil {
+		if v, ok := err.(*statusdb.ValidationError); ok {
+			v.Field = "limits." + v.Field
+		}
+		return err
+	} else if _, err := events.ParseRollout(c.Features.Rollout); err != nil {
+		return err
+	} else if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return &statusdb.ValidationError{Field: "tls", Reason: "cert_file and key_file must be set together"}
+	} else if c.Listen.AdminAddr != "" && c.Listen.AdminToken == "" {
+		return &statusdb.ValidationError{Field: "listen.admin_token", Reason: "required by admin_addr"}
+	} else if _, err := statusdb.ParseLogLevel(c.Log.Level); err != nil {
+		return &statusdb.ValidationError{Field: "log.level", Reason: "unknown level: " + c.Log.Level}
+	} else if c.Log.MaxSize < 0 || c.Log.Keep < 0 || c.Log.Interval < 0 || c.Log.MaxAge < 0 {
+		return &statusdb.ValidationError{Field: "log", Reason: "limits must not be negative"}
+	}
+	return nil
+}
+
+// OpenDB opens the configured database and creates an
+// EventDB around it.
+func (c *Config) OpenDB() (db statusdb.DB, edb events.EventDB, err error) {
+	defer essentials.AddCtxTo("open database", &err)
+	var fdb statusdb.DB
+	switch c.DB.Backend {
+	case "file":
+		fdb, err = statusdb.OpenFileDB(c.DB.Path)
+	case "shared_file":
+		fdb, err = statusdb.OpenSharedFileDB(c.DB.Path)
+	default:
+		return nil, nil, ErrConfigBackend
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	rollout, err := events.ParseRollout(c.Features.Rollout)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy, err := c.StatusPolicy()
+	if err != nil {
+		return nil, nil, err
+	}
+	db = fdb
+	if ldap := c.LDAPAuthenticator(); ldap != nil {
+		db = ldap.WrapDB(db)
+	}
+	if faults := c.FaultInjector(); faults != nil {
+		db = faults.WrapDB(db)
+	}
+	opts := events.Options{
+		BufferSize:    c.Events.BufferSize,
+		ReauthWindow:  c.Events.ReauthWindow,
+		IdleThreshold: c.Events.IdleThreshold,
+		MaxLifetime:   c.Events.MaxLifetime,
+		SessionShards: c.Events.SessionShards,
+		StatusPolicy:  policy,
+		Features:      events.FeatureFlags{Rollout: rollout},
+		Limits:        c.limits(),
+		Alerter:       c.Alerter(),
+		NodeID:        c.Cluster.NodeID,
+	}
+	if c.Cluster.RedisAddr != "" {
+		opts.Bus = NewRedisBus(c.Cluster.RedisAddr, c.Cluster.RedisPassword,
+			c.Cluster.Channel, opts.Alerter)
+	}
+	var relays Relays
+	if peers, err := c.FederationPeers(); err != nil {
+		return nil, nil, err
+	} else if peers != nil {
+		relays = append(relays, NewFederationRelay(peers, opts.Alerter))
+	}
+	if c.Matrix.HomeserverURL != "" {
+		c.matrix = NewMatrixBridge(c.Matrix.HomeserverURL, c.Matrix.ServerName, c.Matrix.ASToken,
+			c.Matrix.HSToken, opts.Alerter)
+		c.matrix.UserPrefix = c.Matrix.UserPrefix
+		c.matrix.Bot = c.Matrix.Bot
+		relays = append(relays, c.matrix)
+	}
+	if len(relays) == 1 {
+		opts.Relay = relays[0]
+	} else if len(relays) > 1 {
+		opts.Relay = relays
+	}
+	if c.DB.AvatarDir != "" {
+		if err := os.MkdirAll(c.DB.AvatarDir, 0755); err != nil {
+			return nil, nil, err
+		}
+		opts.Avatars = &events.DirAvatarStore{Dir: c.DB.AvatarDir}
+	}
+	if c.DB.AuditPath != "" {
+		opts.Audit = &events.FileAuditLog{Path: c.DB.AuditPath}
+	}
+	if opts.Mailer, err = c.Mailer(); err != nil {
+		return nil, nil, err
+	}
+	if c.Push.VAPIDPrivateKey != "" {
+		sender, err := NewWebPushSender(c.Push.VAPIDPrivateKey, c.Push.VAPIDSubject)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Push = sender
+	}
+	if c.Webhooks.Enabled {
+		opts.Webhooks = NewUserWebhookSender(c.Webhooks.AllowPrivate)
+	}
+	if opts.Integrations, err = c.StatusProviders(); err != nil {
+		return nil, nil, err
+	}
+	opts.ContactSources = c.ContactSources()
+	switch c.Gravatar.Mode {
+	case "url":
+		opts.AvatarFallback = &Gravatar{Default: c.Gravatar.Default}
+	case "proxy":
+		opts.AvatarFallback = &Gravatar{Default: c.Gravatar.Default, ProxyURL: c.Gravatar.ProxyURL}
+	}
+	fdb.SetAlerter(opts.Alerter)
+	eventDB := events.New(db, opts)
+	if c.DB.ReadOnly {
+		eventDB.SetMaintenance(true)
+	}
+	return fdb, eventDB, nil
+}
+
+// limits converts the limits section to Limits.
+func (c *Config) limits() statusdb.Limits {
+	return statusdb.Limits{
+		MaxBuddies:             c.Limits.MaxBuddies,
+		MaxPendingRequests:     c.Limits.MaxPendingRequests,
+		MaxSessionsPerUser:     c.Limits.MaxSessionsPerUser,
+		MaxStatusMessageLength: c.Limits.MaxStatusMessageLength,
+		MessagesPerMinute:      c.Limits.MessagesPerMinute,
+		LookupsPerMinute:       c.Limits.LookupsPerMinute,
+		ReportsPerHour:         c.Limits.ReportsPerHour,
+		StatusHistoryLength:    c.Limits.StatusHistoryLength,
+	}
+}
+
+// FaultInjector creates the FaultInjector for resilience
+// testing, or returns nil if it is not enabled.
+//
+// The DB opened by OpenDB is wrapped automatically, but
+// connections must be wrapped by the caller.
+func (c *Config) FaultInjector() *FaultInjector {
+	if !c.Chaos.Enabled {
+		return nil
+	}
+	return &FaultInjector{
+		ErrorPercent: c.Chaos.ErrorPercent,
+		DelayPercent: c.Chaos.DelayPercent,
+		MaxDelay:     c.Chaos.MaxDelay,
+	}
+}
+
+// GravatarProxy creates the proxy which the WebSocket
+// listener serves at GravatarProxyPath, or returns nil if
+// Gravatar images are not proxied.
+func (c *Config) GravatarProxy() *GravatarProxy {
+	if c.Gravatar.Mode != "proxy" {
+		return nil
+	}
+	return NewGravatarProxy(c.Gravatar.Default)
+}
+
+// LDAPAuthenticator creates the directory which users log
+// in with, or returns nil if they use local passwords.
+func (c *Config) LDAPAuthenticator() *LDAPAuthenticator {
+	if c.LDAP.URL == "" {
+		return nil
+	}
+	return &LDAPAuthenticator{
+		URL:           c.LDAP.URL,
+		StartTLS:      c.LDAP.StartTLS,
+		BindDN:        c.LDAP.BindDN,
+		BindPassword:  c.LDAP.BindPassword,
+		BaseDN:        c.LDAP.BaseDN,
+		UserFilter:    c.LDAP.UserFilter,
+		NameAttribute: c.LDAP.NameAttribute,
+	}
+}
+
+// FederationPeers reads the federated servers, or returns
+// nil if federation is disabled.
+func (c *Config) FederationPeers() ([]FederationPeer, error) {
+	if c.Federation.PeersFile == "" {
+		return nil, nil
+	}
+	return ReadFederationPeers(c.Federation.PeersFile)
+}
+
+// StatusPolicy creates the policy for status messages and
+// metadata. The message length comes from the limits.
+func (c *Config) StatusPolicy() (policy events.StatusPolicy, err error) {
+	for _, word := range strings.Split(c.Status.BannedWords, ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			policy.BannedWords = append(policy.BannedWords, word)
+		}
+	}
+	if c.Status.MetadataSchema != "" {
+		data, err := os.ReadFile(c.Status.MetadataSchema)
+		if err != nil {
+			return policy, essentials.AddCtx("read metadata schema", err)
+		}
+		policy.Metadata = &statusdb.MetadataSchema{}
+		if err := json.Unmarshal(data, policy.Metadata); err != nil {
+			return policy, essentials.AddCtx("read metadata schema", err)
+		}
+	}
+	return policy, nil
+}
+
+// Alerter creates an Alerter for the configured sinks, or
+// returns nil if there are none.
+func (c *Config) Alerter() *statusdb.Alerter {
+	var sinks []statusdb.AlertSink
+	if c.Alerts.WebhookURL != "" {
+		sinks = append(sinks, &WebhookAlertSink{URL: c.Alerts.WebhookURL})
+	}
+	if c.Alerts.SlackURL != "" {
+		sinks = append(sinks, &SlackAlertSink{WebhookURL: c.Alerts.SlackURL})
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	return &statusdb.Alerter{
+		Sinks:                  sinks,
+		Cooldown:               c.Alerts.Cooldown,
+		LoginFailuresPerMinute: c.Alerts.LoginFailuresPerMinute,
+	}
+}
+
+// Mailer creates the configured Mailer, or returns nil if
+// emails are disabled.
+func (c *Config) Mailer() (mailer events.Mailer, err error) {
+	defer essentials.AddCtxTo("create mailer", &err)
+	if c.Mail.Provider == "" {
+		return nil, nil
+	}
+	var templates MailTemplates
+	if c.Mail.TemplateDir != "" {
+		if templates, err = LoadMailTemplates(c.Mail.TemplateDir); err != nil {
+			return nil, err
+		}
+	}
+	switch c.Mail.Provider {
+	case "smtp":
+		return &SMTPMailer{
+			Host:      c.SMTP.Host,
+			Port:      c.SMTP.Port,
+			Username:  c.SMTP.Username,
+			Password:  c.SMTP.Password,
+			From:      c.SMTP.From,
+			Templates: templates,
+		}, nil
+	case "ses":
+		mailer := &SESMailer{
+			Region:          c.Mail.SESRegion,
+			AccessKeyID:     c.Mail.SESAccessKeyID,
+			SecretAccessKey: c.Mail.SESSecretAccessKey,
+			From:            c.SMTP.From,
+			Templates:       templates,
+		}
+		if mailer.Region == "" {
+			mailer.Region = os.Getenv("AWS_REGION")
+		}
+		if mailer.AccessKeyID == "" {
+			mailer.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+			mailer.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			mailer.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		return mailer, nil
+	case "sendgrid":
+		return &SendGridMailer{
+			APIKey:    c.Mail.SendGridAPIKey,
+			From:      c.SMTP.From,
+			Templates: templates,
+		}, nil
+	default:
+		return nil, ErrConfigMailProvider
+	}
+}
+
+// StatusProviders creates the services which users may
+// synchronize their statuses with, by provider name.
+//
+// The Discord bridge, if configured, is connected to the
+// gateway in the background.
+func (c *Config) StatusProviders() (providers map[string]events.StatusProvider, err error) {
+	defer essentials.AddCtxTo("create status providers", &err)
+	providers = map[string]events.StatusProvider{}
+	if c.Integrations.SlackClientID != "" {
+		tokens, err := NewTokenCipher(c.Integrations.Key)
+		if err != nil {
+			return nil, err
+		}
+		providers[events.IntegrationSlack] = &SlackProvider{
+			ClientID:     c.Integrations.SlackClientID,
+			ClientSecret: c.Integrations.SlackClientSecret,
+			Tokens:       tokens,
+		}
+	}
+	if c.Integrations.DiscordBotToken != "" {
+		bridge := NewDiscordBridge(c.Integrations.DiscordBotToken,
+			c.Integrations.DiscordClientID, c.Integrations.DiscordClientSecret)
+		go bridge.Run(nil)
+		providers[events.IntegrationDiscord] = bridge
+	}
+	if alertmanager := c.Alertmanager(); alertmanager != nil {
+		providers[events.IntegrationAlertmanager] = alertmanager
+	}
+	return providers, nil
+}
+
+// MatrixBridge gets the bridge which OpenDB created, which
+// the WebSocket listener serves at MatrixPath, or returns
+// nil if there is none.
+func (c *Config) MatrixBridge() *MatrixBridge {
+	return c.matrix
+}
+
+// Alertmanager gets the receiver which the WebSocket
+// listener serves at AlertmanagerPath, or returns nil if
+// Alertmanager webhooks are disabled.
+//
+// It is the same receiver which StatusProviders uses.
+func (c *Config) Alertmanager() *Alertmanager {
+	if c.Integrations.AlertmanagerToken == "" {
+		return nil
+	}
+	if c.alertmanager == nil {
+		c.alertmanager = NewAlertmanager(c.Integrations.AlertmanagerToken)
+		c.alertmanager.Message = c.Integrations.AlertMessage
+		c.alertmanager.Emoji = c.Integrations.AlertEmoji
+	}
+	return c.alertmanager
+}
+
+// ContactSources creates the services which users may
+// import contacts from, by source name.
+func (c *Config) ContactSources() map[string]events.ContactSource {
+	sources := map[string]events.ContactSource{}
+	if c.Contacts.GoogleClientID != "" {
+		sources[protocol.ContactsGoogle] = &GoogleContacts{
+			ClientID:     c.Contacts.GoogleClientID,
+			ClientSecret: c.Contacts.GoogleClientSecret,
+		}
+	}
+	if c.Contacts.CardDAV {
+		sources[protocol.ContactsCardDAV] = NewCardDAVContacts(c.Contacts.AllowPrivate)
+	}
+	return sources
+}
+
+// SummarySinks creates the SummarySinks for activity
+// summaries.
+func (c *Config) SummarySinks() []SummarySink {
+	var sinks []SummarySink
+	if c.Summary.WebhookURL != "" {
+		sinks = append(sinks, &WebhookSummarySink{URL: c.Summary.WebhookURL})
+	}
+	if c.Summary.Email != "" {
+		sink := &EmailSummarySink{
+			Host:     c.SMTP.Host,
+			Port:     c.SMTP.Port,
+			Username: c.SMTP.Username,
+			Password: c.SMTP.Password,
+			From:     c.SMTP.From,
+		}
+		for _, addr := range strings.Split(c.Summary.Email, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				sink.To = append(sink.To, addr)
+			}
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// OpenLog creates the writer for the server's logs, which
+// may be passed to log.SetOutput.
+//
+// It also applies the configured log level.
+func (c *Config) OpenLog() io.Writer {
+	if level, err := statusdb.ParseLogLevel(c.Log.Level); err == nil {
+		statusdb.SetLogLevel(level)
+	}
+	if c.Log.Path == "" {
+		return os.Stderr
+	}
+	return &RotatingLog{
+		Path:     c.Log.Path,
+		MaxSize:  int64(c.Log.MaxSize) << 20,
+		Interval: c.Log.Interval,
+		Keep:     c.Log.Keep,
+		MaxAge:   c.Log.MaxAge,
+	}
+}
+
+// SessionRecorder creates a SessionRecorder for the
+// configured users, or returns nil if none are recorded.
+func (c *Config) SessionRecorder() (*SessionRecorder, error) {
+	if c.Record.Dir == "" || c.Record.Emails == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(c.Record.Dir, 0700); err != nil {
+		return nil, essentials.AddCtx("create recording directory", err)
+	}
+	res := &SessionRecorder{Dir: c.Record.Dir}
+	for _, email := range strings.Split(c.Record.Emails, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			res.Emails = append(res.Emails, email)
+		}
+	}
+	return res, nil
+}
+
+// LoadCatalogs registers the message catalogs in the
+// locale directory, if there is one.
+func (c *Config) LoadCatalogs() error {
+	if c.Listen.LocaleDir == "" {
+		return nil
+	}
+	return LoadCatalogs(c.Listen.LocaleDir)
+}
+
+// ClientOptions creates the options for serving clients,
+// including the SessionRecorder.
+func (c *Config) ClientOptions() (ClientOptions, error) {
+	recorder, err := c.SessionRecorder()
+	if err != nil {
+		return ClientOptions{}, err
+	}
+	return ClientOptions{Recorder: recorder, StrictDecoding: c.Listen.StrictDecoding}, nil
+}
+
+func (c *Config) loadFile(path string) (err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]string{}
+	if filepath.Ext(path) == ".json" {
+		var sections map[string]map[string]interface{}
+		if err := json.Unmarshal(data, &sections); err != nil {
+			return err
+		}
+		for section, obj := range sections {
+			for key, val := range obj {
+				values[section+"."+key] = fmt.Sprint(val)
+			}
+		}
+	} else if values, err = parseFlatConfig(string(data)); err != nil {
+		return err
+	}
+	fields := map[string]*configField{}
+	for _, field := range c.fields() {
+		fields[field.name] = field
+	}
+	for name, val := range values {
+		field, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown option: %s", name)
+		}
+		if err := field.Set(val); err != nil {
+			return essentials.AddCtx(name, err)
+		}
+	}
+	return nil
+}
+
+// parseFlatConfig parses the TOML and YAML subsets accepted
+// by LoadConfig into "<section>.<key>" options.
+func parseFlatConfig(data string) (map[string]string, error) {
+	values := map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			continue
+		}
+		sep := strings.IndexAny(trimmed, "=:")
+		if sep < 0 {
+			return nil, fmt.Errorf("line %d: expected key and value", lineNum)
+		}
+		key := strings.TrimSpace(trimmed[:sep])
+		val := strings.TrimSpace(trimmed[sep+1:])
+		if val == "" && trimmed[sep] == ':' && line == strings.TrimLeft(line, " \t") {
+			// A YAML section header.
+			section = key
+			continue
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: option outside of a section", lineNum)
+		}
+		if unquoted, err := strconv.Unquote(val); err == nil {
+			val = unquoted
+		} else if len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'' {
+			val = val[1 : len(val)-1]
+		}
+		values[section+"."+key] = val
+	}
+	return values, scanner.Err()
+}
+
+// A configField is a settable option in a Config.
+//
+// It implements flag.Value.
+type configField struct {
+	name  string
+	usage string
+	value reflect.Value
+}
+
+func (c *Config) fields() []*configField {
+	var res []*configField
+	root := reflect.ValueOf(c).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i)
+		sectionVal := root.Field(i)
+		if section.PkgPath != "" {
+			continue
+		}
+		for j := 0; j < sectionVal.NumField(); j++ {
+			field := section.Type.Field(j)
+			res = append(res, &configField{
+				name:  section.Tag.Get("config") + "." + field.Tag.Get("config"),
+				usage: field.Tag.Get("usage"),
+				value: sectionVal.Field(j),
+			})
+		}
+	}
+	return res
+}
+
+func (c *configField) String() string {
+	if c == nil || !c.value.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(c.value.Interface())
+}
+
+func (c *configField) Set(s string) error {
+	switch c.value.Interface().(type) {
+	case string:
+		c.value.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		c.value.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		c.value.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.value.SetInt(int64(d))
+	default:
+		panic("unsupported config field type: " + c.value.Type().String())
+	}
+	return nil
+}
+
+// IsBoolFlag allows boolean options to be set with a
+// plain flag, such as -db.read_only.
+func (c *configField) IsBoolFlag() bool {
+	return c.value.IsValid() && c.value.Kind() == reflect.Bool
+}
+
+// configPathArg finds the value of a -config flag without
+// parsing the other flags, since the file must be loaded
+// before flags override it.
+func configPathArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		} else if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	DefaultGoogleAuthURL   = "https://accounts.google.com/o/oauth2/v2/auth"
+	DefaultGoogleTokenURL  = "https://oauth2.googleapis.com"
+	DefaultGooglePeopleURL = "https://people.googleapis.com"
+
+	// maxAddressBookSize limits the responses of contact
+	// sources.
+	maxAddressBookSize = 8 << 20
+)
+
+// GoogleContacts is an events.ContactSource which reads a
+// user's Google contacts with the People API.
+//
+// The access token is revoked as soon as the contacts are
+// read.
+type GoogleContacts struct {
+	ClientID     string
+	ClientSecret string
+
+	// AuthURL, TokenURL, and PeopleURL override the
+	// defaults if they are non-empty.
+	AuthURL   string
+	TokenURL  string
+	PeopleURL string
+}
+
+func (g *GoogleContacts) AuthorizeURL(redirectURI string) string {
+	query := url.Values{
+		"client_id":     {g.ClientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"https://www.googleapis.com/auth/contacts.readonly"},
+	}
+	return urlOrDefault(g.AuthURL, DefaultGoogleAuthURL) + "?" + query.Encode()
+}
+
+func (g *GoogleContacts) Contacts(creds events.ContactCredentials) (emails []string, err error) {
+	defer essentials.AddCtxTo("read google contacts", &err)
+	tokenURL := urlOrDefault(g.TokenURL, DefaultGoogleTokenURL)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = googleCall("POST", tokenURL+"/token", url.Values{
+		"client_id":     {g.ClientID},
+		"client_secret": {g.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {creds.Code},
+		"redirect_uri":  {creds.RedirectURI},
+	}, "", &token)
+	if err != nil {
+		return nil, err
+	}
+	defer googleCall("POST", tokenURL+"/revoke", url.Values{"token": {token.AccessToken}}, "", nil)
+
+	peopleURL := urlOrDefault(g.PeopleURL, DefaultGooglePeopleURL)
+	var pageToken string
+	for len(emails) < statusdb.MaxContactLookup {
+		query := url.Values{
+			"personFields": {"emailAddresses"},
+			"pageSize":     {"1000"},
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Connections []struct {
+				EmailAddresses []struct {
+					Value string `json:"value"`
+				} `json:"emailAddresses"`
+			} `json:"connections"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err := googleCall("GET", peopleURL+"/v1/people/me/connections?"+query.Encode(), nil,
+			token.AccessToken, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, person := range page.Connections {
+			for _, address := range person.EmailAddresses {
+				emails = append(emails, address.Value)
+			}
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	return emails, nil
+}
+
+// googleCall makes an API request, sending form as the
+// body if it is non-nil.
+func googleCall(method, rawURL string, form url.Values, bearer string,
+	result interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAddressBookSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Error       interface{} `json:"error"`
+			Description string      `json:"error_description"`
+		}
+		json.Unmarshal(data, &apiErr)
+		reason := apiErr.Description
+		if reason == "" {
+			if e, ok := apiErr.Error.(string); ok {
+				reason = e
+			}
+		}
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status, reason)
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// CardDAVContacts is an events.ContactSource which reads
+// an address book from a CardDAV server (RFC 6352), given
+// its URL and the user's credentials.
+//
+// The credentials are used for a single request and never
+// stored.
+type CardDAVContacts struct {
+	client *http.Client
+}
+
+// NewCardDAVContacts creates a CardDAV source.
+//
+// Unless allowPrivate is set, address books may not be on
+// loopback, private, or link-local addresses.
+func NewCardDAVContacts(allowPrivate bool) *CardDAVContacts {
+	return &CardDAVContacts{client: userURLClient(allowPrivate)}
+}
+
+func (c *CardDAVContacts) AuthorizeURL(redirectURI string) string {
+	return ""
+}
+
+func (c *CardDAVContacts) Contacts(creds events.ContactCredentials) (emails []string, err error) {
+	defer essentials.AddCtxTo("read carddav contacts", &err)
+	query := `<?xml version="1.0" encoding="utf-8"?>` +
+		`<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">` +
+		`<D:prop><C:address-data><C:prop name="EMAIL"/></C:address-data></D:prop>` +
+		`</C:addressbook-query>`
+	req, err := http.NewRequest("REPORT", creds.URL, strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	if creds.Username != "" || creds.Password != "" {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAddressBookSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxAddressBookSize {
+		return nil, errors.New("address book too large")
+	}
+	var result struct {
+		Responses []struct {
+			AddressData []string `xml:"propstat>prop>address-data"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	for _, response := range result.Responses {
+		for _, card := range response.AddressData {
+			emails = append(emails, vCardEmails(card)...)
+		}
+	}
+	return emails, nil
+}
+
+// vCardEmails finds the EMAIL properties of a vCard.
+func vCardEmails(card string) []string {
+	// Long lines are folded by starting their
+	// continuations with whitespace.
+	card = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(card)
+	var emails []string
+	for _, line := range strings.Split(card, "\n") {
+		line = strings.TrimRight(line, "\r")
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name := line[:colon]
+		if semi := strings.IndexByte(name, ';'); semi >= 0 {
+			name = name[:semi]
+		}
+		if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+			// Properties may be grouped, as in "item1.EMAIL".
+			name = name[dot+1:]
+		}
+		if strings.EqualFold(name, "EMAIL") {
+			emails = append(emails, strings.TrimPrefix(strings.TrimSpace(line[colon+1:]), "mailto:"))
+		}
+	}
+	return emails
+}
+
+func urlOrDefault(override, defaultURL string) string {
+	if override != "" {
+		return strings.TrimRight(override, "/")
+	}
+	return defaultURL
+}
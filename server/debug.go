@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+	runtimepprof "runtime/pprof"
+)
+
+// AdminDebug makes AdminHandler serve profiling and
+// runtime dump endpoints under /debug/:
+//
+//	/debug/pprof/               net/http/pprof profiles
+//	/debug/dump/goroutines      stack traces of all goroutines
+//	/debug/dump/heap            a runtime heap dump
+//
+// Mutex and block profiling are enabled when the handler
+// is created, so that lock contention can be diagnosed.
+//
+// This should only be enabled for trusted operators, since
+// dumps may contain user data.
+var AdminDebug = false
+
+// Sampling rates used for mutex and block profiles when
+// AdminDebug is enabled.
+const (
+	DebugMutexProfileFraction = 5
+	DebugBlockProfileRate     = 10000
+)
+
+func newDebugHandler() http.Handler {
+	runtime.SetMutexProfileFraction(DebugMutexProfileFraction)
+	runtime.SetBlockProfileRate(DebugBlockProfileRate)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/dump/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	mux.HandleFunc("/debug/dump/heap", serveHeapDump)
+	return mux
+}
+
+// serveHeapDump writes a heap dump to a temporary file and
+// sends it to the client, since debug.WriteHeapDump needs
+// a file descriptor.
+func serveHeapDump(w http.ResponseWriter, r *http.Request) {
+	f, err := ioutil.TempFile("", "heapdump")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	debug.WriteHeapDump(f.Fd())
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="heapdump"`)
+	io.Copy(w, f)
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// DefaultDiscordURL is the base URL of Discord's OAuth
+	// pages and API.
+	DefaultDiscordURL = "https://discord.com"
+
+	// DefaultDiscordGateway is the URL of Discord's
+	// gateway, which sends bots presence updates.
+	DefaultDiscordGateway = "wss://gateway.discord.gg/?v=10&encoding=json"
+
+	// DiscordRetryDelay is the time before reconnecting to
+	// the gateway, which doubles after each failure up to
+	// MaxDiscordRetryDelay.
+	DiscordRetryDelay    = 5 * time.Second
+	MaxDiscordRetryDelay = 2 * time.Minute
+
+	// discordIntents subscribes to guilds and, with the
+	// privileged presence intent, their members' presence.
+	discordIntents = 1<<0 | 1<<8
+
+	maxDiscordMessage = 16 << 20
+)
+
+// Discord gateway opcodes.
+const (
+	discordDispatch       = 0
+	discordHeartbeat      = 1
+	discordIdentify       = 2
+	discordReconnect      = 7
+	discordInvalidSession = 9
+	discordHello          = 10
+	discordHeartbeatAck   = 11
+)
+
+// discordActivityVerbs describe activities other than
+// custom statuses, which have type 4.
+var discordActivityVerbs = map[int]string{
+	0: "Playing",
+	1: "Streaming",
+	2: "Listening to",
+	3: "Watching",
+	5: "Competing in",
+}
+
+// A DiscordBridge is an events.StatusNotifier which imports
+// users' Discord presence, as seen by a bot which shares a
+// guild with them.
+//
+// Users link their Discord accounts through OAuth with the
+// identify scope, which proves which account is theirs
+// without granting the server any access to it.
+//
+// Presence is mapped to Available, Away, or DoNotDisturb,
+// and a custom status or activity becomes the message.
+// Users who are offline or invisible on Discord keep their
+// current status. Statuses cannot be exported to Discord.
+type DiscordBridge struct {
+	BotToken     string
+	ClientID     string
+	ClientSecret string
+
+	// URL and GatewayURL override DefaultDiscordURL and
+	// DefaultDiscordGateway if they are non-empty.
+	URL        string
+	GatewayURL string
+
+	lock      sync.Mutex
+	presences map[string]discordPresence
+	changes   chan struct{}
+}
+
+// NewDiscordBridge creates a bridge, which receives no
+// presence updates until Run is called.
+func NewDiscordBridge(botToken, clientID, clientSecret string) *DiscordBridge {
+	return &DiscordBridge{
+		BotToken:     botToken,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		presences:    map[string]discordPresence{},
+		changes:      make(chan struct{}, 1),
+	}
+}
+
+// Run stays connected to the gateway until stop is closed,
+// reconnecting whenever the connection is lost.
+func (d *DiscordBridge) Run(stop <-chan struct{}) {
+	delay := DiscordRetryDelay
+	for {
+		start := time.Now()
+		err := d.runSession(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		statusdb.LogAt(statusdb.LogWarn, "discord gateway: %v", err)
+		if time.Since(start) > MaxDiscordRetryDelay {
+			delay = DiscordRetryDelay
+		}
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+		if delay *= 2; delay > MaxDiscordRetryDelay {
+			delay = MaxDiscordRetryDelay
+		}
+	}
+}
+
+func (d *DiscordBridge) Changes() <-chan struct{} {
+	return d.changes
+}
+
+func (d *DiscordBridge) AuthorizeURL(redirectURI string) string {
+	query := url.Values{
+		"client_id":     {d.ClientID},
+		"response_type": {"code"},
+		"scope":         {"identify"},
+		"redirect_uri":  {redirectURI},
+	}
+	return d.baseURL() + "/oauth2/authorize?" + query.Encode()
+}
+
+func (d *DiscordBridge) Connect(code, redirectURI string) (in statusdb.Integration, err error) {
+	defer essentials.AddCtxTo("connect discord", &err)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = d.call("POST", "/oauth2/token", url.Values{
+		"client_id":     {d.ClientID},
+		"client_secret": {d.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+	}, "", &token)
+	if err != nil {
+		return in, err
+	}
+	var user struct {
+		ID string `json:"id"`
+	}
+	err = d.call("GET", "/users/@me", nil, token.AccessToken, &user)
+
+	// The token is only needed to identify the user.
+	d.call("POST", "/oauth2/token/revoke", url.Values{
+		"client_id":     {d.ClientID},
+		"client_secret": {d.ClientSecret},
+		"token":         {token.AccessToken},
+	}, "", nil)
+
+	if err != nil {
+		return in, err
+	}
+	return statusdb.Integration{Provider: events.IntegrationDiscord, AccountID: user.ID}, nil
+}
+
+func (d *DiscordBridge) Fetch(in statusdb.Integration) (status statusdb.UserStatus,
+	version string, err error) {
+	d.lock.Lock()
+	presence, ok := d.presences[in.AccountID]
+	d.lock.Unlock()
+	if !ok {
+		return status, "", nil
+	}
+	status, ok = presence.userStatus()
+	if !ok {
+		return status, "", nil
+	}
+	version = fmt.Sprintf("%d\n%s\n%s", status.Availability, status.Message, status.Emoji)
+	return status, version, nil
+}
+
+func (d *DiscordBridge) CanExport() bool {
+	return false
+}
+
+func (d *DiscordBridge) Publish(in statusdb.Integration, status statusdb.UserStatus) error {
+	return events.ErrExportUnsupported
+}
+
+func (d *DiscordBridge) Disconnect(in statusdb.Integration) error {
+	// No token is kept, so there is nothing to revoke.
+	return nil
+}
+
+// runSession connects to the gateway and handles events
+// until the connection fails or stop is closed.
+func (d *DiscordBridge) runSession(stop <-chan struct{}) error {
+	gateway := d.GatewayURL
+	if gateway == "" {
+		gateway = DefaultDiscordGateway
+	}
+	conn, err := dialWebSocket(gateway, maxDiscordMessage)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	hello, err := readDiscordPayload(conn)
+	if err != nil {
+		return err
+	} else if hello.Op != discordHello {
+		return fmt.Errorf("expected hello but got opcode %d", hello.Op)
+	}
+	var helloData struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	if err := json.Unmarshal(hello.D, &helloData); err != nil {
+		return err
+	} else if helloData.HeartbeatInterval <= 0 {
+		return errors.New("invalid heartbeat interval")
+	}
+	err = writeDiscordPayload(conn, discordIdentify, map[string]interface{}{
+		"token":   d.BotToken,
+		"intents": discordIntents,
+		"properties": map[string]string{
+			"os":      "linux",
+			"browser": "status-server",
+			"device":  "status-server",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var seq int64 = -1
+	var acked int32 = 1
+	heartbeat := func() error {
+		var s interface{}
+		if last := atomic.LoadInt64(&seq); last >= 0 {
+			s = last
+		}
+		return writeDiscordPayload(conn, discordHeartbeat, s)
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(helloData.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			// A connection which stops acknowledging
+			// heartbeats is dead, even if it is open.
+			if !atomic.CompareAndSwapInt32(&acked, 1, 0) || heartbeat() != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		payload, err := readDiscordPayload(conn)
+		if err != nil {
+			return err
+		}
+		if payload.S != nil {
+			atomic.StoreInt64(&seq, *payload.S)
+		}
+		switch payload.Op {
+		case discordDispatch:
+			d.dispatch(payload.T, payload.D)
+		case discordHeartbeat:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		case discordHeartbeatAck:
+			atomic.StoreInt32(&acked, 1)
+		case discordReconnect:
+			return errors.New("reconnect requested")
+		case discordInvalidSession:
+			return errors.New("session invalidated")
+		}
+	}
+}
+
+// dispatch handles a gateway event.
+func (d *DiscordBridge) dispatch(eventType string, data json.RawMessage) {
+	var presences []discordPresence
+	switch eventType {
+	case "GUILD_CREATE":
+		var guild struct {
+			Presences []discordPresence `json:"presences"`
+		}
+		if json.Unmarshal(data, &guild) != nil {
+			return
+		}
+		presences = guild.Presences
+	case "PRESENCE_UPDATE":
+		var presence discordPresence
+		if json.Unmarshal(data, &presence) != nil {
+			return
+		}
+		presences = []discordPresence{presence}
+	default:
+		return
+	}
+
+	var changed bool
+	d.lock.Lock()
+	for _, p := range presences {
+		if p.User.ID == "" {
+			continue
+		}
+		old, ok := d.presences[p.User.ID]
+		newStatus, _ := p.userStatus()
+		oldStatus, _ := old.userStatus()
+		if !ok || newStatus.Availability != oldStatus.Availability ||
+			newStatus.Message != oldStatus.Message || newStatus.Emoji != oldStatus.Emoji {
+			changed = true
+		}
+		d.presences[p.User.ID] = p
+	}
+	d.lock.Unlock()
+	if changed {
+		select {
+		case d.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// call makes an API request, sending form as the body if
+// it is non-nil.
+func (d *DiscordBridge) call(method, path string, form url.Values, bearer string,
+	result interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, d.baseURL()+"/api/v10"+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+			Message     string `json:"message"`
+		}
+		json.Unmarshal(data, &apiErr)
+		reason := apiErr.Error
+		if reason == "" {
+			reason = apiErr.Message
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, reason)
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+func (d *DiscordBridge) baseURL() string {
+	if d.URL != "" {
+		return strings.TrimRight(d.URL, "/")
+	}
+	return DefaultDiscordURL
+}
+
+type discordPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s"`
+	T  string          `json:"t"`
+}
+
+func readDiscordPayload(conn *webSocketClient) (*discordPayload, error) {
+	data, err := conn.ReadText()
+	if err != nil {
+		return nil, err
+	}
+	var payload discordPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+func writeDiscordPayload(conn *webSocketClient, op int, data interface{}) error {
+	encoded, err := json.Marshal(map[string]interface{}{"op": op, "d": data})
+	if err != nil {
+		return err
+	}
+	return conn.WriteText(encoded)
+}
+
+type discordPresence struct {
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	Status     string `json:"status"`
+	Activities []struct {
+		Type  int    `json:"type"`
+		Name  string `json:"name"`
+		State string `json:"state"`
+		Emoji *struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"emoji"`
+	} `json:"activities"`
+}
+
+// userStatus converts the presence to a status, or returns
+// false if the user is offline.
+func (d *discordPresence) userStatus() (status statusdb.UserStatus, ok bool) {
+	switch d.Status {
+	case "online":
+		status.Availability = statusdb.Available
+	case "idle":
+		status.Availability = statusdb.Away
+	case "dnd":
+		status.Availability = statusdb.DoNotDisturb
+	default:
+		return status, false
+	}
+	for _, activity := range d.Activities {
+		if activity.Type == 4 {
+			status.Message = activity.State
+			// Only standard emoji have no ID; custom emoji
+			// are images which cannot be shown here.
+			if activity.Emoji != nil && activity.Emoji.ID == "" {
+				status.Emoji = activity.Emoji.Name
+			}
+			return status, true
+		}
+	}
+	for _, activity := range d.Activities {
+		if verb, ok := discordActivityVerbs[activity.Type]; ok && activity.Name != "" {
+			status.Message = verb + " " + activity.Name
+			break
+		}
+	}
+	return status, true
+}
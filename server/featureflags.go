@@ -0,0 +1,21 @@
+package server
+
+import (
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// sessionCapabilities is like ServerCapabilities, but
+// omits extensions for features the user does not have.
+func sessionCapabilities(id protocol.MessageID, sess events.DBSession) *protocol.CapabilitiesMessage {
+	res := protocol.ServerCapabilities(id)
+	if !sess.FeatureEnabled(events.FeatureRichStatus) {
+		for i, ext := range res.Extensions {
+			if ext == protocol.ExtRichStatus {
+				res.Extensions = append(res.Extensions[:i], res.Extensions[i+1:]...)
+				break
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// FederationRetryDelay is the time to wait before
+	// resending a message to a server which could not be
+	// reached.
+	FederationRetryDelay = 5 * time.Second
+
+	// MaxFederationQueue is the number of messages which
+	// may wait for each server, after which new messages
+	// are dropped.
+	MaxFederationQueue = 10000
+
+	// FederationClockSkew is how far the time of a signed
+	// request may be from the receiver's clock.
+	FederationClockSkew = 5 * time.Minute
+
+	maxFederationBody = 1 << 16
+)
+
+// A FederationPeer is another server whose users may be
+// buddies with ours.
+type FederationPeer struct {
+	// Domain is the email domain of the peer's users.
+	Domain string `json:"domain"`
+
+	// URL is the peer's federation endpoint.
+	URL string `json:"url"`
+
+	// Key is the secret shared with the peer, which signs
+	// requests in both directions.
+	Key string `json:"key"`
+}
+
+// ReadFederationPeers reads a JSON array of peers.
+func ReadFederationPeers(path string) (peers []FederationPeer, err error) {
+	defer essentials.AddCtxTo("read federation peers", &err)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, err
+	}
+	for _, peer := range peers {
+		if peer.Domain == "" || peer.URL == "" || peer.Key == "" {
+			return nil, &statusdb.ValidationError{Field: "peers",
+				Reason: "each peer needs a domain, url and key"}
+		}
+	}
+	return peers, nil
+}
+
+// A FederationRelay is an events.Relay which sends signed
+// HTTP requests to the FederationHandler of each peer.
+//
+// Users whose email domain belongs to a peer are remote,
+// and every other user is local.
+//
+// Messages for each peer are sent in order. Messages which
+// cannot be delivered are retried, while messages which a
+// peer rejects are dropped and reported to the alerter.
+type FederationRelay struct {
+	peers   map[string]*federationQueue
+	alerter *statusdb.Alerter
+}
+
+// NewFederationRelay creates a relay and starts sending
+// messages in the background.
+//
+// The alerter may be nil.
+func NewFederationRelay(peers []FederationPeer, alerter *statusdb.Alerter) *FederationRelay {
+	f := &FederationRelay{
+		peers:   map[string]*federationQueue{},
+		alerter: alerter,
+	}
+	for _, peer := range peers {
+		q := &federationQueue{
+			peer: peer,
+			wake: make(chan struct{}, 1),
+		}
+		f.peers[strings.ToLower(peer.Domain)] = q
+		go f.sendLoop(q)
+	}
+	return f
+}
+
+// Relays combines relays for different domains, such as
+// federation peers and a Matrix homeserver.
+type Relays []events.Relay
+
+func (r Relays) Home(email string) string {
+	for _, relay := range r {
+		if domain := relay.Home(email); domain != "" {
+			return domain
+		}
+	}
+	return ""
+}
+
+func (r Relays) Send(domain string, msg *events.RelayMessage) {
+	for _, relay := range r {
+		if relay.Home(msg.To) == domain {
+			relay.Send(domain, msg)
+			return
+		}
+	}
+}
+
+func (f *FederationRelay) Home(email string) string {
+	domain := emailDomain(email)
+	if _, ok := f.peers[domain]; ok {
+		return domain
+	}
+	return ""
+}
+
+func (f *FederationRelay) Send(domain string, msg *events.RelayMessage) {
+	q, ok := f.peers[domain]
+	if !ok {
+		return
+	}
+	q.lock.Lock()
+	if len(q.queue) >= MaxFederationQueue {
+		q.lock.Unlock()
+		f.alerter.Raise(statusdb.AlertFederation, "queue for "+domain+" is full; dropping messages")
+		return
+	}
+	q.queue = append(q.queue, msg)
+	q.lock.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *FederationRelay) sendLoop(q *federationQueue) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for range q.wake {
+		for {
+			q.lock.Lock()
+			if len(q.queue) == 0 {
+				q.lock.Unlock()
+				break
+			}
+			msg := q.queue[0]
+			q.lock.Unlock()
+
+			retry, err := postRelay(client, q.peer, msg)
+			if err != nil {
+				f.alerter.Raise(statusdb.AlertFederation, "relay to "+q.peer.Domain+": "+err.Error())
+				if retry {
+					time.Sleep(FederationRetryDelay)
+					continue
+				}
+			}
+
+			q.lock.Lock()
+			essentials.OrderedDelete(&q.queue, 0)
+			q.lock.Unlock()
+		}
+	}
+}
+
+type federationQueue struct {
+	peer  FederationPeer
+	lock  sync.Mutex
+	queue []*events.RelayMessage
+	wake  chan struct{}
+}
+
+// postRelay sends a message to a peer, and decides if a
+// failure is worth retrying.
+func postRelay(client *http.Client, peer FederationPeer, msg *events.RelayMessage) (retry bool,
+	err error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", peer.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Federation-Time", timestamp)
+	req.Header.Set("X-Federation-Signature", signRequest(peer.Key, timestamp, data))
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("unexpected status: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusUnauthorized, err
+}
+
+// FederationHandler serves the endpoint which peers send
+// relayed changes to.
+//
+// Each request is a POST of an events.RelayMessage, with
+// the headers
+//
+//	X-Federation-Time: <Unix time>
+//	X-Federation-Signature: <hex HMAC-SHA256 of time, "\n", body>
+//
+// signed with the key of the peer which the message's From
+// user belongs to.
+//
+// Successful requests respond with 204 No Content, and
+// rejected changes with a JSON error like the admin API's.
+func FederationHandler(edb events.EventDB, peers []FederationPeer) http.Handler {
+	keys := map[string]string{}
+	for _, peer := range peers {
+		keys[strings.ToLower(peer.Domain)] = peer.Key
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFederationBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var msg events.RelayMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The signature must come from the sender's home,
+		// so that peers cannot act for each other's users.
+		key, ok := keys[emailDomain(msg.From)]
+		timestamp := r.Header.Get("X-Federation-Time")
+		if !ok || !federationTimeValid(timestamp) ||
+			subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Federation-Signature")),
+				[]byte(signRequest(key, timestamp, body))) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeAdminResult(w, edb.ApplyRelay(&msg))
+	})
+}
+
+// signRequest computes the hex HMAC-SHA256 with which
+// federation requests and webhook deliveries are signed.
+func signRequest(key, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func federationTimeValid(timestamp string) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	return skew < FederationClockSkew && skew > -FederationClockSkew
+}
+
+func emailDomain(email string) string {
+	idx := strings.LastIndex(email, "@")
+	if idx < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[idx+1:]))
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+)
+
+const (
+	DefaultGravatarURL = "https://gravatar.com/avatar/"
+
+	// GravatarProxyPath is where the WebSocket listener
+	// serves a GravatarProxy.
+	GravatarProxyPath = "/gravatar/"
+
+	// GravatarCacheTTL is how long a GravatarProxy keeps
+	// images, and how long clients may cache them.
+	GravatarCacheTTL = time.Hour
+
+	maxGravatarCache = 1000
+	maxGravatarSize  = 1 << 20
+)
+
+// GravatarHash hashes a normalized email as Gravatar does.
+func GravatarHash(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// Gravatar is an events.AvatarFallback which links users
+// without avatars to their Gravatar images.
+type Gravatar struct {
+	// Default is the image for emails with no Gravatar,
+	// such as "identicon" or "mp". If empty, Gravatar's
+	// own default is used.
+	Default string
+
+	// ProxyURL, if non-empty, is the public URL of a
+	// GravatarProxy, through which images are linked
+	// instead, so that Gravatar does not see clients'
+	// addresses.
+	ProxyURL string
+}
+
+func (g *Gravatar) AvatarURL(email string) string {
+	hash := GravatarHash(email)
+	if g.ProxyURL != "" {
+		return strings.TrimRight(g.ProxyURL, "/") + "/" + hash
+	}
+	return DefaultGravatarURL + hash + "?" + gravatarQuery(g.Default).Encode()
+}
+
+// A GravatarProxy is an http.Handler which serves Gravatar
+// images at paths ending in GravatarHash values, caching
+// them for GravatarCacheTTL.
+type GravatarProxy struct {
+	// Default is the image for emails with no Gravatar, as
+	// for Gravatar.Default.
+	Default string
+
+	// URL overrides DefaultGravatarURL if it is non-empty.
+	URL string
+
+	client *http.Client
+	lock   sync.Mutex
+	cache  map[string]*gravatarImage
+}
+
+type gravatarImage struct {
+	found       bool
+	contentType string
+	data        []byte
+	expires     time.Time
+}
+
+// NewGravatarProxy creates a proxy with an empty cache.
+func NewGravatarProxy(defaultImage string) *GravatarProxy {
+	return &GravatarProxy{
+		Default: defaultImage,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		cache:   map[string]*gravatarImage{},
+	}
+}
+
+func (g *GravatarProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := path.Base(r.URL.Path)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if !validGravatarHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	img, err := g.image(hash)
+	if err != nil {
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", GravatarCacheTTL/time.Second))
+	if !img.found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", img.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(img.data)))
+	w.Write(img.data)
+}
+
+// image gets an image from the cache or from Gravatar.
+func (g *GravatarProxy) image(hash string) (*gravatarImage, error) {
+	now := time.Now()
+	g.lock.Lock()
+	img := g.cache[hash]
+	g.lock.Unlock()
+	if img != nil && now.Before(img.expires) {
+		return img, nil
+	}
+
+	base := DefaultGravatarURL
+	if g.URL != "" {
+		base = strings.TrimRight(g.URL, "/") + "/"
+	}
+	resp, err := g.client.Get(base + hash + "?" + gravatarQuery(g.Default).Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	img = &gravatarImage{expires: now.Add(GravatarCacheTTL)}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		img.found = true
+		img.contentType = resp.Header.Get("Content-Type")
+		if !strings.HasPrefix(img.contentType, "image/") {
+			return nil, fmt.Errorf("unexpected content type: %s", img.contentType)
+		}
+		img.data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxGravatarSize+1))
+		if err != nil {
+			return nil, err
+		} else if len(img.data) > maxGravatarSize {
+			return nil, errors.New("image too large")
+		}
+	case resp.StatusCode != http.StatusNotFound:
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if len(g.cache) >= maxGravatarCache {
+		for key, cached := range g.cache {
+			if !now.Before(cached.expires) {
+				delete(g.cache, key)
+			}
+		}
+		for key := range g.cache {
+			if len(g.cache) < maxGravatarCache {
+				break
+			}
+			delete(g.cache, key)
+		}
+	}
+	g.cache[hash] = img
+	return img, nil
+}
+
+func gravatarQuery(defaultImage string) url.Values {
+	query := url.Values{"s": {strconv.Itoa(events.AvatarSize)}}
+	if defaultImage != "" {
+		query.Set("d", defaultImage)
+	}
+	return query
+}
+
+// validGravatarHash checks for a lowercase hex SHA-256 hash.
+func validGravatarHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
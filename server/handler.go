@@ -0,0 +1,654 @@
+package server
+
+import (
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// ClientOptions configures how HandleClient serves a
+// client.
+type ClientOptions struct {
+	// Recorder, if non-nil, records the selected users'
+	// connections.
+	Recorder *SessionRecorder
+
+	// StrictDecoding rejects messages with fields which
+	// their type does not have, like DecodeMessageStrict,
+	// for servers used to develop clients. It only applies
+	// to protocol.StrictConnections, which decode what
+	// they read.
+	StrictDecoding bool
+}
+
+// HandleClient provides the client access to the database
+// through a message-based API.
+//
+// This automatically closes the connection.
+//
+// A panic while serving the client is logged and ends
+// only this client's connection.
+func HandleClient(conn protocol.Connection, db events.EventDB, opts ClientOptions) {
+	defer recoverClientPanic("handle client")
+	defer conn.Close()
+	if strictConn, ok := conn.(protocol.StrictConnection); ok {
+		strictConn.SetStrictDecoding(opts.StrictDecoding)
+	}
+	if opts.Recorder != nil {
+		conn = opts.Recorder.Wrap(conn)
+	}
+	atomic.AddInt64(&events.ActiveConnections, 1)
+	defer atomic.AddInt64(&events.ActiveConnections, -1)
+	var remoteAddr string
+	if remote, ok := conn.(protocol.RemoteConnection); ok {
+		remoteAddr = remote.RemoteAddr()
+	}
+	caps := &clientCapabilities{}
+	conn = &compressingConn{Connection: conn, caps: caps, strict: opts.StrictDecoding}
+	conn = &localizedConn{Connection: conn, caps: caps}
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			if res, ok := decodeErrorReply(err); ok && conn.WriteMessage(res) == nil {
+				continue
+			}
+			return
+		}
+		if err := protocol.ValidateMessage(msg); err != nil {
+			if conn.WriteMessage(ackOrError(msg, err)) != nil {
+				return
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *protocol.LoginMessage:
+			if msg.Locale != "" {
+				caps.SetLocale(msg.Locale)
+			}
+			sess, err := db.BeginSession(msg.Email, msg.Password, msg.Code)
+			if !handleLogin(conn, db, caps, remoteAddr, msg.MessageID, msg.Email, msg.Events,
+				msg.Since, opts.StrictDecoding, sess, err) {
+				return
+			}
+		case *protocol.BotLoginMessage:
+			if msg.Locale != "" {
+				caps.SetLocale(msg.Locale)
+			}
+			sess, err := db.BeginBotSession(msg.Email, msg.APIKey)
+			if !handleLogin(conn, db, caps, remoteAddr, msg.MessageID, msg.Email, msg.Events, 0,
+				opts.StrictDecoding, sess, err) {
+				return
+			}
+		case *protocol.RegisterMessage:
+			if msg.Locale != "" {
+				caps.SetLocale(msg.Locale)
+			}
+			var resMessage protocol.Message
+			err := db.AddUser(msg.Email, msg.Password)
+			entry := events.AuditEntry{Actor: msg.Email, RemoteAddr: remoteAddr, Action: "register"}
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			db.RecordAudit(entry)
+			if err != nil {
+				resMessage = (*protocol.RegisterFailureMessage)(newErrorMessage(msg.MessageID, err))
+			} else {
+				resMessage = &protocol.RegisterSuccessMessage{MessageID: msg.MessageID}
+			}
+			if err := conn.WriteMessage(resMessage); err != nil {
+				return
+			}
+		case *protocol.CapabilitiesMessage:
+			caps.Set(msg)
+			if err := conn.WriteMessage(protocol.ServerCapabilities(msg.MessageID)); err != nil {
+				return
+			}
+		case *protocol.PingMessage:
+			if err := conn.WriteMessage(pong(msg)); err != nil {
+				return
+			}
+		case *protocol.GetServerInfoMessage:
+			res := &protocol.ServerInfoMessage{MessageID: msg.MessageID, ServerInfo: CurrentServerInfo()}
+			if err := conn.WriteMessage(res); err != nil {
+				return
+			}
+		case *protocol.RegisterVerifyMessage:
+			err := db.VerifyUser(msg.Email, msg.Token)
+			recordPreLogin(db, msg.Email, remoteAddr, "verify email", err)
+			if err := conn.WriteMessage(ackOrError(msg, err)); err != nil {
+				return
+			}
+		case *protocol.ResetPasswordMessage:
+			err := db.RequestPasswordReset(msg.Email)
+			recordPreLogin(db, msg.Email, remoteAddr, "request password reset", err)
+			if err := conn.WriteMessage(ackOrError(msg, err)); err != nil {
+				return
+			}
+		case *protocol.SetPasswordMessage:
+			// Before logging in, the old password is a code
+			// from a ResetPasswordMessage.
+			err := db.ResetPassword(msg.Email, msg.OldPassword, msg.NewPassword)
+			recordPreLogin(db, msg.Email, remoteAddr, "reset password", err)
+			if err := conn.WriteMessage(ackOrError(msg, err)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleAuthenticated serves a logged in client.
+//
+// If since is non-zero and the client supports the
+// sequence_resume extension, the full state which starts
+// the session is replaced by the changes since then.
+//
+// If strict is set, batched messages are decoded like
+// DecodeMessageStrict.
+func handleAuthenticated(conn protocol.Connection, db events.EventDB, sess events.DBSession,
+	caps *clientCapabilities, since int64, strict bool) {
+	defer sess.Close()
+	stopChan := make(chan struct{})
+	var wg sync.WaitGroup
+	out := newOutboundQueue(conn)
+
+	pinger := &keepalive{conn: conn, out: out, caps: caps}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer recoverClientPanic("keepalive")
+		pinger.Run(stopChan)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer recoverClientPanic("forward events")
+
+		// If forwarding stops or panics, the connection is
+		// closed to end the session rather than leave it
+		// silent.
+		defer out.CloseConn(stopChan)
+
+		resume := since != 0 && caps.SupportsExtension(protocol.ExtSequenceResume)
+		for {
+			select {
+			case <-stopChan:
+				return
+			default:
+			}
+			select {
+			case <-stopChan:
+				return
+			case event := <-sess.Events():
+				msgs := eventMessages(event, caps)
+				if resume && event.Type == events.EventFullState {
+					resume = false
+					sinceTime := time.Unix(0, since*int64(time.Millisecond))
+					if delta, err := sess.SyncSince(sinceTime); err == nil {
+						msgs = []protocol.Message{newSyncDeltaMessage(protocol.MessageID{}, delta)}
+					}
+				}
+				for _, msg := range msgs {
+					if !caps.SupportsType(msg.Type()) {
+						continue
+					}
+					if err := out.Send(msg, stopChan); err != nil {
+						return
+					}
+				}
+				if event.ClosesSession() {
+					return
+				}
+			}
+		}
+	}()
+
+	defer func() {
+		close(stopChan)
+		wg.Wait()
+		out.Close()
+	}()
+
+	handler := &sessionHandler{sess: sess, caps: caps, pinger: pinger, strict: strict}
+	limiter := statusdb.RateLimiter{Limit: db.Limits().MessagesPerMinute, Window: time.Minute}
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			res, ok := decodeErrorReply(err)
+			if !ok {
+				break
+			}
+			if err := out.Send(res, nil); err != nil {
+				return
+			}
+			continue
+		}
+		if !limiter.Allow(time.Now()) {
+			if err := out.Send(ackOrError(msg, events.ErrRateLimited), nil); err != nil {
+				return
+			}
+			continue
+		}
+		res, logout := handler.Handle(msg)
+		if res != nil {
+			if err := out.Send(res, nil); err != nil {
+				return
+			}
+		}
+		if logout {
+			return
+		}
+	}
+}
+
+// handleLogin replies to a login attempt, and serves the
+// client for the rest of the connection if it succeeded.
+//
+// It returns false if the connection should be closed.
+func handleLogin(conn protocol.Connection, db events.EventDB, caps *clientCapabilities,
+	remoteAddr string, id protocol.MessageID, email string, filter []protocol.EventCategory,
+	since int64, strict bool, sess events.DBSession, err error) bool {
+	if err != nil {
+		db.RecordAudit(events.AuditEntry{
+			Actor:      email,
+			RemoteAddr: remoteAddr,
+			Action:     "login",
+			Error:      err.Error(),
+		})
+		err = conn.WriteMessage((*protocol.LoginFailureMessage)(newErrorMessage(id, err)))
+		return err == nil
+	}
+	sess.SetRemoteAddr(remoteAddr)
+	db.RecordAudit(events.AuditEntry{
+		Actor:      email,
+		Session:    sess.ID(),
+		RemoteAddr: remoteAddr,
+		Action:     "login",
+	})
+	if filter != nil {
+		err = sess.SetEventFilter(filter)
+	}
+	if err == nil {
+		err = conn.WriteMessage(&protocol.LoginSuccessMessage{MessageID: id})
+	}
+	if err == nil {
+		err = conn.WriteMessage(sessionCapabilities(protocol.MessageID{}, sess))
+	}
+	if err == nil {
+		err = conn.WriteMessage(protocol.ServerLimits(db.Limits()))
+	}
+	if err != nil {
+		sess.Close()
+		return false
+	}
+	handleAuthenticated(conn, db, sess, caps, since, strict)
+	return false
+}
+
+// decodeErrorReply creates the response to a message which
+// could not be decoded, or returns false if err is a read
+// error after which the connection cannot be used.
+func decodeErrorReply(err error) (protocol.Message, bool) {
+	decodeErr, ok := events.RootError(err).(*protocol.DecodeError)
+	if !ok {
+		return nil, false
+	}
+	return newErrorMessage(protocol.MessageID{ID: decodeErr.ID}, decodeErr.Err), true
+}
+
+// recordPreLogin audits an operation by a client which has
+// not logged in.
+func recordPreLogin(db events.EventDB, email, remoteAddr, action string, err error) {
+	entry := events.AuditEntry{Actor: email, RemoteAddr: remoteAddr, Action: action}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	db.RecordAudit(entry)
+}
+
+// recoverClientPanic logs a panic caused by one client, so
+// that it does not crash the server.
+//
+// It must be deferred directly.
+func recoverClientPanic(ctx string) {
+	if r := recover(); r != nil {
+		statusdb.LogAt(statusdb.LogError, "%s: panic: %v\n%s", ctx, r, debug.Stack())
+	}
+}
+
+// A sessionHandler processes messages from a client that
+// has logged in.
+type sessionHandler struct {
+	sess   events.DBSession
+	caps   *clientCapabilities
+	pinger *keepalive
+
+	// strict is set if batched messages are decoded like
+	// DecodeMessageStrict.
+	strict bool
+}
+
+// Handle processes a client message.
+//
+// It returns the response to send to the client (if any),
+// and a flag indicating if the client has logged out.
+func (s *sessionHandler) Handle(msg protocol.Message) (res protocol.Message, logout bool) {
+	if err := protocol.ValidateMessage(msg); err != nil {
+		return ackOrError(msg, err), false
+	}
+	switch msg := msg.(type) {
+	case *protocol.LogoutMessage:
+		// TODO: should we just get rid of this silly API?
+		return nil, true
+	case *protocol.BatchMessage:
+		return s.handleBatch(msg)
+	case *protocol.LogoutOtherMessage:
+		return ackOrError(msg, s.sess.DisconnectOthers()), false
+	case *protocol.SetStatusMessage:
+		return ackOrError(msg, s.sess.SetStatus(msg.UserStatus)), false
+	case *protocol.SetPasswordMessage:
+		return ackOrError(msg, s.sess.SetPassword(msg.OldPassword, msg.NewPassword)), false
+	case *protocol.AddBuddyMessage:
+		return ackOrError(msg, s.sess.SendRequest(msg.Email, msg.Greeting)), false
+	case *protocol.AcceptRequestMessage:
+		return ackOrError(msg, s.sess.AcceptRequest(msg.Email)), false
+	case *protocol.DeclineRequestMessage:
+		return ackOrError(msg, s.sess.DeclineRequest(msg.Email)), false
+	case *protocol.CancelRequestMessage:
+		return ackOrError(msg, s.sess.CancelRequest(msg.Email)), false
+	case *protocol.BlockUserMessage:
+		return ackOrError(msg, s.sess.BlockUser(msg.Email)), false
+	case *protocol.UnblockUserMessage:
+		return ackOrError(msg, s.sess.UnblockUser(msg.Email)), false
+	case *protocol.SetAliasMessage:
+		return ackOrError(msg, s.sess.SetAlias(msg.Email, msg.Alias)), false
+	case *protocol.SetDNDSettingsMessage:
+		return ackOrError(msg, s.sess.SetDNDSuppressEvents(msg.SuppressEvents)), false
+	case *protocol.SetVisibilityMessage:
+		return ackOrError(msg, s.sess.SetInvisible(msg.Invisible)), false
+	case *protocol.SetIdleMessage:
+		idle := time.Duration(msg.IdleSeconds) * time.Second
+		return ackOrError(msg, s.sess.ReportIdle(idle)), false
+	case *protocol.SetActiveMessage:
+		return ackOrError(msg, s.sess.ReportActive()), false
+	case *protocol.ReportUserMessage:
+		return ackOrError(msg, s.sess.ReportUser(msg.Email, msg.Reason, msg.Evidence)), false
+	case *protocol.GetServerInfoMessage:
+		return &protocol.ServerInfoMessage{MessageID: msg.MessageID, ServerInfo: CurrentServerInfo()}, false
+	case *protocol.GetServerStatsMessage:
+		stats, err := s.sess.ServerStats()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.ServerStatsMessage{MessageID: msg.MessageID, ServerStats: stats}, false
+	case *protocol.GetStatsMessage:
+		stats, err := s.sess.GetStats()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.StatsMessage{MessageID: msg.MessageID, UsageSummary: stats.Summary()}, false
+	case *protocol.LookupUserMessage:
+		res, err := s.sess.LookupUser(msg.Email)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.LookupResultMessage{
+			MessageID:   msg.MessageID,
+			Email:       res.Email,
+			Registered:  res.Registered,
+			Requestable: res.Requestable,
+			Reason:      res.Reason,
+		}, false
+	case *protocol.ExportBuddiesMessage:
+		entries, err := s.sess.ExportBuddies()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		data, err := protocol.EncodeBuddyList(entries, msg.Format)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.BuddyListMessage{MessageID: msg.MessageID, Format: msg.Format, Data: data}, false
+	case *protocol.ImportBuddiesMessage:
+		entries, err := protocol.DecodeBuddyList(msg.Data, msg.Format)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.ImportResultMessage{
+			MessageID: msg.MessageID,
+			Results:   importBuddies(s.sess, entries),
+		}, false
+	case *protocol.SetProfileMessage:
+		return ackOrError(msg, s.sess.SetProfile(statusdb.Profile{
+			DisplayName: msg.DisplayName,
+			Pronouns:    msg.Pronouns,
+			Bio:         msg.Bio,
+		})), false
+	case *protocol.GetProfileMessage:
+		profile, err := s.sess.GetProfile(msg.Email)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.ProfileMessage{MessageID: msg.MessageID, Email: msg.Email, Profile: profile}, false
+	case *protocol.SetAwayNoteMessage:
+		return ackOrError(msg, s.sess.SetAwayNote(msg.Note)), false
+	case *protocol.GetAwayNoteMessage:
+		note, err := s.sess.GetAwayNote(msg.Email)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.AwayNoteMessage{MessageID: msg.MessageID, Email: msg.Email, Note: note}, false
+	case *protocol.SetAvatarMessage:
+		return ackOrError(msg, s.sess.SetAvatar(msg.Data)), false
+	case *protocol.GetAvatarMessage:
+		data, err := s.sess.GetAvatar(msg.Hash)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.AvatarMessage{MessageID: msg.MessageID, Hash: msg.Hash, Data: data}, false
+	case *protocol.GetPushKeyMessage:
+		key, err := s.sess.PushKey()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.PushKeyMessage{MessageID: msg.MessageID, PublicKey: key}, false
+	case *protocol.AddPushSubscriptionMessage:
+		return ackOrError(msg, s.sess.AddPushSubscription(statusdb.PushSubscription{
+			Endpoint: msg.Endpoint,
+			P256DH:   msg.Keys.P256DH,
+			Auth:     msg.Keys.Auth,
+		})), false
+	case *protocol.RemovePushSubscriptionMessage:
+		return ackOrError(msg, s.sess.RemovePushSubscription(msg.Endpoint)), false
+	case *protocol.AddWebhookMessage:
+		hook, err := s.sess.AddWebhook(msg.URL, msg.Events)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.WebhookMessage{MessageID: msg.MessageID, Webhook: hook}, false
+	case *protocol.RemoveWebhookMessage:
+		return ackOrError(msg, s.sess.RemoveWebhook(msg.ID)), false
+	case *protocol.ListWebhooksMessage:
+		hooks, err := s.sess.ListWebhooks()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.WebhooksMessage{MessageID: msg.MessageID, Webhooks: hooks}, false
+	case *protocol.TestWebhookMessage:
+		return ackOrError(msg, s.sess.TestWebhook(msg.ID)), false
+	case *protocol.CreateAPIKeyMessage:
+		apiKey, err := s.sess.CreateAPIKey()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.APIKeyMessage{MessageID: msg.MessageID, APIKey: apiKey}, false
+	case *protocol.RevokeAPIKeyMessage:
+		return ackOrError(msg, s.sess.RevokeAPIKey()), false
+	case *protocol.AuthorizeIntegrationMessage:
+		url, err := s.sess.IntegrationURL(msg.Provider, msg.RedirectURI)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.IntegrationURLMessage{MessageID: msg.MessageID, URL: url}, false
+	case *protocol.ConnectIntegrationMessage:
+		in, err := s.sess.ConnectIntegration(msg.Provider, msg.Code, msg.RedirectURI, msg.Import,
+			msg.Export)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.IntegrationMessage{MessageID: msg.MessageID, Integration: in}, false
+	case *protocol.DisconnectIntegrationMessage:
+		return ackOrError(msg, s.sess.DisconnectIntegration(msg.Provider)), false
+	case *protocol.ListIntegrationsMessage:
+		integrations, err := s.sess.ListIntegrations()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.IntegrationsMessage{MessageID: msg.MessageID,
+			Integrations: integrations}, false
+	case *protocol.SetDiscoverableMessage:
+		return ackOrError(msg, s.sess.SetDiscoverable(msg.Discoverable)), false
+	case *protocol.AuthorizeContactsMessage:
+		url, err := s.sess.ContactsURL(msg.Source, msg.RedirectURI)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.IntegrationURLMessage{MessageID: msg.MessageID, URL: url}, false
+	case *protocol.ImportContactsMessage:
+		suggestions, err := s.sess.ImportContacts(msg.Source, events.ContactCredentials{
+			Code:        msg.Code,
+			RedirectURI: msg.RedirectURI,
+			URL:         msg.URL,
+			Username:    msg.Username,
+			Password:    msg.Password,
+		})
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.SuggestionsMessage{MessageID: msg.MessageID,
+			Suggestions: suggestions}, false
+	case *protocol.SuggestBuddiesMessage:
+		suggestions, err := s.sess.SuggestBuddies()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.SuggestionsMessage{MessageID: msg.MessageID,
+			Suggestions: suggestions}, false
+	case *protocol.SetLastSeenMessage:
+		return ackOrError(msg, s.sess.SetLastSeenVisibility(msg.Visibility)), false
+	case *protocol.SetPrivacyMessage:
+		return ackOrError(msg, s.sess.SetPrivacy(msg.Privacy)), false
+	case *protocol.GetStatusHistoryMessage:
+		since := time.Unix(0, msg.Since*int64(time.Millisecond))
+		history, err := s.sess.StatusHistory(msg.Email, since)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.StatusHistoryMessage{MessageID: msg.MessageID, Email: msg.Email,
+			History: history}, false
+	case *protocol.GetPrivacyMessage:
+		privacy, err := s.sess.Privacy()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.PrivacyMessage{MessageID: msg.MessageID, Privacy: privacy}, false
+	case *protocol.SetTimeZoneMessage:
+		return ackOrError(msg, s.sess.SetTimeZone(msg.TimeZone)), false
+	case *protocol.SetPublicMessage:
+		return ackOrError(msg, s.sess.SetPublicPresence(msg.Public)), false
+	case *protocol.SubscribeMessage:
+		return ackOrError(msg, s.sess.Subscribe(msg.Email)), false
+	case *protocol.UnsubscribeMessage:
+		return ackOrError(msg, s.sess.Unsubscribe(msg.Email)), false
+	case *protocol.SetCustomStatesMessage:
+		return ackOrError(msg, s.sess.SetCustomStates(msg.States)), false
+	case *protocol.SetScheduleMessage:
+		return ackOrError(msg, s.sess.SetSchedule(msg.Schedule)), false
+	case *protocol.RemoveBuddyMessage:
+		return ackOrError(msg, s.sess.DeleteBuddy(msg.Email)), false
+	case *protocol.CapabilitiesMessage:
+		s.caps.Set(msg)
+		return sessionCapabilities(msg.MessageID, s.sess), false
+	case *protocol.PingMessage:
+		return pong(msg), false
+	case *protocol.PongMessage:
+		s.pinger.HandlePong(msg)
+		return nil, false
+	case *protocol.ReauthenticateMessage:
+		if err := s.sess.Reauthenticate(msg.Password, msg.Code); err != nil {
+			return (*protocol.ReauthFailureMessage)(newErrorMessage(msg.MessageID, err)), false
+		}
+		return &protocol.ReauthSuccessMessage{MessageID: msg.MessageID}, false
+	case *protocol.SyncSinceMessage:
+		since := time.Unix(0, msg.Since*int64(time.Millisecond))
+		event, err := s.sess.SyncSince(since)
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return newSyncDeltaMessage(msg.MessageID, event), false
+	case *protocol.DeleteAccountMessage:
+		return ackOrError(msg, s.sess.DeleteAccount(msg.Password, msg.Code)), false
+	case *protocol.EnableTwoFactorMessage:
+		secret, codes, err := s.sess.EnableTwoFactor()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.TwoFactorEnabledMessage{
+			MessageID:     msg.MessageID,
+			Secret:        secret,
+			RecoveryCodes: codes,
+		}, false
+	case *protocol.DisableTwoFactorMessage:
+		return ackOrError(msg, s.sess.DisableTwoFactor()), false
+	case *protocol.RegenerateRecoveryCodesMessage:
+		codes, err := s.sess.RegenerateRecoveryCodes()
+		if err != nil {
+			return newErrorMessage(msg.MessageID, err), false
+		}
+		return &protocol.RecoveryCodesMessage{MessageID: msg.MessageID, RecoveryCodes: codes}, false
+	default:
+		return handleRegistered(s.sess, msg), false
+	}
+}
+
+func (s *sessionHandler) handleBatch(msg *protocol.BatchMessage) (res protocol.Message, logout bool) {
+	batchRes := &protocol.BatchResultMessage{MessageID: msg.MessageID, Results: []*protocol.BatchResult{}}
+	for _, command := range msg.Commands {
+		var subRes protocol.Message
+		decode := protocol.DecodeMessage
+		if s.strict {
+			decode = protocol.DecodeMessageStrict
+		}
+		if subMsg, err := decode(command.Type, command.Data); err != nil {
+			subRes = newErrorMessage(protocol.MessageID{}, err)
+		} else if _, ok := subMsg.(*protocol.BatchMessage); ok {
+			subRes = ackOrError(subMsg, protocol.ErrNestedBatch)
+		} else {
+			subRes, logout = s.Handle(subMsg)
+			if subRes == nil {
+				subRes = ackOrError(subMsg, nil)
+			}
+		}
+		subRes = Localize(s.caps.Locale(), subRes)
+		batchRes.Results = append(batchRes.Results, protocol.NewBatchResult(subRes))
+		if logout {
+			break
+		}
+	}
+	return batchRes, logout
+}
+
+// ackOrError creates an ack if err is nil, or an error
+// message otherwise, echoing the ID of the client message.
+func ackOrError(msg protocol.Message, err error) protocol.Message {
+	id := protocol.MessageID{ID: protocol.RequestID(msg)}
+	if err != nil {
+		return newErrorMessage(id, err)
+	}
+	return &protocol.AckMessage{MessageID: id}
+}
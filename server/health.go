@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/PickledCode/status-server/events"
+)
+
+// HealthProbes serves probes for orchestrators such as
+// Kubernetes:
+//
+//   - /healthz fails if the EventDB fails its self-check,
+//     meaning that the server should be restarted.
+//   - /readyz also fails once the server is stopping, so
+//     that new clients are sent to other servers.
+type HealthProbes struct {
+	EDB events.EventDB
+
+	stopping int32
+}
+
+// Stop makes the readiness probe fail from now on.
+func (h *HealthProbes) Stop() {
+	atomic.StoreInt32(&h.stopping, 1)
+}
+
+func (h *HealthProbes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+	case "/readyz":
+		if atomic.LoadInt32(&h.stopping) != 0 {
+			http.Error(w, "stopping", http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err := h.EDB.SelfCheck(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
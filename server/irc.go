@@ -0,0 +1,895 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// IRCChannel is the channel in which an IRC client sees
+	// its user's online buddies.
+	IRCChannel = "#buddies"
+
+	// IRCPingInterval is the time between pings to an IRC
+	// client, which is disconnected if it sends nothing for
+	// IRCTimeout.
+	IRCPingInterval = time.Minute
+	IRCTimeout      = 3 * time.Minute
+
+	ircServerName   = "status-server"
+	ircTopic        = "Online buddies; away buddies are not voiced"
+	ircWriteTimeout = 30 * time.Second
+	maxIRCLine      = 8192
+	maxIRCOutput    = 510
+	maxIRCNick      = 30
+)
+
+// ServeIRC accepts IRC connections from a listener and
+// handles each client in its own Goroutine, until the
+// listener is closed.
+func ServeIRC(listener net.Listener, edb events.EventDB) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return essentials.AddCtx("serve IRC", err)
+		}
+		go HandleIRCClient(conn, edb)
+	}
+}
+
+// HandleIRCClient lets an IRC client monitor its user's
+// buddies, until the connection is closed.
+//
+// The client logs in with "PASS <email>:<password>", and
+// may pass a two-factor code as a second parameter. The
+// user's online buddies are the members of IRCChannel,
+// with available buddies voiced and the others marked as
+// away. The client's own away state sets the user's
+// status.
+func HandleIRCClient(conn net.Conn, edb events.EventDB) {
+	defer recoverClientPanic("handle IRC client")
+	defer conn.Close()
+	atomic.AddInt64(&events.ActiveConnections, 1)
+	defer atomic.AddInt64(&events.ActiveConnections, -1)
+
+	c := &ircClient{
+		conn:    conn,
+		edb:     edb,
+		nick:    "*",
+		buddies: map[string]*ircBuddy{},
+		nicks:   map[string]string{},
+	}
+	defer func() {
+		if c.sess != nil {
+			c.sess.Close()
+		}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 512), maxIRCLine)
+	for {
+		conn.SetReadDeadline(time.Now().Add(IRCTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		command, params := parseIRCLine(scanner.Text())
+		if command == "" {
+			continue
+		}
+		var ok bool
+		if c.sess == nil {
+			ok = c.handleRegistration(command, params)
+			if ok && c.sess != nil {
+				go c.handleEvents()
+				go c.keepalive(stop)
+			}
+		} else {
+			ok = c.handleCommand(command, params)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// An ircClient is the state of an IRC connection.
+//
+// The lock protects the buddy state and orders writes, so
+// that replies reflect the changes sent before them.
+type ircClient struct {
+	conn net.Conn
+	edb  events.EventDB
+	sess events.DBSession
+
+	// Registration state.
+	pass       []string
+	gotUser    bool
+	negotiated bool
+	email      string
+
+	lock       sync.Mutex
+	nick       string
+	awayNotify bool
+	synced     bool
+	joined     bool
+	buddies    map[string]*ircBuddy
+	nicks      map[string]string
+}
+
+// An ircBuddy is a buddy as an IRC client sees them.
+type ircBuddy struct {
+	Email  string
+	Nick   string
+	Online bool
+
+	// Away is the away message, or "" if the buddy is
+	// available.
+	Away string
+}
+
+func (c *ircClient) handleRegistration(command string, params []string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch command {
+	case "CAP":
+		if len(params) > 0 && strings.ToUpper(params[0]) != "END" {
+			c.negotiated = true
+		} else {
+			c.negotiated = false
+		}
+		if !c.handleCap(params) {
+			return false
+		}
+	case "PASS":
+		if len(params) == 0 {
+			return c.reply("461", "PASS", "Not enough parameters")
+		}
+		c.pass = params
+	case "NICK":
+		if len(params) == 0 {
+			return c.reply("431", "No nickname given")
+		} else if !validIRCNick(params[0]) {
+			return c.reply("432", params[0], "Erroneous nickname")
+		}
+		c.nick = params[0]
+	case "USER":
+		if len(params) < 4 {
+			return c.reply("461", "USER", "Not enough parameters")
+		}
+		c.gotUser = true
+	case "PING":
+		return c.send(ircServerName, "PONG", append([]string{ircServerName}, params...)...)
+	case "PONG":
+	case "QUIT":
+		c.send("", "ERROR", "Closing link")
+		return false
+	default:
+		return c.reply("451", "You have not registered")
+	}
+	if c.nick == "*" || !c.gotUser || c.negotiated {
+		return true
+	}
+	return c.login()
+}
+
+// login begins the session once the client has registered,
+// and welcomes the client.
+func (c *ircClient) login() bool {
+	var remoteAddr string
+	if addr := c.conn.RemoteAddr(); addr != nil {
+		remoteAddr = addr.String()
+	}
+	var email, password, code string
+	if len(c.pass) > 0 {
+		parts := strings.SplitN(c.pass[0], ":", 2)
+		email = parts[0]
+		if len(parts) == 2 {
+			password = parts[1]
+		}
+	}
+	if len(c.pass) > 1 {
+		code = c.pass[1]
+	}
+	if email == "" || password == "" {
+		c.reply("464", "Log in with PASS <email>:<password>")
+		c.send("", "ERROR", "Closing link: password required")
+		return false
+	}
+	sess, err := c.edb.BeginSession(email, password, code)
+	entry := events.AuditEntry{Actor: email, RemoteAddr: remoteAddr, Action: "login"}
+	if err != nil {
+		entry.Error = err.Error()
+		c.edb.RecordAudit(entry)
+		_, message := events.DescribeError(err)
+		c.reply("464", message)
+		c.send("", "ERROR", "Closing link: "+message)
+		return false
+	}
+	sess.SetRemoteAddr(remoteAddr)
+	entry.Session = sess.ID()
+	c.edb.RecordAudit(entry)
+	c.sess = sess
+	c.email = strings.ToLower(email)
+
+	return c.reply("001", "Welcome to the status server, "+c.nick) &&
+		c.reply("002", "Your host is "+ircServerName+", running version "+Version) &&
+		c.reply("004", ircServerName, Version, "i", "ntv") &&
+		c.reply("005", "CHANTYPES=#", "PREFIX=(v)+", "CASEMAPPING=ascii", "NICKLEN="+
+			strconv.Itoa(maxIRCNick), "are supported by this server") &&
+		c.reply("422", "Your buddies are in "+IRCChannel)
+}
+
+func (c *ircClient) handleCommand(command string, params []string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch command {
+	case "PING":
+		return c.send(ircServerName, "PONG", append([]string{ircServerName}, params...)...)
+	case "PONG":
+		return true
+	case "QUIT":
+		c.send("", "ERROR", "Closing link")
+		return false
+	case "CAP":
+		return c.handleCap(params)
+	case "PASS", "USER":
+		return c.reply("462", "You may not reregister")
+	case "NICK":
+		if len(params) == 0 {
+			return c.reply("431", "No nickname given")
+		} else if !validIRCNick(params[0]) {
+			return c.reply("432", params[0], "Erroneous nickname")
+		} else if email, ok := c.nicks[strings.ToLower(params[0])]; ok && email != c.email {
+			return c.reply("433", params[0], "Nickname is already in use")
+		}
+		prefix := c.prefix()
+		c.nick = params[0]
+		return c.send(prefix, "NICK", c.nick)
+	case "JOIN":
+		if len(params) == 0 {
+			return c.reply("461", "JOIN", "Not enough parameters")
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			if channel == "0" {
+				if !c.part() {
+					return false
+				}
+			} else if !strings.EqualFold(channel, IRCChannel) {
+				if !c.reply("403", channel, "No such channel") {
+					return false
+				}
+			} else if !c.joined && c.synced {
+				if !c.join() {
+					return false
+				}
+			}
+		}
+		return true
+	case "PART":
+		if len(params) == 0 {
+			return c.reply("461", "PART", "Not enough parameters")
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			if !strings.EqualFold(channel, IRCChannel) {
+				if !c.reply("403", channel, "No such channel") {
+					return false
+				}
+			} else if !c.joined {
+				if !c.reply("442", channel, "You're not on that channel") {
+					return false
+				}
+			} else if !c.part() {
+				return false
+			}
+		}
+		return true
+	case "NAMES":
+		if len(params) > 0 && !strings.EqualFold(params[0], IRCChannel) {
+			return c.reply("366", params[0], "End of /NAMES list")
+		}
+		return c.names()
+	case "TOPIC":
+		if len(params) == 0 {
+			return c.reply("461", "TOPIC", "Not enough parameters")
+		} else if !strings.EqualFold(params[0], IRCChannel) {
+			return c.reply("403", params[0], "No such channel")
+		} else if len(params) > 1 {
+			return c.reply("482", IRCChannel, "You're not channel operator")
+		}
+		return c.reply("332", IRCChannel, ircTopic)
+	case "MODE":
+		if len(params) == 0 {
+			return c.reply("461", "MODE", "Not enough parameters")
+		} else if strings.EqualFold(params[0], IRCChannel) {
+			if len(params) == 1 {
+				return c.reply("324", IRCChannel, "+nt")
+			} else if strings.TrimLeft(params[1], "+") == "b" {
+				return c.reply("368", IRCChannel, "End of channel ban list")
+			}
+			return c.reply("482", IRCChannel, "You're not channel operator")
+		} else if strings.EqualFold(params[0], c.nick) {
+			return c.reply("221", "+i")
+		}
+		return c.reply("502", "Cannot change mode for other users")
+	case "WHO":
+		mask := "*"
+		if len(params) > 0 {
+			mask = params[0]
+		}
+		return c.who(mask)
+	case "WHOIS":
+		if len(params) == 0 {
+			return c.reply("431", "No nickname given")
+		}
+		return c.whois(params[len(params)-1])
+	case "ISON":
+		var online []string
+		for _, param := range params {
+			for _, nick := range strings.Fields(param) {
+				if strings.EqualFold(nick, c.nick) {
+					online = append(online, c.nick)
+				} else if buddy := c.buddyByNick(nick); buddy != nil && buddy.Online {
+					online = append(online, buddy.Nick)
+				}
+			}
+		}
+		return c.reply("303", strings.Join(online, " "))
+	case "AWAY":
+		status := statusdb.UserStatus{Availability: statusdb.Available}
+		if len(params) > 0 && params[0] != "" {
+			status = statusdb.UserStatus{Availability: statusdb.Away, Message: params[0]}
+		}
+		if err := c.sess.SetStatus(status); err != nil {
+			_, message := events.DescribeError(err)
+			return c.send(ircServerName, "NOTICE", c.nick, message)
+		} else if status.Availability == statusdb.Away {
+			return c.reply("306", "You have been marked as being away")
+		}
+		return c.reply("305", "You are no longer marked as being away")
+	case "PRIVMSG":
+		if len(params) == 0 {
+			return c.reply("411", "No recipient given (PRIVMSG)")
+		}
+		return c.reply("404", params[0], "Messages are not supported")
+	case "NOTICE":
+		return true
+	default:
+		return c.reply("421", command, "Unknown command")
+	}
+}
+
+// handleCap negotiates the away-notify capability, which
+// is the only one supported.
+func (c *ircClient) handleCap(params []string) bool {
+	if len(params) == 0 {
+		return c.reply("461", "CAP", "Not enough parameters")
+	}
+	switch strings.ToUpper(params[0]) {
+	case "LS":
+		return c.send(ircServerName, "CAP", c.nick, "LS", "away-notify")
+	case "LIST":
+		var enabled string
+		if c.awayNotify {
+			enabled = "away-notify"
+		}
+		return c.send(ircServerName, "CAP", c.nick, "LIST", enabled)
+	case "REQ":
+		if len(params) < 2 {
+			return c.reply("461", "CAP", "Not enough parameters")
+		}
+		enable := c.awayNotify
+		for _, capability := range strings.Fields(params[1]) {
+			switch capability {
+			case "away-notify":
+				enable = true
+			case "-away-notify":
+				enable = false
+			default:
+				return c.send(ircServerName, "CAP", c.nick, "NAK", params[1])
+			}
+		}
+		c.awayNotify = enable
+		return c.send(ircServerName, "CAP", c.nick, "ACK", params[1])
+	case "END":
+		return true
+	default:
+		return c.reply("410", params[0], "Invalid CAP command")
+	}
+}
+
+func (c *ircClient) keepalive(stop <-chan struct{}) {
+	ticker := time.NewTicker(IRCPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		c.lock.Lock()
+		ok := c.send("", "PING", ircServerName)
+		c.lock.Unlock()
+		if !ok {
+			return
+		}
+	}
+}
+
+// handleEvents reflects the session's events in the
+// channel, and closes the connection once the session
+// ends.
+func (c *ircClient) handleEvents() {
+	defer recoverClientPanic("handle IRC events")
+	defer c.conn.Close()
+	for event := range c.sess.Events() {
+		c.lock.Lock()
+		ok := c.handleEvent(event)
+		c.lock.Unlock()
+		if !ok {
+			return
+		}
+	}
+	c.lock.Lock()
+	c.send("", "ERROR", "Closing link: session ended")
+	c.lock.Unlock()
+}
+
+func (c *ircClient) handleEvent(event *events.Event) bool {
+	switch event.Type {
+	case events.EventFullState:
+		info := event.UserInfo
+		current := map[string]bool{}
+		for i, email := range info.Buddies {
+			current[email] = true
+			if !c.setBuddy(email, info.Aliases[email], event.BuddyStatuses[i]) {
+				return false
+			}
+		}
+		for email := range c.buddies {
+			if !current[email] && !c.removeBuddy(email, "No longer a buddy") {
+				return false
+			}
+		}
+		if !c.synced {
+			c.synced = true
+			if !c.join() {
+				return false
+			}
+		}
+		for _, priority := range event.Priority {
+			if !c.handleEvent(priority) {
+				return false
+			}
+		}
+		return true
+	case events.EventStatusChanged:
+		if _, ok := c.buddies[event.Email]; !ok {
+			return true
+		}
+		return c.setBuddy(event.Email, "", event.Status)
+	case events.EventAcceptSent, events.EventRequestAccepted:
+		return c.setBuddy(event.Email, "", event.Status)
+	case events.EventBuddyRemoved:
+		return c.removeBuddy(event.Email, "No longer a buddy")
+	case events.EventUserBlocked:
+		return c.removeBuddy(event.Email, "Blocked")
+	case events.EventAliasChanged:
+		return c.renameBuddy(event.Email, event.Alias)
+	case events.EventRequestReceived:
+		text := event.Email + " wants to be your buddy"
+		if event.Greeting != "" {
+			text += ": " + event.Greeting
+		}
+		return c.send(ircServerName, "NOTICE", c.nick, text)
+	case events.EventServerNotice:
+		return c.send(ircServerName, "NOTICE", c.nick, event.Notice.Text)
+	case events.EventReconnect:
+		c.send("", "ERROR", "Closing link: server restarting, please reconnect")
+		return false
+	case events.EventIntentionalDisconnect:
+		c.send("", "ERROR", "Closing link: logged out")
+		return false
+	}
+	return true
+}
+
+// setBuddy adds a buddy or updates their status, telling
+// the client about the change if it is in the channel.
+//
+// If alias is empty, a known buddy's nick is kept.
+func (c *ircClient) setBuddy(email, alias string, status statusdb.UserStatus) bool {
+	buddy, ok := c.buddies[email]
+	if !ok {
+		buddy = &ircBuddy{Email: email, Nick: c.uniqueNick(alias, email)}
+		c.buddies[email] = buddy
+		c.nicks[strings.ToLower(buddy.Nick)] = email
+	} else if alias != "" && !c.renameBuddy(email, alias) {
+		return false
+	}
+	old := *buddy
+	buddy.Online = status.Availability != statusdb.Offline
+	buddy.Away = ""
+	if buddy.Online {
+		buddy.Away = ircAwayMessage(status)
+	}
+	if !c.joined {
+		return true
+	}
+	prefix := buddy.prefix()
+	if old.Online && !buddy.Online {
+		return c.send(prefix, "PART", IRCChannel, "Offline")
+	} else if !buddy.Online {
+		return true
+	}
+	if !old.Online && !c.send(prefix, "JOIN", IRCChannel) {
+		return false
+	}
+	wasHere := old.Online && old.Away == ""
+	if here := buddy.Away == ""; here && !wasHere {
+		if !c.send(ircServerName, "MODE", IRCChannel, "+v", buddy.Nick) {
+			return false
+		}
+	} else if !here && wasHere {
+		if !c.send(ircServerName, "MODE", IRCChannel, "-v", buddy.Nick) {
+			return false
+		}
+	}
+	if !c.awayNotify || (old.Online && old.Away == buddy.Away) {
+		return true
+	} else if buddy.Away != "" {
+		return c.send(prefix, "AWAY", buddy.Away)
+	} else if old.Online {
+		return c.send(prefix, "AWAY")
+	}
+	return true
+}
+
+func (c *ircClient) removeBuddy(email, reason string) bool {
+	buddy, ok := c.buddies[email]
+	if !ok {
+		return true
+	}
+	delete(c.buddies, email)
+	delete(c.nicks, strings.ToLower(buddy.Nick))
+	if c.joined && buddy.Online {
+		return c.send(buddy.prefix(), "PART", IRCChannel, reason)
+	}
+	return true
+}
+
+// renameBuddy changes a buddy's nick to suit a new alias,
+// or their email if the alias is empty.
+func (c *ircClient) renameBuddy(email, alias string) bool {
+	buddy, ok := c.buddies[email]
+	if !ok {
+		return true
+	}
+	nick := c.uniqueNick(alias, email)
+	if nick == buddy.Nick {
+		return true
+	}
+	prefix := buddy.prefix()
+	delete(c.nicks, strings.ToLower(buddy.Nick))
+	buddy.Nick = nick
+	c.nicks[strings.ToLower(nick)] = email
+	if c.joined && buddy.Online {
+		return c.send(prefix, "NICK", nick)
+	}
+	return true
+}
+
+// uniqueNick derives a nick from a buddy's alias or email
+// which no other buddy or the client has.
+func (c *ircClient) uniqueNick(alias, email string) string {
+	base := ircNick(alias, email)
+	nick := base
+	for i := 2; ; i++ {
+		lower := strings.ToLower(nick)
+		if other, ok := c.nicks[lower]; (!ok || other == email) && lower != strings.ToLower(c.nick) {
+			return nick
+		}
+		suffix := strconv.Itoa(i)
+		nick = base[:essentials.MinInt(len(base), maxIRCNick-len(suffix))] + suffix
+	}
+}
+
+func (c *ircClient) buddyByNick(nick string) *ircBuddy {
+	if email, ok := c.nicks[strings.ToLower(nick)]; ok {
+		return c.buddies[email]
+	}
+	return nil
+}
+
+func (c *ircClient) join() bool {
+	c.joined = true
+	return c.send(c.prefix(), "JOIN", IRCChannel) &&
+		c.reply("332", IRCChannel, ircTopic) &&
+		c.names()
+}
+
+func (c *ircClient) part() bool {
+	if !c.joined {
+		return true
+	}
+	c.joined = false
+	return c.send(c.prefix(), "PART", IRCChannel)
+}
+
+// names lists the channel's members in as many replies as
+// their lengths require.
+func (c *ircClient) names() bool {
+	if c.joined {
+		line := c.nick
+		for _, buddy := range c.buddies {
+			if !buddy.Online {
+				continue
+			}
+			name := buddy.Nick
+			if buddy.Away == "" {
+				name = "+" + name
+			}
+			if len(line)+len(name) > 400 {
+				if !c.reply("353", "=", IRCChannel, line) {
+					return false
+				}
+				line = name
+			} else {
+				line += " " + name
+			}
+		}
+		if !c.reply("353", "=", IRCChannel, line) {
+			return false
+		}
+	}
+	return c.reply("366", IRCChannel, "End of /NAMES list")
+}
+
+func (c *ircClient) who(mask string) bool {
+	if strings.EqualFold(mask, IRCChannel) {
+		if c.joined {
+			if !c.whoReply(IRCChannel, c.nick, c.email, "H") {
+				return false
+			}
+			for _, buddy := range c.buddies {
+				if buddy.Online && !c.whoReply(IRCChannel, buddy.Nick, buddy.Email, buddy.whoFlags()) {
+					return false
+				}
+			}
+		}
+	} else if strings.EqualFold(mask, c.nick) {
+		if !c.whoReply("*", c.nick, c.email, "H") {
+			return false
+		}
+	} else if buddy := c.buddyByNick(mask); buddy != nil && buddy.Online {
+		if !c.whoReply("*", buddy.Nick, buddy.Email, buddy.whoFlags()) {
+			return false
+		}
+	}
+	return c.reply("315", mask, "End of /WHO list")
+}
+
+func (c *ircClient) whoReply(channel, nick, email, flags string) bool {
+	user, host := ircUserHost(email)
+	return c.reply("352", channel, user, host, ircServerName, nick, flags, "0 "+email)
+}
+
+func (c *ircClient) whois(nick string) bool {
+	if strings.EqualFold(nick, c.nick) {
+		user, host := ircUserHost(c.email)
+		if !c.reply("311", c.nick, user, host, "*", c.email) {
+			return false
+		}
+	} else if buddy := c.buddyByNick(nick); buddy != nil && buddy.Online {
+		user, host := ircUserHost(buddy.Email)
+		if !c.reply("311", buddy.Nick, user, host, "*", buddy.Email) {
+			return false
+		}
+		if c.joined {
+			channel := IRCChannel
+			if buddy.Away == "" {
+				channel = "+" + channel
+			}
+			if !c.reply("319", buddy.Nick, channel) {
+				return false
+			}
+		}
+		if buddy.Away != "" && !c.reply("301", buddy.Nick, buddy.Away) {
+			return false
+		}
+	} else if !c.reply("401", nick, "No such nick") {
+		return false
+	}
+	return c.reply("318", nick, "End of /WHOIS list")
+}
+
+// prefix gets the source of the client's own changes.
+func (c *ircClient) prefix() string {
+	user, host := ircUserHost(c.email)
+	return c.nick + "!" + user + "@" + host
+}
+
+// reply sends a numeric reply to the client.
+func (c *ircClient) reply(numeric string, params ...string) bool {
+	return c.send(ircServerName, numeric, append([]string{c.nick}, params...)...)
+}
+
+// send writes a message to the client, closing the
+// connection if it fails.
+//
+// The last parameter may contain spaces. Line breaks are
+// removed from every parameter, and long messages are
+// truncated.
+func (c *ircClient) send(prefix, command string, params ...string) bool {
+	var line strings.Builder
+	if prefix != "" {
+		line.WriteString(":" + prefix + " ")
+	}
+	line.WriteString(command)
+	for i, param := range params {
+		param = strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == 0 {
+				return ' '
+			}
+			return r
+		}, param)
+		line.WriteByte(' ')
+		if i == len(params)-1 && (param == "" || param[0] == ':' || strings.Contains(param, " ")) {
+			line.WriteByte(':')
+		}
+		line.WriteString(param)
+	}
+	data := line.String()
+	if len(data) > maxIRCOutput {
+		data = data[:maxIRCOutput]
+		for !utf8.ValidString(data) {
+			data = data[:len(data)-1]
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	if _, err := c.conn.Write([]byte(data + "\r\n")); err != nil {
+		c.conn.Close()
+		return false
+	}
+	return true
+}
+
+func (b *ircBuddy) prefix() string {
+	user, host := ircUserHost(b.Email)
+	return b.Nick + "!" + user + "@" + host
+}
+
+// whoFlags gets the away flag and channel prefix of a
+// WHO reply.
+func (b *ircBuddy) whoFlags() string {
+	if b.Away != "" {
+		return "G"
+	}
+	return "H+"
+}
+
+// parseIRCLine splits a line into its command and its
+// parameters, ignoring any tags and prefix.
+func parseIRCLine(line string) (command string, params []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		if idx := strings.IndexByte(line, ' '); idx >= 0 {
+			line = strings.TrimLeft(line[idx:], " ")
+		} else {
+			return "", nil
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		if idx := strings.IndexByte(line, ' '); idx >= 0 {
+			line = strings.TrimLeft(line[idx:], " ")
+		} else {
+			return "", nil
+		}
+	}
+	var trailing *string
+	if idx := strings.Index(line, " :"); idx >= 0 {
+		rest := line[idx+2:]
+		trailing = &rest
+		line = line[:idx]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params = fields[1:]
+	if trailing != nil {
+		params = append(params, *trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
+
+// ircNick derives a valid nick from an alias, or from the
+// local part of an email if the alias is empty.
+func ircNick(alias, email string) string {
+	name := alias
+	if name == "" {
+		name = email
+		if idx := strings.LastIndex(email, "@"); idx >= 0 {
+			name = email[:idx]
+		}
+	}
+	var nick strings.Builder
+	for _, r := range name {
+		if r < 0x80 && (isIRCLetter(byte(r)) || (r >= '0' && r <= '9') || r == '-') {
+			nick.WriteRune(r)
+		} else {
+			nick.WriteByte('_')
+		}
+	}
+	res := nick.String()
+	if res == "" || !isIRCLetter(res[0]) {
+		res = "_" + res
+	}
+	if len(res) > maxIRCNick {
+		res = res[:maxIRCNick]
+	}
+	return res
+}
+
+func validIRCNick(nick string) bool {
+	if nick == "" || len(nick) > maxIRCNick || !isIRCLetter(nick[0]) {
+		return false
+	}
+	for i := 1; i < len(nick); i++ {
+		if !isIRCLetter(nick[i]) && !(nick[i] >= '0' && nick[i] <= '9') && nick[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isIRCLetter checks if a byte may begin a nick.
+func isIRCLetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || strings.IndexByte("[]\\`_^{|}", b) >= 0
+}
+
+// ircUserHost splits an email into the user and host of
+// an IRC prefix.
+func ircUserHost(email string) (user, host string) {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '!' || r == '@' || r == ':' {
+				return '_'
+			}
+			return r
+		}, s)
+	}
+	idx := strings.LastIndex(email, "@")
+	if idx < 0 {
+		return clean(email), ircServerName
+	}
+	return clean(email[:idx]), clean(email[idx+1:])
+}
+
+// ircAwayMessage describes a status which is not
+// Available, for an away reply.
+func ircAwayMessage(status statusdb.UserStatus) string {
+	if status.Availability == statusdb.Available {
+		return ""
+	} else if status.Message != "" {
+		return status.Message
+	} else if status.Custom != nil && status.Custom.Label != "" {
+		return status.Custom.Label
+	} else if status.Idle {
+		return "Idle"
+	} else if status.Availability == statusdb.DoNotDisturb {
+		return "Do not disturb"
+	}
+	return "Away"
+}
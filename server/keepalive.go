@@ -0,0 +1,116 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// A keepalive pings a client periodically and disconnects
+// it if it stops answering.
+//
+// Pings go through the client's outbound queue, and are
+// skipped while it is full, so that a client which stops
+// reading cannot hold up the keepalive. Disconnecting
+// closes the connection itself, which also stops a writer
+// that is stuck on it.
+//
+// Clients which declare the ping type in their
+// capabilities are disconnected once a ping has gone
+// unanswered for PingTimeout. Clients which declare
+// capabilities without it are never pinged, and so are
+// never disconnected. Clients which declare nothing are
+// pinged, but are only disconnected once they have
+// answered a ping and then stopped, since older clients
+// may ignore pings.
+type keepalive struct {
+	conn protocol.Connection
+	out  *outboundQueue
+	caps *clientCapabilities
+
+	lock     sync.Mutex
+	lastPing time.Time
+	lastPong time.Time
+	rtt      time.Duration
+}
+
+// keepaliveCheckInterval is how often a keepalive checks
+// whether its client has timed out.
+const keepaliveCheckInterval = 5 * time.Second
+
+// Run sends pings until stopChan is closed or the client
+// is disconnected.
+//
+// The timeout is checked on its own timer, and closes the
+// connection directly, so that it fires even while the
+// client's messages are stuck waiting to be written.
+func (k *keepalive) Run(stopChan <-chan struct{}) {
+	pings := time.NewTicker(protocol.PingInterval)
+	defer pings.Stop()
+	checks := time.NewTicker(keepaliveCheckInterval)
+	defer checks.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case now := <-pings.C:
+			k.ping(now)
+		case now := <-checks.C:
+			if k.timedOut(now) {
+				k.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// ping queues a ping, unless the client does not support
+// them or the queue is full.
+func (k *keepalive) ping(now time.Time) {
+	if !k.caps.SupportsType(protocol.MsgTypePing) {
+		return
+	}
+	declared := k.caps.DeclaresType(protocol.MsgTypePing)
+	k.lock.Lock()
+	// lastPing is the first ping since the last pong, so
+	// that the timeout runs from the oldest unanswered
+	// ping.
+	if !declared || !k.lastPong.Before(k.lastPing) {
+		k.lastPing = now
+	}
+	rtt := k.rtt
+	k.lock.Unlock()
+	k.out.TrySend(&protocol.PingMessage{Time: protocol.UnixMillis(now), RTT: int64(rtt / time.Millisecond)})
+}
+
+// timedOut checks if the client should be disconnected.
+func (k *keepalive) timedOut(now time.Time) bool {
+	declared := k.caps.DeclaresType(protocol.MsgTypePing)
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if declared {
+		return k.lastPong.Before(k.lastPing) && now.Sub(k.lastPing) > protocol.PingTimeout
+	}
+	return !k.lastPong.IsZero() && now.Sub(k.lastPong) > protocol.PingTimeout
+}
+
+// HandlePong records a pong from the client.
+func (k *keepalive) HandlePong(msg *protocol.PongMessage) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	now := time.Now()
+	k.lastPong = now
+	if msg.Time > 0 {
+		k.rtt = time.Duration(protocol.UnixMillis(now)-msg.Time) * time.Millisecond
+	}
+}
+
+// pong creates the response to a client's ping.
+func pong(msg *protocol.PingMessage) *protocol.PongMessage {
+	return &protocol.PongMessage{
+		MessageID:  msg.MessageID,
+		Time:       msg.Time,
+		ServerTime: protocol.UnixMillis(time.Now()),
+	}
+}
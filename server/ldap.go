@@ -0,0 +1,631 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// LDAPTimeout bounds each exchange with the directory,
+	// from connecting to the final bind.
+	LDAPTimeout = 10 * time.Second
+
+	DefaultLDAPUserFilter    = "(mail=%s)"
+	DefaultLDAPNameAttribute = "displayName"
+
+	maxLDAPMessage = 1 << 20
+
+	ldapInvalidCredentials = 49
+	ldapSizeLimitExceeded  = 4
+)
+
+var ErrLDAPFilter = errors.New("invalid LDAP filter")
+
+// An LDAPAuthenticator checks passwords against an LDAP
+// directory, such as Active Directory.
+//
+// A user is found by searching BaseDN with UserFilter, in
+// which %s is replaced by their email, and is then
+// authenticated by binding as the entry that was found.
+type LDAPAuthenticator struct {
+	// URL is an ldap:// or ldaps:// URL of the server.
+	URL string
+
+	// StartTLS upgrades ldap:// connections to TLS before
+	// any credentials are sent.
+	StartTLS bool
+
+	// BindDN and BindPassword authenticate the search for
+	// users. If BindDN is empty, the search is anonymous.
+	BindDN       string
+	BindPassword string
+
+	BaseDN     string
+	UserFilter string
+
+	// NameAttribute is copied into the display names of
+	// users when they are first provisioned.
+	NameAttribute string
+}
+
+// WrapDB creates a DB which authenticates users with the
+// directory instead of local passwords.
+//
+// Users who log in for the first time are added to db, so
+// that their buddies and statuses are stored locally.
+// Registration and password changes fail with
+// statusdb.ErrExternalAccounts, since the directory owns
+// both.
+func (l *LDAPAuthenticator) WrapDB(db statusdb.DB) statusdb.DB {
+	return &ldapDB{DB: db, ldap: l}
+}
+
+// Authenticate checks a user's password, returning the
+// name of their directory entry.
+//
+// It fails with statusdb.ErrNoEmail if no entry matches
+// the email, or statusdb.ErrPassword if the password is
+// incorrect.
+func (l *LDAPAuthenticator) Authenticate(email, password string) (name string, err error) {
+	defer essentials.AddCtxTo("ldap authenticate", &err)
+	if password == "" {
+		// Servers treat a bind without a password as an
+		// anonymous bind, which always succeeds.
+		return "", statusdb.ErrPassword
+	}
+	filter, err := l.filter(email)
+	if err != nil {
+		return "", err
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if l.BindDN != "" {
+		if err := conn.bind(l.BindDN, l.BindPassword); err != nil {
+			return "", essentials.AddCtx("service bind", err)
+		}
+	}
+	nameAttr := l.NameAttribute
+	if nameAttr == "" {
+		nameAttr = DefaultLDAPNameAttribute
+	}
+	entries, err := conn.search(l.BaseDN, filter, nameAttr)
+	if err != nil {
+		return "", err
+	} else if len(entries) == 0 {
+		return "", statusdb.ErrNoEmail
+	} else if len(entries) > 1 {
+		return "", errors.New("email matches multiple entries")
+	}
+	if err := conn.bind(entries[0].DN, password); err != nil {
+		if ldapErr, ok := err.(*ldapError); ok && ldapErr.Code == ldapInvalidCredentials {
+			return "", statusdb.ErrPassword
+		}
+		return "", err
+	}
+	if names := entries[0].Attributes[strings.ToLower(nameAttr)]; len(names) > 0 {
+		name = names[0]
+	}
+	return name, nil
+}
+
+// CheckFilter checks that UserFilter is supported.
+func (l *LDAPAuthenticator) CheckFilter() error {
+	_, err := l.filter("user@example.com")
+	return err
+}
+
+func (l *LDAPAuthenticator) filter(email string) ([]byte, error) {
+	template := l.UserFilter
+	if template == "" {
+		template = DefaultLDAPUserFilter
+	}
+	if !strings.Contains(template, "%s") {
+		return nil, ErrLDAPFilter
+	}
+	return parseLDAPFilter(strings.Replace(template, "%s", escapeLDAPFilter(email), -1))
+}
+
+func (l *LDAPAuthenticator) dial() (*ldapConn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, errors.New("unsupported LDAP URL scheme: " + u.Scheme)
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	dialer := &net.Dialer{Timeout: LDAPTimeout}
+	var netConn net.Conn
+	if u.Scheme == "ldaps" {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Now().Add(LDAPTimeout))
+	conn := &ldapConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if l.StartTLS && u.Scheme == "ldap" {
+		if err := conn.startTLS(tlsConfig); err != nil {
+			netConn.Close()
+			return nil, essentials.AddCtx("start TLS", err)
+		}
+	}
+	return conn, nil
+}
+
+type ldapDB struct {
+	statusdb.DB
+	ldap *LDAPAuthenticator
+}
+
+func (l *ldapDB) AddUser(email, password string) error {
+	return statusdb.ErrExternalAccounts
+}
+
+func (l *ldapDB) CheckLogin(email, password string) (err error) {
+	defer essentials.AddCtxTo("check login", &err)
+	name, err := l.ldap.Authenticate(email, password)
+	if err != nil {
+		return err
+	}
+	info, err := l.DB.GetUserInfo(email)
+	if events.RootError(err) == statusdb.ErrNoEmail {
+		return l.provision(email, name)
+	} else if err != nil {
+		return err
+	}
+	if info.Remote {
+		return statusdb.ErrNoEmail
+	} else if info.Bot {
+		return statusdb.ErrPassword
+	} else if info.Locked {
+		return statusdb.ErrAccountLocked
+	} else if time.Now().Before(info.SuspendedUntil) {
+		return statusdb.ErrAccountSuspended
+	}
+	return nil
+}
+
+func (l *ldapDB) SetPassword(email, oldPass, newPass string) error {
+	return statusdb.ErrExternalAccounts
+}
+
+func (l *ldapDB) BeginPasswordReset(email string, lifetime time.Duration) (string, error) {
+	return "", statusdb.ErrExternalAccounts
+}
+
+func (l *ldapDB) ResetPassword(email, code, newPass string) error {
+	return statusdb.ErrExternalAccounts
+}
+
+// provision adds a user who has logged in for the first
+// time, with a random local password which is never used.
+func (l *ldapDB) provision(email, name string) error {
+	err := l.DB.AddUser(email, events.NewRandomID())
+	if events.RootError(err) == statusdb.ErrEmailInUse {
+		// A concurrent login provisioned the user.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for len(name) > protocol.MaxDisplayNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name != "" {
+		return l.DB.SetProfile(email, statusdb.Profile{DisplayName: name})
+	}
+	return nil
+}
+
+type ldapError struct {
+	Code    int
+	Message string
+}
+
+func (l *ldapError) Error() string {
+	if l.Message == "" {
+		return "LDAP result code " + strconv.Itoa(l.Code)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", l.Code, l.Message)
+}
+
+type ldapEntry struct {
+	DN string
+
+	// Attributes maps lowercase attribute names to values.
+	Attributes map[string][]string
+}
+
+// An ldapConn makes LDAPv3 requests (RFC 4511) one at a
+// time.
+type ldapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	lastID int
+}
+
+func (l *ldapConn) Close() error {
+	l.request(berTLV(0x42))
+	return l.conn.Close()
+}
+
+func (l *ldapConn) bind(dn, password string) error {
+	op := berTLV(0x60, berInt(0x02, 3), berTLV(0x04, []byte(dn)), berTLV(0x80, []byte(password)))
+	tag, content, err := l.roundTrip(op)
+	if err != nil {
+		return err
+	} else if tag != 0x61 {
+		return errors.New("unexpected response to bind")
+	}
+	return parseLDAPResult(content)
+}
+
+func (l *ldapConn) startTLS(config *tls.Config) error {
+	op := berTLV(0x77, berTLV(0x80, []byte("1.3.6.1.4.1.1466.20037")))
+	tag, content, err := l.roundTrip(op)
+	if err != nil {
+		return err
+	} else if tag != 0x78 {
+		return errors.New("unexpected response to StartTLS")
+	} else if err := parseLDAPResult(content); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(l.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	l.conn = tlsConn
+	l.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// search finds the entries under base which match filter,
+// stopping after two since a login needs exactly one.
+func (l *ldapConn) search(base string, filter []byte, attributes ...string) ([]*ldapEntry, error) {
+	var attrs [][]byte
+	for _, attr := range attributes {
+		attrs = append(attrs, berTLV(0x04, []byte(attr)))
+	}
+	op := berTLV(0x63,
+		berTLV(0x04, []byte(base)),
+		berInt(0x0a, 2), // whole subtree
+		berInt(0x0a, 0), // never dereference aliases
+		berInt(0x02, 2),
+		berInt(0x02, int(LDAPTimeout/time.Second)),
+		berTLV(0x01, []byte{0}),
+		filter,
+		berTLV(0x30, attrs...),
+	)
+	id, err := l.request(op)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ldapEntry
+	for {
+		tag, content, err := l.response(id)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0x64:
+			entry, err := parseLDAPEntry(content)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case 0x73:
+			// Referrals to other servers are not followed.
+		case 0x65:
+			err := parseLDAPResult(content)
+			if ldapErr, ok := err.(*ldapError); ok && ldapErr.Code == ldapSizeLimitExceeded {
+				err = nil
+			}
+			return entries, err
+		default:
+			return nil, errors.New("unexpected response to search")
+		}
+	}
+}
+
+func (l *ldapConn) roundTrip(op []byte) (tag byte, content []byte, err error) {
+	id, err := l.request(op)
+	if err != nil {
+		return 0, nil, err
+	}
+	return l.response(id)
+}
+
+func (l *ldapConn) request(op []byte) (id int, err error) {
+	l.lastID++
+	_, err = l.conn.Write(berTLV(0x30, berInt(0x02, l.lastID), op))
+	return l.lastID, err
+}
+
+// response reads the operation of the next message, which
+// must answer the request with the given ID.
+func (l *ldapConn) response(id int) (tag byte, content []byte, err error) {
+	tag, message, err := readBER(l.reader)
+	if err != nil {
+		return 0, nil, err
+	} else if tag != 0x30 {
+		return 0, nil, errors.New("malformed LDAP message")
+	}
+	_, idBytes, rest, err := parseBER(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	if berIntValue(idBytes) != id {
+		// Unsolicited notices, such as disconnection
+		// warnings, have ID 0.
+		return 0, nil, errors.New("unexpected LDAP message ID")
+	}
+	tag, content, _, err = parseBER(rest)
+	return tag, content, err
+}
+
+func parseLDAPResult(content []byte) error {
+	_, code, rest, err := parseBER(content)
+	if err != nil {
+		return err
+	}
+	_, _, rest, err = parseBER(rest)
+	if err != nil {
+		return err
+	}
+	_, message, _, err := parseBER(rest)
+	if err != nil {
+		return err
+	}
+	if n := berIntValue(code); n != 0 {
+		return &ldapError{Code: n, Message: string(message)}
+	}
+	return nil
+}
+
+func parseLDAPEntry(content []byte) (*ldapEntry, error) {
+	_, dn, rest, err := parseBER(content)
+	if err != nil {
+		return nil, err
+	}
+	_, attrList, _, err := parseBER(rest)
+	if err != nil {
+		return nil, err
+	}
+	entry := &ldapEntry{DN: string(dn), Attributes: map[string][]string{}}
+	for len(attrList) > 0 {
+		var attr []byte
+		if _, attr, attrList, err = parseBER(attrList); err != nil {
+			return nil, err
+		}
+		_, name, vals, err := parseBER(attr)
+		if err != nil {
+			return nil, err
+		}
+		if _, vals, _, err = parseBER(vals); err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(string(name))
+		for len(vals) > 0 {
+			var val []byte
+			if _, val, vals, err = parseBER(vals); err != nil {
+				return nil, err
+			}
+			entry.Attributes[key] = append(entry.Attributes[key], string(val))
+		}
+	}
+	return entry, nil
+}
+
+// escapeLDAPFilter escapes a value for a filter string, as
+// described in RFC 4515.
+func escapeLDAPFilter(value string) string {
+	var res strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&res, "\\%02x", c)
+		default:
+			res.WriteByte(c)
+		}
+	}
+	return res.String()
+}
+
+// parseLDAPFilter encodes a filter string, supporting the
+// and, or, not, equality, and presence filters.
+func parseLDAPFilter(filter string) ([]byte, error) {
+	res, rest, err := parseLDAPFilterItem(filter)
+	if err != nil {
+		return nil, err
+	} else if rest != "" {
+		return nil, ErrLDAPFilter
+	}
+	return res, nil
+}
+
+func parseLDAPFilterItem(filter string) (res []byte, rest string, err error) {
+	if !strings.HasPrefix(filter, "(") || len(filter) < 2 {
+		return nil, "", ErrLDAPFilter
+	}
+	filter = filter[1:]
+	switch filter[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[filter[0]]
+		rest = filter[1:]
+		var items [][]byte
+		for strings.HasPrefix(rest, "(") {
+			var item []byte
+			if item, rest, err = parseLDAPFilterItem(rest); err != nil {
+				return nil, "", err
+			}
+			items = append(items, item)
+		}
+		if !strings.HasPrefix(rest, ")") || len(items) == 0 ||
+			(tag == 0xa2 && len(items) != 1) {
+			return nil, "", ErrLDAPFilter
+		}
+		return berTLV(tag, items...), rest[1:], nil
+	}
+	end := strings.IndexByte(filter, ')')
+	eq := strings.IndexByte(filter, '=')
+	if end < 0 || eq <= 0 || eq > end {
+		return nil, "", ErrLDAPFilter
+	}
+	attr, value := filter[:eq], filter[eq+1:end]
+	if strings.ContainsAny(attr, "~<>:") {
+		return nil, "", ErrLDAPFilter
+	} else if value == "*" {
+		return berTLV(0x87, []byte(attr)), filter[end+1:], nil
+	} else if strings.Contains(value, "*") {
+		// Substring filters are not supported.
+		return nil, "", ErrLDAPFilter
+	}
+	raw, err := unescapeLDAPFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berTLV(0xa3, berTLV(0x04, []byte(attr)), berTLV(0x04, raw)), filter[end+1:], nil
+}
+
+func unescapeLDAPFilter(value string) ([]byte, error) {
+	var res []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			res = append(res, value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return nil, ErrLDAPFilter
+		}
+		n, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, ErrLDAPFilter
+		}
+		res = append(res, byte(n))
+		i += 2
+	}
+	return res, nil
+}
+
+// berTLV encodes a BER element from its tag and contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var size int
+	for _, c := range contents {
+		size += len(c)
+	}
+	res := []byte{tag}
+	if size < 0x80 {
+		res = append(res, byte(size))
+	} else {
+		var length []byte
+		for n := size; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		res = append(append(res, 0x80|byte(len(length))), length...)
+	}
+	for _, c := range contents {
+		res = append(res, c...)
+	}
+	return res
+}
+
+// berInt encodes a non-negative integer or enumeration.
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berIntValue(b []byte) int {
+	var n int
+	for _, x := range b {
+		n = n<<8 | int(x)
+	}
+	return n
+}
+
+// parseBER splits the first element off of data.
+func parseBER(data []byte) (tag byte, content, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag = data[0]
+	size := int(data[1])
+	data = data[2:]
+	if size&0x80 != 0 {
+		n := size & 0x7f
+		if n == 0 || n > 4 || len(data) < n {
+			return 0, nil, nil, errors.New("unsupported BER length")
+		}
+		size = berIntValue(data[:n])
+		data = data[n:]
+	}
+	if size > len(data) {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, data[:size], data[size:], nil
+}
+
+// readBER reads an element of at most maxLDAPMessage bytes.
+func readBER(r *bufio.Reader) (tag byte, content []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(header[1])
+	if size&0x80 != 0 {
+		n := size & 0x7f
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		length := make([]byte, n)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return 0, nil, err
+		}
+		size = berIntValue(length)
+	}
+	if size > maxLDAPMessage {
+		return 0, nil, errors.New("LDAP message too large")
+	}
+	content = make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return header[0], content, nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+const (
+	// StatusSweepInterval is the time between checks for
+	// rich statuses which expired without being cleared.
+	StatusSweepInterval = time.Minute
+
+	// StaleAccountInterval is the time between purges of
+	// stale accounts.
+	StaleAccountInterval = time.Hour
+
+	// IntegrationSyncInterval is the time between imports
+	// of users' statuses from integrated services.
+	IntegrationSyncInterval = time.Minute
+
+	// ScheduleInterval is the time between checks for
+	// users' schedules changing windows.
+	ScheduleInterval = time.Minute
+)
+
+// RunLeaderTask runs a cluster-wide task each interval
+// while this node leads the cluster, so that exactly one
+// node runs it, until stop is closed.
+//
+// The EventDB's election must be run separately.
+func RunLeaderTask(edb events.EventDB, name string, interval time.Duration, task func() error,
+	stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if !edb.IsLeader() {
+			continue
+		}
+		if err := task(); err != nil {
+			statusdb.LogAt(statusdb.LogWarn, "%s: %v", name, err)
+		}
+	}
+}
+
+// StaleAccountPurger creates a task for RunLeaderTask
+// which deletes the accounts which have been neither used
+// nor changed for maxAge.
+func StaleAccountPurger(edb events.EventDB, maxAge time.Duration) func() error {
+	return func() error {
+		purged, err := edb.PurgeStaleAccounts(maxAge)
+		if purged > 0 {
+			statusdb.LogAt(statusdb.LogInfo, "purged %d stale accounts", purged)
+		}
+		return err
+	}
+}
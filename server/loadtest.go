@@ -0,0 +1,268 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// LoadTestPassword is the password of the simulated users
+// created by a LoadTest.
+const LoadTestPassword = "loadtest-password"
+
+// A LoadTest simulates many clients using an EventDB at
+// once, to measure how the server performs under load.
+//
+// Clients are served by HandleClient over in-memory
+// connections, so the results include the cost of
+// handling messages and routing events, but not of the
+// network or message encoding.
+type LoadTest struct {
+	// Clients is the number of simulated clients.
+	Clients int
+
+	// Duration is the time that each client spends
+	// sending requests after it logs in.
+	Duration time.Duration
+
+	// Interval is the mean time between the requests of
+	// each client. If zero, clients send requests as fast
+	// as they are answered.
+	Interval time.Duration
+
+	// Timeout is the time to wait for each response. If
+	// zero, a minute is used.
+	Timeout time.Duration
+}
+
+// A LoadTestReport summarizes the latencies observed by
+// the clients of a LoadTest, by request type.
+type LoadTestReport struct {
+	Latencies map[string][]time.Duration
+
+	// Errors counts failed requests, including ones which
+	// the server rejected, such as accepting a buddy
+	// request that was never sent.
+	Errors map[string]int
+}
+
+// String formats the report as a table of latency
+// percentiles.
+func (l *LoadTestReport) String() string {
+	var types []string
+	for msgType := range l.Latencies {
+		types = append(types, msgType)
+	}
+	for msgType := range l.Errors {
+		if _, ok := l.Latencies[msgType]; !ok {
+			types = append(types, msgType)
+		}
+	}
+	sort.Strings(types)
+	var res strings.Builder
+	fmt.Fprintf(&res, "%-16s %8s %8s %10s %10s %10s %10s\n", "request", "count",
+		"errors", "p50", "p90", "p99", "max")
+	for _, msgType := range types {
+		latencies := l.Latencies[msgType]
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		fmt.Fprintf(&res, "%-16s %8d %8d %10s %10s %10s %10s\n", msgType, len(latencies),
+			l.Errors[msgType], percentile(latencies, 0.5), percentile(latencies, 0.9),
+			percentile(latencies, 0.99), percentile(latencies, 1))
+	}
+	return res.String()
+}
+
+func (l *LoadTestReport) add(msgType string, latency time.Duration, failed bool) {
+	if failed {
+		l.Errors[msgType]++
+	} else {
+		l.Latencies[msgType] = append(l.Latencies[msgType], latency)
+	}
+}
+
+// percentile finds a percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx].Round(time.Microsecond)
+}
+
+// Run performs the load test against edb.
+//
+// The simulated users are named loadtest-<n>@loadtest.invalid
+// and are created if they do not already exist. Each one
+// logs in, and then repeatedly changes its status or sends,
+// accepts, or removes buddies at random.
+func (l *LoadTest) Run(edb events.EventDB) (*LoadTestReport, error) {
+	emails := make([]string, l.Clients)
+	for i := range emails {
+		emails[i] = "loadtest-" + strconv.Itoa(i) + "@loadtest.invalid"
+		if err := edb.AddUser(emails[i], LoadTestPassword); err != nil &&
+			events.RootError(err) != statusdb.ErrEmailInUse {
+			return nil, err
+		}
+	}
+
+	report := &LoadTestReport{
+		Latencies: map[string][]time.Duration{},
+		Errors:    map[string]int{},
+	}
+	var reportLock sync.Mutex
+	var wg sync.WaitGroup
+	for _, email := range emails {
+		wg.Add(1)
+		go func(email string) {
+			defer wg.Done()
+			clientReport := &LoadTestReport{
+				Latencies: map[string][]time.Duration{},
+				Errors:    map[string]int{},
+			}
+			l.runClient(edb, email, emails, clientReport)
+			reportLock.Lock()
+			defer reportLock.Unlock()
+			for msgType, latencies := range clientReport.Latencies {
+				report.Latencies[msgType] = append(report.Latencies[msgType], latencies...)
+			}
+			for msgType, count := range clientReport.Errors {
+				report.Errors[msgType] += count
+			}
+		}(email)
+	}
+	wg.Wait()
+	return report, nil
+}
+
+func (l *LoadTest) runClient(edb events.EventDB, email string, emails []string,
+	report *LoadTestReport) {
+	serverConn, clientConn := protocol.NewPipe()
+	go HandleClient(serverConn, edb, ClientOptions{})
+	client := newLoadTestClient(clientConn, l.Timeout)
+	defer client.Close()
+
+	if !client.Send(&protocol.LoginMessage{Email: email, Password: LoadTestPassword}, report) {
+		return
+	}
+	deadline := time.Now().Add(l.Duration)
+	for time.Now().Before(deadline) {
+		if l.Interval > 0 {
+			time.Sleep(time.Duration(rand.ExpFloat64() * float64(l.Interval)))
+		}
+		other := emails[rand.Intn(len(emails))]
+		var msg protocol.Message
+		switch rand.Intn(5) {
+		case 0, 1:
+			msg = &protocol.SetStatusMessage{UserStatus: statusdb.UserStatus{
+				Availability: statusdb.Available + statusdb.Availability(rand.Intn(3)),
+				Message:      "load test " + strconv.Itoa(rand.Int()),
+			}}
+		case 2:
+			msg = &protocol.AddBuddyMessage{Email: other}
+		case 3:
+			msg = &protocol.AcceptRequestMessage{Email: other}
+		case 4:
+			msg = &protocol.RemoveBuddyMessage{Email: other}
+		}
+		if !client.Send(msg, report) {
+			return
+		}
+	}
+	client.Send(&protocol.LogoutMessage{}, report)
+}
+
+// A loadTestClient sends requests over a Connection and
+// waits for their responses, ignoring other messages.
+type loadTestClient struct {
+	conn    protocol.Connection
+	timeout time.Duration
+
+	lock    sync.Mutex
+	nextID  int
+	waiting map[string]chan protocol.Message
+}
+
+func newLoadTestClient(conn protocol.Connection, timeout time.Duration) *loadTestClient {
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	res := &loadTestClient{
+		conn:    conn,
+		timeout: timeout,
+		waiting: map[string]chan protocol.Message{},
+	}
+	go res.readLoop()
+	return res
+}
+
+// Send sends a request, records its latency in the report,
+// and returns false if the connection is no longer usable.
+func (l *loadTestClient) Send(msg protocol.Message, report *LoadTestReport) bool {
+	l.lock.Lock()
+	l.nextID++
+	id := strconv.Itoa(l.nextID)
+	resChan := make(chan protocol.Message, 1)
+	l.waiting[id] = resChan
+	l.lock.Unlock()
+
+	msgType := msg.Type()
+	if m, ok := msg.(interface{ SetID(string) }); ok {
+		m.SetID(id)
+	}
+	start := time.Now()
+	if err := l.conn.WriteMessage(msg); err != nil {
+		report.add(msgType, 0, true)
+		return false
+	}
+	if msgType == protocol.MsgTypeLogout {
+		// The server does not answer logouts.
+		return true
+	}
+	select {
+	case res := <-resChan:
+		switch res.(type) {
+		case *protocol.ErrorMessage, *protocol.LoginFailureMessage:
+			report.add(msgType, 0, true)
+			return msgType != protocol.MsgTypeLogin
+		}
+		report.add(msgType, time.Since(start), false)
+		return true
+	case <-time.After(l.timeout):
+		report.add(msgType, 0, true)
+		return false
+	}
+}
+
+func (l *loadTestClient) Close() error {
+	return l.conn.Close()
+}
+
+func (l *loadTestClient) readLoop() {
+	for {
+		msg, err := l.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		id := protocol.RequestID(msg)
+		if id == "" {
+			continue
+		}
+		l.lock.Lock()
+		resChan, ok := l.waiting[id]
+		delete(l.waiting, id)
+		l.lock.Unlock()
+		if ok {
+			resChan <- msg
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/unixpickle/essentials"
+)
+
+// A Catalog maps keys to human-readable strings in one
+// locale.
+//
+// Error codes, such as "ERR_NO_EMAIL", are used as keys
+// for error messages, and ServerNotice keys are used for
+// notices.
+type Catalog map[string]string
+
+var catalogs = struct {
+	lock sync.RWMutex
+	m    map[string]Catalog
+}{m: map[string]Catalog{}}
+
+// RegisterCatalog adds or replaces the catalog for a
+// locale, such as "es" or "pt-BR".
+func RegisterCatalog(locale string, catalog Catalog) {
+	catalogs.lock.Lock()
+	defer catalogs.lock.Unlock()
+	catalogs.m[normalizeLocale(locale)] = catalog
+}
+
+// LoadCatalogs registers a catalog for every file named
+// <locale>.json in a directory.
+func LoadCatalogs(dir string) (err error) {
+	defer essentials.AddCtxTo("load catalogs", &err)
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var catalog Catalog
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return essentials.AddCtx(filepath.Base(path), err)
+		}
+		RegisterCatalog(strings.TrimSuffix(filepath.Base(path), ".json"), catalog)
+	}
+	return nil
+}
+
+// translate looks up a key in the best catalog for the
+// locale, falling back from e.g. "pt-BR" to "pt".
+func translate(locale, key, fallback string) string {
+	if locale == "" || key == "" {
+		return fallback
+	}
+	catalogs.lock.RLock()
+	defer catalogs.lock.RUnlock()
+	locale = normalizeLocale(locale)
+	for {
+		if text, ok := catalogs.m[locale][key]; ok {
+			return text
+		}
+		idx := strings.LastIndex(locale, "-")
+		if idx < 0 {
+			return fallback
+		}
+		locale = locale[:idx]
+	}
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(locale, "_", "-", -1))
+}
+
+// Localize translates the human-readable strings in a
+// message, leaving machine-readable codes intact.
+//
+// Messages are copied rather than modified, since they may
+// be shared between sessions.
+func Localize(locale string, msg protocol.Message) protocol.Message {
+	if locale == "" {
+		return msg
+	}
+	switch msg := msg.(type) {
+	case *protocol.ErrorMessage:
+		return localizeError(locale, msg)
+	case *protocol.LoginFailureMessage:
+		return (*protocol.LoginFailureMessage)(localizeError(locale, (*protocol.ErrorMessage)(msg)))
+	case *protocol.RegisterFailureMessage:
+		return (*protocol.RegisterFailureMessage)(localizeError(locale, (*protocol.ErrorMessage)(msg)))
+	case *protocol.ReauthFailureMessage:
+		return (*protocol.ReauthFailureMessage)(localizeError(locale, (*protocol.ErrorMessage)(msg)))
+	case *protocol.ServerNoticeMessage:
+		res := *msg
+		res.Text = translate(locale, msg.Key, msg.Text)
+		return &res
+	case *protocol.ImportResultMessage:
+		res := *msg
+		res.Results = append([]protocol.ImportResult{}, msg.Results...)
+		for i, result := range res.Results {
+			res.Results[i].Message = translate(locale, string(result.Code), result.Message)
+		}
+		return &res
+	}
+	return msg
+}
+
+func localizeError(locale string, msg *protocol.ErrorMessage) *protocol.ErrorMessage {
+	res := *msg
+	res.Message = translate(locale, string(msg.Code), msg.Message)
+	return &res
+}
+
+// localizedConn localizes every message written to a
+// Connection according to the client's locale.
+type localizedConn struct {
+	protocol.Connection
+	caps *clientCapabilities
+}
+
+func (l *localizedConn) WriteMessage(msg protocol.Message) error {
+	return l.Connection.WriteMessage(Localize(l.caps.Locale(), msg))
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+const rotatedLogTimeFormat = "20060102T150405.000"
+
+// A RotatingLog is an io.Writer which appends to a log file,
+// moving the file aside when it gets too large or too old.
+//
+// Rotated files are named "<Path>.<timestamp>", and are
+// deleted once they exceed the retention limits.
+type RotatingLog struct {
+	Path string
+
+	// MaxSize is the size in bytes at which the file is
+	// rotated. If zero, files are not rotated by size.
+	MaxSize int64
+
+	// Interval is the age at which the file is rotated.
+	// If zero, files are not rotated by age.
+	Interval time.Duration
+
+	// Keep is the number of rotated files to keep.
+	// If zero, the count is not limited.
+	Keep int
+
+	// MaxAge is the time after which rotated files are
+	// deleted. If zero, their age is not limited.
+	MaxAge time.Duration
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Write appends p to the log, first rotating the file if
+// necessary.
+//
+// A single write is never split between files, so files
+// may exceed MaxSize by the size of one write.
+func (r *RotatingLog) Write(p []byte) (n int, err error) {
+	defer essentials.AddCtxTo("write log", &err)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.needsRotation(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one,
+// for example in response to SIGHUP.
+func (r *RotatingLog) Rotate() (err error) {
+	defer essentials.AddCtxTo("rotate log", &err)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	return r.rotate()
+}
+
+// Close closes the current file.
+// A later Write will reopen it.
+func (r *RotatingLog) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingLog) open() error {
+	file, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	if r.size > 0 {
+		// The file may have been started by a previous
+		// process, so its age is measured from its last
+		// write at the latest.
+		r.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (r *RotatingLog) needsRotation(writeSize int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.MaxSize > 0 && r.size+writeSize > r.MaxSize {
+		return true
+	}
+	return r.Interval > 0 && time.Since(r.opened) >= r.Interval
+}
+
+func (r *RotatingLog) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	if r.size > 0 {
+		rotatedPath := r.Path + "." + time.Now().Format(rotatedLogTimeFormat)
+		if err := os.Rename(r.Path, rotatedPath); err != nil {
+			return err
+		}
+	}
+	if err := r.prune(); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// prune deletes rotated files beyond the retention limits.
+func (r *RotatingLog) prune() error {
+	matches, err := filepath.Glob(r.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, r.Path+".")
+		if _, err := time.Parse(rotatedLogTimeFormat, suffix); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	// Timestamps sort lexically, so this is newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	for i, path := range rotated {
+		suffix := strings.TrimPrefix(path, r.Path+".")
+		rotatedAt, _ := time.ParseInLocation(rotatedLogTimeFormat, suffix, time.Local)
+		if (r.Keep > 0 && i >= r.Keep) || (r.MaxAge > 0 && time.Since(rotatedAt) > r.MaxAge) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
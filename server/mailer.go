@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/unixpickle/essentials"
+)
+
+// DefaultSendGridURL is the SendGrid API endpoint for
+// sending mail.
+const DefaultSendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+// An SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+
+	// Templates are the emails to send, or nil for the
+	// defaults.
+	Templates MailTemplates
+}
+
+func (s *SMTPMailer) Send(to string, template events.MailTemplate, data events.MailData) (err error) {
+	defer essentials.AddCtxTo("send mail", &err)
+	subject, body, err := s.Templates.Render(template, data)
+	if err != nil {
+		return err
+	}
+	return sendSMTP(s.Host, s.Port, s.Username, s.Password, s.From, []string{to}, subject, body)
+}
+
+// sendSMTP sends a plain-text email through an SMTP
+// server, authenticating if a username is given.
+func sendSMTP(host string, port int, username, password, from string, to []string,
+	subject, body string) error {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	msg := "From: " + from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+	addr := host + ":" + strconv.Itoa(port)
+	return smtp.SendMail(addr, auth, from, to, []byte(msg))
+}
+
+// An SESMailer sends emails through the Amazon SES API.
+type SESMailer struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// SessionToken is needed for temporary credentials,
+	// such as those of an IAM role.
+	SessionToken string
+
+	From string
+
+	// Endpoint overrides the regional API endpoint, such
+	// as for a VPC endpoint.
+	Endpoint string
+
+	// Templates are the emails to send, or nil for the
+	// defaults.
+	Templates MailTemplates
+}
+
+func (s *SESMailer) Send(to string, template events.MailTemplate, data events.MailData) (err error) {
+	defer essentials.AddCtxTo("send mail with SES", &err)
+	subject, body, err := s.Templates.Render(template, data)
+	if err != nil {
+		return err
+	}
+	content := func(data string) map[string]string {
+		return map[string]string{"Data": data, "Charset": "UTF-8"}
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"FromEmailAddress": s.From,
+		"Destination":      map[string][]string{"ToAddresses": {to}},
+		"Content": map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": content(subject),
+				"Body":    map[string]interface{}{"Text": content(body)},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://email." + s.Region + ".amazonaws.com"
+	}
+	req, err := http.NewRequest("POST", endpoint+"/v2/email/outbound-emails",
+		bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	signAWSRequest(req, payload, s.Region, "ses", s.AccessKeyID, s.SecretAccessKey, time.Now())
+	return doMailRequest(req)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to a
+// request, signing every header which is set.
+func signAWSRequest(req *http.Request, payload []byte, region, service, keyID, secret string,
+	now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+keyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// A SendGridMailer sends emails through the SendGrid API.
+type SendGridMailer struct {
+	APIKey string
+	From   string
+
+	// URL overrides DefaultSendGridURL.
+	URL string
+
+	// Templates are the emails to send, or nil for the
+	// defaults.
+	Templates MailTemplates
+}
+
+func (s *SendGridMailer) Send(to string, template events.MailTemplate,
+	data events.MailData) (err error) {
+	defer essentials.AddCtxTo("send mail with SendGrid", &err)
+	subject, body, err := s.Templates.Render(template, data)
+	if err != nil {
+		return err
+	}
+	address := func(email string) map[string]string {
+		return map[string]string{"email": email}
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"personalizations": []interface{}{
+			map[string]interface{}{"to": []interface{}{address(to)}},
+		},
+		"from":    address(s.From),
+		"subject": subject,
+		"content": []interface{}{
+			map[string]string{"type": "text/plain", "value": body},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	apiURL := s.URL
+	if apiURL == "" {
+		apiURL = DefaultSendGridURL
+	}
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	return doMailRequest(req)
+}
+
+// doMailRequest sends a request to an email API, and
+// includes the start of the response in the error if the
+// request was rejected.
+func doMailRequest(req *http.Request) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status,
+			strings.TrimSpace(string(data)))
+	}
+	return nil
+}
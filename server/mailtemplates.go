@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/unixpickle/essentials"
+)
+
+var ErrMailTemplate = errors.New("email template must start with a Subject line")
+
+// MailTemplates render the emails sent to users, keyed by
+// template name.
+//
+// Each template is a text/template executed with an
+// events.MailData, whose output starts with a line such as
+// "Subject: Verify your email", followed by a blank line
+// and the body.
+type MailTemplates map[events.MailTemplate]*template.Template
+
+var defaultMailTemplates = map[events.MailTemplate]string{
+	events.MailVerify: `Subject: Verify your email address
+
+Welcome! Enter this code in your status app to verify
+{{.Email}}:
+
+    {{.Code}}
+
+If you did not sign up, you can ignore this email.
+`,
+	events.MailResetPassword: `Subject: Reset your password
+
+Someone asked to reset the password for {{.Email}}. To
+choose a new password, enter this code in your status app
+before {{.Expires.Format "Jan 2 15:04 MST"}}:
+
+    {{.Code}}
+
+If it was not you, you can ignore this email; your
+password has not been changed.
+`,
+	events.MailSecurityAlert: `Subject: {{if eq .Alert "password_changed"}}Your password was changed{{else if eq .Alert "account_suspended"}}Your account was suspended{{else if eq .Alert "account_deleted"}}Your account was deleted{{else if eq .Alert "account_merged"}}Your accounts were merged{{else}}Security alert{{end}}
+
+{{if eq .Alert "password_changed"}}The password for {{.Email}} was just changed, and every
+device was logged out. If it was not you, reset your
+password right away.
+{{else if eq .Alert "account_suspended"}}The account {{.Email}} was suspended by the server's
+moderators.
+{{else if eq .Alert "account_deleted"}}The account {{.Email}} was deleted.
+{{else if eq .Alert "account_merged"}}The account {{.Email}} was merged into your other
+account by the server's administrators. Log in with that
+account from now on.
+{{else}}There was a security event on {{.Email}}: {{.Alert}}.
+{{end}}`,
+}
+
+// DefaultMailTemplates creates the built-in templates.
+func DefaultMailTemplates() MailTemplates {
+	res := MailTemplates{}
+	for name, text := range defaultMailTemplates {
+		res[name] = template.Must(template.New(string(name)).Parse(text))
+	}
+	return res
+}
+
+// LoadMailTemplates creates the built-in templates, and
+// replaces them with any files named <template>.txt in a
+// directory.
+func LoadMailTemplates(dir string) (templates MailTemplates, err error) {
+	defer essentials.AddCtxTo("load mail templates", &err)
+	res := DefaultMailTemplates()
+	for name := range res {
+		path := filepath.Join(dir, string(name)+".txt")
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		t, err := template.New(string(name)).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		res[name] = t
+	}
+	return res, nil
+}
+
+// Render executes a template, which is looked up in the
+// defaults if m is nil.
+func (m MailTemplates) Render(name events.MailTemplate, data events.MailData) (subject,
+	body string, err error) {
+	defer essentials.AddCtxTo("render "+string(name)+" email", &err)
+	if m == nil {
+		m = DefaultMailTemplates()
+	}
+	t, ok := m[name]
+	if !ok {
+		return "", "", errors.New("no such template")
+	}
+	var res strings.Builder
+	if err := t.Execute(&res, data); err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(res.String(), "\n\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject: ") ||
+		strings.Contains(parts[0], "\n") {
+		return "", "", ErrMailTemplate
+	}
+	return strings.TrimPrefix(parts[0], "Subject: "), parts[1], nil
+}
@@ -0,0 +1,652 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// MatrixPath is where the WebSocket listener serves the
+	// application service API which the homeserver calls.
+	MatrixPath = "/_matrix/"
+
+	// MatrixRetryDelay is the time to wait before retrying
+	// a request which the homeserver failed.
+	MatrixRetryDelay = 5 * time.Second
+
+	// MaxMatrixQueue is the number of messages which may
+	// wait for the homeserver, after which new messages are
+	// dropped.
+	MaxMatrixQueue = 10000
+
+	DefaultMatrixUserPrefix = "status_"
+	DefaultMatrixBot        = "statusbot"
+
+	maxMatrixBody         = 1 << 20
+	maxMatrixTransactions = 1000
+)
+
+// A MatrixBridge is an events.Relay which lets the users
+// of a Matrix homeserver be buddies with ours, acting as
+// an application service on the homeserver.
+//
+// Matrix users appear to our users as remote users whose
+// addresses are their localparts at the homeserver's
+// server name, such as alice@matrix.example.com for
+// @alice:matrix.example.com. Our users appear in Matrix as
+// puppets, such as @status_bob=40example.com, whose
+// presence mirrors their statuses.
+//
+// A buddy request becomes a direct chat which the puppet
+// creates and invites the Matrix user to, and joining it
+// accepts the request. Likewise, a Matrix user invites a
+// puppet to send a request, which the puppet joins once it
+// is accepted. Leaving the chat removes the buddy. Each
+// chat has an alias in the bridge's namespace naming both
+// users, so the bridge keeps no state of its own.
+type MatrixBridge struct {
+	// URL is the homeserver's client-server API base URL,
+	// and ServerName is its Matrix domain.
+	URL        string
+	ServerName string
+
+	// ASToken authenticates the bridge to the homeserver,
+	// and HSToken authenticates the homeserver to the
+	// bridge, as in the registration file.
+	ASToken string
+	HSToken string
+
+	// UserPrefix begins the localparts of puppets and
+	// aliases, which must be the bridge's exclusive
+	// namespaces. Bot is the localpart of the bridge's own
+	// user, which joins every chat.
+	UserPrefix string
+	Bot        string
+
+	alerter *statusdb.Alerter
+	client  *http.Client
+
+	lock       sync.Mutex
+	queue      []*events.RelayMessage
+	wake       chan struct{}
+	registered map[string]bool
+	presence   map[string]string
+	txns       map[string]bool
+}
+
+// NewMatrixBridge creates a bridge and starts sending
+// messages to the homeserver in the background.
+//
+// The alerter may be nil.
+func NewMatrixBridge(homeserverURL, serverName, asToken, hsToken string,
+	alerter *statusdb.Alerter) *MatrixBridge {
+	m := &MatrixBridge{
+		URL:        strings.TrimRight(homeserverURL, "/"),
+		ServerName: strings.ToLower(serverName),
+		ASToken:    asToken,
+		HSToken:    hsToken,
+		UserPrefix: DefaultMatrixUserPrefix,
+		Bot:        DefaultMatrixBot,
+		alerter:    alerter,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		wake:       make(chan struct{}, 1),
+		registered: map[string]bool{},
+		presence:   map[string]string{},
+		txns:       map[string]bool{},
+	}
+	go m.sendLoop()
+	return m
+}
+
+func (m *MatrixBridge) Home(email string) string {
+	if emailDomain(email) == m.ServerName {
+		return m.ServerName
+	}
+	return ""
+}
+
+func (m *MatrixBridge) Send(domain string, msg *events.RelayMessage) {
+	m.lock.Lock()
+	if len(m.queue) >= MaxMatrixQueue {
+		m.lock.Unlock()
+		m.alerter.Raise(statusdb.AlertFederation, "matrix queue is full; dropping messages")
+		return
+	}
+	m.queue = append(m.queue, msg)
+	m.lock.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Handler serves the application service API, applying
+// the changes which Matrix users make to the EventDB.
+func (m *MatrixBridge) Handler(db statusdb.DB, edb events.EventDB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("access_token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if m.HSToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(m.HSToken)) != 1 {
+			writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN", "invalid hs_token")
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+		switch {
+		case r.Method == "PUT" && strings.HasPrefix(path, "/transactions/"):
+			m.serveTransaction(w, r, edb, strings.TrimPrefix(path, "/transactions/"))
+		case r.Method == "GET" && strings.HasPrefix(path, "/users/"):
+			m.serveUserQuery(w, db, strings.TrimPrefix(path, "/users/"))
+		default:
+			writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "not found")
+		}
+	})
+}
+
+func (m *MatrixBridge) serveTransaction(w http.ResponseWriter, r *http.Request, edb events.EventDB,
+	txnID string) {
+	var txn struct {
+		Events []matrixEvent `json:"events"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxMatrixBody)).Decode(&txn); err != nil {
+		writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	m.lock.Lock()
+	seen := m.txns[txnID]
+	m.lock.Unlock()
+	if !seen {
+		for _, event := range txn.Events {
+			if event.Type == "m.room.member" {
+				m.handleMembership(edb, &event)
+			}
+		}
+		m.lock.Lock()
+		if len(m.txns) >= maxMatrixTransactions {
+			m.txns = map[string]bool{}
+		}
+		m.txns[txnID] = true
+		m.lock.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+// serveUserQuery creates the puppets of our users when the
+// homeserver asks about them.
+func (m *MatrixBridge) serveUserQuery(w http.ResponseWriter, db statusdb.DB, userID string) {
+	email, ok := m.puppetEmail(userID)
+	if ok {
+		info, err := db.GetUserInfo(email)
+		ok = err == nil && !info.Remote
+	}
+	if !ok || m.register(userID, email) != nil {
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "no such user")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+type matrixEvent struct {
+	Type     string `json:"type"`
+	RoomID   string `json:"room_id"`
+	Sender   string `json:"sender"`
+	StateKey string `json:"state_key"`
+	Content  struct {
+		Membership string `json:"membership"`
+	} `json:"content"`
+	Unsigned struct {
+		PrevContent struct {
+			Membership string `json:"membership"`
+		} `json:"prev_content"`
+	} `json:"unsigned"`
+}
+
+// handleMembership turns a Matrix user's membership change
+// in a chat with a puppet into a relayed change.
+func (m *MatrixBridge) handleMembership(edb events.EventDB, event *matrixEvent) {
+	from, ok := m.matrixEmail(event.Sender)
+	if !ok {
+		return
+	}
+	var msg *events.RelayMessage
+	if to, ok := m.puppetEmail(event.StateKey); ok {
+		// The Matrix user invited or removed a puppet.
+		switch event.Content.Membership {
+		case "invite":
+			if err := m.setAlias(event.RoomID, to, event.Sender); err != nil {
+				m.alerter.Raise(statusdb.AlertFederation, "matrix: "+err.Error())
+				return
+			}
+			msg = &events.RelayMessage{Type: events.RelayRequest, From: from, To: to}
+		case "leave", "ban":
+			msg = m.departure(event, from, to)
+		}
+	} else if event.StateKey == event.Sender {
+		// The Matrix user answered a puppet's invite or left
+		// a chat.
+		to, ok := m.roomPuppet(event.RoomID)
+		if !ok {
+			return
+		}
+		switch event.Content.Membership {
+		case "join":
+			if event.Unsigned.PrevContent.Membership == "invite" {
+				msg = &events.RelayMessage{Type: events.RelayAccept, From: from, To: to}
+			}
+		case "leave":
+			msg = m.departure(event, from, to)
+		}
+	}
+	if msg != nil {
+		if err := edb.ApplyRelay(msg); err != nil {
+			statusdb.LogAt(statusdb.LogWarn, "matrix: apply %s from %s: %v", msg.Type, from, err)
+		}
+	}
+}
+
+// departure interprets the end of a membership, which
+// cancels or declines a request which was pending, and
+// otherwise removes a buddy.
+func (m *MatrixBridge) departure(event *matrixEvent, from, to string) *events.RelayMessage {
+	if event.Unsigned.PrevContent.Membership == "invite" {
+		if event.StateKey == event.Sender {
+			return &events.RelayMessage{Type: events.RelayDecline, From: from, To: to}
+		}
+		return &events.RelayMessage{Type: events.RelayCancel, From: from, To: to}
+	}
+	return &events.RelayMessage{Type: events.RelayRemove, From: from, To: to}
+}
+
+func (m *MatrixBridge) sendLoop() {
+	for range m.wake {
+		for {
+			m.lock.Lock()
+			if len(m.queue) == 0 {
+				m.lock.Unlock()
+				break
+			}
+			msg := m.queue[0]
+			m.lock.Unlock()
+
+			if err := m.deliver(msg); err != nil {
+				m.alerter.Raise(statusdb.AlertFederation, "matrix: "+err.Error())
+				if retryMatrix(err) {
+					time.Sleep(MatrixRetryDelay)
+					continue
+				}
+			}
+
+			m.lock.Lock()
+			essentials.OrderedDelete(&m.queue, 0)
+			m.lock.Unlock()
+		}
+	}
+}
+
+// deliver makes the Matrix side of a change by one of our
+// users.
+func (m *MatrixBridge) deliver(msg *events.RelayMessage) (err error) {
+	defer essentials.AddCtxTo("relay "+string(msg.Type)+" to "+msg.To, &err)
+	puppet := m.puppetID(msg.From)
+	user, ok := m.matrixID(msg.To)
+	if !ok {
+		return nil
+	}
+	if err := m.register(puppet, msg.From); err != nil {
+		return err
+	}
+	if msg.Type == events.RelayStatus {
+		return m.setPresence(puppet, msg.Status)
+	}
+	room, err := m.resolveAlias(m.alias(msg.From, user))
+	if err != nil {
+		return err
+	}
+	switch msg.Type {
+	case events.RelayRequest:
+		if room == "" {
+			room, err = m.createRoom(puppet, msg.From, user)
+		} else {
+			err = m.call("POST", "/rooms/"+url.PathEscape(room)+"/invite", puppet,
+				map[string]string{"user_id": user}, nil)
+		}
+		if err != nil {
+			return err
+		}
+		text := msg.From + " wants to be your buddy. Join this chat to accept."
+		if msg.Greeting != "" {
+			text += "\n\n" + msg.Greeting
+		}
+		return m.call("PUT", "/rooms/"+url.PathEscape(room)+"/send/m.room.message/"+
+			events.NewRandomID(), puppet, map[string]string{"msgtype": "m.notice", "body": text}, nil)
+	case events.RelayAccept:
+		if room == "" {
+			_, err = m.createRoom(puppet, msg.From, user)
+			return err
+		}
+		if err := m.call("POST", "/join/"+url.PathEscape(room), puppet, struct{}{}, nil); err != nil {
+			return err
+		}
+		return m.addBot(room, puppet)
+	case events.RelayDecline, events.RelayCancel, events.RelayRemove, events.RelayBlock:
+		if room == "" {
+			return nil
+		}
+		err := m.call("POST", "/rooms/"+url.PathEscape(room)+"/leave", puppet, struct{}{}, nil)
+		if err != nil && !isMatrixError(err, "M_FORBIDDEN") {
+			return err
+		}
+		err = m.call("DELETE", "/directory/room/"+url.PathEscape(m.alias(msg.From, user)), "", nil, nil)
+		if isMatrixError(err, "M_NOT_FOUND") {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// setPresence maps a status to the puppet's presence,
+// unless it is already set.
+func (m *MatrixBridge) setPresence(puppet string, status *statusdb.UserStatus) error {
+	if status == nil {
+		return nil
+	}
+	body := map[string]string{"presence": "offline", "status_msg": status.Message}
+	switch status.Availability {
+	case statusdb.Available:
+		body["presence"] = "online"
+	case statusdb.Away, statusdb.DoNotDisturb:
+		body["presence"] = "unavailable"
+	}
+	key := body["presence"] + "\n" + body["status_msg"]
+	m.lock.Lock()
+	unchanged := m.presence[puppet] == key
+	m.lock.Unlock()
+	if unchanged {
+		return nil
+	}
+	err := m.call("PUT", "/presence/"+url.PathEscape(puppet)+"/status", puppet, body, nil)
+	if err == nil {
+		m.lock.Lock()
+		m.presence[puppet] = key
+		m.lock.Unlock()
+	}
+	return err
+}
+
+// createRoom creates a direct chat between a puppet and a
+// Matrix user, with the alias naming them both.
+func (m *MatrixBridge) createRoom(puppet, email, user string) (string, error) {
+	alias := m.alias(email, user)
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	err := m.call("POST", "/createRoom", puppet, map[string]interface{}{
+		"preset":          "trusted_private_chat",
+		"is_direct":       true,
+		"invite":          []string{user},
+		"room_alias_name": strings.TrimSuffix(strings.TrimPrefix(alias, "#"), ":"+m.ServerName),
+		"name":            email,
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.RoomID, m.addBot(res.RoomID, puppet)
+}
+
+// addBot brings the bridge's own user into a chat, so that
+// it can tell which puppet is there.
+func (m *MatrixBridge) addBot(room, puppet string) error {
+	bot := "@" + m.Bot + ":" + m.ServerName
+	err := m.call("POST", "/rooms/"+url.PathEscape(room)+"/invite", puppet,
+		map[string]string{"user_id": bot}, nil)
+	if err != nil && !isMatrixError(err, "M_FORBIDDEN") {
+		// M_FORBIDDEN means that the bot is already there.
+		return err
+	}
+	return m.call("POST", "/join/"+url.PathEscape(room), bot, struct{}{}, nil)
+}
+
+// roomPuppet finds the puppet in a chat, by the email of
+// its user.
+func (m *MatrixBridge) roomPuppet(room string) (string, bool) {
+	var res struct {
+		Joined map[string]interface{} `json:"joined"`
+	}
+	bot := "@" + m.Bot + ":" + m.ServerName
+	if err := m.call("GET", "/rooms/"+url.PathEscape(room)+"/joined_members", bot, nil, &res); err != nil {
+		return "", false
+	}
+	for member := range res.Joined {
+		if email, ok := m.puppetEmail(member); ok {
+			return email, true
+		}
+	}
+	return "", false
+}
+
+func (m *MatrixBridge) setAlias(room, email, user string) error {
+	path := "/directory/room/" + url.PathEscape(m.alias(email, user))
+	if err := m.call("DELETE", path, "", nil, nil); err != nil && !isMatrixError(err, "M_NOT_FOUND") {
+		return err
+	}
+	return m.call("PUT", path, "", map[string]string{"room_id": room}, nil)
+}
+
+// resolveAlias gets the room of an alias, or "" if there
+// is none.
+func (m *MatrixBridge) resolveAlias(alias string) (string, error) {
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	err := m.call("GET", "/directory/room/"+url.PathEscape(alias), "", nil, &res)
+	if isMatrixError(err, "M_NOT_FOUND") {
+		return "", nil
+	}
+	return res.RoomID, err
+}
+
+// register creates a puppet, if it has not been created
+// since the bridge started, and names it after its user.
+func (m *MatrixBridge) register(puppet, email string) error {
+	m.lock.Lock()
+	done := m.registered[puppet]
+	m.lock.Unlock()
+	if done {
+		return nil
+	}
+	localpart := strings.TrimPrefix(strings.TrimSuffix(puppet, ":"+m.ServerName), "@")
+	err := m.call("POST", "/register", "", map[string]string{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}, nil)
+	if err != nil && !isMatrixError(err, "M_USER_IN_USE") {
+		return err
+	}
+	err = m.call("PUT", "/profile/"+url.PathEscape(puppet)+"/displayname", puppet,
+		map[string]string{"displayname": email}, nil)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.registered[puppet] = true
+	m.lock.Unlock()
+	return nil
+}
+
+// call makes a client-server API request as the bridge,
+// or as one of its users if asUser is non-empty.
+func (m *MatrixBridge) call(method, path, asUser string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	rawURL := m.URL + "/_matrix/client/v3" + path
+	if asUser != "" {
+		rawURL += "?user_id=" + url.QueryEscape(asUser)
+	}
+	req, err := http.NewRequest(method, rawURL, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.ASToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMatrixBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		res := &matrixError{Status: resp.StatusCode}
+		json.Unmarshal(data, res)
+		return res
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// A matrixError is an error response from the homeserver.
+type matrixError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (m *matrixError) Error() string {
+	return fmt.Sprintf("homeserver error %d: %s: %s", m.Status, m.Code, m.Message)
+}
+
+func isMatrixError(err error, code string) bool {
+	matrixErr, ok := events.RootError(err).(*matrixError)
+	return ok && matrixErr.Code == code
+}
+
+// retryMatrix checks if a failure may be temporary, such
+// as a network error or an overloaded homeserver.
+func retryMatrix(err error) bool {
+	matrixErr, ok := events.RootError(err).(*matrixError)
+	return !ok || matrixErr.Status >= 500 || matrixErr.Status == http.StatusTooManyRequests
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&matrixError{Code: code, Message: message})
+}
+
+// puppetID gets the Matrix user of one of our users.
+func (m *MatrixBridge) puppetID(email string) string {
+	return "@" + m.UserPrefix + escapeMatrix(email) + ":" + m.ServerName
+}
+
+// puppetEmail gets the email of a puppet's user.
+func (m *MatrixBridge) puppetEmail(userID string) (string, bool) {
+	suffix := ":" + m.ServerName
+	if !strings.HasPrefix(userID, "@"+m.UserPrefix) || !strings.HasSuffix(userID, suffix) {
+		return "", false
+	}
+	email, ok := unescapeMatrix(userID[1+len(m.UserPrefix) : len(userID)-len(suffix)])
+	return email, ok && strings.Contains(email, "@")
+}
+
+// matrixID gets the Matrix user of one of the homeserver's
+// users, given their email on our server.
+func (m *MatrixBridge) matrixID(email string) (string, bool) {
+	idx := strings.LastIndex(email, "@")
+	if idx < 0 {
+		return "", false
+	}
+	localpart := strings.ToLower(email[:idx])
+	if localpart == "" {
+		return "", false
+	}
+	for _, c := range localpart {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && !strings.ContainsRune("._=-/", c) {
+			return "", false
+		}
+	}
+	return "@" + localpart + ":" + m.ServerName, true
+}
+
+// matrixEmail gets our email for one of the homeserver's
+// users, excluding the bridge's own users.
+func (m *MatrixBridge) matrixEmail(userID string) (string, bool) {
+	suffix := ":" + m.ServerName
+	if !strings.HasPrefix(userID, "@") || !strings.HasSuffix(userID, suffix) ||
+		strings.HasPrefix(userID, "@"+m.UserPrefix) || userID == "@"+m.Bot+suffix {
+		return "", false
+	}
+	return userID[1:len(userID)-len(suffix)] + "@" + m.ServerName, true
+}
+
+// alias names the chat between one of our users and a
+// Matrix user.
+func (m *MatrixBridge) alias(email, user string) string {
+	localpart := strings.TrimSuffix(strings.TrimPrefix(user, "@"), ":"+m.ServerName)
+	return "#" + m.UserPrefix + escapeMatrix(email) + "_" + escapeMatrix(localpart) + ":" +
+		m.ServerName
+}
+
+// escapeMatrix lowercases s and escapes the bytes which
+// Matrix localparts may not contain, as well as "_" and
+// "=", as "=" and two hex digits.
+func escapeMatrix(s string) string {
+	var res strings.Builder
+	for _, b := range []byte(strings.ToLower(s)) {
+		if (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '.' || b == '-' {
+			res.WriteByte(b)
+		} else {
+			fmt.Fprintf(&res, "=%02x", b)
+		}
+	}
+	return res.String()
+}
+
+func unescapeMatrix(s string) (string, bool) {
+	var res []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			res = append(res, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", false
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", false
+		}
+		res = append(res, b...)
+		i += 2
+	}
+	return string(res), true
+}
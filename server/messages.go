@@ -0,0 +1,161 @@
+package server
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// eventMessages converts an event into the messages that
+// should be pushed to the client, taking into account the
+// extensions it supports.
+func eventMessages(event *events.Event, caps *clientCapabilities) []protocol.Message {
+	switch event.Type {
+	case events.EventFullState:
+		var res []protocol.Message
+		if caps.SupportsExtension(protocol.ExtPagedState) {
+			res = newFullStateMessages(event)
+		} else {
+			res = []protocol.Message{newFullStateMessage(event)}
+		}
+		for _, priority := range event.Priority {
+			res = append(res, eventMessages(priority, caps)...)
+		}
+		return res
+	case events.EventServerNotice:
+		return []protocol.Message{&protocol.ServerNoticeMessage{ServerNotice: *event.Notice}}
+	case events.EventRequestSent:
+		return []protocol.Message{&protocol.RequestSentMessage{Email: event.Email}}
+	case events.EventRequestReceived:
+		return []protocol.Message{&protocol.RequestReceivedMessage{Email: event.Email, Greeting: event.Greeting}}
+	case events.EventAcceptSent:
+		return []protocol.Message{&protocol.AcceptSentMessage{Email: event.Email, Status: event.Status}}
+	case events.EventRequestAccepted:
+		return []protocol.Message{&protocol.RequestAcceptedMessage{Email: event.Email, Status: event.Status}}
+	case events.EventBuddyRemoved:
+		return []protocol.Message{&protocol.BuddyRemovedMessage{Email: event.Email}}
+	case events.EventSyncError:
+		return []protocol.Message{&protocol.SyncErrorMessage{Message: event.ErrorMessage}}
+	case events.EventRequestDeclined:
+		return []protocol.Message{&protocol.RequestDeclinedMessage{Email: event.Email}}
+	case events.EventRequestCanceled:
+		return []protocol.Message{&protocol.RequestCanceledMessage{Email: event.Email}}
+	case events.EventStatusChanged:
+		return []protocol.Message{&protocol.StatusChangedMessage{Email: event.Email, Status: event.Status}}
+	case events.EventUserBlocked:
+		return []protocol.Message{&protocol.UserBlockedMessage{Email: event.Email}}
+	case events.EventUserUnblocked:
+		return []protocol.Message{&protocol.UserUnblockedMessage{Email: event.Email}}
+	case events.EventAliasChanged:
+		return []protocol.Message{&protocol.AliasChangedMessage{Email: event.Email, Alias: event.Alias}}
+	case events.EventMissedEvents:
+		return []protocol.Message{&protocol.MissedEventsMessage{Events: event.Missed}}
+	case events.EventProfileChanged:
+		return []protocol.Message{&protocol.ProfileChangedMessage{Email: event.Email, Profile: event.Profile}}
+	case events.EventSecurityAlert:
+		return []protocol.Message{&protocol.SecurityAlertMessage{Alert: event.Alert}}
+	case events.EventAnnouncements:
+		return []protocol.Message{&protocol.AnnouncementsMessage{Announcements: event.Announcements}}
+	case events.EventReconnect:
+		return []protocol.Message{&protocol.ReconnectMessage{}}
+	case events.EventIntentionalDisconnect:
+		var res []protocol.Message
+		if event.Alert != "" {
+			res = append(res, &protocol.SecurityAlertMessage{Alert: event.Alert})
+		}
+		return append(res, &protocol.ForcedLogoutMessage{})
+	default:
+		// TODO: turn other events into messages.
+		return nil
+	}
+}
+
+// newSyncDeltaMessage creates a SyncDeltaMessage from a
+// sync-delta or full-state event.
+func newSyncDeltaMessage(id protocol.MessageID, e *events.Event) *protocol.SyncDeltaMessage {
+	res := &protocol.SyncDeltaMessage{MessageID: id, ServerTime: protocol.UnixMillis(e.Time)}
+	if e.Type == events.EventFullState {
+		res.Full = newFullStateMessage(e)
+		return res
+	}
+	status := e.UserInfo.LatestStatus.Expire(time.Now())
+	res.Status = &status
+	res.Announcements = e.Announcements
+	for i, email := range e.Buddies {
+		res.Buddies = append(res.Buddies, protocol.BuddyState{
+			Email:   email,
+			Alias:   e.UserInfo.Aliases[email],
+			Status:  e.BuddyStatuses[i],
+			Profile: e.BuddyProfiles[i],
+		})
+	}
+	return res
+}
+
+// newFullStateMessages splits a full-state event into a
+// FullStateBeginMessage, chunks, and a FullStateEndMessage.
+func newFullStateMessages(e *events.Event) []protocol.Message {
+	state := newFullStateMessage(e)
+	buddies := state.Buddies
+	state.Buddies = []protocol.BuddyState{}
+
+	begin := &protocol.FullStateBeginMessage{State: state, BuddyCount: len(buddies)}
+	res := []protocol.Message{begin}
+	for i := 0; i < len(buddies); i += protocol.FullStateChunkSize {
+		chunk := buddies[i:essentials.MinInt(i+protocol.FullStateChunkSize, len(buddies))]
+		res = append(res, &protocol.FullStateChunkMessage{Index: len(res) - 1, Buddies: chunk})
+	}
+	begin.ChunkCount = len(res) - 1
+	return append(res, &protocol.FullStateEndMessage{})
+}
+
+// newFullStateMessage creates a FullStateMessage from an
+// EventFullState event.
+func newFullStateMessage(e *events.Event) *protocol.FullStateMessage {
+	res := &protocol.FullStateMessage{
+		ServerTime:       protocol.UnixMillis(e.Time),
+		Status:           e.UserInfo.LatestStatus.Expire(time.Now()),
+		Profile:          e.UserInfo.Profile,
+		Buddies:          []protocol.BuddyState{},
+		IncomingRequests: append([]string{}, e.UserInfo.IncomingRequests...),
+		OutgoingRequests: append([]string{}, e.UserInfo.OutgoingRequests...),
+		Greetings:        e.UserInfo.Greetings,
+		Blocked:          append([]string{}, e.UserInfo.Blocked...),
+
+		DNDSuppressEvents:  e.UserInfo.DNDSuppressEvents,
+		AwayNote:           e.UserInfo.AwayNote,
+		TimeZone:           e.UserInfo.TimeZone,
+		LastSeenVisibility: e.UserInfo.Privacy.LastSeen,
+		Privacy:            e.UserInfo.Privacy,
+		PublicPresence:     e.UserInfo.PublicPresence,
+		Discoverable:       e.UserInfo.Discoverable,
+		CustomStates:       append([]statusdb.CustomState{}, e.UserInfo.CustomStates...),
+		Schedule:           e.UserInfo.Schedule,
+		Announcements:      e.Announcements,
+	}
+	for i, email := range e.UserInfo.Buddies {
+		res.Buddies = append(res.Buddies, protocol.BuddyState{
+			Email:   email,
+			Alias:   e.UserInfo.Aliases[email],
+			Status:  e.BuddyStatuses[i],
+			Profile: e.BuddyProfiles[i],
+		})
+	}
+	return res
+}
+
+// newErrorMessage creates an ErrorMessage describing the
+// error in response to the identified client message.
+func newErrorMessage(id protocol.MessageID, err error) *protocol.ErrorMessage {
+	code, message := events.DescribeError(err)
+	res := &protocol.ErrorMessage{MessageID: id, Code: code, Message: message}
+	if validationErr, ok := events.RootError(err).(*statusdb.ValidationError); ok {
+		res.Field = validationErr.Field
+	} else if fieldsErr, ok := events.RootError(err).(*protocol.UnknownFieldsError); ok {
+		res.Fields = fieldsErr.Fields
+	}
+	return res
+}
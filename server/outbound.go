@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// MaxOutboundQueue is the number of messages which may wait
+// to be written to an authenticated client before whatever
+// is sending them has to wait as well.
+//
+// Events which cannot be forwarded in the meantime pile up
+// in the session's buffer, which is replaced with a full
+// state if it overflows.
+const MaxOutboundQueue = 64
+
+// OutboundFlushTimeout is how long closing a queue waits
+// for its remaining messages to be written before closing
+// the connection, in case the client has stopped reading.
+const OutboundFlushTimeout = 5 * time.Second
+
+var errOutboundStopped = errors.New("outbound queue stopped")
+
+// An outboundQueue writes messages to a connection from its
+// own Goroutine, so that a client which is slow to read its
+// messages does not hold up the Goroutine reading its
+// commands until the queue is full.
+type outboundQueue struct {
+	conn     protocol.Connection
+	messages chan protocol.Message
+	done     chan struct{}
+
+	// err is set by the writer before done is closed.
+	err error
+}
+
+// newOutboundQueue creates a queue and starts its writer.
+func newOutboundQueue(conn protocol.Connection) *outboundQueue {
+	q := &outboundQueue{
+		conn:     conn,
+		messages: make(chan protocol.Message, MaxOutboundQueue),
+		done:     make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Send queues a message, waiting while the queue is full.
+//
+// It fails if the writer has stopped, or if stopChan is
+// closed while waiting.
+func (q *outboundQueue) Send(msg protocol.Message, stopChan <-chan struct{}) error {
+	select {
+	case q.messages <- msg:
+		return nil
+	case <-q.done:
+		return q.err
+	case <-stopChan:
+		return errOutboundStopped
+	}
+}
+
+// TrySend queues a message unless the queue is full, and
+// reports whether it did. Unlike Send, it never waits for
+// a client which is slow to read.
+func (q *outboundQueue) TrySend(msg protocol.Message) bool {
+	select {
+	case q.messages <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseConn queues the closing of the connection after the
+// messages which are already queued.
+func (q *outboundQueue) CloseConn(stopChan <-chan struct{}) {
+	q.Send(nil, stopChan)
+}
+
+// Close writes the remaining messages and stops the writer.
+// If they are not written within OutboundFlushTimeout, the
+// connection is closed so that the writer stops waiting.
+//
+// Nothing may be sent once Close has been called.
+func (q *outboundQueue) Close() {
+	close(q.messages)
+	timer := time.NewTimer(OutboundFlushTimeout)
+	defer timer.Stop()
+	select {
+	case <-q.done:
+	case <-timer.C:
+		q.conn.Close()
+		<-q.done
+	}
+}
+
+func (q *outboundQueue) run() {
+	defer close(q.done)
+	defer recoverClientPanic("write messages")
+
+	// If writing fails or panics, the connection is closed
+	// so that reading stops as well.
+	q.err = errOutboundStopped
+	defer func() {
+		if q.err != nil {
+			q.conn.Close()
+		}
+	}()
+
+	for msg := range q.messages {
+		if msg == nil {
+			return
+		}
+		if err := q.conn.WriteMessage(msg); err != nil {
+			q.err = err
+			return
+		}
+	}
+	q.err = nil
+}
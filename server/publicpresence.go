@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PickledCode/status-server/events"
+)
+
+// PublicPresencePath is where the WebSocket listener
+// serves PublicPresenceHandler.
+const PublicPresencePath = "/presence/"
+
+// PublicPresenceHandler serves the availability of users
+// who have enabled public presence, without requiring
+// authentication.
+//
+// A GET request for PublicPresencePath followed by an
+// email returns the current status as JSON. If the client
+// accepts text/event-stream, updates are streamed as
+// server-sent events until the client goes away.
+func PublicPresenceHandler(db events.EventDB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		email := strings.Trim(strings.TrimPrefix(r.URL.Path, PublicPresencePath), "/")
+		statuses, cancel, err := db.WatchPublicStatus(email)
+		if err != nil {
+			// Private and unknown users are indistinguishable.
+			http.NotFound(w, r)
+			return
+		}
+		defer cancel()
+
+		if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(<-statuses)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case status, ok := <-statuses:
+				if !ok {
+					return
+				}
+				data, _ := json.Marshal(status)
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// RedactedSecret replaces passwords and other secrets in
+// recordings.
+//
+// When a recording is replayed, the users who log in are
+// given this password.
+const RedactedSecret = "[redacted]"
+
+// Recording directions.
+const (
+	RecordedIn  = "in"
+	RecordedOut = "out"
+)
+
+// A RecordedMessage is one message in a recording.
+type RecordedMessage struct {
+	Time time.Time `json:"time"`
+
+	// Direction is RecordedIn for messages from the client
+	// and RecordedOut for messages from the server.
+	Direction string          `json:"direction"`
+	Type      string          `json:"type"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// redactedFields are the JSON fields of messages which are
+// replaced with RedactedSecret, by direction.
+var redactedFields = map[string]map[string]bool{
+	RecordedIn: {
+		"password":     true,
+		"old_password": true,
+		"new_password": true,
+		"code":         true,
+		"api_key":      true,
+		"token":        true,
+
+		// Push subscriptions carry the browser's keys, and
+		// endpoints which act as bearer URLs.
+		"auth":     true,
+		"p256dh":   true,
+		"endpoint": true,
+	},
+	RecordedOut: {
+		"secret":         true,
+		"recovery_codes": true,
+		"api_key":        true,
+	},
+}
+
+// NewRecordedMessage encodes a message for a recording,
+// redacting its secrets.
+//
+// A compressed message is recorded as the message which it
+// wraps, so that the secrets inside it are redacted too.
+func NewRecordedMessage(direction string, msg protocol.Message) (*RecordedMessage, error) {
+	if compressed, ok := msg.(*protocol.CompressedMessage); ok {
+		inner, err := compressed.Decompress()
+		if err != nil {
+			return nil, err
+		}
+		msg = inner
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var obj interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	redactSecrets(obj, redactedFields[direction])
+	data, err = json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordedMessage{
+		Time:      time.Now(),
+		Direction: direction,
+		Type:      msg.Type(),
+		Message:   data,
+	}, nil
+}
+
+// redactSecrets replaces fields of a decoded JSON value,
+// including those of nested objects such as the messages
+// in a batch.
+func redactSecrets(obj interface{}, fields map[string]bool) {
+	switch obj := obj.(type) {
+	case map[string]interface{}:
+		for key, val := range obj {
+			if fields[key] {
+				obj[key] = RedactedSecret
+			} else {
+				redactSecrets(val, fields)
+			}
+		}
+	case []interface{}:
+		for _, val := range obj {
+			redactSecrets(val, fields)
+		}
+	}
+}
+
+// A SessionRecorder records the messages exchanged with
+// selected users to files, one per connection, as lines of
+// JSON-encoded RecordedMessages.
+type SessionRecorder struct {
+	// Dir is the directory for recordings.
+	Dir string
+
+	// Emails lists the users to record.
+	Emails []string
+}
+
+// Wrap creates a Connection which records messages to a
+// file once the client logs in or registers as one of the
+// selected users.
+//
+// Messages from before then are recorded as well.
+func (s *SessionRecorder) Wrap(conn protocol.Connection) protocol.Connection {
+	return &recordingConn{Connection: conn, recorder: s}
+}
+
+func (s *SessionRecorder) selected(email string) bool {
+	for _, e := range s.Emails {
+		if statusdb.EmailsEquivalent(e, email) {
+			return true
+		}
+	}
+	return false
+}
+
+type recordingConn struct {
+	protocol.Connection
+	recorder *SessionRecorder
+
+	lock    sync.Mutex
+	done    bool
+	pending []*RecordedMessage
+	file    *os.File
+}
+
+func (r *recordingConn) ReadMessage() (protocol.Message, error) {
+	msg, err := r.Connection.ReadMessage()
+	if err == nil {
+		r.record(RecordedIn, msg)
+	}
+	return msg, err
+}
+
+func (r *recordingConn) WriteMessage(msg protocol.Message) error {
+	r.record(RecordedOut, msg)
+	return r.Connection.WriteMessage(msg)
+}
+
+func (r *recordingConn) Close() error {
+	r.lock.Lock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	r.done = true
+	r.lock.Unlock()
+	return r.Connection.Close()
+}
+
+// RemoteAddr forwards the address of the underlying
+// connection, if it has one.
+func (r *recordingConn) RemoteAddr() string {
+	if remote, ok := r.Connection.(protocol.RemoteConnection); ok {
+		return remote.RemoteAddr()
+	}
+	return ""
+}
+
+func (r *recordingConn) record(direction string, msg protocol.Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.done {
+		return
+	}
+	recorded, err := NewRecordedMessage(direction, msg)
+	if err != nil {
+		return
+	}
+	if r.file == nil {
+		r.pending = append(r.pending, recorded)
+		var email string
+		switch msg := msg.(type) {
+		case *protocol.LoginMessage:
+			email = msg.Email
+		case *protocol.RegisterMessage:
+			email = msg.Email
+		default:
+			return
+		}
+		if !r.recorder.selected(email) {
+			r.done = true
+			r.pending = nil
+			return
+		}
+		name := fmt.Sprintf("%s-%s.jsonl", time.Now().Format("20060102T150405"), events.NewRandomID())
+		r.file, err = os.Create(filepath.Join(r.recorder.Dir, name))
+		if err != nil {
+			r.done = true
+			r.pending = nil
+			return
+		}
+		for _, m := range r.pending {
+			r.write(m)
+		}
+		r.pending = nil
+		return
+	}
+	r.write(recorded)
+}
+
+func (r *recordingConn) write(m *RecordedMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if _, err := r.file.Write(append(data, '\n')); err != nil {
+		r.file.Close()
+		r.file = nil
+		r.done = true
+	}
+}
+
+// ReadRecording reads a recording created by a
+// SessionRecorder.
+func ReadRecording(r io.Reader) (res []*RecordedMessage, err error) {
+	defer essentials.AddCtxTo("read recording", &err)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var m RecordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, err
+		}
+		res = append(res, &m)
+	}
+	return res, scanner.Err()
+}
+
+// ReplayRecording feeds the client messages of a recording
+// through HandleClient, and returns every message that the
+// server sends back.
+//
+// Users who log in are created in the DB with the password
+// RedactedSecret if they do not exist. Users who already
+// exist must have that password for their logins to be
+// replayed.
+//
+// Messages are sent with their original delays divided by
+// speed, or without delay if speed is zero. The replay
+// ends once the server has been silent for wait after the
+// last message.
+func ReplayRecording(recording []*RecordedMessage, edb events.EventDB, speed float64,
+	wait time.Duration) (res []*RecordedMessage, err error) {
+	defer essentials.AddCtxTo("replay recording", &err)
+	var incoming []protocol.Message
+	var times []time.Time
+	for _, m := range recording {
+		if m.Direction != RecordedIn {
+			continue
+		}
+		msg, err := protocol.DecodeMessage(m.Type, m.Message)
+		if err != nil {
+			return nil, err
+		}
+		if login, ok := msg.(*protocol.LoginMessage); ok {
+			err := edb.AddUser(login.Email, RedactedSecret)
+			if err != nil && events.RootError(err) != statusdb.ErrEmailInUse {
+				return nil, err
+			}
+		}
+		incoming = append(incoming, msg)
+		times = append(times, m.Time)
+	}
+
+	serverConn, clientConn := protocol.NewPipe()
+	go HandleClient(serverConn, edb, ClientOptions{})
+
+	var resLock sync.Mutex
+	activity := make(chan struct{}, 1)
+	readerDone := make(chan struct{})
+	record := func(direction string, msg protocol.Message) {
+		recorded, err := NewRecordedMessage(direction, msg)
+		if err != nil {
+			// Every message was encoded by the server or
+			// decoded from JSON, so this should not happen.
+			return
+		}
+		resLock.Lock()
+		res = append(res, recorded)
+		resLock.Unlock()
+	}
+	go func() {
+		defer close(readerDone)
+		for {
+			msg, err := clientConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			record(RecordedOut, msg)
+			select {
+			case activity <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	for i, msg := range incoming {
+		if i > 0 && speed > 0 {
+			time.Sleep(time.Duration(float64(times[i].Sub(times[i-1])) / speed))
+		}
+		record(RecordedIn, msg)
+		if err := clientConn.WriteMessage(msg); err != nil {
+			// The server ended the connection.
+			break
+		}
+	}
+WaitLoop:
+	for {
+		select {
+		case <-activity:
+		case <-readerDone:
+			break WaitLoop
+		case <-time.After(wait):
+			break WaitLoop
+		}
+	}
+	clientConn.Close()
+	<-readerDone
+	return res, nil
+}
+
+// ReplayMain replays a recording against a temporary DB,
+// for the server's --replay mode, and prints the exchanged
+// messages as lines of JSON.
+//
+// The arguments are flags followed by the recording file.
+func ReplayMain(args []string) (err error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "users file to copy into the test DB (default: empty DB)")
+	speed := fs.Float64("speed", 0, "replay speed relative to the recording (0 for no delays)")
+	wait := fs.Duration("wait", time.Second, "time to wait for responses after the last message")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: replay [flags] <recording>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	recording, err := ReadRecording(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "status-replay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.DB.Path = filepath.Join(dir, "users.json")
+	if *dbPath != "" {
+		data, err := os.ReadFile(*dbPath)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(config.DB.Path, data, 0600); err != nil {
+			return err
+		}
+	}
+	_, edb, err := config.OpenDB()
+	if err != nil {
+		return err
+	}
+
+	replayed, err := ReplayRecording(recording, edb, *speed, *wait)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, m := range replayed {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
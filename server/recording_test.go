@@ -0,0 +1,42 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+func TestRecordingRedactsSecrets(t *testing.T) {
+	const secret = "hunter2"
+	messages := []struct {
+		direction string
+		msg       protocol.Message
+	}{
+		{RecordedIn, &protocol.LoginMessage{Email: "a@b.c", Password: secret, Code: secret}},
+		{RecordedIn, &protocol.BotLoginMessage{Email: "a@b.c", APIKey: secret}},
+		{RecordedIn, &protocol.RegisterVerifyMessage{Email: "a@b.c", Token: secret}},
+		{RecordedIn, &protocol.SetPasswordMessage{OldPassword: secret, NewPassword: secret}},
+		{RecordedIn, &protocol.ConnectIntegrationMessage{Provider: "slack", Code: secret}},
+		{RecordedIn, &protocol.ImportContactsMessage{Source: "carddav", Code: secret, Password: secret}},
+		{RecordedIn, &protocol.ReauthenticateMessage{Password: secret, Code: secret}},
+		{RecordedIn, &protocol.DeleteAccountMessage{Password: secret, Code: secret}},
+		{RecordedIn, &protocol.AddPushSubscriptionMessage{
+			Endpoint: secret,
+			Keys:     protocol.PushKeys{P256DH: secret, Auth: secret},
+		}},
+		{RecordedIn, &protocol.RemovePushSubscriptionMessage{Endpoint: secret}},
+		{RecordedOut, &protocol.TwoFactorEnabledMessage{Secret: secret, RecoveryCodes: []string{secret}}},
+		{RecordedOut, &protocol.RecoveryCodesMessage{RecoveryCodes: []string{secret}}},
+		{RecordedOut, &protocol.APIKeyMessage{APIKey: secret}},
+	}
+	for _, m := range messages {
+		recorded, err := NewRecordedMessage(m.direction, m.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(recorded.Message), secret) {
+			t.Errorf("%s message not redacted: %s", m.msg.Type(), recorded.Message)
+		}
+	}
+}
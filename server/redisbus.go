@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// RedisRetryDelay is the time to wait before
+	// reconnecting to Redis after an error.
+	RedisRetryDelay = time.Second
+
+	// MaxRedisQueue is the number of messages which may
+	// wait to be published while Redis is unavailable,
+	// after which new messages are dropped.
+	MaxRedisQueue = 10000
+)
+
+// A RedisBus is an events.Bus which uses a Redis pub/sub
+// channel, so that each node only needs to know the
+// address of the Redis server.
+type RedisBus struct {
+	addr     string
+	password string
+	channel  string
+	alerter  *statusdb.Alerter
+
+	lock     sync.Mutex
+	queue    []*events.BusMessage
+	wake     chan struct{}
+	messages chan *events.BusMessage
+}
+
+// NewRedisBus creates a RedisBus and starts connecting to
+// Redis in the background.
+//
+// The password may be empty if Redis does not require
+// authentication. Connection failures are reported to the
+// alerter, which may be nil.
+func NewRedisBus(addr, password, channel string, alerter *statusdb.Alerter) *RedisBus {
+	r := &RedisBus{
+		addr:     addr,
+		password: password,
+		channel:  channel,
+		alerter:  alerter,
+		wake:     make(chan struct{}, 1),
+		messages: make(chan *events.BusMessage, 100),
+	}
+	go r.publishLoop()
+	go r.subscribeLoop()
+	return r
+}
+
+func (r *RedisBus) Publish(msg *events.BusMessage) {
+	r.lock.Lock()
+	if len(r.queue) >= MaxRedisQueue {
+		r.lock.Unlock()
+		r.alerter.Raise(statusdb.AlertClusterBus, "Redis queue is full; dropping messages")
+		return
+	}
+	r.queue = append(r.queue, msg)
+	r.lock.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *RedisBus) Messages() <-chan *events.BusMessage {
+	return r.messages
+}
+
+func (r *RedisBus) publishLoop() {
+	var conn *redisConn
+	for range r.wake {
+		for {
+			r.lock.Lock()
+			if len(r.queue) == 0 {
+				r.lock.Unlock()
+				break
+			}
+			msg := r.queue[0]
+			r.lock.Unlock()
+
+			if conn == nil {
+				var err error
+				if conn, err = r.dial(); err != nil {
+					r.failed("publish", err)
+					continue
+				}
+			}
+			data, err := json.Marshal(msg)
+			if err == nil {
+				_, err = conn.Do("PUBLISH", r.channel, string(data))
+			}
+			if err != nil {
+				r.failed("publish", err)
+				conn.Close()
+				conn = nil
+				continue
+			}
+
+			r.lock.Lock()
+			essentials.OrderedDelete(&r.queue, 0)
+			r.lock.Unlock()
+		}
+	}
+}
+
+func (r *RedisBus) subscribeLoop() {
+	for {
+		if err := r.subscribe(); err != nil {
+			r.failed("subscribe", err)
+		}
+	}
+}
+
+func (r *RedisBus) subscribe() (err error) {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Send("SUBSCRIBE", r.channel); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			// Confirmations of the subscription.
+			continue
+		}
+		data, _ := parts[2].(string)
+		var msg events.BusMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return essentials.AddCtx("decode message", err)
+		}
+		r.messages <- &msg
+	}
+}
+
+func (r *RedisBus) dial() (*redisConn, error) {
+	conn, err := net.Dial("tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	res := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err := res.Do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, essentials.AddCtx("authenticate", err)
+		}
+	}
+	return res, nil
+}
+
+// failed reports an error and waits before the caller
+// retries.
+func (r *RedisBus) failed(ctx string, err error) {
+	r.alerter.Raise(statusdb.AlertClusterBus, "Redis "+ctx+": "+err.Error())
+	time.Sleep(RedisRetryDelay)
+}
+
+// A redisConn speaks the Redis serialization protocol.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Do sends a command and reads its reply.
+func (r *redisConn) Do(args ...string) (interface{}, error) {
+	if err := r.Send(args...); err != nil {
+		return nil, err
+	}
+	return r.Receive()
+}
+
+// Send sends a command without waiting for a reply.
+func (r *redisConn) Send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	_, err := r.conn.Write(buf)
+	return err
+}
+
+// Receive reads a reply, which is a string, an int64, nil,
+// or a []interface{} of replies.
+//
+// Error replies are returned as errors.
+func (r *redisConn) Receive() (interface{}, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("invalid Redis reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, errors.New(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		res := make([]interface{}, count)
+		for i := range res {
+			if res[i], err = r.Receive(); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unknown Redis reply type: %q", kind)
+}
+
+func (r *redisConn) Close() error {
+	return r.conn.Close()
+}
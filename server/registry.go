@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// A MessageHandler handles messages of a type added with
+// protocol.RegisterMessageType from logged in clients.
+//
+// It returns the response, or nil to acknowledge the
+// message. An error is sent to the client instead.
+type MessageHandler func(sess events.DBSession, msg protocol.Message) (protocol.Message, error)
+
+var messageHandlers = struct {
+	lock sync.RWMutex
+	m    map[string]MessageHandler
+}{m: map[string]MessageHandler{}}
+
+// RegisterMessageHandler handles a message type which is
+// not built into the protocol.
+//
+// It panics if the type already has a handler.
+func RegisterMessageHandler(msgType string, handler MessageHandler) {
+	messageHandlers.lock.Lock()
+	defer messageHandlers.lock.Unlock()
+	if _, ok := messageHandlers.m[msgType]; ok {
+		panic("message handler already registered: " + msgType)
+	}
+	messageHandlers.m[msgType] = handler
+}
+
+// handleRegistered passes a message to its registered
+// handler, or rejects it if there is none.
+func handleRegistered(sess events.DBSession, msg protocol.Message) protocol.Message {
+	messageHandlers.lock.RLock()
+	handler, ok := messageHandlers.m[msg.Type()]
+	messageHandlers.lock.RUnlock()
+	if !ok {
+		return ackOrError(msg, protocol.ErrUnsupportedMessage)
+	}
+	res, err := handler(sess, msg)
+	if err != nil || res == nil {
+		return ackOrError(msg, err)
+	}
+	return res
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// ListenFDsEnv is the environment variable which tells a
+// new process which inherited file descriptors are
+// listeners, as a comma-separated list of addresses.
+// The i-th address is file descriptor 3+i.
+const ListenFDsEnv = "STATUS_LISTEN_FDS"
+
+var ErrNotInheritable = errors.New("listener cannot be passed to another process")
+
+var inherited = struct {
+	sync.Mutex
+	loaded    bool
+	listeners map[string]net.Listener
+}{}
+
+// Listen creates a TCP listener, reusing a listener which
+// was passed down by Upgrade if one exists for the address.
+//
+// Servers should use Listen instead of net.Listen so that
+// connections are never refused during a restart.
+func Listen(addr string) (net.Listener, error) {
+	inherited.Lock()
+	defer inherited.Unlock()
+	if !inherited.loaded {
+		inherited.loaded = true
+		inherited.listeners = map[string]net.Listener{}
+		addrs := os.Getenv(ListenFDsEnv)
+		os.Unsetenv(ListenFDsEnv)
+		if addrs != "" {
+			for i, a := range strings.Split(addrs, ",") {
+				f := os.NewFile(uintptr(3+i), a)
+				l, err := net.FileListener(f)
+				f.Close()
+				if err != nil {
+					return nil, essentials.AddCtx("inherit listener "+a, err)
+				}
+				inherited.listeners[a] = l
+			}
+		}
+	}
+	if l, ok := inherited.listeners[addr]; ok {
+		delete(inherited.listeners, addr)
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// An Upgrade hands listeners off to a new server process,
+// typically after the binary has been replaced.
+//
+// A restart proceeds as follows:
+//
+//  1. PrepareUpgrade duplicates the listeners.
+//  2. The old process stops serving, e.g. with
+//     http.Server.Shutdown. Connections which arrive now
+//     wait in the listeners' queues.
+//  3. EventDB.Drain tells clients to reconnect, and ends
+//     every session so the database is no longer modified.
+//  4. Start launches the new process, which loads the
+//     database and accepts the queued connections.
+//  5. The old process exits.
+type Upgrade struct {
+	addrs []string
+	files []*os.File
+}
+
+// PrepareUpgrade duplicates the listeners so that they
+// stay open after the old process closes them.
+// The map keys are the addresses given to Listen.
+func PrepareUpgrade(listeners map[string]net.Listener) (u *Upgrade, err error) {
+	defer essentials.AddCtxTo("prepare upgrade", &err)
+	u = &Upgrade{}
+	for addr, l := range listeners {
+		fileListener, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			u.Close()
+			return nil, ErrNotInheritable
+		}
+		f, err := fileListener.File()
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+		u.addrs = append(u.addrs, addr)
+		u.files = append(u.files, f)
+	}
+	return u, nil
+}
+
+// Start launches the current executable with the same
+// arguments, passing it the listeners.
+//
+// The Upgrade is closed afterwards, whether or not the new
+// process started.
+func (u *Upgrade) Start() (proc *os.Process, err error) {
+	defer essentials.AddCtxTo("start upgrade", &err)
+	defer u.Close()
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, ListenFDsEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	env = append(env, ListenFDsEnv+"="+strings.Join(u.addrs, ","))
+	files := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, u.files...)
+	return os.StartProcess(path, os.Args, &os.ProcAttr{Env: env, Files: files})
+}
+
+// Close releases the duplicated listeners without starting
+// a new process.
+func (u *Upgrade) Close() error {
+	for _, f := range u.files {
+		f.Close()
+	}
+	u.files = nil
+	return nil
+}
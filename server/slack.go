@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// DefaultSlackURL is the base URL of Slack's OAuth
+	// pages and Web API.
+	DefaultSlackURL = "https://slack.com"
+
+	slackUserScopes     = "users:read,users:write,users.profile:read,users.profile:write"
+	maxSlackStatusText  = 100
+	slackResponseLimit  = 1 << 20
+	slackRequestTimeout = 10 * time.Second
+)
+
+// A SlackProvider is an events.StatusProvider which
+// synchronizes users' statuses with their Slack presence
+// and profile status, using user tokens from a Slack app.
+//
+// Slack's presence is imported as Available or Away, and
+// exported by setting it to auto or away. The status text,
+// emoji, and expiration map to the rich status fields,
+// although only emoji shortcodes such as ":coffee:" can be
+// exported.
+type SlackProvider struct {
+	ClientID     string
+	ClientSecret string
+	Tokens       *TokenCipher
+
+	// URL overrides DefaultSlackURL if it is non-empty.
+	URL string
+}
+
+func (s *SlackProvider) AuthorizeURL(redirectURI string) string {
+	query := url.Values{
+		"client_id":    {s.ClientID},
+		"user_scope":   {slackUserScopes},
+		"redirect_uri": {redirectURI},
+	}
+	return s.baseURL() + "/oauth/v2/authorize?" + query.Encode()
+}
+
+func (s *SlackProvider) Connect(code, redirectURI string) (in statusdb.Integration, err error) {
+	defer essentials.AddCtxTo("connect slack", &err)
+	var res struct {
+		AuthedUser struct {
+			ID          string `json:"id"`
+			AccessToken string `json:"access_token"`
+		} `json:"authed_user"`
+	}
+	err = s.call("oauth.v2.access", "", url.Values{
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+	}, &res)
+	if err != nil {
+		return in, err
+	}
+	token, err := s.Tokens.Seal(res.AuthedUser.AccessToken)
+	if err != nil {
+		return in, err
+	}
+	return statusdb.Integration{
+		Provider:  events.IntegrationSlack,
+		AccountID: res.AuthedUser.ID,
+		Token:     token,
+	}, nil
+}
+
+func (s *SlackProvider) Fetch(in statusdb.Integration) (status statusdb.UserStatus,
+	version string, err error) {
+	defer essentials.AddCtxTo("fetch slack status", &err)
+	token, err := s.Tokens.Open(in.Token)
+	if err != nil {
+		return status, "", err
+	}
+	var presence struct {
+		Presence string `json:"presence"`
+	}
+	err = s.call("users.getPresence", token, url.Values{"user": {in.AccountID}}, &presence)
+	if err != nil {
+		return status, "", err
+	}
+	var profile struct {
+		Profile struct {
+			StatusText       string `json:"status_text"`
+			StatusEmoji      string `json:"status_emoji"`
+			StatusExpiration int64  `json:"status_expiration"`
+		} `json:"profile"`
+	}
+	if err := s.call("users.profile.get", token, url.Values{}, &profile); err != nil {
+		return status, "", err
+	}
+	p := profile.Profile
+
+	status.Availability = statusdb.Available
+	if presence.Presence == "away" {
+		status.Availability = statusdb.Away
+	}
+	status.Message = p.StatusText
+	status.Emoji = p.StatusEmoji
+	if p.StatusExpiration != 0 {
+		expires := time.Unix(p.StatusExpiration, 0)
+		if expires.After(time.Now()) {
+			status.ExpiresAt = &expires
+		}
+	}
+	version = strings.Join([]string{presence.Presence, p.StatusText, p.StatusEmoji,
+		strconv.FormatInt(p.StatusExpiration, 10)}, "\n")
+	return status, version, nil
+}
+
+func (s *SlackProvider) CanExport() bool {
+	return true
+}
+
+func (s *SlackProvider) Publish(in statusdb.Integration, status statusdb.UserStatus) (err error) {
+	defer essentials.AddCtxTo("publish slack status", &err)
+	token, err := s.Tokens.Open(in.Token)
+	if err != nil {
+		return err
+	}
+	profile := map[string]interface{}{
+		"status_text":       truncateRunes(status.Message, maxSlackStatusText),
+		"status_emoji":      "",
+		"status_expiration": 0,
+	}
+	if strings.HasPrefix(status.Emoji, ":") && strings.HasSuffix(status.Emoji, ":") {
+		profile["status_emoji"] = status.Emoji
+	}
+	if status.ExpiresAt != nil {
+		profile["status_expiration"] = status.ExpiresAt.Unix()
+	}
+	body := map[string]interface{}{"profile": profile}
+	if err := s.call("users.profile.set", token, body, nil); err != nil {
+		return err
+	}
+	presence := "auto"
+	if status.Availability != statusdb.Available {
+		presence = "away"
+	}
+	return s.call("users.setPresence", token, url.Values{"presence": {presence}}, nil)
+}
+
+func (s *SlackProvider) Disconnect(in statusdb.Integration) (err error) {
+	defer essentials.AddCtxTo("disconnect slack", &err)
+	token, err := s.Tokens.Open(in.Token)
+	if err != nil {
+		return err
+	}
+	return s.call("auth.revoke", token, url.Values{}, nil)
+}
+
+// call invokes a Web API method, with url.Values sent as
+// a form and anything else as JSON, and decodes the
+// result if it is ok.
+func (s *SlackProvider) call(method, token string, params interface{}, result interface{}) error {
+	var body []byte
+	contentType := "application/x-www-form-urlencoded"
+	if form, ok := params.(url.Values); ok {
+		body = []byte(form.Encode())
+	} else {
+		var err error
+		if body, err = json.Marshal(params); err != nil {
+			return err
+		}
+		contentType = "application/json; charset=utf-8"
+	}
+	req, err := http.NewRequest("POST", s.baseURL()+"/api/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: slackRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status: %s", method, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, slackResponseLimit))
+	if err != nil {
+		return err
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	} else if !status.OK {
+		return fmt.Errorf("%s: %s", method, status.Error)
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+func (s *SlackProvider) baseURL() string {
+	if s.URL != "" {
+		return strings.TrimRight(s.URL, "/")
+	}
+	return DefaultSlackURL
+}
+
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) > max {
+		return string(runes[:max])
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+// A SummarySink delivers activity summaries to
+// administrators.
+type SummarySink interface {
+	SendSummary(s *events.ActivitySummary) error
+}
+
+// A WebhookSummarySink posts summaries as JSON objects to
+// a URL.
+type WebhookSummarySink struct {
+	URL string
+}
+
+func (w *WebhookSummarySink) SendSummary(s *events.ActivitySummary) error {
+	return postWebhookJSON(w.URL, s)
+}
+
+// An EmailSummarySink emails summaries through an SMTP
+// server.
+type EmailSummarySink struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (e *EmailSummarySink) SendSummary(s *events.ActivitySummary) (err error) {
+	defer essentials.AddCtxTo("email summary", &err)
+	subject := "Status server summary for " + s.End.Format("2006-01-02")
+	return sendSMTP(e.Host, e.Port, e.Username, e.Password, e.From, e.To, subject, s.String())
+}
+
+// RunSummaryReports sends a summary to every sink each
+// interval, such as daily or weekly, until stop is closed.
+//
+// Only the leader of the cluster sends its summaries, so
+// that administrators get one report per interval, and the
+// EventDB's election must be run separately.
+func RunSummaryReports(edb events.EventDB, interval time.Duration, sinks []SummarySink,
+	stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		summary := edb.TakeSummary()
+		if !edb.IsLeader() {
+			continue
+		}
+		for _, sink := range sinks {
+			if err := sink.SendSummary(summary); err != nil {
+				statusdb.LogAt(statusdb.LogWarn, "send summary: %v", err)
+			}
+		}
+	}
+}
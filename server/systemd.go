@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/unixpickle/essentials"
+)
+
+// NotifySystemd sends a state string, such as "READY=1",
+// to the systemd service manager.
+//
+// If the server was not started by systemd with a notify
+// socket, this does nothing.
+func NotifySystemd(state string) (err error) {
+	defer essentials.AddCtxTo("notify systemd", &err)
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if socketPath[0] == '@' {
+		// An abstract socket.
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// SystemdWatchdogInterval gets the interval at which
+// systemd expects watchdog pings, or 0 if the watchdog is
+// not enabled for this process.
+func SystemdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunSystemdWatchdog notifies systemd that the server is
+// ready, and then pings the watchdog for as long as the
+// EventDB passes its self-check, until stop is closed.
+//
+// When a self-check fails, pings stop, so systemd restarts
+// the server once the watchdog interval passes.
+func RunSystemdWatchdog(edb events.EventDB, stop <-chan struct{}) error {
+	if err := edb.SelfCheck(); err != nil {
+		return err
+	}
+	if err := NotifySystemd("READY=1"); err != nil {
+		return err
+	}
+	interval := SystemdWatchdogInterval()
+	if interval == 0 {
+		<-stop
+		return NotifySystemd("STOPPING=1")
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return NotifySystemd("STOPPING=1")
+		}
+		if err := edb.SelfCheck(); err != nil {
+			NotifySystemd("STATUS=" + err.Error())
+			continue
+		}
+		NotifySystemd("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	ErrTokenKey    = errors.New("integration key must be 32 bytes encoded with base64")
+	ErrSealedToken = errors.New("invalid encrypted token")
+)
+
+// A TokenCipher encrypts the tokens of users' integrations
+// with AES-256-GCM, so that a leaked DB file does not
+// grant access to users' other accounts.
+type TokenCipher struct {
+	aead cipher.AEAD
+}
+
+// NewTokenCipher creates a TokenCipher from a base64 key
+// of 32 bytes, such as the output of
+// `head -c 32 /dev/urandom | base64`.
+func NewTokenCipher(key string) (*TokenCipher, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, ErrTokenKey
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCipher{aead: aead}, nil
+}
+
+// Seal encrypts a token, returning the nonce and the
+// ciphertext encoded with base64.
+func (t *TokenCipher) Seal(token string) (string, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := t.aead.Seal(nonce, nonce, []byte(token), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a token created by Seal.
+func (t *TokenCipher) Open(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < t.aead.NonceSize() {
+		return "", ErrSealedToken
+	}
+	nonceSize := t.aead.NonceSize()
+	token, err := t.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return "", ErrSealedToken
+	}
+	return string(token), nil
+}
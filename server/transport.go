@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/unixpickle/essentials"
+)
+
+// Serve accepts stream connections from a listener and
+// handles each client in its own Goroutine, until the
+// listener is closed.
+//
+// Clients are served with the given options.
+func Serve(listener net.Listener, edb events.EventDB, opts ClientOptions) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return essentials.AddCtx("serve", err)
+		}
+		go HandleClient(protocol.NewStreamConnection(conn), edb, opts)
+	}
+}
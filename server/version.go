@@ -0,0 +1,28 @@
+package server
+
+import (
+	"runtime"
+
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// Build information, set when building with flags like
+//
+//	-ldflags "-X $PKG.Version=1.2.0 -X $PKG.Commit=abc123 -X $PKG.BuildDate=2024-01-02"
+//
+// where $PKG is github.com/PickledCode/status-server/server.
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// CurrentServerInfo gets the ServerInfo for this build.
+func CurrentServerInfo() protocol.ServerInfo {
+	return protocol.ServerInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
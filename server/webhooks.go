@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// WebhookAttempts is the number of times a delivery is
+	// attempted before it is dropped.
+	WebhookAttempts = 5
+
+	// WebhookRetryDelay is the time before the first retry
+	// of a failed delivery, which doubles for each retry.
+	WebhookRetryDelay = 10 * time.Second
+
+	// MaxWebhookQueue is the number of deliveries which may
+	// wait to be sent, after which new ones are dropped.
+	MaxWebhookQueue = 10000
+
+	webhookWorkers = 4
+)
+
+var ErrWebhookAddress = errors.New("webhook address is not public")
+
+// A UserWebhookSender is an events.WebhookSender which
+// posts deliveries from a pool of workers.
+//
+// Each request carries the delivery's ID and event in the
+// X-Webhook-ID and X-Webhook-Event headers, and is signed
+// like a federation request: X-Webhook-Signature is the
+// hex HMAC-SHA256, keyed by the webhook's secret, of the
+// X-Webhook-Time header, a newline, and the body.
+//
+// Deliveries which fail with a network error, a 5xx, or a
+// 429 are retried with exponential backoff.
+type UserWebhookSender struct {
+	client *http.Client
+	queue  chan *webhookJob
+}
+
+type webhookJob struct {
+	hook     statusdb.Webhook
+	delivery *events.WebhookDelivery
+	attempt  int
+}
+
+// NewUserWebhookSender creates a sender and starts its
+// workers.
+//
+// Unless allowPrivate is set, webhooks may not connect to
+// loopback, private, or link-local addresses, so that
+// users cannot reach services behind the server.
+func NewUserWebhookSender(allowPrivate bool) *UserWebhookSender {
+	w := &UserWebhookSender{
+		client: userURLClient(allowPrivate),
+		queue:  make(chan *webhookJob, MaxWebhookQueue),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go w.worker()
+	}
+	return w
+}
+
+func (w *UserWebhookSender) Send(hook statusdb.Webhook, delivery *events.WebhookDelivery) {
+	w.enqueue(&webhookJob{hook: hook, delivery: delivery})
+}
+
+func (w *UserWebhookSender) Deliver(hook statusdb.Webhook, delivery *events.WebhookDelivery) error {
+	_, err := w.post(hook, delivery)
+	return err
+}
+
+func (w *UserWebhookSender) enqueue(job *webhookJob) {
+	select {
+	case w.queue <- job:
+	default:
+		statusdb.LogAt(statusdb.LogWarn, "webhook queue is full; dropping delivery %s",
+			job.delivery.ID)
+	}
+}
+
+func (w *UserWebhookSender) worker() {
+	for job := range w.queue {
+		retry, err := w.post(job.hook, job.delivery)
+		if err == nil {
+			continue
+		}
+		job.attempt++
+		if !retry || job.attempt >= WebhookAttempts {
+			statusdb.LogAt(statusdb.LogWarn, "dropping delivery %s to webhook of %s: %v",
+				job.delivery.ID, job.delivery.User, err)
+			continue
+		}
+		delay := WebhookRetryDelay << uint(job.attempt-1)
+		time.AfterFunc(delay, func() {
+			w.enqueue(job)
+		})
+	}
+}
+
+// post makes one attempt at a delivery, and decides if a
+// failure is worth retrying.
+func (w *UserWebhookSender) post(hook statusdb.Webhook,
+	delivery *events.WebhookDelivery) (retry bool, err error) {
+	defer essentials.AddCtxTo("post to webhook", &err)
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", delivery.ID)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Time", timestamp)
+	req.Header.Set("X-Webhook-Signature", signRequest(hook.Secret, timestamp, data))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// userURLClient creates a client for URLs which users
+// chose, which only connects to public addresses unless
+// allowPrivate is set.
+func userURLClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = checkWebhookAddress
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
+
+// checkWebhookAddress is a net.Dialer Control function
+// which rejects addresses that are not public.
+//
+// Checking at dial time covers redirects and DNS names
+// which resolve to internal addresses.
+func checkWebhookAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return ErrWebhookAddress
+	}
+	return nil
+}
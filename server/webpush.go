@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/statusdb"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	// PushTTL is how long a push service holds a message
+	// for a browser which is not running.
+	PushTTL = 24 * time.Hour
+
+	// pushRecordSize is the aes128gcm record size. Every
+	// payload fits in a single record.
+	pushRecordSize = 4096
+)
+
+var ErrVAPIDKey = errors.New("invalid VAPID private key")
+
+// A WebPushSender sends push messages to browsers with the
+// Web Push protocol, identifying the server with VAPID
+// (RFC 8292) and encrypting payloads as in RFC 8291.
+type WebPushSender struct {
+	key       *ecdsa.PrivateKey
+	publicKey []byte
+
+	// Subject is a mailto: or https: URL which push
+	// services may use to contact the operator.
+	Subject string
+
+	// Client, if non-nil, is used to make requests.
+	Client *http.Client
+}
+
+// NewWebPushSender creates a WebPushSender from a VAPID
+// private key, which is the raw P-256 scalar encoded with
+// base64url, as printed by GenerateVAPIDKeys.
+func NewWebPushSender(privateKey, subject string) (*WebPushSender, error) {
+	raw, err := decodeBase64URL(privateKey)
+	if err != nil {
+		return nil, ErrVAPIDKey
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, ErrVAPIDKey
+	}
+	pub := ecdhKey.PublicKey().Bytes()
+	return &WebPushSender{
+		key: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(pub[1:33]),
+				Y:     new(big.Int).SetBytes(pub[33:]),
+			},
+			D: new(big.Int).SetBytes(raw),
+		},
+		publicKey: pub,
+		Subject:   subject,
+	}, nil
+}
+
+// GenerateVAPIDKeys creates a new VAPID key pair, encoded
+// with base64url.
+//
+// The private key configures a WebPushSender, and the
+// public key is what browsers subscribe with.
+func GenerateVAPIDKeys() (privateKey, publicKey string, err error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(key.Bytes()), enc.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+func (w *WebPushSender) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(w.publicKey)
+}
+
+func (w *WebPushSender) Push(sub statusdb.PushSubscription, payload []byte) (err error) {
+	defer essentials.AddCtxTo("web push", &err)
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := w.authorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(PushTTL/time.Second)))
+	req.Header.Set("Urgency", "high")
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return events.ErrPushGone
+	case resp.StatusCode/100 != 2:
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status,
+			strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// authorization creates the VAPID Authorization header for
+// a push endpoint, signing a JWT for its origin.
+func (w *WebPushSender) authorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": w.Subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, w.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, enc.EncodeToString(sig),
+		w.PublicKey()), nil
+}
+
+// encryptPushPayload encrypts a payload for a subscription
+// with the aes128gcm content encoding.
+func encryptPushPayload(sub statusdb.PushSubscription, payload []byte) ([]byte, error) {
+	uaPublicBytes, err := decodeBase64URL(sub.P256DH)
+	if err != nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	authSecret, err := decodeBase64URL(sub.Auth)
+	if err != nil {
+		return nil, errors.New("invalid auth secret")
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The 0x02 delimiter marks the last (and only) record.
+	plaintext := append(append([]byte{}, payload...), 2)
+	if len(plaintext)+gcm.Overhead() > pushRecordSize {
+		return nil, errors.New("payload too large")
+	}
+
+	res := append([]byte{}, salt...)
+	res = binary.BigEndian.AppendUint32(res, pushRecordSize)
+	res = append(res, byte(len(asPublic)))
+	res = append(res, asPublic...)
+	return gcm.Seal(res, nonce, plaintext, nil), nil
+}
+
+// hkdf derives a key of at most 32 bytes with HKDF-SHA-256.
+func hkdf(salt, secret, info []byte, size int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:size]
+}
+
+// decodeBase64URL decodes base64url with or without
+// padding, since browsers and tools differ.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+)
+
+// webSocketGUID is appended to a client's key to compute
+// the Sec-WebSocket-Accept header.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketCloseTimeout is how long closing a WebSocket
+// waits to write the close frame.
+const webSocketCloseTimeout = time.Second
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var (
+	ErrWebSocketFrame     = errors.New("invalid WebSocket frame")
+	ErrWebSocketTooLarge  = errors.New("WebSocket message is too large")
+	ErrWebSocketClosed    = errors.New("WebSocket closed by client")
+	ErrWebSocketHandshake = errors.New("not a WebSocket handshake")
+)
+
+// WebSocketHandler creates an HTTP handler which accepts
+// WebSocket connections, for browser clients.
+//
+// Each text frame holds one message, encoded like the
+// lines of a stream connection.
+//
+// Clients are served with the given options.
+func WebSocketHandler(edb events.EventDB, opts ClientOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		HandleClient(conn, edb, opts)
+	})
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		return nil, ErrWebSocketHandshake
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &webSocketConn{conn: conn, reader: rw.Reader, remoteAddr: r.RemoteAddr}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A webSocketConn is the server end of a WebSocket
+// connection.
+type webSocketConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	remoteAddr string
+	strict     bool
+
+	writeLock sync.Mutex
+}
+
+func (w *webSocketConn) ReadMessage() (protocol.Message, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readWebSocketFrame(w.reader, true,
+			protocol.MaxStreamMessageSize)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := w.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			w.writeFrame(wsClose, nil)
+			return nil, ErrWebSocketClosed
+		case wsText, wsBinary:
+			message = payload
+		case wsContinuation:
+			message = append(message, payload...)
+		default:
+			return nil, ErrWebSocketFrame
+		}
+		if len(message) > protocol.MaxStreamMessageSize {
+			return nil, ErrWebSocketTooLarge
+		}
+		if fin {
+			return protocol.UnmarshalMessage(message, w.strict)
+		}
+	}
+}
+
+func (w *webSocketConn) WriteMessage(msg protocol.Message) error {
+	data, err := protocol.MarshalMessage(msg)
+	if err != nil {
+		return err
+	}
+	return w.writeFrame(wsText, data)
+}
+
+// Close sends a close frame and closes the connection.
+//
+// The write deadline keeps a write which is stuck on a
+// client that has stopped reading from holding up the
+// close frame, and so Close, for more than a moment.
+func (w *webSocketConn) Close() error {
+	w.conn.SetWriteDeadline(time.Now().Add(webSocketCloseTimeout))
+	w.writeFrame(wsClose, nil)
+	return w.conn.Close()
+}
+
+func (w *webSocketConn) RemoteAddr() string {
+	return w.remoteAddr
+}
+
+func (w *webSocketConn) SetStrictDecoding(strict bool) {
+	w.strict = strict
+}
+
+// writeFrame writes an unfragmented frame to the client.
+func (w *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+	_, err := w.conn.Write(encodeWebSocketFrame(opcode, payload, nil))
+	return err
+}
+
+// readWebSocketFrame reads a frame of at most limit bytes,
+// unmasking it if it is from a client.
+//
+// Frames from clients must be masked, while frames from
+// servers must not be.
+func readWebSocketFrame(r *bufio.Reader, fromClient bool, limit uint64) (fin bool, opcode byte,
+	payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0xf
+	if (header[1]&0x80 != 0) != fromClient {
+		return false, 0, nil, ErrWebSocketFrame
+	}
+	size := uint64(header[1] & 0x7f)
+	if size == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	} else if size == 127 {
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > limit {
+		return false, 0, nil, ErrWebSocketTooLarge
+	}
+	var mask [4]byte
+	if fromClient {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if fromClient {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// encodeWebSocketFrame encodes an unfragmented frame,
+// which is masked if mask is non-nil, as clients must do.
+func encodeWebSocketFrame(opcode byte, payload []byte, mask []byte) []byte {
+	header := []byte{0x80 | opcode}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	if len(payload) < 126 {
+		header = append(header, maskBit|byte(len(payload)))
+	} else if len(payload) <= 0xffff {
+		header = append(header, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	} else {
+		header = append(header, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(header, payload...)
+	}
+	header = append(header, mask...)
+	for i, b := range payload {
+		header = append(header, b^mask[i%4])
+	}
+	return header
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A webSocketClient is the client end of a WebSocket
+// connection, for services such as the Discord gateway.
+//
+// Messages are raw text frames, rather than protocol
+// messages.
+type webSocketClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	limit  uint64
+
+	writeLock sync.Mutex
+}
+
+// dialWebSocket connects to a ws:// or wss:// URL.
+//
+// Messages larger than limit bytes cannot be read.
+func dialWebSocket(rawURL string, limit uint64) (*webSocketClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", hostWithPort(u, "80"))
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithPort(u, "443"),
+			&tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keyBytes [16]byte
+	if _, err := rand.Read(keyBytes[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes[:])
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(hash[:]) {
+		conn.Close()
+		return nil, ErrWebSocketHandshake
+	}
+	conn.SetDeadline(time.Time{})
+	return &webSocketClient{conn: conn, reader: reader, limit: limit}, nil
+}
+
+// ReadText reads the next text or binary message,
+// answering pings along the way.
+func (w *webSocketClient) ReadText() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readWebSocketFrame(w.reader, false, w.limit)
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := w.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			w.writeFrame(wsClose, nil)
+			return nil, errors.New("WebSocket closed by server")
+		case wsText, wsBinary:
+			message = payload
+		case wsContinuation:
+			message = append(message, payload...)
+		default:
+			return nil, ErrWebSocketFrame
+		}
+		if uint64(len(message)) > w.limit {
+			return nil, ErrWebSocketTooLarge
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (w *webSocketClient) WriteText(data []byte) error {
+	return w.writeFrame(wsText, data)
+}
+
+func (w *webSocketClient) Close() error {
+	w.writeFrame(wsClose, nil)
+	return w.conn.Close()
+}
+
+func (w *webSocketClient) writeFrame(opcode byte, payload []byte) error {
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+	_, err := w.conn.Write(encodeWebSocketFrame(opcode, payload, mask[:]))
+	return err
+}
+
+func hostWithPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
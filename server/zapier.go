@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+const (
+	// ZapierPath is where the WebSocket listener serves the
+	// Zapier triggers.
+	ZapierPath = "/zapier/"
+
+	maxZapierBody = 1 << 16
+)
+
+// A ZapierSubscription is the body which Zapier posts to
+// subscribe a REST hook to one of protocol.WebhookEvents.
+type ZapierSubscription struct {
+	TargetURL string `json:"target_url"`
+	Event     string `json:"event"`
+}
+
+// ZapierHandler serves triggers for the user's own events
+// in the form which Zapier expects, so that automations
+// can be built on a user's presence.
+//
+// Requests authenticate with HTTP basic authentication,
+// using the user's email and the API key from
+// CreateAPIKey.
+//
+// The API supports:
+//
+//	GET    /zapier/me                        test authentication
+//	GET    /zapier/triggers/status_changed   poll for status changes
+//	GET    /zapier/triggers/request_received poll for buddy requests
+//	POST   /zapier/hooks                     subscribe a REST hook
+//	DELETE /zapier/hooks/<id>                unsubscribe a REST hook
+//
+// Polling triggers return lists of events.WebhookDelivery,
+// newest first, like the ones posted to REST hooks. Their
+// IDs identify the status or request, so that Zapier only
+// triggers once for each.
+//
+// REST hooks are the user's webhooks, and require webhooks
+// to be enabled.
+func ZapierHandler(db statusdb.DB, edb events.EventDB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, apiKey, ok := r.BasicAuth()
+		if ok {
+			if err := edb.CheckAPIKey(email, apiKey); err != nil {
+				ok = false
+			}
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="zapier"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, ZapierPath), "/")
+		switch {
+		case r.Method == "GET" && path == "me":
+			writeAdminJSON(w, map[string]string{"email": email})
+		case r.Method == "GET" && path == "triggers/"+protocol.WebhookStatusChanged:
+			pollStatusChanged(w, db, email)
+		case r.Method == "GET" && path == "triggers/"+protocol.WebhookRequestReceived:
+			pollRequestReceived(w, db, email)
+		case r.Method == "POST" && path == "hooks":
+			subscribeZapier(w, r, edb, email)
+		case r.Method == "DELETE" && strings.HasPrefix(path, "hooks/"):
+			err := edb.RemoveWebhook(email, strings.TrimPrefix(path, "hooks/"))
+			writeAdminResult(w, err)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// pollStatusChanged lists the user's current status, which
+// is identified by the time it was set.
+func pollStatusChanged(w http.ResponseWriter, db statusdb.DB, email string) {
+	statuses, err := db.GetStatuses([]string{email})
+	if err == nil {
+		err = statuses[0].Err
+	}
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	status := statuses[0].Status
+	writeAdminJSON(w, []events.WebhookDelivery{{
+		ID:     strconv.FormatInt(status.Time.UnixNano(), 10),
+		Event:  protocol.WebhookStatusChanged,
+		Time:   status.Time,
+		User:   email,
+		Status: &status,
+	}})
+}
+
+// pollRequestReceived lists the user's pending incoming
+// requests, which are identified by their senders.
+func pollRequestReceived(w http.ResponseWriter, db statusdb.DB, email string) {
+	info, err := db.GetUserInfo(email)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	res := []events.WebhookDelivery{}
+	for i := len(info.IncomingRequests) - 1; i >= 0; i-- {
+		sender := info.IncomingRequests[i]
+		res = append(res, events.WebhookDelivery{
+			ID:       sender,
+			Event:    protocol.WebhookRequestReceived,
+			User:     info.Email,
+			Email:    sender,
+			Greeting: info.Greetings[sender],
+		})
+	}
+	writeAdminJSON(w, res)
+}
+
+func subscribeZapier(w http.ResponseWriter, r *http.Request, edb events.EventDB, email string) {
+	var sub ZapierSubscription
+	err := json.NewDecoder(io.LimitReader(r.Body, maxZapierBody)).Decode(&sub)
+	if err != nil {
+		writeAdminError(w, &statusdb.ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	hookEvents := []string{sub.Event}
+	err = protocol.ValidateMessage(&protocol.AddWebhookMessage{URL: sub.TargetURL, Events: hookEvents})
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	hook, err := edb.AddWebhook(email, sub.TargetURL, hookEvents)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": hook.ID})
+}
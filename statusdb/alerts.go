@@ -0,0 +1,104 @@
+package statusdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Conditions which raise alerts.
+const (
+	AlertDBWrite      = "db_write_failed"
+	AlertSyncError    = "sync_error"
+	AlertLoginFailure = "login_failure_spike"
+	AlertClusterBus   = "cluster_bus_failed"
+	AlertFederation   = "federation_failed"
+)
+
+// DefaultAlertCooldown is the minimum time between alerts
+// for the same condition if an Alerter has no cooldown.
+const DefaultAlertCooldown = 15 * time.Minute
+
+// An Alert notifies operators of a problem with the
+// server.
+type Alert struct {
+	Time      time.Time `json:"time"`
+	Condition string    `json:"condition"`
+	Message   string    `json:"message"`
+}
+
+// An AlertSink delivers alerts to operators.
+type AlertSink interface {
+	SendAlert(a *Alert) error
+}
+
+// An Alerter raises alerts through AlertSinks, limiting
+// how often each condition is reported.
+//
+// A nil Alerter discards alerts.
+type Alerter struct {
+	Sinks []AlertSink
+
+	// Cooldown overrides DefaultAlertCooldown if it is
+	// non-zero.
+	Cooldown time.Duration
+
+	// LoginFailuresPerMinute is the rate of failed logins
+	// which raises an AlertLoginFailure.
+	// If zero, failed logins are not monitored.
+	LoginFailuresPerMinute int
+
+	lock          sync.Mutex
+	lastRaised    map[string]time.Time
+	loginFailures RateLimiter
+}
+
+// Raise sends an alert to every sink in the background,
+// unless the condition was raised within the cooldown.
+func (a *Alerter) Raise(condition, message string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.raise(condition, message)
+}
+
+// LoginFailed records a failed login, raising an alert if
+// they have passed the limit.
+func (a *Alerter) LoginFailed() {
+	if a == nil || a.LoginFailuresPerMinute == 0 {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.loginFailures.Limit = a.LoginFailuresPerMinute
+	a.loginFailures.Window = time.Minute
+	if !a.loginFailures.Allow(time.Now()) {
+		a.raise(AlertLoginFailure, fmt.Sprintf("more than %d failed logins in the last minute",
+			a.LoginFailuresPerMinute))
+	}
+}
+
+func (a *Alerter) raise(condition, message string) {
+	now := time.Now()
+	cooldown := a.Cooldown
+	if cooldown == 0 {
+		cooldown = DefaultAlertCooldown
+	}
+	if last, ok := a.lastRaised[condition]; ok && now.Sub(last) < cooldown {
+		return
+	}
+	if a.lastRaised == nil {
+		a.lastRaised = map[string]time.Time{}
+	}
+	a.lastRaised[condition] = now
+	alert := &Alert{Time: now, Condition: condition, Message: message}
+	for _, sink := range a.Sinks {
+		go func(sink AlertSink) {
+			if err := sink.SendAlert(alert); err != nil {
+				LogAt(LogWarn, "alert %s: %v", condition, err)
+			}
+		}(sink)
+	}
+}
@@ -0,0 +1,43 @@
+package statusdb
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNoAnnouncement = errors.New("no such announcement")
+
+// An Announcement is a banner shown to every client while
+// it is active, such as a maintenance window or a feature
+// notice.
+type Announcement struct {
+	ID    string      `json:"id"`
+	Level NoticeLevel `json:"level"`
+	Text  string      `json:"text"`
+
+	// Key optionally identifies a translation of Text in
+	// the message catalogs.
+	Key string `json:"key,omitempty"`
+
+	// Start and End bound the time during which the
+	// announcement is shown.
+	// A zero End means the announcement never expires.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"`
+}
+
+// Active checks if the announcement should be shown at the
+// given time.
+func (a *Announcement) Active(now time.Time) bool {
+	return !now.Before(a.Start) && (a.End.IsZero() || now.Before(a.End))
+}
+
+// Valid checks that the announcement can be shown.
+func (a *Announcement) Valid() bool {
+	switch a.Level {
+	case NoticeInfo, NoticeWarning, NoticeCritical:
+	default:
+		return false
+	}
+	return a.Text != "" && (a.End.IsZero() || a.End.After(a.Start))
+}
@@ -0,0 +1,113 @@
+package statusdb
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// generateAPIKey creates a key with 256 bits of entropy,
+// which is enough that a fast hash can store it safely.
+//
+// The prefix tells people what kind of key it is.
+func generateAPIKey(prefix string) (string, error) {
+	var data [32]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return "", err
+	}
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	return prefix + strings.ToLower(encoding.EncodeToString(data[:])), nil
+}
+
+// AddBot stores only the hash of the API key. Bots have no
+// password, so they always fail CheckLogin.
+func (f *fileDB) AddBot(email string) (apiKey string, err error) {
+	apiKey, err = generateAPIKey("bot_")
+	if err != nil {
+		return "", err
+	}
+	err = f.mutate("add bot", func() error {
+		if f.findUser(email) != nil {
+			return ErrEmailInUse
+		}
+		f.UserRecords = append(f.UserRecords, &UserInfo{
+			Email:      email,
+			Verified:   true,
+			Bot:        true,
+			APIKeyHash: hashPassword(apiKey),
+			Profile:    Profile{Bot: true},
+
+			LatestStatus: UserStatus{Availability: Available, Time: time.Now()},
+			ModTime:      time.Now(),
+		})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return apiKey, nil
+}
+
+func (f *fileDB) RotateAPIKey(email string) (apiKey string, err error) {
+	return f.replaceAPIKey("rotate api key", email, "bot_", true)
+}
+
+func (f *fileDB) CreateAPIKey(email string) (apiKey string, err error) {
+	return f.replaceAPIKey("create api key", email, "key_", false)
+}
+
+func (f *fileDB) replaceAPIKey(ctx, email, prefix string, botOnly bool) (apiKey string,
+	err error) {
+	apiKey, err = generateAPIKey(prefix)
+	if err != nil {
+		return "", err
+	}
+	err = f.mutate(ctx, func() error {
+		user := f.findUser(email)
+		if user == nil || user.Remote {
+			return ErrNoEmail
+		} else if botOnly && !user.Bot {
+			return ErrNotBot
+		}
+		user.APIKeyHash = hashPassword(apiKey)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return apiKey, nil
+}
+
+func (f *fileDB) RevokeAPIKey(email string) error {
+	return f.mutate("revoke api key", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		user.APIKeyHash = ""
+		return nil
+	})
+}
+
+func (f *fileDB) CheckAPIKey(email, apiKey string) (err error) {
+	defer essentials.AddCtxTo("check api key", &err)
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	user := f.findUser(email)
+	if user == nil || user.Remote {
+		return ErrNoEmail
+	}
+	if user.APIKeyHash == "" ||
+		subtle.ConstantTimeCompare([]byte(user.APIKeyHash), []byte(hashPassword(apiKey))) != 1 {
+		return ErrPassword
+	} else if user.Locked {
+		return ErrAccountLocked
+	} else if time.Now().Before(user.SuspendedUntil) {
+		return ErrAccountSuspended
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package statusdb
+
+// MaxContactLookup is the most emails which
+// FindDiscoverable checks at once.
+const MaxContactLookup = 5000
+
+func (f *fileDB) SetDiscoverable(email string, discoverable bool) error {
+	return f.mutate("set discoverable", func() error {
+		if user := f.findUser(email); user != nil {
+			user.Discoverable = discoverable
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) FindDiscoverable(viewer string, emails []string) ([]*UserInfo, error) {
+	if len(emails) > MaxContactLookup {
+		emails = emails[:MaxContactLookup]
+	}
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	from := f.findUser(viewer)
+	if from == nil {
+		return nil, ErrNoEmail
+	}
+	wanted := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		wanted[email] = true
+	}
+	var res []*UserInfo
+	for _, user := range f.UserRecords {
+		if !wanted[user.Email] || !user.Discoverable || user.Remote || user.Locked ||
+			EmailsEquivalent(user.Email, viewer) || RequestBlocker(from, user) != nil {
+			continue
+		}
+		res = append(res, user.Copy())
+	}
+	return res, nil
+}
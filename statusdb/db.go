@@ -0,0 +1,1756 @@
+package statusdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/essentials"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPassword             = errors.New("password incorrect")
+	ErrNoEmail              = errors.New("no such email address")
+	ErrEmailInUse           = errors.New("email already in use")
+	ErrTwoFactorRequired    = errors.New("two-factor code required")
+	ErrTwoFactorCode        = errors.New("two-factor code incorrect")
+	ErrTwoFactorEnabled     = errors.New("two-factor already enabled")
+	ErrTwoFactorDisabled    = errors.New("two-factor not enabled")
+	ErrAlreadyBuddies       = errors.New("already buddies")
+	ErrNotBuddies           = errors.New("not buddies")
+	ErrRequestExists        = errors.New("request already exists")
+	ErrReverseRequestExists = errors.New("request exists in the other direction")
+	ErrNoRequest            = errors.New("request does not exist")
+	ErrInvalidAvailability  = errors.New("invalid availability")
+	ErrBlocked              = errors.New("user is blocked")
+	ErrAlreadyBlocked       = errors.New("user already blocked")
+	ErrNotBlocked           = errors.New("user not blocked")
+	ErrNoCustomState        = errors.New("no such custom state")
+	ErrInvalidVisibility    = errors.New("invalid visibility")
+	ErrAccountLocked        = errors.New("account locked")
+	ErrNotBot               = errors.New("not a bot account")
+
+	// ErrExternalAccounts is returned by DBs whose accounts
+	// and passwords are managed by another service.
+	ErrExternalAccounts = errors.New("accounts are managed externally")
+)
+
+type Availability int
+
+const (
+	Offline Availability = iota
+	Available
+	Away
+	DoNotDisturb
+)
+
+// Settable checks if a user may set their availability to
+// this value.
+func (a Availability) Settable() bool {
+	return a == Available || a == Away || a == DoNotDisturb
+}
+
+// A CustomState is a user-defined availability, such as
+// "In a meeting", which behaves like a built-in one.
+type CustomState struct {
+	// Name identifies the state among the user's states.
+	Name string `json:"name"`
+
+	Label string       `json:"label"`
+	Base  Availability `json:"base"`
+
+	// Color is an optional "#rrggbb" color for clients to
+	// render the state with.
+	Color string `json:"color,omitempty"`
+}
+
+// A Profile contains the information about a user which
+// their buddies see besides their status.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	Pronouns    string `json:"pronouns,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+
+	// AvatarHash identifies the user's avatar in the
+	// server's AvatarStore, or is empty if the user has no
+	// avatar.
+	AvatarHash string `json:"avatar_hash,omitempty"`
+
+	// AvatarURL is an image shown in place of an avatar
+	// for users without one, such as from Gravatar. It is
+	// filled in when profiles are sent, and never stored.
+	AvatarURL string `json:"avatar_url,omitempty"`
+
+	// Bot is set for bot accounts, so that clients can
+	// show them differently. SetProfile cannot change it.
+	Bot bool `json:"bot,omitempty"`
+}
+
+// A Visibility determines who may see a piece of a user's
+// information.
+type Visibility string
+
+const (
+	VisibleEveryone Visibility = "everyone"
+	VisibleBuddies  Visibility = "buddies"
+	VisibleNobody   Visibility = "nobody"
+)
+
+// Valid checks if v is a known visibility.
+// The empty visibility is the default, and is valid.
+func (v Visibility) Valid() bool {
+	switch v {
+	case "", VisibleEveryone, VisibleBuddies, VisibleNobody:
+		return true
+	}
+	return false
+}
+
+// VisibleToBuddies checks if buddies may see the
+// information.
+// The default visibility is VisibleBuddies.
+func (v Visibility) VisibleToBuddies() bool {
+	return v != VisibleNobody
+}
+
+// UserStatus stores a user's current status.
+type UserStatus struct {
+	Availability Availability
+	Message      string
+	Time         time.Time
+
+	// UserMetadata is an optional JSON object attached to
+	// the status, such as the user's current song.
+	// It is checked against the StatusPolicy's schema.
+	UserMetadata json.RawMessage `json:",omitempty"`
+
+	// Optional rich status fields.
+	//
+	// When ExpiresAt passes, the message, emoji, and link are
+	// cleared but the availability is kept.
+	Emoji     string     `json:",omitempty"`
+	Link      string     `json:",omitempty"`
+	ExpiresAt *time.Time `json:",omitempty"`
+
+	// Idle indicates that the server changed the user's
+	// availability to Away because all of their clients
+	// reported being idle.
+	Idle bool `json:",omitempty"`
+
+	// Custom is set if the user selected one of their
+	// custom states, in which case Availability is the
+	// state's base availability.
+	Custom *CustomState `json:",omitempty"`
+
+	// LastSeen is set on Offline statuses sent to buddies
+	// if the user's PrivacySettings allow it.
+	LastSeen *time.Time `json:",omitempty"`
+
+	// TimeZone and LocalTime are set on statuses sent to
+	// buddies if the user has given their time zone.
+	// LocalTime is the user's time when the status was
+	// sent, in their time zone.
+	TimeZone  string     `json:",omitempty"`
+	LocalTime *time.Time `json:",omitempty"`
+}
+
+// Expire clears the rich parts of the status if it has
+// expired by the given time.
+func (u UserStatus) Expire(now time.Time) UserStatus {
+	if u.ExpiresAt == nil || now.Before(*u.ExpiresAt) {
+		return u
+	}
+	return UserStatus{
+		Availability: u.Availability,
+		Time:         *u.ExpiresAt,
+		UserMetadata: u.UserMetadata,
+		Idle:         u.Idle,
+		Custom:       u.Custom,
+	}
+}
+
+// UserInfo stores meta-data for a user.
+//
+// This does not include information that relies on a
+// a user's current connection.
+type UserInfo struct {
+	Email string
+	Hash  []byte
+
+	// VerifyToken is set while the user has yet to prove
+	// that they own their email address.
+	VerifyToken string
+	Verified    bool
+
+	// ResetHash is the hash of a code which may be used to
+	// reset the user's password until ResetExpires.
+	ResetHash    string
+	ResetExpires time.Time
+
+	// Locked prevents the user from logging in.
+	Locked bool
+
+	// Bot marks an account for a service, such as a build
+	// server, which logs in with an API key instead of a
+	// password. Bots are always Available while online.
+	Bot bool
+
+	// APIKeyHash is the hash of the user's API key, with
+	// which a bot logs in, and with which any user's REST
+	// integrations, such as Zapier, authenticate.
+	APIKeyHash string
+
+	// Admin allows the user to use administrative messages,
+	// such as ServerStatsMessage.
+	Admin bool
+
+	// SuspendedUntil prevents the user from logging in
+	// until the given time.
+	SuspendedUntil time.Time
+
+	// ShadowLimited silently stops the user's buddy
+	// requests from reaching their recipients.
+	ShadowLimited bool
+
+	// Remote marks a user of another server, who is stored
+	// so that they can be buddies with this server's users.
+	// Remote users cannot log in.
+	Remote bool
+
+	// Reports are the abuse reports filed against the user.
+	Reports []Report
+
+	Stats UsageStats
+
+	// FeatureOverrides enable or disable features for the
+	// user regardless of FeatureFlags.Rollout.
+	FeatureOverrides map[Feature]bool
+
+	// TwoFactorSecret is the TOTP secret, or "" if two-factor
+	// authentication is disabled.
+	TwoFactorSecret string
+
+	// RecoveryCodes stores hashes of the unused recovery
+	// codes which may be used in place of a TOTP code.
+	RecoveryCodes []string
+
+	Buddies          []string
+	IncomingRequests []string
+	OutgoingRequests []string
+
+	// Greetings maps the senders of incoming requests to
+	// the introductions they attached to their requests.
+	Greetings map[string]string
+
+	// Blocked lists users who may not send this user
+	// requests or see this user's presence.
+	Blocked []string
+
+	// Aliases maps buddies to nicknames chosen by the user.
+	Aliases map[string]string
+
+	Profile Profile
+
+	// AwayNote is a longer message than the status message,
+	// which buddies may read while the user is Away or
+	// DoNotDisturb.
+	AwayNote string
+
+	// CustomStates are the user's own availability states.
+	CustomStates []CustomState
+
+	// DNDSuppressEvents indicates that non-critical events,
+	// such as buddy status changes, should not be sent to
+	// the user while they are in DoNotDisturb mode.
+	DNDSuppressEvents bool
+
+	// LastSeen is the last time that the user stopped
+	// appearing online.
+	LastSeen time.Time
+
+	// TimeZone is the IANA name of the user's time zone,
+	// or "" if they have not given it.
+	TimeZone string
+
+	Privacy PrivacySettings
+
+	// PublicPresence allows users who are not buddies to
+	// subscribe to the user's availability.
+	PublicPresence bool
+
+	// Discoverable lets users who have the user's email in
+	// their contacts find them by importing the contacts.
+	Discoverable bool
+
+	// MissedEvents are events which occurred while the user
+	// had no sessions.
+	MissedEvents []MissedEvent
+
+	// PushSubscriptions are the browsers which are sent
+	// notifications of missed events, oldest first.
+	PushSubscriptions []PushSubscription
+
+	// Webhooks are the URLs which the user has registered
+	// to be called on their own events.
+	Webhooks []Webhook
+
+	// Integrations connect the user to other services which
+	// their status is synchronized with.
+	Integrations []Integration
+
+	Schedule Schedule
+
+	// ScheduleWindow is the key of the schedule window
+	// whose status was last applied, or "" if it was
+	// applied outside of every window.
+	ScheduleWindow string
+
+	LatestStatus UserStatus
+
+	// StatusHistory lists the statuses which the user set,
+	// oldest first.
+	StatusHistory []StatusHistoryEntry
+
+	// ModTime is the last time that the user's settings,
+	// profile, or relationships changed.
+	// It does not reflect status changes.
+	ModTime time.Time
+}
+
+// Copy creates a deep copy of the object.
+//
+// The lists of emails share one allocation. Each list is
+// capped at its length, so appending to one of them moves
+// it instead of overwriting the next.
+func (u *UserInfo) Copy() *UserInfo {
+	res := *u
+	fields := [...]*[]string{&res.Buddies, &res.IncomingRequests, &res.OutgoingRequests,
+		&res.RecoveryCodes, &res.Blocked}
+	var total int
+	for _, field := range fields {
+		total += len(*field)
+	}
+	emails := make([]string, 0, total)
+	for _, field := range fields {
+		start := len(emails)
+		emails = append(emails, *field...)
+		*field = emails[start:len(emails):len(emails)]
+	}
+	res.Greetings = make(map[string]string, len(u.Greetings))
+	for email, greeting := range u.Greetings {
+		res.Greetings[email] = greeting
+	}
+	res.CustomStates = append([]CustomState{}, u.CustomStates...)
+	res.MissedEvents = append([]MissedEvent{}, u.MissedEvents...)
+	res.StatusHistory = append([]StatusHistoryEntry{}, u.StatusHistory...)
+	res.PushSubscriptions = append([]PushSubscription{}, u.PushSubscriptions...)
+	res.Webhooks = append([]Webhook{}, u.Webhooks...)
+	res.Integrations = append([]Integration{}, u.Integrations...)
+	res.Schedule.Rules = append([]ScheduleRule{}, u.Schedule.Rules...)
+	res.Reports = append([]Report{}, u.Reports...)
+	res.Aliases = make(map[string]string, len(u.Aliases))
+	for email, alias := range u.Aliases {
+		res.Aliases[email] = alias
+	}
+	res.FeatureOverrides = make(map[Feature]bool, len(u.FeatureOverrides))
+	for feature, enabled := range u.FeatureOverrides {
+		res.FeatureOverrides[feature] = enabled
+	}
+	return &res
+}
+
+// A StatusResult is one user's entry in the result of
+// GetStatuses.
+type StatusResult struct {
+	Status UserStatus
+
+	// Err is ErrNoEmail if the user does not exist, such
+	// as when they were deleted while a buddy list was
+	// being read.
+	Err error
+}
+
+// A BuddyState is what a user sees of one of their
+// buddies, read without copying the buddy's UserInfo.
+//
+// A buddy who no longer exists is Offline.
+type BuddyState struct {
+	Email   string
+	Status  UserStatus
+	Profile Profile
+
+	// LastSeen is zero unless the buddy lets their buddies
+	// see it.
+	LastSeen time.Time
+
+	TimeZone string
+
+	// Blocking is set if the buddy has blocked the user.
+	Blocking bool
+}
+
+// A DB provides synchronized access to a persistent store
+// of user information.
+type DB interface {
+	AddUser(email, password string) error
+
+	// AddBot creates a bot account, which logs in with the
+	// returned API key instead of a password.
+	AddBot(email string) (apiKey string, err error)
+
+	// RotateAPIKey replaces a bot's API key, failing with
+	// ErrNotBot for other users.
+	RotateAPIKey(email string) (apiKey string, err error)
+
+	// CreateAPIKey is like RotateAPIKey, but works for any
+	// user, so that they can authenticate integrations.
+	CreateAPIKey(email string) (apiKey string, err error)
+
+	// RevokeAPIKey removes a user's API key.
+	RevokeAPIKey(email string) error
+
+	// CheckAPIKey is like CheckLogin, but with an API key.
+	CheckAPIKey(email, apiKey string) error
+
+	// BeginVerification marks a user unverified, and
+	// creates the token which VerifyUser checks.
+	// Users fail CheckLogin with ErrNotVerified until they
+	// are verified.
+	BeginVerification(email string) (token string, err error)
+	VerifyUser(email, token string) error
+
+	// BeginPasswordReset creates a code with which
+	// ResetPassword may change the user's password until
+	// the lifetime passes.
+	BeginPasswordReset(email string, lifetime time.Duration) (code string, err error)
+	ResetPassword(email, code, newPass string) error
+
+	CheckLogin(email, password string) error
+	GetUserInfo(email string) (*UserInfo, error)
+	SetPassword(email, oldPass, newPass string) error
+
+	// ListUsers gets a copy of every user's info.
+	ListUsers() ([]*UserInfo, error)
+
+	// SetVerified and SetLocked are administrative
+	// operations.
+	// Locked users fail CheckLogin with ErrAccountLocked.
+	SetVerified(email string, verified bool) error
+	SetLocked(email string, locked bool) error
+	SetAdmin(email string, admin bool) error
+
+	// SetFeatureOverride enables or disables a feature for
+	// the user. A nil value removes the override.
+	SetFeatureOverride(email string, feature Feature, enabled *bool) error
+
+	// DeleteUser removes a user and every reference to them
+	// from other users' buddy lists, requests, aliases, and
+	// block lists.
+	DeleteUser(email string) error
+
+	// MergeUsers moves the relationships of one user into
+	// another and deletes the first, failing with
+	// ErrCannotMerge for bots and remote users.
+	MergeUsers(from, into string) error
+
+	// SetSuspended prevents the user from logging in until
+	// the given time.
+	// Suspended users fail CheckLogin with
+	// ErrAccountSuspended.
+	SetSuspended(email string, until time.Time) error
+
+	// SetShadowLimited changes whether the user's buddy
+	// requests are delivered.
+	SetShadowLimited(email string, limited bool) error
+
+	// AddReport files an abuse report against its target.
+	AddReport(report Report) error
+
+	// Reports lists every abuse report, oldest first.
+	Reports() ([]Report, error)
+
+	// ResolveReport records the action taken on a report.
+	ResolveReport(id string, action ModerationAction) error
+
+	// RecordUsage adds to the user's usage stats.
+	RecordUsage(email string, usage UsageStats) error
+
+	// Announcements lists every announcement, including
+	// those which are not active.
+	Announcements() ([]Announcement, error)
+
+	// SetAnnouncement adds an announcement, or replaces the
+	// announcement with the same ID.
+	SetAnnouncement(a Announcement) error
+
+	DeleteAnnouncement(id string) error
+
+	// SetLimits changes the limits enforced when buddy
+	// requests are sent and accepted.
+	SetLimits(limits Limits)
+
+	// SetReadOnly makes every change fail with
+	// ErrMaintenance, leaving the underlying storage
+	// untouched, until it is called again with false.
+	SetReadOnly(readOnly bool)
+
+	// SetAlerter sets the Alerter which is told when
+	// changes cannot be saved.
+	SetAlerter(a *Alerter)
+
+	// ImportUsers adds users from a backup, such as one
+	// produced by ListUsers.
+	// Users whose emails are already in use are skipped.
+	ImportUsers(users []*UserInfo) (imported int, err error)
+
+	// CheckTwoFactor checks a TOTP code or a recovery code.
+	// If a recovery code is used, it is consumed.
+	//
+	// If the user does not have two-factor authentication
+	// enabled, any code is accepted.
+	CheckTwoFactor(email, code string) error
+
+	// EnableTwoFactor generates a new TOTP secret and set of
+	// recovery codes for the user.
+	EnableTwoFactor(email string) (secret string, recoveryCodes []string, err error)
+
+	DisableTwoFactor(email string) error
+
+	// RegenerateRecoveryCodes replaces the user's recovery
+	// codes with a new set.
+	RegenerateRecoveryCodes(email string) ([]string, error)
+
+	// SendRequest creates a buddy request, optionally with a
+	// greeting for the recipient.
+	SendRequest(from, to, greeting string) error
+	AcceptRequest(email, other string) error
+
+	// DeclineRequest removes an incoming request from other
+	// without making the users buddies.
+	DeclineRequest(email, other string) error
+
+	// CancelRequest withdraws an outgoing request to other.
+	CancelRequest(email, other string) error
+	DeleteBuddy(email, other string) error
+
+	BlockUser(email, other string) error
+	UnblockUser(email, other string) error
+
+	SetDNDSuppressEvents(email string, suppress bool) error
+
+	SetLastSeen(email string, t time.Time) error
+
+	// SetTimeZone changes the user's time zone, failing
+	// with ErrInvalidTimeZone if it is unknown.
+	SetTimeZone(email, zone string) error
+
+	// SetPrivacy replaces the user's privacy settings,
+	// failing if any of them is unknown.
+	SetPrivacy(email string, privacy PrivacySettings) error
+	SetPublicPresence(email string, public bool) error
+
+	// AddMissedEvent stores an event for the user's next
+	// login, dropping old events past MaxMissedEvents.
+	AddMissedEvent(email string, event MissedEvent) error
+
+	// TakeMissedEvents returns and clears the user's missed
+	// events.
+	TakeMissedEvents(email string) ([]MissedEvent, error)
+
+	// AddPushSubscription adds or replaces the subscription
+	// with the same endpoint, dropping the oldest past
+	// MaxPushSubscriptions.
+	AddPushSubscription(email string, sub PushSubscription) error
+
+	// RemovePushSubscription removes the subscription with
+	// an endpoint, if there is one.
+	RemovePushSubscription(email, endpoint string) error
+
+	// AddWebhook registers a webhook for the user, failing
+	// with ErrTooManyWebhooks past MaxWebhooks.
+	AddWebhook(email string, hook Webhook) error
+
+	// RemoveWebhook removes a webhook by its ID, failing
+	// with ErrNoWebhook if there is none.
+	RemoveWebhook(email, id string) error
+
+	// SetIntegration adds an integration, or replaces the
+	// user's integration with the same provider.
+	SetIntegration(email string, in Integration) error
+
+	// RemoveIntegration fails with ErrNoIntegration if the
+	// user has no integration with the provider.
+	RemoveIntegration(email, provider string) error
+
+	// SetSchedule replaces the user's schedule, failing
+	// with ErrInvalidSchedule if it is invalid, so that its
+	// current window is applied again.
+	SetSchedule(email string, schedule Schedule) error
+
+	// SetScheduleWindow records the schedule window whose
+	// status was applied.
+	SetScheduleWindow(email, window string) error
+
+	SetDiscoverable(email string, discoverable bool) error
+
+	// FindDiscoverable finds the discoverable users among
+	// emails, checking at most MaxContactLookup of them,
+	// who the viewer could send buddy requests to.
+	FindDiscoverable(viewer string, emails []string) ([]*UserInfo, error)
+
+	// SuggestBuddies finds at most MaxBuddySuggestions
+	// discoverable buddies of the viewer's buddies who the
+	// viewer could send buddy requests to, with the most
+	// mutual buddies first.
+	SuggestBuddies(viewer string) ([]BuddySuggestion, error)
+
+	// SetCustomStates replaces the user's custom states.
+	SetCustomStates(email string, states []CustomState) error
+
+	// SetProfile changes the user's profile, except for
+	// the avatar hash, which is changed by SetAvatar.
+	SetProfile(email string, profile Profile) error
+
+	// SetAvatar changes the user's avatar hash.
+	SetAvatar(email, hash string) error
+
+	SetAwayNote(email, note string) error
+
+	// SetAlias sets the user's nickname for a buddy.
+	// An empty alias removes the nickname.
+	SetAlias(email, buddy, alias string) error
+
+	SetStatus(email string, status UserStatus) error
+
+	// GetStatuses gets the status of each user, failing
+	// only for the missing users' results, so that one
+	// missing user does not fail the batch.
+	GetStatuses(emails []string) ([]StatusResult, error)
+
+	// GetBuddyStates is like GetStatuses, but gets all of
+	// what a user sees of the listed buddies.
+	GetBuddyStates(email string, buddies []string) ([]BuddyState, error)
+
+	// AcquireLease takes or renews the named lease for a
+	// holder until ttl passes, and reports false if another
+	// holder's lease has not expired yet.
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease gives up a lease if the holder has it.
+	ReleaseLease(name, holder string) error
+}
+
+type fileDB struct {
+	Lock                sync.RWMutex
+	Path                string
+	UserRecords         []*UserInfo
+	AnnouncementRecords []Announcement
+	LeaseRecords        map[string]Lease
+
+	readOnly bool
+	limits   Limits
+
+	// alerter is told when the file cannot be written.
+	alerter *Alerter
+
+	// shared is set if other processes may change the
+	// file, in which case loaded is the version which was
+	// last loaded.
+	//
+	// The file is kept open so that its inode cannot be
+	// reused by a replacement, which would look unchanged.
+	shared bool
+	loaded *os.File
+}
+
+// fileDBContents is the format of a fileDB's file.
+//
+// Older formats are upgraded by fileDBMigrations.
+type fileDBContents struct {
+	Version       int
+	Users         []*UserInfo
+	Announcements []Announcement
+	Leases        map[string]Lease `json:",omitempty"`
+}
+
+// OpenFileDB loads a DB from a JSON file, creating an
+// empty DB if the file does not exist.
+//
+// A file in an older format is upgraded and written back
+// before the DB is returned.
+//
+// Every change is written back to the file.
+func OpenFileDB(path string) (db DB, err error) {
+	defer essentials.AddCtxTo("open file DB", &err)
+	res := &fileDB{Path: path}
+	if err := res.open(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// OpenSharedFileDB is like OpenFileDB, but the file may be
+// shared by several processes, such as the nodes of a
+// cluster on one host or on a shared filesystem.
+//
+// Changes are serialized with a lock file next to the DB,
+// and each process reloads the file when another process
+// has replaced it.
+//
+// The file is upgraded while holding the lock, so only the
+// first process to open it after a deploy migrates it, and
+// processes of an older version refuse to open it after.
+func OpenSharedFileDB(path string) (db DB, err error) {
+	defer essentials.AddCtxTo("open shared file DB", &err)
+	res := &fileDB{Path: path, shared: true}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := res.open(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// open loads the file, and writes it back if it had to be
+// migrated.
+func (f *fileDB) open() error {
+	migrated, err := f.load()
+	if err != nil || migrated == 0 {
+		return err
+	}
+	LogAt(LogInfo, "migrated %s to version %d (%d migrations)\n", f.Path, FileDBVersion,
+		migrated)
+	return f.write()
+}
+
+// load reads the file, which may not exist yet, and
+// returns the number of migrations which were applied to
+// its contents.
+func (f *fileDB) load() (migrated int, err error) {
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		f.UserRecords = nil
+		f.AnnouncementRecords = nil
+		f.LeaseRecords = nil
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	if !f.shared {
+		file.Close()
+	} else {
+		f.setLoaded(file)
+	}
+	contents, migrated, err = migrateFileDB(contents)
+	if err != nil {
+		return 0, err
+	}
+	var obj fileDBContents
+	if err := json.Unmarshal(contents, &obj); err != nil {
+		return 0, err
+	}
+	f.UserRecords = obj.Users
+	f.AnnouncementRecords = obj.Announcements
+	if f.shared {
+		f.LeaseRecords = obj.Leases
+	}
+	return migrated, nil
+}
+
+func (f *fileDB) setLoaded(file *os.File) {
+	if f.loaded != nil {
+		f.loaded.Close()
+	}
+	f.loaded = file
+}
+
+// reload loads a shared file if it has been replaced
+// since it was last loaded.
+//
+// The caller must hold f.Lock for writing.
+func (f *fileDB) reload() error {
+	info, err := os.Stat(f.Path)
+	if os.IsNotExist(err) && f.loaded == nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if f.loaded != nil {
+		if loadedInfo, err := f.loaded.Stat(); err == nil && os.SameFile(info, loadedInfo) {
+			return nil
+		}
+	}
+	_, err = f.load()
+	return err
+}
+
+// beginRead locks the DB for reading, reloading a shared
+// file first if necessary.
+func (f *fileDB) beginRead() {
+	if f.shared {
+		f.Lock.Lock()
+		if err := f.reload(); err != nil {
+			f.alerter.Raise(AlertDBWrite, "reload: "+err.Error())
+		}
+		f.Lock.Unlock()
+	}
+	f.Lock.RLock()
+}
+
+func (f *fileDB) AddUser(email, password string) error {
+	return f.mutate("add user", func() error {
+		if f.findUser(email) != nil {
+			return ErrEmailInUse
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		f.UserRecords = append(f.UserRecords, &UserInfo{
+			Email: email,
+			Hash:  hash,
+
+			// Users start out verified, until
+			// BeginVerification clears the flag.
+			Verified: true,
+
+			LatestStatus: UserStatus{Availability: Available, Time: time.Now()},
+			ModTime:      time.Now(),
+		})
+		return nil
+	})
+}
+
+func (f *fileDB) CheckLogin(email, password string) (err error) {
+	defer essentials.AddCtxTo("check login", &err)
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	if user := f.findUser(email); user != nil && !user.Remote {
+		if user.Bot {
+			return ErrPassword
+		} else if err := checkPasswordHash(user.Hash, password); err != nil {
+			return err
+		} else if !user.Verified && user.VerifyToken != "" {
+			return ErrNotVerified
+		} else if user.Locked {
+			return ErrAccountLocked
+		} else if time.Now().Before(user.SuspendedUntil) {
+			return ErrAccountSuspended
+		}
+		return nil
+	}
+	return ErrNoEmail
+}
+
+func (f *fileDB) GetUserInfo(email string) (*UserInfo, error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	if user := f.findUser(email); user != nil {
+		return user.Copy(), nil
+	}
+	return nil, essentials.AddCtx("get user info", ErrNoEmail)
+}
+
+func (f *fileDB) SetPassword(email, oldPass, newPass string) error {
+	return f.mutate("set password", func() error {
+		if user := f.findUser(email); user != nil {
+			if err := checkPasswordHash(user.Hash, oldPass); err != nil {
+				return err
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			user.Hash = hash
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) CheckTwoFactor(email, code string) (err error) {
+	defer essentials.AddCtxTo("check two-factor", &err)
+	secret, recovery, err := f.twoFactorState(email, code)
+	if err != nil {
+		return err
+	} else if secret == "" {
+		return nil
+	} else if code == "" {
+		return ErrTwoFactorRequired
+	} else if checkTOTP(secret, code, time.Now()) {
+		return nil
+	} else if !recovery {
+		return ErrTwoFactorCode
+	}
+
+	// Only a recovery code changes the DB, since it is used
+	// up, so logins with TOTP codes work during maintenance.
+	codeHash := hashPassword(normalizeRecoveryCode(code))
+	return f.mutate("use recovery code", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		for i, hash := range user.RecoveryCodes {
+			if hash == codeHash {
+				essentials.OrderedDelete(&user.RecoveryCodes, i)
+				return nil
+			}
+		}
+		return ErrTwoFactorCode
+	})
+}
+
+// twoFactorState reads a user's TOTP secret, and whether
+// code is one of their unused recovery codes.
+func (f *fileDB) twoFactorState(email, code string) (secret string, recovery bool, err error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	user := f.findUser(email)
+	if user == nil {
+		return "", false, ErrNoEmail
+	}
+	if code != "" {
+		codeHash := hashPassword(normalizeRecoveryCode(code))
+		for _, hash := range user.RecoveryCodes {
+			if hash == codeHash {
+				recovery = true
+				break
+			}
+		}
+	}
+	return user.TwoFactorSecret, recovery, nil
+}
+
+func (f *fileDB) EnableTwoFactor(email string) (secret string, codes []string, err error) {
+	err = f.mutate("enable two-factor", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		if user.TwoFactorSecret != "" {
+			return ErrTwoFactorEnabled
+		}
+		secret, err = generateTOTPSecret()
+		if err != nil {
+			return err
+		}
+		codes, err = generateRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		user.TwoFactorSecret = secret
+		user.RecoveryCodes = hashRecoveryCodes(codes)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return
+}
+
+func (f *fileDB) DisableTwoFactor(email string) error {
+	return f.mutate("disable two-factor", func() error {
+		if user := f.findUser(email); user != nil {
+			user.TwoFactorSecret = ""
+			user.RecoveryCodes = nil
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) RegenerateRecoveryCodes(email string) (codes []string, err error) {
+	err = f.mutate("regenerate recovery codes", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		if user.TwoFactorSecret == "" {
+			return ErrTwoFactorDisabled
+		}
+		codes, err = generateRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		user.RecoveryCodes = hashRecoveryCodes(codes)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (f *fileDB) ListUsers() ([]*UserInfo, error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	res := make([]*UserInfo, len(f.UserRecords))
+	for i, user := range f.UserRecords {
+		res[i] = user.Copy()
+	}
+	return res, nil
+}
+
+func (f *fileDB) SetVerified(email string, verified bool) error {
+	return f.mutate("set verified", func() error {
+		if user := f.findUser(email); user != nil {
+			user.Verified = verified
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetLocked(email string, locked bool) error {
+	return f.mutate("set locked", func() error {
+		if user := f.findUser(email); user != nil {
+			user.Locked = locked
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetSuspended(email string, until time.Time) error {
+	return f.mutate("set suspended", func() error {
+		if user := f.findUser(email); user != nil {
+			user.SuspendedUntil = until
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetShadowLimited(email string, limited bool) error {
+	return f.mutate("set shadow limited", func() error {
+		if user := f.findUser(email); user != nil {
+			user.ShadowLimited = limited
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) RecordUsage(email string, usage UsageStats) error {
+	return f.mutate("record usage", func() error {
+		if user := f.findUser(email); user != nil {
+			user.Stats.Add(usage)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) Announcements() ([]Announcement, error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	return append([]Announcement{}, f.AnnouncementRecords...), nil
+}
+
+func (f *fileDB) SetAnnouncement(a Announcement) error {
+	return f.mutate("set announcement", func() error {
+		for i, old := range f.AnnouncementRecords {
+			if old.ID == a.ID {
+				f.AnnouncementRecords[i] = a
+				return nil
+			}
+		}
+		f.AnnouncementRecords = append(f.AnnouncementRecords, a)
+		return nil
+	})
+}
+
+func (f *fileDB) DeleteAnnouncement(id string) error {
+	return f.mutate("delete announcement", func() error {
+		for i, a := range f.AnnouncementRecords {
+			if a.ID == id {
+				essentials.OrderedDelete(&f.AnnouncementRecords, i)
+				return nil
+			}
+		}
+		return ErrNoAnnouncement
+	})
+}
+
+func (f *fileDB) AddReport(report Report) error {
+	return f.mutate("add report", func() error {
+		if user := f.findUser(report.Target); user != nil {
+			report.Target = user.Email
+			user.Reports = append(user.Reports, report)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) Reports() ([]Report, error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	var res []Report
+	for _, user := range f.UserRecords {
+		res = append(res, user.Reports...)
+	}
+	sortReports(res)
+	return res, nil
+}
+
+func (f *fileDB) ResolveReport(id string, action ModerationAction) error {
+	return f.mutate("resolve report", func() error {
+		for _, user := range f.UserRecords {
+			for i, report := range user.Reports {
+				if report.ID == id {
+					if report.Resolved() {
+						return ErrReportResolved
+					}
+					user.Reports[i].Action = action
+					user.Reports[i].ResolvedTime = time.Now()
+					return nil
+				}
+			}
+		}
+		return ErrNoReport
+	})
+}
+
+func (f *fileDB) SetAdmin(email string, admin bool) error {
+	return f.mutate("set admin", func() error {
+		if user := f.findUser(email); user != nil {
+			user.Admin = admin
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetFeatureOverride(email string, feature Feature, enabled *bool) error {
+	return f.mutate("set feature override", func() error {
+		if user := f.findUser(email); user != nil {
+			if enabled == nil {
+				delete(user.FeatureOverrides, feature)
+			} else {
+				if user.FeatureOverrides == nil {
+					user.FeatureOverrides = map[Feature]bool{}
+				}
+				user.FeatureOverrides[feature] = *enabled
+			}
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) DeleteUser(email string) error {
+	return f.mutate("delete user", func() error {
+		for i, user := range f.UserRecords {
+			if EmailsEquivalent(user.Email, email) {
+				essentials.OrderedDelete(&f.UserRecords, i)
+				for _, other := range f.UserRecords {
+					if forgetEmail(other, user.Email) {
+						touch(other)
+					}
+				}
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) ImportUsers(users []*UserInfo) (imported int, err error) {
+	err = f.mutate("import users", func() error {
+		for _, user := range users {
+			if f.findUser(user.Email) == nil {
+				f.UserRecords = append(f.UserRecords, user.Copy())
+				imported++
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (f *fileDB) SendRequest(from, to, greeting string) error {
+	return f.mutate("send request", func() error {
+		if fromUser := f.findUser(from); fromUser != nil {
+			if toUser := f.findUser(to); toUser != nil {
+				// Requests to users who blocked the sender are
+				// silently dropped, like those of shadow-limited
+				// users.
+				dropped := HasBlocked(toUser, fromUser) && !HasBlocked(fromUser, toUser)
+				if dropped {
+					if ContainsEmail(fromUser.Buddies, toUser.Email) {
+						return ErrAlreadyBuddies
+					}
+				} else if err := RequestBlocker(fromUser, toUser); err != nil {
+					return err
+				}
+				if err := f.limits.checkNewRequest(fromUser); err != nil {
+					return err
+				}
+				if fromUser.ShadowLimited || dropped {
+					// The request only appears to be sent.
+					if ContainsEmail(fromUser.OutgoingRequests, toUser.Email) {
+						return ErrRequestExists
+					}
+					fromUser.OutgoingRequests = append(fromUser.OutgoingRequests, toUser.Email)
+					touch(fromUser)
+					return nil
+				}
+				toUser.IncomingRequests = append(toUser.IncomingRequests, fromUser.Email)
+				fromUser.OutgoingRequests = append(fromUser.OutgoingRequests, toUser.Email)
+				if greeting != "" {
+					if toUser.Greetings == nil {
+						toUser.Greetings = map[string]string{}
+					}
+					toUser.Greetings[fromUser.Email] = greeting
+				}
+				touch(fromUser, toUser)
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) AcceptRequest(email, other string) error {
+	return f.mutate("accept request", func() error {
+		if user := f.findUser(email); user != nil {
+			if otherUser := f.findUser(other); otherUser != nil {
+				if !ContainsEmail(otherUser.OutgoingRequests, user.Email) {
+					return ErrNoRequest
+				} else if HasBlocked(user, otherUser) || HasBlocked(otherUser, user) {
+					return ErrBlocked
+				} else if err := f.limits.checkNewBuddy(user); err != nil {
+					return err
+				} else if err := f.limits.checkNewBuddy(otherUser); err != nil {
+					return err
+				}
+				removeEmail(&otherUser.OutgoingRequests, user.Email)
+				removeEmail(&user.IncomingRequests, otherUser.Email)
+				delete(user.Greetings, otherUser.Email)
+
+				// A shadow-limited user may have an undelivered
+				// request to the other user.
+				removeEmail(&user.OutgoingRequests, otherUser.Email)
+
+				otherUser.Buddies = append(otherUser.Buddies, user.Email)
+				user.Buddies = append(user.Buddies, otherUser.Email)
+				touch(user, otherUser)
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) DeclineRequest(email, other string) error {
+	return f.mutate("decline request", func() error {
+		if user := f.findUser(email); user != nil {
+			if otherUser := f.findUser(other); otherUser != nil {
+				if !ContainsEmail(otherUser.OutgoingRequests, user.Email) {
+					return ErrNoRequest
+				}
+				removeEmail(&otherUser.OutgoingRequests, user.Email)
+				removeEmail(&user.IncomingRequests, otherUser.Email)
+				delete(user.Greetings, otherUser.Email)
+				touch(user, otherUser)
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) CancelRequest(email, other string) error {
+	return f.mutate("cancel request", func() error {
+		if user := f.findUser(email); user != nil {
+			if otherUser := f.findUser(other); otherUser != nil {
+				if !ContainsEmail(user.OutgoingRequests, otherUser.Email) {
+					return ErrNoRequest
+				}
+				removeEmail(&user.OutgoingRequests, otherUser.Email)
+				removeEmail(&otherUser.IncomingRequests, user.Email)
+				delete(otherUser.Greetings, user.Email)
+				touch(user, otherUser)
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) DeleteBuddy(email, other string) error {
+	return f.mutate("delete buddy", func() error {
+		if user := f.findUser(email); user != nil {
+			if otherUser := f.findUser(other); otherUser != nil {
+				if ContainsEmail(user.IncomingRequests, otherUser.Email) {
+					removeEmail(&user.IncomingRequests, otherUser.Email)
+					removeEmail(&otherUser.OutgoingRequests, user.Email)
+					delete(user.Greetings, otherUser.Email)
+				} else if ContainsEmail(user.OutgoingRequests, otherUser.Email) {
+					removeEmail(&user.OutgoingRequests, otherUser.Email)
+					removeEmail(&otherUser.IncomingRequests, user.Email)
+					delete(otherUser.Greetings, user.Email)
+				} else if ContainsEmail(user.Buddies, otherUser.Email) {
+					removeEmail(&user.Buddies, otherUser.Email)
+					removeEmail(&otherUser.Buddies, user.Email)
+					delete(user.Aliases, otherUser.Email)
+					delete(otherUser.Aliases, user.Email)
+				} else {
+					return ErrNotBuddies
+				}
+				touch(user, otherUser)
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) BlockUser(email, other string) error {
+	return f.mutate("block user", func() error {
+		if user := f.findUser(email); user != nil {
+			if otherUser := f.findUser(other); otherUser != nil {
+				if HasBlocked(user, otherUser) {
+					return ErrAlreadyBlocked
+				}
+				user.Blocked = append(user.Blocked, otherUser.Email)
+				severBlocked(user, otherUser)
+				touch(user, otherUser)
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+// severBlocked removes the links between a user and
+// someone they blocked.
+func severBlocked(user, blocked *UserInfo) {
+	// The users stop being buddies in the same change, so
+	// that no reader sees a blocked buddy.
+	removeEmail(&user.Buddies, blocked.Email)
+	removeEmail(&blocked.Buddies, user.Email)
+	delete(user.Aliases, blocked.Email)
+	delete(blocked.Aliases, user.Email)
+
+	// The blocked user's request is dropped from the
+	// blocker's list, but appears pending to them.
+	removeEmail(&user.IncomingRequests, blocked.Email)
+	delete(user.Greetings, blocked.Email)
+	removeEmail(&user.OutgoingRequests, blocked.Email)
+	removeEmail(&blocked.IncomingRequests, user.Email)
+	delete(blocked.Greetings, user.Email)
+}
+
+func (f *fileDB) UnblockUser(email, other string) error {
+	return f.mutate("unblock user", func() error {
+		if user := f.findUser(email); user != nil {
+			if !ContainsEmail(user.Blocked, other) {
+				return ErrNotBlocked
+			}
+			removeEmail(&user.Blocked, other)
+			touch(user, f.findUser(other))
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetDNDSuppressEvents(email string, suppress bool) error {
+	return f.mutate("set DND settings", func() error {
+		if user := f.findUser(email); user != nil {
+			user.DNDSuppressEvents = suppress
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetCustomStates(email string, states []CustomState) error {
+	return f.mutate("set custom states", func() error {
+		if user := f.findUser(email); user != nil {
+			user.CustomStates = append([]CustomState{}, states...)
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetProfile(email string, profile Profile) error {
+	return f.mutate("set profile", func() error {
+		if user := f.findUser(email); user != nil {
+			profile.AvatarHash = user.Profile.AvatarHash
+			profile.AvatarURL = ""
+			profile.Bot = user.Bot
+			user.Profile = profile
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetAwayNote(email, note string) error {
+	return f.mutate("set away note", func() error {
+		if user := f.findUser(email); user != nil {
+			user.AwayNote = note
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetAvatar(email, hash string) error {
+	return f.mutate("set avatar", func() error {
+		if user := f.findUser(email); user != nil {
+			user.Profile.AvatarHash = hash
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetAlias(email, buddy, alias string) error {
+	return f.mutate("set alias", func() error {
+		if user := f.findUser(email); user != nil {
+			if buddyUser := f.findUser(buddy); buddyUser != nil {
+				if !ContainsEmail(user.Buddies, buddyUser.Email) {
+					return ErrNotBuddies
+				}
+				if alias == "" {
+					delete(user.Aliases, buddyUser.Email)
+				} else {
+					if user.Aliases == nil {
+						user.Aliases = map[string]string{}
+					}
+					user.Aliases[buddyUser.Email] = alias
+				}
+				touch(user)
+				return nil
+			}
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetLastSeen(email string, t time.Time) error {
+	return f.mutate("set last seen", func() error {
+		if user := f.findUser(email); user != nil {
+			user.LastSeen = t
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetPublicPresence(email string, public bool) error {
+	return f.mutate("set public presence", func() error {
+		if user := f.findUser(email); user != nil {
+			user.PublicPresence = public
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) AddMissedEvent(email string, event MissedEvent) error {
+	return f.mutate("add missed event", func() error {
+		if user := f.findUser(email); user != nil {
+			user.MissedEvents = append(user.MissedEvents, event)
+			if extra := len(user.MissedEvents) - MaxMissedEvents; extra > 0 {
+				user.MissedEvents = append([]MissedEvent{}, user.MissedEvents[extra:]...)
+			}
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) TakeMissedEvents(email string) (events []MissedEvent, err error) {
+	err = f.mutate("take missed events", func() error {
+		if user := f.findUser(email); user != nil {
+			events = user.MissedEvents
+			user.MissedEvents = nil
+			return nil
+		}
+		return ErrNoEmail
+	})
+	return
+}
+
+func (f *fileDB) SetStatus(email string, status UserStatus) error {
+	return f.mutate("set status", func() error {
+		if user := f.findUser(email); user != nil {
+			if !status.Availability.Settable() && !user.Remote {
+				// Remote users' statuses are stored as their
+				// buddies see them, which may be offline.
+				return ErrInvalidAvailability
+			}
+			if user.Bot {
+				// Bots only set their messages.
+				status.Availability = Available
+				status.Idle = false
+				status.Custom = nil
+			}
+			user.LatestStatus = status
+			user.LatestStatus.Time = time.Now()
+			recordStatus(user, user.LatestStatus, f.limits.StatusHistoryLength)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) GetStatuses(emails []string) ([]StatusResult, error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+
+	result := make([]StatusResult, len(emails))
+	for i, email := range emails {
+		if user := f.findUser(email); user != nil {
+			result[i].Status = user.LatestStatus
+		} else {
+			result[i].Err = ErrNoEmail
+		}
+	}
+	return result, nil
+}
+
+func (f *fileDB) GetBuddyStates(email string, buddies []string) ([]BuddyState, error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+
+	result := make([]BuddyState, len(buddies))
+	for i, buddy := range buddies {
+		user := f.findUser(buddy)
+		if user == nil {
+			result[i] = BuddyState{Email: buddy}
+			continue
+		}
+		result[i] = BuddyState{
+			Email:    user.Email,
+			Status:   user.LatestStatus,
+			Profile:  user.Profile,
+			Blocking: ContainsEmail(user.Blocked, email),
+			TimeZone: user.TimeZone,
+		}
+		if user.Privacy.LastSeen.VisibleToBuddies() {
+			result[i].LastSeen = user.LastSeen
+		}
+		if !user.Privacy.StatusMessage.VisibleToBuddies() {
+			result[i].Status = result[i].Status.HideMessage()
+		}
+	}
+	return result, nil
+}
+
+func (f *fileDB) SetLimits(limits Limits) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	f.limits = limits
+}
+
+func (f *fileDB) SetReadOnly(readOnly bool) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	f.readOnly = readOnly
+}
+
+func (f *fileDB) SetAlerter(a *Alerter) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	f.alerter = a
+}
+
+func (f *fileDB) mutate(ctx string, mutator func() error) (err error) {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+
+	if f.readOnly {
+		return essentials.AddCtx(ctx, ErrMaintenance)
+	}
+
+	if f.shared {
+		unlock, err := lockFile(f.Path + ".lock")
+		if err != nil {
+			return essentials.AddCtx(ctx, err)
+		}
+		defer unlock()
+		if err := f.reload(); err != nil {
+			return essentials.AddCtx(ctx, err)
+		}
+	}
+
+	if err := mutator(); err != nil {
+		return essentials.AddCtx(ctx, err)
+	}
+	err = f.write()
+	if err != nil {
+		f.alerter.Raise(AlertDBWrite, ctx+": "+err.Error())
+	}
+	return err
+}
+
+// write saves the records to the file in the current
+// format.
+func (f *fileDB) write() error {
+	obj := &fileDBContents{
+		Version:       FileDBVersion,
+		Users:         f.UserRecords,
+		Announcements: f.AnnouncementRecords,
+	}
+	if f.shared {
+		obj.Leases = f.LeaseRecords
+	}
+	contents, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if f.shared {
+		return f.replaceFile(contents)
+	}
+	return ioutil.WriteFile(f.Path, contents, 0600)
+}
+
+// replaceFile atomically replaces a shared file, so that
+// other processes never read a partial write, and so that
+// they see a new file to reload.
+func (f *fileDB) replaceFile(contents []byte) error {
+	tempPath := f.Path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, contents, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, f.Path); err != nil {
+		return err
+	}
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	f.setLoaded(file)
+	return nil
+}
+
+func (f *fileDB) findUser(email string) *UserInfo {
+	for _, user := range f.UserRecords {
+		if EmailsEquivalent(user.Email, email) {
+			return user
+		}
+	}
+	return nil
+}
+
+func EmailsEquivalent(e1, e2 string) bool {
+	// TODO: check for dots, case sensitivity, etc.
+	return e1 == e2
+}
+
+// RequestBlocker returns the reason that one user may not
+// send a buddy request to another, or nil if they may.
+func RequestBlocker(from, to *UserInfo) error {
+	if HasBlocked(to, from) || HasBlocked(from, to) {
+		return ErrBlocked
+	} else if ContainsEmail(to.Buddies, from.Email) {
+		return ErrAlreadyBuddies
+	} else if ContainsEmail(to.OutgoingRequests, from.Email) && !to.ShadowLimited {
+		return ErrReverseRequestExists
+	} else if ContainsEmail(to.IncomingRequests, from.Email) {
+		return ErrRequestExists
+	} else if !to.Privacy.Requests.Allows(from, to) {
+		return ErrRequestsRestricted
+	}
+	return nil
+}
+
+// HasBlocked checks if blocker has blocked the other user.
+func HasBlocked(blocker, other *UserInfo) bool {
+	return ContainsEmail(blocker.Blocked, other.Email)
+}
+
+func ContainsEmail(list []string, email string) bool {
+	for _, item := range list {
+		if EmailsEquivalent(item, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetEmail removes every reference to an email from a
+// user's lists, and reports whether there were any.
+func forgetEmail(user *UserInfo, email string) bool {
+	found := ContainsEmail(user.Buddies, email) ||
+		ContainsEmail(user.IncomingRequests, email) ||
+		ContainsEmail(user.OutgoingRequests, email) ||
+		ContainsEmail(user.Blocked, email)
+	removeEmail(&user.Buddies, email)
+	removeEmail(&user.IncomingRequests, email)
+	removeEmail(&user.OutgoingRequests, email)
+	removeEmail(&user.Blocked, email)
+	delete(user.Greetings, email)
+	delete(user.Aliases, email)
+	return found
+}
+
+func removeEmail(list *[]string, email string) {
+	for i, item := range *list {
+		if EmailsEquivalent(item, email) {
+			essentials.OrderedDelete(list, i)
+			return
+		}
+	}
+}
+
+// touch updates the ModTime of users whose relationships
+// or settings changed.
+// Nil users are ignored.
+func touch(users ...*UserInfo) {
+	now := time.Now()
+	for _, user := range users {
+		if user != nil {
+			user.ModTime = now
+		}
+	}
+}
+
+func hashPassword(pass string) string {
+	hash := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(hash[:])
+}
+
+func checkPasswordHash(hash []byte, password string) error {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPassword
+	}
+	return err
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	var res []string
+	for _, code := range codes {
+		res = append(res, hashPassword(normalizeRecoveryCode(code)))
+	}
+	return res
+}
@@ -0,0 +1,73 @@
+package statusdb
+
+import (
+	"fmt"
+)
+
+// CheckUsers looks for inconsistencies between user
+// records, such as one-sided buddy relationships or
+// references to users who do not exist.
+//
+// The result describes each problem in a human-readable
+// form, and is empty if no problems were found.
+func CheckUsers(users []*UserInfo) []string {
+	var problems []string
+	byEmail := map[string]*UserInfo{}
+	for _, user := range users {
+		if byEmail[user.Email] != nil {
+			problems = append(problems, fmt.Sprintf("duplicate user: %s", user.Email))
+		}
+		byEmail[user.Email] = user
+	}
+
+	checkLink := func(user *UserInfo, list string, other string, reverse func(*UserInfo) []string) {
+		otherUser := byEmail[other]
+		if otherUser == nil {
+			problems = append(problems, fmt.Sprintf("%s: %s references missing user %s",
+				user.Email, list, other))
+		} else if reverse != nil && !ContainsEmail(reverse(otherUser), user.Email) {
+			problems = append(problems, fmt.Sprintf("%s: %s entry %s is not reciprocated",
+				user.Email, list, other))
+		}
+	}
+
+	for _, user := range users {
+		for _, other := range user.Buddies {
+			checkLink(user, "buddies", other, func(u *UserInfo) []string { return u.Buddies })
+		}
+		for _, other := range user.IncomingRequests {
+			checkLink(user, "incoming requests", other,
+				func(u *UserInfo) []string { return u.OutgoingRequests })
+		}
+		for _, other := range user.OutgoingRequests {
+			if user.ShadowLimited || (byEmail[other] != nil && HasBlocked(byEmail[other], user)) {
+				// Requests from shadow-limited users, and to
+				// users who blocked the sender, are not
+				// delivered.
+				checkLink(user, "outgoing requests", other, nil)
+			} else {
+				checkLink(user, "outgoing requests", other,
+					func(u *UserInfo) []string { return u.IncomingRequests })
+			}
+		}
+		for _, other := range user.Blocked {
+			checkLink(user, "blocked", other, nil)
+			if ContainsEmail(user.Buddies, other) {
+				problems = append(problems, fmt.Sprintf("%s: blocked buddy %s", user.Email, other))
+			}
+		}
+		for other := range user.Greetings {
+			if !ContainsEmail(user.IncomingRequests, other) {
+				problems = append(problems, fmt.Sprintf("%s: greeting from %s without a request",
+					user.Email, other))
+			}
+		}
+		for other := range user.Aliases {
+			if !ContainsEmail(user.Buddies, other) {
+				problems = append(problems, fmt.Sprintf("%s: alias for non-buddy %s",
+					user.Email, other))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,5 @@
+package statusdb
+
+// A Feature names functionality which may be rolled out to
+// a subset of users.
+type Feature string
@@ -0,0 +1,43 @@
+package statusdb
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrHistoryHidden = errors.New("status history is not visible")
+
+// A StatusHistoryEntry records a status which a user set.
+//
+// Statuses are only recorded while the Limits'
+// StatusHistoryLength is positive.
+type StatusHistoryEntry struct {
+	Time         time.Time    `json:"time"`
+	Availability Availability `json:"availability"`
+	Message      string       `json:"message,omitempty"`
+	Emoji        string       `json:"emoji,omitempty"`
+}
+
+// HideMessage is like UserStatus.HideMessage.
+func (s StatusHistoryEntry) HideMessage() StatusHistoryEntry {
+	s.Message = ""
+	s.Emoji = ""
+	return s
+}
+
+// recordStatus adds a status to the user's history,
+// dropping the oldest entries past length.
+func recordStatus(user *UserInfo, status UserStatus, length int) {
+	if length <= 0 || user.Remote {
+		return
+	}
+	user.StatusHistory = append(user.StatusHistory, StatusHistoryEntry{
+		Time:         status.Time,
+		Availability: status.Availability,
+		Message:      status.Message,
+		Emoji:        status.Emoji,
+	})
+	if extra := len(user.StatusHistory) - length; extra > 0 {
+		user.StatusHistory = append([]StatusHistoryEntry{}, user.StatusHistory[extra:]...)
+	}
+}
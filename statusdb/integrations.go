@@ -0,0 +1,76 @@
+package statusdb
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNoIntegration = errors.New("no such integration")
+
+// An Integration connects a user's account to another
+// service, such as Slack, which their status is kept in
+// sync with.
+type Integration struct {
+	Provider string `json:"provider"`
+
+	// AccountID identifies the user on the other service.
+	AccountID string `json:"account_id"`
+
+	// Token authorizes requests on the user's behalf. It is
+	// encrypted by the server, and never sent to clients.
+	Token string `json:"token,omitempty"`
+
+	// Import copies the user's status from the service,
+	// and Export copies it to the service.
+	Import bool `json:"import"`
+	Export bool `json:"export"`
+
+	// LastSync identifies the status last seen on the
+	// service, so that it is only imported once it
+	// changes.
+	LastSync string `json:"last_sync,omitempty"`
+
+	Connected time.Time `json:"connected"`
+}
+
+// FindIntegration finds the user's integration with a
+// provider, or returns nil.
+func (u *UserInfo) FindIntegration(provider string) *Integration {
+	for i, in := range u.Integrations {
+		if in.Provider == provider {
+			return &u.Integrations[i]
+		}
+	}
+	return nil
+}
+
+func (f *fileDB) SetIntegration(email string, in Integration) error {
+	return f.mutate("set integration", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		if existing := user.FindIntegration(in.Provider); existing != nil {
+			*existing = in
+		} else {
+			user.Integrations = append(user.Integrations, in)
+		}
+		return nil
+	})
+}
+
+func (f *fileDB) RemoveIntegration(email, provider string) error {
+	return f.mutate("remove integration", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		for i, in := range user.Integrations {
+			if in.Provider == provider {
+				user.Integrations = append(user.Integrations[:i:i], user.Integrations[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNoIntegration
+	})
+}
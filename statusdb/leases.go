@@ -0,0 +1,72 @@
+package statusdb
+
+import (
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A Lease gives one holder, such as a node of a cluster,
+// the exclusive right to something until it expires.
+type Lease struct {
+	Holder  string
+	Expires time.Time
+}
+
+// AcquireLease takes or renews a lease.
+//
+// Leases are kept in the file only if it is shared, since
+// nobody else could hold them otherwise. They may be taken
+// while the DB is read-only, and expire by the clocks of
+// the processes sharing the file, which should therefore
+// be synchronized.
+func (f *fileDB) AcquireLease(name, holder string, ttl time.Duration) (acquired bool, err error) {
+	defer essentials.AddCtxTo("acquire lease", &err)
+	err = f.updateLeases(func(now time.Time) bool {
+		lease := f.LeaseRecords[name]
+		if lease.Holder != holder && now.Before(lease.Expires) {
+			return false
+		}
+		if f.LeaseRecords == nil {
+			f.LeaseRecords = map[string]Lease{}
+		}
+		f.LeaseRecords[name] = Lease{Holder: holder, Expires: now.Add(ttl)}
+		acquired = true
+		return true
+	})
+	return acquired, err
+}
+
+func (f *fileDB) ReleaseLease(name, holder string) (err error) {
+	defer essentials.AddCtxTo("release lease", &err)
+	return f.updateLeases(func(now time.Time) bool {
+		if f.LeaseRecords[name].Holder != holder {
+			return false
+		}
+		delete(f.LeaseRecords, name)
+		return true
+	})
+}
+
+// updateLeases is like mutate, but update may only change
+// the leases, which are written if it returns true.
+func (f *fileDB) updateLeases(update func(now time.Time) bool) error {
+	f.Lock.Lock()
+	defer f.Lock.Unlock()
+	if !f.shared {
+		update(time.Now())
+		return nil
+	}
+	unlock, err := lockFile(f.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := f.reload(); err != nil {
+		return err
+	}
+	if !update(time.Now()) {
+		return nil
+	}
+	return f.write()
+}
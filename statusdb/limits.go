@@ -0,0 +1,107 @@
+package statusdb
+
+import (
+	"errors"
+)
+
+var (
+	ErrTooManyBuddies  = errors.New("buddy list is full")
+	ErrTooManyRequests = errors.New("too many pending buddy requests")
+)
+
+// Limits restricts how much each user may do.
+//
+// Zero fields use the values from DefaultLimits.
+type Limits struct {
+	// MaxBuddies applies to both users when a request is
+	// sent or accepted.
+	MaxBuddies int `json:"max_buddies"`
+
+	// MaxPendingRequests is the number of outgoing buddy
+	// requests which may await a response.
+	MaxPendingRequests int `json:"max_pending_requests"`
+
+	MaxSessionsPerUser     int `json:"max_sessions_per_user"`
+	MaxStatusMessageLength int `json:"max_status_message_length"`
+
+	// Rate limits, applied to each session, except for
+	// lookups, which are limited for each user.
+	MessagesPerMinute int `json:"messages_per_minute"`
+	LookupsPerMinute  int `json:"lookups_per_minute"`
+	ReportsPerHour    int `json:"reports_per_hour"`
+
+	// StatusHistoryLength is the number of statuses kept in
+	// each user's history. It defaults to zero, which
+	// disables the history.
+	StatusHistoryLength int `json:"status_history_length"`
+}
+
+// DefaultLimits creates the default Limits.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxBuddies:             1000,
+		MaxPendingRequests:     100,
+		MaxSessionsPerUser:     10,
+		MaxStatusMessageLength: MaxStatusMessageLength,
+		MessagesPerMinute:      600,
+		LookupsPerMinute:       MaxLookupsPerMinute,
+		ReportsPerHour:         MaxReportsPerHour,
+	}
+}
+
+// WithDefaults replaces zero fields with their defaults.
+func (l Limits) WithDefaults() Limits {
+	defaults := DefaultLimits()
+	fill := func(field *int, def int) {
+		if *field == 0 {
+			*field = def
+		}
+	}
+	fill(&l.MaxBuddies, defaults.MaxBuddies)
+	fill(&l.MaxPendingRequests, defaults.MaxPendingRequests)
+	fill(&l.MaxSessionsPerUser, defaults.MaxSessionsPerUser)
+	fill(&l.MaxStatusMessageLength, defaults.MaxStatusMessageLength)
+	fill(&l.MessagesPerMinute, defaults.MessagesPerMinute)
+	fill(&l.LookupsPerMinute, defaults.LookupsPerMinute)
+	fill(&l.ReportsPerHour, defaults.ReportsPerHour)
+	return l
+}
+
+// Validate checks that no limit is negative.
+func (l Limits) Validate() error {
+	fields := []struct {
+		name  string
+		value int
+	}{
+		{"max_buddies", l.MaxBuddies},
+		{"max_pending_requests", l.MaxPendingRequests},
+		{"max_sessions_per_user", l.MaxSessionsPerUser},
+		{"max_status_message_length", l.MaxStatusMessageLength},
+		{"messages_per_minute", l.MessagesPerMinute},
+		{"lookups_per_minute", l.LookupsPerMinute},
+		{"reports_per_hour", l.ReportsPerHour},
+		{"status_history_length", l.StatusHistoryLength},
+	}
+	for _, field := range fields {
+		if field.value < 0 {
+			return &ValidationError{Field: field.name, Reason: "must not be negative"}
+		}
+	}
+	return nil
+}
+
+// checkNewBuddy checks that a user has room for a buddy.
+func (l Limits) checkNewBuddy(user *UserInfo) error {
+	if len(user.Buddies) >= l.WithDefaults().MaxBuddies {
+		return ErrTooManyBuddies
+	}
+	return nil
+}
+
+// checkNewRequest checks that a user may send a request.
+func (l Limits) checkNewRequest(user *UserInfo) error {
+	if len(user.OutgoingRequests) >= l.WithDefaults().MaxPendingRequests {
+		return ErrTooManyRequests
+	}
+	return l.checkNewBuddy(user)
+}
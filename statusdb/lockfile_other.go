@@ -0,0 +1,11 @@
+//go:build !unix
+
+package statusdb
+
+import "errors"
+
+// lockFile is not supported without flock(2), so shared
+// file DBs cannot be used.
+func lockFile(path string) (unlock func(), err error) {
+	return nil, errors.New("file locking is not supported on this platform")
+}
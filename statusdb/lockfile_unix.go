@@ -0,0 +1,25 @@
+//go:build unix
+
+package statusdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on a file, waiting for
+// other processes to release it.
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
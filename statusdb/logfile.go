@@ -0,0 +1,58 @@
+package statusdb
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// A LogLevel is the severity of a log message.
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// currentLogLevel is the minimum LogLevel of messages
+// which are logged.
+var currentLogLevel = int32(LogInfo)
+
+// ParseLogLevel parses a level name, such as "warn".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, &ValidationError{Field: "log_level", Reason: "unknown level: " + s}
+}
+
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+// SetLogLevel changes the minimum level of messages which
+// are logged.
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(level))
+}
+
+// CurrentLogLevel gets the level set by SetLogLevel.
+func CurrentLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+// LogAt logs a message if its level is enabled.
+func LogAt(level LogLevel, format string, args ...interface{}) {
+	if level >= CurrentLogLevel() {
+		log.Printf(level.String()+": "+format, args...)
+	}
+}
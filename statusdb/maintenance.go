@@ -0,0 +1,9 @@
+package statusdb
+
+import (
+	"errors"
+)
+
+// ErrMaintenance is returned for changes attempted while
+// the server is in maintenance mode.
+var ErrMaintenance = errors.New("server is in read-only maintenance mode")
@@ -0,0 +1,154 @@
+package statusdb
+
+import "errors"
+
+// ErrCannotMerge is returned when merging a user into
+// themself, or merging bots or remote users.
+var ErrCannotMerge = errors.New("users cannot be merged")
+
+// MergeUsers moves the relationships of one user, from,
+// into another, into, and deletes from.
+//
+// The users' buddy lists, requests, blocks, aliases, and
+// reports are combined, and every other user's lists name
+// into in place of from. Remote users, whose servers only
+// know from, forget from instead, as if it were deleted.
+//
+// Where the combined user would both block and befriend
+// someone, the block wins, as if it were made after the
+// merge, and requests in both directions between the same
+// users become a buddy link. The other settings of into
+// are kept.
+func (f *fileDB) MergeUsers(from, into string) error {
+	return f.mutate("merge users", func() error {
+		fromUser, intoUser := f.findUser(from), f.findUser(into)
+		if fromUser == nil || intoUser == nil {
+			return ErrNoEmail
+		} else if fromUser == intoUser || fromUser.Remote || intoUser.Remote ||
+			fromUser.Bot || intoUser.Bot {
+			return ErrCannotMerge
+		}
+		for _, user := range f.UserRecords {
+			if user.Remote {
+				if forgetEmail(user, fromUser.Email) {
+					touch(user)
+				}
+				forgetEmail(fromUser, user.Email)
+			} else if user != fromUser && renameInLists(user, fromUser.Email, intoUser.Email) {
+				touch(user)
+			}
+		}
+		for _, email := range fromUser.Buddies {
+			addEmail(&intoUser.Buddies, email)
+		}
+		for _, email := range fromUser.IncomingRequests {
+			addEmail(&intoUser.IncomingRequests, email)
+		}
+		for _, email := range fromUser.OutgoingRequests {
+			addEmail(&intoUser.OutgoingRequests, email)
+		}
+		for _, email := range fromUser.Blocked {
+			addEmail(&intoUser.Blocked, email)
+		}
+		intoUser.Greetings = mergeMap(intoUser.Greetings, fromUser.Greetings)
+		intoUser.Aliases = mergeMap(intoUser.Aliases, fromUser.Aliases)
+		intoUser.Reports = append(intoUser.Reports, fromUser.Reports...)
+		for _, email := range []string{fromUser.Email, intoUser.Email} {
+			unlinkUsers(intoUser, email)
+			removeEmail(&intoUser.Blocked, email)
+			delete(intoUser.Aliases, email)
+		}
+
+		for i, user := range f.UserRecords {
+			if user == fromUser {
+				f.UserRecords = append(f.UserRecords[:i:i], f.UserRecords[i+1:]...)
+				break
+			}
+		}
+		for _, other := range f.UserRecords {
+			if other != intoUser {
+				reconcileMerged(intoUser, other)
+			}
+		}
+		touch(intoUser)
+		return nil
+	})
+}
+
+// renameInLists replaces oldEmail with newEmail in each of
+// the user's lists and maps, keeping the entries which
+// already name newEmail, and reports whether it changed.
+func renameInLists(user *UserInfo, oldEmail, newEmail string) bool {
+	changed := false
+	for _, list := range []*[]string{&user.Buddies, &user.IncomingRequests,
+		&user.OutgoingRequests, &user.Blocked} {
+		if ContainsEmail(*list, oldEmail) {
+			removeEmail(list, oldEmail)
+			addEmail(list, newEmail)
+			changed = true
+		}
+	}
+	for _, m := range []map[string]string{user.Greetings, user.Aliases} {
+		if value, ok := m[oldEmail]; ok {
+			delete(m, oldEmail)
+			if _, ok := m[newEmail]; !ok {
+				m[newEmail] = value
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// reconcileMerged resolves the conflicts which merging
+// left between the merged user and another user.
+func reconcileMerged(user, other *UserInfo) {
+	if HasBlocked(user, other) {
+		severBlocked(user, other)
+	}
+	if HasBlocked(other, user) {
+		severBlocked(other, user)
+	}
+	if HasBlocked(user, other) || HasBlocked(other, user) {
+		return
+	}
+	buddies := ContainsEmail(user.Buddies, other.Email) || ContainsEmail(other.Buddies, user.Email)
+	mutual := ContainsEmail(user.IncomingRequests, other.Email) &&
+		ContainsEmail(user.OutgoingRequests, other.Email)
+	if buddies || mutual {
+		unlinkUsers(user, other.Email)
+		unlinkUsers(other, user.Email)
+		addEmail(&user.Buddies, other.Email)
+		addEmail(&other.Buddies, user.Email)
+	}
+}
+
+// unlinkUsers removes another user from the user's buddies
+// and requests, but not from their blocks or aliases.
+func unlinkUsers(user *UserInfo, other string) {
+	removeEmail(&user.Buddies, other)
+	removeEmail(&user.IncomingRequests, other)
+	removeEmail(&user.OutgoingRequests, other)
+	delete(user.Greetings, other)
+}
+
+// addEmail appends an email to a list unless it is
+// already there.
+func addEmail(list *[]string, email string) {
+	if !ContainsEmail(*list, email) {
+		*list = append(*list, email)
+	}
+}
+
+// mergeMap adds the entries of src which are not in dst.
+func mergeMap(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = map[string]string{}
+	}
+	for key, value := range src {
+		if _, ok := dst[key]; !ok {
+			dst[key] = value
+		}
+	}
+	return dst
+}
@@ -0,0 +1,124 @@
+package statusdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"unicode/utf8"
+)
+
+// A MetadataType is the JSON type of a metadata field.
+type MetadataType string
+
+const (
+	MetadataString MetadataType = "string"
+	MetadataNumber MetadataType = "number"
+	MetadataBool   MetadataType = "bool"
+)
+
+// A MetadataField describes one field of a UserMetadata
+// object.
+type MetadataField struct {
+	Type     MetadataType `json:"type"`
+	Required bool         `json:"required,omitempty"`
+
+	// MaxLength limits the number of characters in a string
+	// field.
+	// If zero, there is no limit beyond the overall size
+	// of the metadata.
+	MaxLength int `json:"max_length,omitempty"`
+}
+
+// A MetadataSchema describes the UserMetadata objects
+// which clients may attach to their statuses, such as
+// {"song": "...", "location": "..."}.
+type MetadataSchema struct {
+	Fields map[string]MetadataField `json:"fields"`
+
+	// AllowUnknown permits fields which are not listed in
+	// Fields, as long as their values are not objects or
+	// arrays.
+	AllowUnknown bool `json:"allow_unknown,omitempty"`
+}
+
+// Validate checks that a UserMetadata object matches the
+// schema.
+//
+// Empty metadata is always valid.
+func (m *MetadataSchema) Validate(data json.RawMessage) error {
+	obj, err := DecodeMetadata(data)
+	if err != nil || obj == nil {
+		return err
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := m.Fields[name]
+		if !ok {
+			if !m.AllowUnknown {
+				return metadataError(name, "unknown field")
+			}
+			if _, ok := obj[name].(map[string]interface{}); ok {
+				return metadataError(name, "unsupported type")
+			} else if _, ok := obj[name].([]interface{}); ok {
+				return metadataError(name, "unsupported type")
+			}
+			continue
+		}
+		if err := field.check(name, obj[name]); err != nil {
+			return err
+		}
+	}
+	for name, field := range m.Fields {
+		if _, ok := obj[name]; field.Required && !ok {
+			return metadataError(name, "required")
+		}
+	}
+	return nil
+}
+
+func (m *MetadataField) check(name string, value interface{}) error {
+	switch m.Type {
+	case MetadataString:
+		str, ok := value.(string)
+		if !ok {
+			return metadataError(name, "not a string")
+		}
+		if m.MaxLength != 0 && utf8.RuneCountInString(str) > m.MaxLength {
+			return metadataError(name, "too long")
+		}
+	case MetadataNumber:
+		if _, ok := value.(float64); !ok {
+			return metadataError(name, "not a number")
+		}
+	case MetadataBool:
+		if _, ok := value.(bool); !ok {
+			return metadataError(name, "not a boolean")
+		}
+	default:
+		return metadataError(name, "unsupported type")
+	}
+	return nil
+}
+
+// DecodeMetadata decodes a UserMetadata object, returning
+// nil for empty or null metadata.
+func DecodeMetadata(data json.RawMessage) (map[string]interface{}, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, &ValidationError{Field: "UserMetadata", Reason: "not a JSON object"}
+	}
+	return obj, nil
+}
+
+func metadataError(name, reason string) error {
+	return &ValidationError{Field: "UserMetadata." + name, Reason: reason}
+}
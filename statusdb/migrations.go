@@ -0,0 +1,128 @@
+package statusdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/unixpickle/essentials"
+)
+
+var ErrNewerFileDB = errors.New("DB file was written by a newer version")
+
+// A fileDBMigration upgrades the encoded contents of a
+// fileDB's file from the previous version of the format.
+//
+// Files written before the format was versioned all claim
+// version 0, so migrations must leave contents which are
+// already upgraded unchanged.
+type fileDBMigration struct {
+	Name    string
+	Migrate func(contents []byte) ([]byte, error)
+}
+
+// fileDBMigrations lists the changes to a fileDB's format
+// in order. A file at version N has had the first N
+// migrations applied.
+//
+// Migrations may only be appended, since each one's
+// version is its position in the list.
+var fileDBMigrations = []fileDBMigration{
+	{
+		Name: "wrap user list in an object",
+		Migrate: func(contents []byte) ([]byte, error) {
+			contents = bytes.TrimSpace(contents)
+			if len(contents) == 0 || contents[0] != '[' {
+				return contents, nil
+			}
+			return json.Marshal(map[string]json.RawMessage{"Users": contents})
+		},
+	},
+	{
+		Name: "move last seen visibility into privacy settings",
+		Migrate: func(contents []byte) ([]byte, error) {
+			return migrateUsers(contents, func(user map[string]json.RawMessage) error {
+				raw, ok := user["LastSeenVisibility"]
+				if !ok {
+					return nil
+				}
+				delete(user, "LastSeenVisibility")
+				var privacy PrivacySettings
+				if err := json.Unmarshal(raw, &privacy.LastSeen); err != nil {
+					return err
+				}
+				encoded, err := json.Marshal(privacy)
+				user["Privacy"] = encoded
+				return err
+			})
+		},
+	},
+}
+
+// FileDBVersion is the version of the format written to a
+// fileDB's file.
+var FileDBVersion = len(fileDBMigrations)
+
+// migrateFileDB applies the migrations which a file's
+// contents are missing, and returns the upgraded contents
+// and the number of migrations applied.
+//
+// Files from a newer version are refused, since writing
+// them back would lose whatever the newer version added.
+func migrateFileDB(contents []byte) (migrated []byte, applied int, err error) {
+	defer essentials.AddCtxTo("migrate file DB", &err)
+	version := fileDBVersion(contents)
+	if version > FileDBVersion {
+		return nil, 0, essentials.AddCtx(fmt.Sprintf("version %d", version), ErrNewerFileDB)
+	}
+	for _, m := range fileDBMigrations[version:] {
+		contents, err = m.Migrate(contents)
+		if err != nil {
+			return nil, 0, essentials.AddCtx(m.Name, err)
+		}
+		applied++
+	}
+	return contents, applied, nil
+}
+
+// migrateUsers applies a change to each encoded user in a
+// file's contents, leaving the other fields untouched.
+func migrateUsers(contents []byte, f func(user map[string]json.RawMessage) error) ([]byte,
+	error) {
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return contents, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &obj); err != nil {
+		return nil, err
+	}
+	var users []map[string]json.RawMessage
+	if raw, ok := obj["Users"]; ok {
+		if err := json.Unmarshal(raw, &users); err != nil {
+			return nil, err
+		}
+	}
+	for _, user := range users {
+		if err := f(user); err != nil {
+			return nil, err
+		}
+	}
+	encoded, err := json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+	obj["Users"] = encoded
+	return json.Marshal(obj)
+}
+
+// fileDBVersion reads the version of a file's format.
+func fileDBVersion(contents []byte) int {
+	var obj struct {
+		Version int
+	}
+	// Lists of users have no version, and other errors
+	// are left to the caller's decoding.
+	json.Unmarshal(contents, &obj)
+	return obj.Version
+}
@@ -0,0 +1,26 @@
+package statusdb
+
+import (
+	"time"
+)
+
+// MaxMissedEvents is the number of missed events stored
+// for a user who has no sessions. Older events are dropped
+// first.
+const MaxMissedEvents = 100
+
+// A MissedEvent records an event which occurred while the
+// user had no sessions.
+type MissedEvent struct {
+	// Type is the message type which would have been sent,
+	// such as "request_received" or "buddy_removed".
+	Type string `json:"type"`
+
+	Email    string `json:"email"`
+	Greeting string `json:"greeting,omitempty"`
+
+	// Text is the text of a server notice, such as a
+	// warning from a moderator.
+	Text string    `json:"text,omitempty"`
+	Time time.Time `json:"time"`
+}
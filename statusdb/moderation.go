@@ -0,0 +1,48 @@
+package statusdb
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// MaxReportsPerHour is the default number of abuse
+// reports a session may file per hour.
+const MaxReportsPerHour = 10
+
+var (
+	ErrNoReport         = errors.New("no such report")
+	ErrReportResolved   = errors.New("report already resolved")
+	ErrAccountSuspended = errors.New("account suspended")
+)
+
+// A ModerationAction is taken by a moderator to resolve an
+// abuse report.
+type ModerationAction string
+
+// A Report is an abuse report filed by one user against
+// another.
+type Report struct {
+	ID       string    `json:"id"`
+	Reporter string    `json:"reporter"`
+	Target   string    `json:"target"`
+	Reason   string    `json:"reason"`
+	Evidence string    `json:"evidence,omitempty"`
+	Time     time.Time `json:"time"`
+
+	// Action is set once a moderator resolves the report.
+	Action       ModerationAction `json:"action,omitempty"`
+	ResolvedTime time.Time        `json:"resolved_time,omitempty"`
+}
+
+// Resolved checks if a moderator has acted on the report.
+func (r *Report) Resolved() bool {
+	return r.Action != ""
+}
+
+// sortReports sorts reports from oldest to newest.
+func sortReports(reports []Report) {
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].Time.Before(reports[j].Time)
+	})
+}
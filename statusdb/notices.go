@@ -0,0 +1,11 @@
+package statusdb
+
+// A NoticeLevel indicates how prominently a client should
+// display a ServerNotice.
+type NoticeLevel string
+
+const (
+	NoticeInfo     NoticeLevel = "info"
+	NoticeWarning  NoticeLevel = "warning"
+	NoticeCritical NoticeLevel = "critical"
+)
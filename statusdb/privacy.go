@@ -0,0 +1,103 @@
+package statusdb
+
+import "errors"
+
+var (
+	ErrInvalidRequestPolicy = errors.New("invalid request policy")
+
+	// ErrRequestsRestricted is returned when a user's
+	// privacy settings do not let the sender request them.
+	ErrRequestsRestricted = errors.New("user does not accept requests from you")
+)
+
+// A RequestPolicy determines who may send a user buddy
+// requests.
+type RequestPolicy string
+
+const (
+	RequestsFromAnyone           RequestPolicy = "anyone"
+	RequestsFromFriendsOfFriends RequestPolicy = "friends_of_friends"
+	RequestsFromNobody           RequestPolicy = "nobody"
+)
+
+// Valid checks if r is a known policy.
+// The empty policy is the default, and is valid.
+func (r RequestPolicy) Valid() bool {
+	switch r {
+	case "", RequestsFromAnyone, RequestsFromFriendsOfFriends, RequestsFromNobody:
+		return true
+	}
+	return false
+}
+
+// Allows checks if the policy of the recipient, to, lets
+// from send them a request.
+// The default policy is RequestsFromAnyone.
+func (r RequestPolicy) Allows(from, to *UserInfo) bool {
+	switch r {
+	case RequestsFromNobody:
+		return false
+	case RequestsFromFriendsOfFriends:
+		for _, buddy := range from.Buddies {
+			if ContainsEmail(to.Buddies, buddy) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// PrivacySettings control who may reach a user and who may
+// see their information.
+//
+// Visibilities default to VisibleBuddies, except for the
+// status history, which defaults to VisibleNobody. The
+// status message, emoji, and link, and the last-seen time,
+// are only shown to public presence subscribers if they
+// are VisibleEveryone.
+type PrivacySettings struct {
+	Requests      RequestPolicy `json:"requests,omitempty"`
+	StatusMessage Visibility    `json:"status_message,omitempty"`
+	LastSeen      Visibility    `json:"last_seen,omitempty"`
+	StatusHistory Visibility    `json:"status_history,omitempty"`
+}
+
+// HistoryVisibleTo checks if the status history may be
+// seen by another user, who may or may not be a buddy.
+func (p PrivacySettings) HistoryVisibleTo(buddy bool) bool {
+	return p.StatusHistory == VisibleEveryone || (buddy && p.StatusHistory == VisibleBuddies)
+}
+
+// Validate checks that every setting is known.
+func (p PrivacySettings) Validate() error {
+	if !p.Requests.Valid() {
+		return ErrInvalidRequestPolicy
+	} else if !p.StatusMessage.Valid() || !p.LastSeen.Valid() || !p.StatusHistory.Valid() {
+		return ErrInvalidVisibility
+	}
+	return nil
+}
+
+// HideMessage clears the parts of a status which its
+// user's StatusMessage visibility may hide.
+func (u UserStatus) HideMessage() UserStatus {
+	u.Message = ""
+	u.Emoji = ""
+	u.Link = ""
+	return u
+}
+
+func (f *fileDB) SetPrivacy(email string, privacy PrivacySettings) error {
+	return f.mutate("set privacy", func() error {
+		if err := privacy.Validate(); err != nil {
+			return err
+		}
+		if user := f.findUser(email); user != nil {
+			user.Privacy = privacy
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
@@ -0,0 +1,59 @@
+package statusdb
+
+import (
+	"time"
+)
+
+// MaxPushSubscriptions is the number of browsers which may
+// receive a user's push notifications. Adding another
+// replaces the oldest.
+const MaxPushSubscriptions = 10
+
+// A PushSubscription is a browser's Web Push endpoint for
+// a user, along with the keys which encrypt messages to it.
+//
+// The keys are base64url encoded, as in the browser's
+// PushSubscription.
+type PushSubscription struct {
+	Endpoint string    `json:"endpoint"`
+	P256DH   string    `json:"p256dh"`
+	Auth     string    `json:"auth"`
+	Created  time.Time `json:"created"`
+}
+
+func (f *fileDB) AddPushSubscription(email string, sub PushSubscription) error {
+	return f.mutate("add push subscription", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		removePushSubscription(user, sub.Endpoint)
+		user.PushSubscriptions = append(user.PushSubscriptions, sub)
+		if extra := len(user.PushSubscriptions) - MaxPushSubscriptions; extra > 0 {
+			user.PushSubscriptions = append([]PushSubscription{},
+				user.PushSubscriptions[extra:]...)
+		}
+		return nil
+	})
+}
+
+func (f *fileDB) RemovePushSubscription(email, endpoint string) error {
+	return f.mutate("remove push subscription", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		removePushSubscription(user, endpoint)
+		return nil
+	})
+}
+
+func removePushSubscription(user *UserInfo, endpoint string) {
+	for i, sub := range user.PushSubscriptions {
+		if sub.Endpoint == endpoint {
+			user.PushSubscriptions = append(user.PushSubscriptions[:i:i],
+				user.PushSubscriptions[i+1:]...)
+			return
+		}
+	}
+}
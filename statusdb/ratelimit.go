@@ -0,0 +1,33 @@
+package statusdb
+
+import (
+	"time"
+)
+
+// MaxLookupsPerMinute is the default number of user
+// lookups a user may perform per minute, across all of
+// their sessions.
+const MaxLookupsPerMinute = 20
+
+// A RateLimiter allows a fixed number of events in a
+// sliding window of time.
+//
+// It is not safe for concurrent use.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+	times  []time.Time
+}
+
+// Allow records an event at the given time if the limit
+// has not been reached, returning false otherwise.
+func (r *RateLimiter) Allow(now time.Time) bool {
+	for len(r.times) > 0 && now.Sub(r.times[0]) >= r.Window {
+		r.times = r.times[1:]
+	}
+	if len(r.times) >= r.Limit {
+		return false
+	}
+	r.times = append(r.times, now)
+	return true
+}
@@ -0,0 +1,155 @@
+package statusdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// A ScheduleRule sets a user's status during a window of
+// time on some days of the week.
+//
+// Start and End are local times of the form "15:04". A
+// window whose End is not after its Start runs past
+// midnight, and belongs to the day on which it starts.
+type ScheduleRule struct {
+	// Days are the days on which the window starts, or
+	// every day if there are none.
+	Days []time.Weekday `json:"days,omitempty"`
+
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	Availability Availability `json:"availability"`
+	Message      string       `json:"message,omitempty"`
+}
+
+// A Schedule is a user's weekly recurring statuses.
+//
+// The status of the first rule whose window contains the
+// current time is applied when the window starts, and the
+// user becomes Available when no window contains it. A
+// status which the user sets manually lasts until the
+// next such change.
+type Schedule struct {
+	// TimeZone is the IANA name of the zone in which the
+	// rules' times are given, or "" for the user's time
+	// zone, or UTC if they have none.
+	TimeZone string `json:"time_zone,omitempty"`
+
+	Rules []ScheduleRule `json:"rules"`
+}
+
+// Validate checks that the time zone is known and that
+// every rule has valid times and a settable availability.
+func (s Schedule) Validate() error {
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return ErrInvalidSchedule
+	}
+	for _, rule := range s.Rules {
+		_, startErr := parseClock(rule.Start)
+		_, endErr := parseClock(rule.End)
+		if startErr != nil || endErr != nil || !rule.Availability.Settable() {
+			return ErrInvalidSchedule
+		}
+		for _, day := range rule.Days {
+			if day < time.Sunday || day > time.Saturday {
+				return ErrInvalidSchedule
+			}
+		}
+	}
+	return nil
+}
+
+// Window finds the rule whose window contains t, returning
+// a key which identifies the rule and the day on which the
+// window started, or "" and nil if there is no such rule.
+//
+// The schedule must be valid.
+func (s Schedule) Window(t time.Time) (key string, rule *ScheduleRule) {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return "", nil
+	}
+	t = t.In(loc)
+	now := t.Hour()*60 + t.Minute()
+	yesterday := t.AddDate(0, 0, -1)
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+		start, _ := parseClock(rule.Start)
+		end, _ := parseClock(rule.End)
+		var day time.Time
+		if end > start {
+			if now >= start && now < end && rule.onDay(t.Weekday()) {
+				day = t
+			}
+		} else if now >= start && rule.onDay(t.Weekday()) {
+			day = t
+		} else if now < end && rule.onDay(yesterday.Weekday()) {
+			day = yesterday
+		}
+		if !day.IsZero() {
+			return fmt.Sprintf("%d@%s", i, day.Format("2006-01-02")), rule
+		}
+	}
+	return "", nil
+}
+
+// CurrentWindow is like Schedule.Window, but applies the
+// user's time zone to a schedule without one.
+func (u *UserInfo) CurrentWindow(now time.Time) (key string, rule *ScheduleRule) {
+	schedule := u.Schedule
+	if schedule.TimeZone == "" {
+		schedule.TimeZone = u.TimeZone
+	}
+	return schedule.Window(now)
+}
+
+func (s ScheduleRule) onDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock converts a time of day into minutes since
+// midnight.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (f *fileDB) SetSchedule(email string, schedule Schedule) error {
+	return f.mutate("set schedule", func() error {
+		if err := schedule.Validate(); err != nil {
+			return err
+		}
+		if user := f.findUser(email); user != nil {
+			user.Schedule = schedule
+			user.ScheduleWindow = ""
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
+
+func (f *fileDB) SetScheduleWindow(email, window string) error {
+	return f.mutate("set schedule window", func() error {
+		if user := f.findUser(email); user != nil {
+			user.ScheduleWindow = window
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
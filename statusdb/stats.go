@@ -0,0 +1,43 @@
+package statusdb
+
+import (
+	"time"
+)
+
+// UsageStats summarizes a user's activity.
+type UsageStats struct {
+	Logins        int
+	OnlineTime    time.Duration
+	StatusChanges int
+	LastActivity  time.Time
+}
+
+// Add combines the counts and durations of other with the
+// stats, keeping the later LastActivity.
+func (u *UsageStats) Add(other UsageStats) {
+	u.Logins += other.Logins
+	u.OnlineTime += other.OnlineTime
+	u.StatusChanges += other.StatusChanges
+	if other.LastActivity.After(u.LastActivity) {
+		u.LastActivity = other.LastActivity
+	}
+}
+
+// Summary converts the stats to the form sent to clients
+// and administrators.
+func (u UsageStats) Summary() UsageSummary {
+	return UsageSummary{
+		Logins:        u.Logins,
+		OnlineSeconds: int64(u.OnlineTime / time.Second),
+		StatusChanges: u.StatusChanges,
+		LastActivity:  u.LastActivity,
+	}
+}
+
+// A UsageSummary is the JSON form of UsageStats.
+type UsageSummary struct {
+	Logins        int       `json:"logins"`
+	OnlineSeconds int64     `json:"online_seconds"`
+	StatusChanges int       `json:"status_changes"`
+	LastActivity  time.Time `json:"last_activity"`
+}
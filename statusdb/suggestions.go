@@ -0,0 +1,58 @@
+package statusdb
+
+import "sort"
+
+// MaxBuddySuggestions is the most users which
+// SuggestBuddies returns.
+const MaxBuddySuggestions = 20
+
+// A BuddySuggestion is a buddy of the viewer's buddies.
+type BuddySuggestion struct {
+	User *UserInfo
+
+	// MutualBuddies is the number of the viewer's buddies
+	// who are buddies with the user.
+	MutualBuddies int
+}
+
+func (f *fileDB) SuggestBuddies(viewer string) ([]BuddySuggestion, error) {
+	f.beginRead()
+	defer f.Lock.RUnlock()
+	from := f.findUser(viewer)
+	if from == nil {
+		return nil, ErrNoEmail
+	}
+	mutual := map[string]int{}
+	for _, buddy := range from.Buddies {
+		user := f.findUser(buddy)
+		if user == nil || HasBlocked(from, user) {
+			continue
+		}
+		for _, email := range user.Buddies {
+			mutual[email]++
+		}
+	}
+	var res []BuddySuggestion
+	for email, count := range mutual {
+		user := f.findUser(email)
+		if user == nil || !user.Discoverable || user.Remote || user.Locked || user.Bot ||
+			EmailsEquivalent(email, viewer) || ContainsEmail(from.IncomingRequests, email) ||
+			RequestBlocker(from, user) != nil {
+			continue
+		}
+		res = append(res, BuddySuggestion{User: user, MutualBuddies: count})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].MutualBuddies != res[j].MutualBuddies {
+			return res[i].MutualBuddies > res[j].MutualBuddies
+		}
+		return res[i].User.Email < res[j].User.Email
+	})
+	if len(res) > MaxBuddySuggestions {
+		res = res[:MaxBuddySuggestions]
+	}
+	for i := range res {
+		res[i].User = res[i].User.Copy()
+	}
+	return res, nil
+}
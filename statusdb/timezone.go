@@ -0,0 +1,49 @@
+package statusdb
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidTimeZone = errors.New("invalid time zone")
+
+// ValidTimeZone checks if zone is the IANA name of a time
+// zone. The empty zone, which means that the user has not
+// given one, is valid.
+func ValidTimeZone(zone string) bool {
+	if zone == "" {
+		return true
+	}
+	_, err := time.LoadLocation(zone)
+	return err == nil
+}
+
+// WithLocalTime sets the time zone and the local time at
+// now of a status sent to buddies, unless zone is empty.
+func (u UserStatus) WithLocalTime(zone string, now time.Time) UserStatus {
+	if zone == "" {
+		return u
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return u
+	}
+	local := now.In(loc)
+	u.TimeZone = zone
+	u.LocalTime = &local
+	return u
+}
+
+func (f *fileDB) SetTimeZone(email, zone string) error {
+	return f.mutate("set time zone", func() error {
+		if !ValidTimeZone(zone) {
+			return ErrInvalidTimeZone
+		}
+		if user := f.findUser(email); user != nil {
+			user.TimeZone = zone
+			touch(user)
+			return nil
+		}
+		return ErrNoEmail
+	})
+}
@@ -0,0 +1,90 @@
+package statusdb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+
+	// totpSkew is the number of periods before and after the
+	// current one which are also accepted, to account for
+	// clock drift on the client's device.
+	totpSkew = 1
+
+	numRecoveryCodes = 10
+)
+
+// generateTOTPSecret creates a random base32-encoded
+// secret suitable for authenticator apps.
+func generateTOTPSecret() (string, error) {
+	var secret [20]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret[:]), nil
+}
+
+// checkTOTP checks a code from an authenticator app
+// against a secret, as described in RFC 6238.
+func checkTOTP(secret, code string, now time.Time) bool {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(
+		strings.ToUpper(secret))
+	if err != nil {
+		return false
+	}
+	counter := now.Unix() / int64(totpPeriod/time.Second)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected := totpCode(key, uint64(counter+int64(i)))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// generateRecoveryCodes creates a new set of single-use
+// recovery codes.
+//
+// The plaintext codes should be shown to the user once;
+// only their hashes should be stored.
+func generateRecoveryCodes() ([]string, error) {
+	var codes []string
+	for i := 0; i < numRecoveryCodes; i++ {
+		var data [5]byte
+		if _, err := rand.Read(data[:]); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(data[:]))
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes recovery code matching
+// insensitive to case, spacing, and dashes.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
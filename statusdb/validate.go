@@ -0,0 +1,15 @@
+package statusdb
+
+const MaxStatusMessageLength = 256
+
+// A ValidationError indicates that a client message was
+// well-formed JSON but contained an invalid field.
+type ValidationError struct {
+	// Field is the JSON name of the offending field.
+	Field  string
+	Reason string
+}
+
+func (v *ValidationError) Error() string {
+	return "invalid " + v.Field + ": " + v.Reason
+}
@@ -0,0 +1,119 @@
+package statusdb
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrNotVerified = errors.New("email address not verified")
+	ErrVerifyToken = errors.New("verification token incorrect")
+	ErrResetCode   = errors.New("reset code incorrect or expired")
+)
+
+// generateMailToken creates a random token to be emailed
+// to a user, which is easy to copy by hand.
+func generateMailToken() (string, error) {
+	var data [10]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(data[:])), nil
+}
+
+func (f *fileDB) BeginVerification(email string) (token string, err error) {
+	err = f.mutate("begin verification", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		token, err = generateMailToken()
+		if err != nil {
+			return err
+		}
+		user.Verified = false
+		user.VerifyToken = token
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (f *fileDB) VerifyUser(email, token string) error {
+	return f.mutate("verify user", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		if user.Verified {
+			return nil
+		}
+		if user.VerifyToken == "" ||
+			subtle.ConstantTimeCompare([]byte(user.VerifyToken), []byte(strings.ToLower(token))) != 1 {
+			return ErrVerifyToken
+		}
+		user.Verified = true
+		user.VerifyToken = ""
+		touch(user)
+		return nil
+	})
+}
+
+// BeginPasswordReset stores only the code's hash, and
+// invalidates the user's previous code.
+func (f *fileDB) BeginPasswordReset(email string, lifetime time.Duration) (code string, err error) {
+	err = f.mutate("begin password reset", func() error {
+		user := f.findUser(email)
+		if user == nil || user.Remote {
+			return ErrNoEmail
+		}
+		code, err = generateMailToken()
+		if err != nil {
+			return err
+		}
+		user.ResetHash = hashPassword(code)
+		user.ResetExpires = time.Now().Add(lifetime)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (f *fileDB) ResetPassword(email, code, newPass string) error {
+	return f.mutate("reset password", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		hash := hashPassword(strings.ToLower(code))
+		if user.ResetHash == "" || !time.Now().Before(user.ResetExpires) ||
+			subtle.ConstantTimeCompare([]byte(user.ResetHash), []byte(hash)) != 1 {
+			return ErrResetCode
+		}
+		newHash, err := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.Hash = newHash
+		user.ResetHash = ""
+		user.ResetExpires = time.Time{}
+
+		// Receiving the code proves that the user owns the
+		// address.
+		if user.VerifyToken != "" {
+			user.Verified = true
+			user.VerifyToken = ""
+		}
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package statusdb
+
+import (
+	"errors"
+	"time"
+)
+
+// MaxWebhooks is the number of webhooks which each user
+// may register.
+const MaxWebhooks = 5
+
+var (
+	ErrNoWebhook       = errors.New("no such webhook")
+	ErrTooManyWebhooks = errors.New("too many webhooks")
+)
+
+// A Webhook is a URL which a user has asked to be called
+// when some of their own events occur, such as their
+// status changing.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// Secret signs each delivery, so that the receiver can
+	// tell that it came from this server.
+	// It is only shown to the user when the webhook is
+	// created.
+	Secret string `json:"secret,omitempty"`
+
+	// Events lists the events which trigger the webhook,
+	// such as "status_changed".
+	Events []string `json:"events"`
+
+	Created time.Time `json:"created"`
+}
+
+// Triggers checks if an event triggers the webhook.
+func (w *Webhook) Triggers(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fileDB) AddWebhook(email string, hook Webhook) error {
+	return f.mutate("add webhook", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		if len(user.Webhooks) >= MaxWebhooks {
+			return ErrTooManyWebhooks
+		}
+		user.Webhooks = append(user.Webhooks, hook)
+		return nil
+	})
+}
+
+func (f *fileDB) RemoveWebhook(email, id string) error {
+	return f.mutate("remove webhook", func() error {
+		user := f.findUser(email)
+		if user == nil {
+			return ErrNoEmail
+		}
+		for i, hook := range user.Webhooks {
+			if hook.ID == id {
+				user.Webhooks = append(user.Webhooks[:i:i], user.Webhooks[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNoWebhook
+	})
+}
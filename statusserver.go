@@ -0,0 +1,110 @@
+// Package statusserver runs the status server inside of
+// another Go program, without listening on any sockets.
+//
+// This is useful for applications which embed a buddy
+// list, and for integration tests which need the full
+// stack of database, sessions, and message handling:
+//
+//	srv := statusserver.New(db)
+//	alice := srv.NewClient()
+//	err := alice.Login("alice@example.com", "password", "")
+package statusserver
+
+import (
+	"github.com/PickledCode/status-server/client"
+	"github.com/PickledCode/status-server/events"
+	"github.com/PickledCode/status-server/protocol"
+	"github.com/PickledCode/status-server/server"
+	"github.com/PickledCode/status-server/statusdb"
+)
+
+// A DB stores the server's users. See statusdb.OpenFileDB.
+type DB = statusdb.DB
+
+// An Option configures a Server created with New.
+type Option func(s *Server)
+
+// WithEventOptions configures the EventDB, such as its
+// limits and feature flags.
+func WithEventOptions(opts events.Options) Option {
+	return func(s *Server) {
+		s.eventOpts = opts
+	}
+}
+
+// WithRecorder records the connections of the recorder's
+// selected users.
+func WithRecorder(recorder *server.SessionRecorder) Option {
+	return func(s *Server) {
+		s.clientOpts.Recorder = recorder
+	}
+}
+
+// WithStrictDecoding rejects client messages with fields
+// which their type does not have, which helps to catch
+// typos while developing clients.
+func WithStrictDecoding() Option {
+	return func(s *Server) {
+		s.clientOpts.StrictDecoding = true
+	}
+}
+
+// A Server serves clients from a DB in the same process.
+type Server struct {
+	eventOpts  events.Options
+	clientOpts server.ClientOptions
+	eventDB    events.EventDB
+}
+
+// New creates a Server for a DB.
+func New(db DB, opts ...Option) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.eventDB = events.New(db, s.eventOpts)
+	return s
+}
+
+// EventDB gets the EventDB which the Server's clients use,
+// for operations such as creating users or sending
+// notices.
+func (s *Server) EventDB() events.EventDB {
+	return s.eventDB
+}
+
+// HandleConn serves a client until it disconnects, and
+// then closes the connection.
+//
+// The connection may come from any transport, such as
+// protocol.NewStreamConnection for a net.Conn.
+func (s *Server) HandleConn(conn protocol.Connection) {
+	server.HandleClient(conn, s.eventDB, s.clientOpts)
+}
+
+// Close ends every session, telling the clients to
+// reconnect, and stops the Goroutines of the EventDB.
+//
+// The Server cannot be used afterwards.
+func (s *Server) Close() error {
+	return s.eventDB.Drain()
+}
+
+// Dialer creates a client.Dialer which connects to the
+// Server in memory.
+func (s *Server) Dialer() client.Dialer {
+	return func() (protocol.Connection, error) {
+		serverConn, clientConn := protocol.NewPipe()
+		go s.HandleConn(serverConn)
+		return clientConn, nil
+	}
+}
+
+// NewClient creates a Client which connects to the Server
+// in memory.
+//
+// Like any other Client, it reconnects after being told
+// to, with a new in-memory connection.
+func (s *Server) NewClient() *client.Client {
+	return &client.Client{Dial: s.Dialer()}
+}